@@ -3,27 +3,28 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
-	"github.com/stathat/consistent"
 	"zagreb/pkg/api"
-	"zagreb/pkg/nodeapi"
-	"zagreb/pkg/router"
 	"zagreb/pkg/routerapi"
 	"zagreb/pkg/storage/bbolt"
-	"zagreb/pkg/types"
 )
 
 var (
 	nodeID     = flag.String("id", "node-1", "Unique ID for this node")
 	nodeAddr   = flag.String("addr", ":8001", "Address this node listens on")
 	routerAddr = flag.String("router", "http://localhost:8081", "Address of the router")
+
+	heartbeatInterval = flag.Duration("heartbeat-interval", time.Second, "Time between heartbeats sent to the router")
 )
 
 func registerNode(nodeID, nodeAddr, routerAddr string) (*routerapi.RegisterNodeResponse, error) {
@@ -86,103 +87,89 @@ func deregisterNode(nodeID, routerAddr string) {
 	log.Printf("Successfully deregistered node %s from router", nodeID)
 }
 
-func main() {
-	flag.Parse()
+// errNotRegistered is returned for a heartbeat the router refused, as it
+// does not know the node.
+var errNotRegistered = errors.New("node is not registered with the router")
 
-	// Register node with router on startup
-	registerResp, err := registerNode(*nodeID, *nodeAddr, *routerAddr)
+func sendHeartbeat(nodeID, routerAddr string) error {
+	jsonBytes, err := json.Marshal(routerapi.HeartbeatRequest{ID: nodeID})
 	if err != nil {
-		log.Fatalf("failed to register node: %v", err)
+		return fmt.Errorf("failed to marshal heartbeat: %w", err)
 	}
 
-	// Initialize consistent hash ring for this node
-	aConsistent := consistent.New()
-	for _, n := range registerResp.ActiveNodes {
-		aConsistent.Add(n.ID)
+	resp, err := http.Post(routerAddr+"/heartbeat", "application/json", bytes.NewBuffer(jsonBytes))
+	if err != nil {
+		return fmt.Errorf("failed to send heartbeat: %w", err)
 	}
+	defer resp.Body.Close()
 
-	// Handle graceful shutdown
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	go func() {
-		<-c
-		deregisterNode(*nodeID, *routerAddr)
-		os.Exit(0)
-	}()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return errNotRegistered
+	default:
+		return fmt.Errorf("failed to send heartbeat, status: %s", resp.Status)
+	}
+}
+
+// heartbeat tells the router that the node is up every interval. A router
+// that does not know the node, as after it restarted, is joined again.
+func heartbeat(interval time.Duration, nodeID, nodeAddr, routerAddr string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		err := sendHeartbeat(nodeID, routerAddr)
+		if errors.Is(err, errNotRegistered) {
+			log.Printf("router does not know node %s, registering again", nodeID)
+			_, err = registerNode(nodeID, nodeAddr, routerAddr)
+		}
+		if err != nil {
+			log.Printf("heartbeat failed: %v", err)
+		}
+	}
+}
+
+func main() {
+	flag.Parse()
 
 	dbPath := "./" + *nodeID + ".db"
 	bboltStorage, err := bbolt.NewBBoltStorage(dbPath)
 	if err != nil {
 		log.Fatalf("failed to create bbolt storage: %v", err)
 	}
+	migration := bboltStorage.KeyMigration()
+	for table, n := range migration.Migrated {
+		log.Printf("migrated %d items in table %s to the current key format", n, table)
+	}
+	for table, err := range migration.Unmigrated {
+		log.Printf("table %s is unavailable: %v", table, err)
+	}
 
-	// Synchronization logic
-	routerClient := nodeapi.NewNodeClient(*routerAddr) // Use nodeapi client to talk to router
-	listTablesReq := &types.ListTablesRequest{}
-	listTablesResp, err := routerClient.ListTables(listTablesReq)
+	// The node serves before it registers: the router creates every table on
+	// it and copies it the items of the partitions it takes over before
+	// adding it to the ring.
+	listener, err := net.Listen("tcp", *nodeAddr)
 	if err != nil {
-		log.Fatalf("failed to list tables from router: %v", err)
+		log.Fatalf("failed to listen on %s: %v", *nodeAddr, err)
 	}
+	server := api.NewServer(bboltStorage)
+	go func() {
+		log.Printf("Server listening on %s\n", *nodeAddr)
+		log.Fatal(http.Serve(listener, server.Router()))
+	}()
 
-	for _, tableName := range listTablesResp.TableNames {
-		ownerNodeID, err := aConsistent.Get(tableName)
-		if err != nil {
-			log.Printf("could not determine owner for table %s: %v", tableName, err)
-			continue
-		}
-
-		if ownerNodeID == *nodeID {
-			// This node is responsible for the table, try to sync data
-			log.Printf("Node %s is responsible for table %s. Attempting to sync.", *nodeID, tableName)
-
-			// Find another active node that is also responsible for this table
-			var sourceNode router.Node
-			for _, n := range registerResp.ActiveNodes {
-				if n.ID != *nodeID {
-					sourceNodeID, err := aConsistent.Get(tableName)
-					if err == nil && sourceNodeID == n.ID {
-						sourceNode = n
-						break
-					}
-				}
-			}
-
-			if sourceNode.ID != "" {
-				log.Printf("Syncing table %s from node %s (%s)", tableName, sourceNode.ID, sourceNode.Addr)
-				sourceClient := nodeapi.NewNodeClient(sourceNode.Addr)
-				
-				var allSyncedItems []map[string]*types.AttributeValue
-				scanReq := &types.ScanRequest{TableName: tableName}
-				
-				for {
-					resp, err := sourceClient.InternalScan(scanReq)
-					if err != nil {
-						log.Printf("failed to internal scan table %s from %s: %v", tableName, sourceNode.ID, err)
-						break // Exit pagination loop on error
-					}
-
-					allSyncedItems = append(allSyncedItems, resp.Items...)
-
-					if resp.LastEvaluatedKey == nil {
-						break // No more pages
-					}
-					scanReq.ExclusiveStartKey = resp.LastEvaluatedKey
-				}
-
-				for _, item := range allSyncedItems {
-					putReq := &types.PutRequest{TableName: tableName, Item: item}
-					if err := bboltStorage.Put(putReq); err != nil {
-						log.Printf("failed to put item into local storage for table %s: %v", tableName, err)
-					}
-				}
-				log.Printf("Finished syncing %d items for table %s.", len(allSyncedItems), tableName)
-			} else {
-				log.Printf("No other active node found to sync table %s from. Starting with empty data.", tableName)
-			}
-		}
+	// Register node with router
+	if _, err := registerNode(*nodeID, *nodeAddr, *routerAddr); err != nil {
+		log.Fatalf("failed to register node: %v", err)
 	}
+	go heartbeat(*heartbeatInterval, *nodeID, *nodeAddr, *routerAddr)
 
-	log.Printf("Node %s synchronization complete. Starting server.", *nodeID)
-	server := api.NewServer(bboltStorage)
-	server.Run(*nodeAddr)
+	// Handle graceful shutdown. Deregistering returns once the partitions of
+	// the node have been handed off, which it serves until then.
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+	deregisterNode(*nodeID, *routerAddr)
 }
@@ -1,14 +1,53 @@
 package main
 
 import (
+	"flag"
+	"log"
+
 	"zagreb/pkg/api"
 	"zagreb/pkg/router"
 )
 
+var (
+	replicationFactor = flag.Int("replication-factor", router.DefaultReplicationFactor, "Number of nodes holding a copy of each item")
+	writeQuorum       = flag.Int("write-quorum", 0, "Number of replicas that must acknowledge a write, 0 for every replica")
+	readQuorum        = flag.Int("read-quorum", 1, "Number of replicas whose copies an eventually consistent read reconciles")
+
+	probeInterval = flag.Duration("probe-interval", router.DefaultHealthConfig.ProbeInterval, "Time between health probes of every node")
+	suspectAfter  = flag.Duration("suspect-after", router.DefaultHealthConfig.SuspectAfter, "Time after which a node not heard from is suspected")
+	failAfter     = flag.Duration("fail-after", router.DefaultHealthConfig.FailAfter, "Time after which a node not heard from is removed from the ring")
+
+	rebalanceBatchSize = flag.Int("rebalance-batch-size", router.DefaultRebalanceBatchSize, "Number of items read from a node at a time when moving partitions")
+
+	transactionLog = flag.String("transaction-log", "router-transactions.db", "Path of the log of transactions run across nodes")
+)
+
 func main() {
+	flag.Parse()
+
 	// Create a new router
 	r := router.NewRouter(nil)
+	if err := r.SetReplicationFactor(*replicationFactor); err != nil {
+		log.Fatalf("invalid replication factor: %v", err)
+	}
+	if err := r.SetQuorums(*writeQuorum, *readQuorum); err != nil {
+		log.Fatalf("invalid quorums: %v", err)
+	}
+	if err := r.SetHealthConfig(router.HealthConfig{
+		ProbeInterval: *probeInterval,
+		SuspectAfter:  *suspectAfter,
+		FailAfter:     *failAfter,
+	}); err != nil {
+		log.Fatalf("invalid health check configuration: %v", err)
+	}
+	if err := r.SetRebalanceBatchSize(*rebalanceBatchSize); err != nil {
+		log.Fatalf("invalid rebalance batch size: %v", err)
+	}
+	if err := r.OpenTransactionLog(*transactionLog); err != nil {
+		log.Fatalf("failed to open transaction log: %v", err)
+	}
+	r.StartHealthChecks()
 
 	server := api.NewRouterServer(r)
 	server.Run(":8081") // Router listens on port 8000
-}
\ No newline at end of file
+}
@@ -1,9 +1,13 @@
 package api_test
 
 import (
+	"bytes"
 	"context"
-	
+	"encoding/json"
+	"errors"
+	"fmt"
 
+	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
@@ -13,6 +17,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	awstypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
 
 	api "zagreb/pkg/api"
 	bbolt "zagreb/pkg/storage/bbolt"
@@ -40,11 +45,11 @@ func setupTestServer(t *testing.T) (*dynamodb.Client, func()) {
 	// Configure AWS SDK to use the test server endpoint
 	customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
 		return aws.Endpoint{
-			PartitionID:   "aws",
-			URL:           testServer.URL,
-			SigningRegion: "us-east-1",
-		},
-		nil
+				PartitionID:   "aws",
+				URL:           testServer.URL,
+				SigningRegion: "us-east-1",
+			},
+			nil
 	})
 
 	cfg, err := config.LoadDefaultConfig(context.TODO(),
@@ -150,6 +155,198 @@ func TestPutGetItem(t *testing.T) {
 	} else if strVal, ok := v.(*awstypes.AttributeValueMemberS); !ok || strVal.Value != "some data" {
 		t.Errorf("expected Data to be 'some data', got %v", v)
 	}
+
+	// A projection returns only the requested attributes.
+	getItemOutput, err = dbClient.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]awstypes.AttributeValue{
+			"ID":       &awstypes.AttributeValueMemberS{Value: "item1"},
+			"RangeKey": &awstypes.AttributeValueMemberN{Value: "123"},
+		},
+		ProjectionExpression: aws.String("#data"),
+		ExpressionAttributeNames: map[string]string{
+			"#data": "Data",
+		},
+	})
+	if err != nil {
+		t.Fatalf("GetItem with ProjectionExpression failed: %v", err)
+	}
+	if len(getItemOutput.Item) != 1 {
+		t.Errorf("expected only the Data attribute, got %v", getItemOutput.Item)
+	}
+	if _, ok := getItemOutput.Item["Data"]; !ok {
+		t.Errorf("expected Data attribute, but not found")
+	}
+}
+
+func TestConditionalPutItem(t *testing.T) {
+	dbClient, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	tableName := "TestConditionalPutTable"
+	_, err := dbClient.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		KeySchema: []awstypes.KeySchemaElement{
+			{AttributeName: aws.String("ID"), KeyType: awstypes.KeyTypeHash},
+		},
+		AttributeDefinitions: []awstypes.AttributeDefinition{
+			{AttributeName: aws.String("ID"), AttributeType: awstypes.ScalarAttributeTypeS},
+		},
+		ProvisionedThroughput: &awstypes.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(1),
+			WriteCapacityUnits: aws.Int64(1),
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateTable failed: %v", err)
+	}
+
+	putIfAbsent := &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item: map[string]awstypes.AttributeValue{
+			"ID": &awstypes.AttributeValueMemberS{Value: "item1"},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(ID)"),
+	}
+
+	if _, err := dbClient.PutItem(context.TODO(), putIfAbsent); err != nil {
+		t.Fatalf("first conditional PutItem failed: %v", err)
+	}
+
+	_, err = dbClient.PutItem(context.TODO(), putIfAbsent)
+	var condErr *awstypes.ConditionalCheckFailedException
+	if !errors.As(err, &condErr) {
+		t.Fatalf("expected ConditionalCheckFailedException, got %v", err)
+	}
+}
+
+func TestReturnValues(t *testing.T) {
+	dbClient, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	tableName := "TestReturnValuesTable"
+	_, err := dbClient.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		KeySchema: []awstypes.KeySchemaElement{
+			{AttributeName: aws.String("ID"), KeyType: awstypes.KeyTypeHash},
+		},
+		AttributeDefinitions: []awstypes.AttributeDefinition{
+			{AttributeName: aws.String("ID"), AttributeType: awstypes.ScalarAttributeTypeS},
+		},
+		ProvisionedThroughput: &awstypes.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(1),
+			WriteCapacityUnits: aws.Int64(1),
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateTable failed: %v", err)
+	}
+
+	key := map[string]awstypes.AttributeValue{
+		"ID": &awstypes.AttributeValueMemberS{Value: "item1"},
+	}
+
+	// Putting a new item with ALL_OLD returns nothing.
+	putOutput, err := dbClient.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item: map[string]awstypes.AttributeValue{
+			"ID":    &awstypes.AttributeValueMemberS{Value: "item1"},
+			"Name":  &awstypes.AttributeValueMemberS{Value: "first"},
+			"Count": &awstypes.AttributeValueMemberN{Value: "1"},
+		},
+		ReturnValues: awstypes.ReturnValueAllOld,
+	})
+	if err != nil {
+		t.Fatalf("PutItem failed: %v", err)
+	}
+	if len(putOutput.Attributes) != 0 {
+		t.Errorf("expected no attributes for a new item, got %v", putOutput.Attributes)
+	}
+
+	// Replacing it returns the item it replaced.
+	putOutput, err = dbClient.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item: map[string]awstypes.AttributeValue{
+			"ID":    &awstypes.AttributeValueMemberS{Value: "item1"},
+			"Name":  &awstypes.AttributeValueMemberS{Value: "second"},
+			"Count": &awstypes.AttributeValueMemberN{Value: "1"},
+		},
+		ReturnValues: awstypes.ReturnValueAllOld,
+	})
+	if err != nil {
+		t.Fatalf("PutItem failed: %v", err)
+	}
+	if v, ok := putOutput.Attributes["Name"].(*awstypes.AttributeValueMemberS); !ok || v.Value != "first" {
+		t.Errorf("expected old Name 'first', got %v", putOutput.Attributes["Name"])
+	}
+
+	// UPDATED_OLD returns only the updated attributes, as they were.
+	updateOutput, err := dbClient.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:        aws.String(tableName),
+		Key:              key,
+		UpdateExpression: aws.String("SET #count = #count + :inc"),
+		ExpressionAttributeNames: map[string]string{
+			"#count": "Count",
+		},
+		ExpressionAttributeValues: map[string]awstypes.AttributeValue{
+			":inc": &awstypes.AttributeValueMemberN{Value: "1"},
+		},
+		ReturnValues: awstypes.ReturnValueUpdatedOld,
+	})
+	if err != nil {
+		t.Fatalf("UpdateItem failed: %v", err)
+	}
+	if len(updateOutput.Attributes) != 1 {
+		t.Errorf("expected only the updated attribute, got %v", updateOutput.Attributes)
+	}
+	if v, ok := updateOutput.Attributes["Count"].(*awstypes.AttributeValueMemberN); !ok || v.Value != "1" {
+		t.Errorf("expected old Count 1, got %v", updateOutput.Attributes["Count"])
+	}
+
+	// With no ReturnValues, UpdateItem returns no attributes.
+	updateOutput, err = dbClient.UpdateItem(context.TODO(), &dynamodb.UpdateItemInput{
+		TableName:        aws.String(tableName),
+		Key:              key,
+		UpdateExpression: aws.String("SET #name = :name"),
+		ExpressionAttributeNames: map[string]string{
+			"#name": "Name",
+		},
+		ExpressionAttributeValues: map[string]awstypes.AttributeValue{
+			":name": &awstypes.AttributeValueMemberS{Value: "third"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("UpdateItem failed: %v", err)
+	}
+	if len(updateOutput.Attributes) != 0 {
+		t.Errorf("expected no attributes, got %v", updateOutput.Attributes)
+	}
+
+	// DeleteItem with ALL_OLD returns the deleted item.
+	deleteOutput, err := dbClient.DeleteItem(context.TODO(), &dynamodb.DeleteItemInput{
+		TableName:    aws.String(tableName),
+		Key:          key,
+		ReturnValues: awstypes.ReturnValueAllOld,
+	})
+	if err != nil {
+		t.Fatalf("DeleteItem failed: %v", err)
+	}
+	if v, ok := deleteOutput.Attributes["Count"].(*awstypes.AttributeValueMemberN); !ok || v.Value != "2" {
+		t.Errorf("expected deleted Count 2, got %v", deleteOutput.Attributes["Count"])
+	}
+	if v, ok := deleteOutput.Attributes["Name"].(*awstypes.AttributeValueMemberS); !ok || v.Value != "third" {
+		t.Errorf("expected deleted Name 'third', got %v", deleteOutput.Attributes["Name"])
+	}
+
+	// PutItem does not accept UPDATED_NEW.
+	_, err = dbClient.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName:    aws.String(tableName),
+		Item:         key,
+		ReturnValues: awstypes.ReturnValueUpdatedNew,
+	})
+	if err == nil {
+		t.Error("expected PutItem with UPDATED_NEW to fail")
+	}
 }
 
 func TestUpdateItem(t *testing.T) {
@@ -236,7 +433,7 @@ func TestUpdateItem(t *testing.T) {
 			"ID": &awstypes.AttributeValueMemberS{Value: "user1"},
 		},
 		UpdateExpression: aws.String("REMOVE Email"),
-		ReturnValues: awstypes.ReturnValueUpdatedNew,
+		ReturnValues:     awstypes.ReturnValueUpdatedNew,
 	})
 	if err != nil {
 		t.Fatalf("UpdateItem REMOVE failed: %v", err)
@@ -245,13 +442,12 @@ func TestUpdateItem(t *testing.T) {
 		t.Errorf("expected Email to be removed, but it still exists")
 	}
 
-	// Test DELETE operation (for scalar attributes, it's similar to REMOVE in our simplified impl)
-	// First, put an item with a boolean attribute to test DELETE on it
+	// Test DELETE operation, which removes elements from a set
 	_, err = dbClient.PutItem(context.TODO(), &dynamodb.PutItemInput{
 		TableName: aws.String(tableName),
 		Item: map[string]awstypes.AttributeValue{
-			"ID":     &awstypes.AttributeValueMemberS{Value: "user2"},
-			"Active": &awstypes.AttributeValueMemberBOOL{Value: true},
+			"ID":   &awstypes.AttributeValueMemberS{Value: "user2"},
+			"Tags": &awstypes.AttributeValueMemberSS{Value: []string{"a", "b"}},
 		},
 	})
 	if err != nil {
@@ -263,14 +459,19 @@ func TestUpdateItem(t *testing.T) {
 		Key: map[string]awstypes.AttributeValue{
 			"ID": &awstypes.AttributeValueMemberS{Value: "user2"},
 		},
-		UpdateExpression: aws.String("DELETE Active"),
+		UpdateExpression: aws.String("DELETE Tags :tags"),
+		ExpressionAttributeValues: map[string]awstypes.AttributeValue{
+			":tags": &awstypes.AttributeValueMemberSS{Value: []string{"a"}},
+		},
 		ReturnValues: awstypes.ReturnValueUpdatedNew,
 	})
 	if err != nil {
 		t.Fatalf("UpdateItem DELETE failed: %v", err)
 	}
-	if _, ok := updateOutput.Attributes["Active"]; ok {
-		t.Errorf("expected Active to be deleted, but it still exists")
+	if v, ok := updateOutput.Attributes["Tags"]; !ok {
+		t.Errorf("expected Tags attribute, but not found")
+	} else if setVal, ok := v.(*awstypes.AttributeValueMemberSS); !ok || len(setVal.Value) != 1 || setVal.Value[0] != "b" {
+		t.Errorf("expected Tags to be [b], got %v", v)
 	}
 }
 
@@ -334,6 +535,424 @@ func TestDeleteItem(t *testing.T) {
 	}
 }
 
+func TestBatchWriteGetItem(t *testing.T) {
+	dbClient, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	tableName := "TestBatchTable"
+	_, err := dbClient.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		KeySchema: []awstypes.KeySchemaElement{
+			{AttributeName: aws.String("ID"), KeyType: awstypes.KeyTypeHash},
+		},
+		AttributeDefinitions: []awstypes.AttributeDefinition{
+			{AttributeName: aws.String("ID"), AttributeType: awstypes.ScalarAttributeTypeS},
+		},
+		ProvisionedThroughput: &awstypes.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(1),
+			WriteCapacityUnits: aws.Int64(1),
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateTable failed: %v", err)
+	}
+
+	var writes []awstypes.WriteRequest
+	for i := 0; i < 25; i++ {
+		writes = append(writes, awstypes.WriteRequest{
+			PutRequest: &awstypes.PutRequest{
+				Item: map[string]awstypes.AttributeValue{
+					"ID":    &awstypes.AttributeValueMemberS{Value: fmt.Sprintf("item%d", i)},
+					"Value": &awstypes.AttributeValueMemberN{Value: fmt.Sprint(i)},
+				},
+			},
+		})
+	}
+
+	writeOutput, err := dbClient.BatchWriteItem(context.TODO(), &dynamodb.BatchWriteItemInput{
+		RequestItems: map[string][]awstypes.WriteRequest{tableName: writes},
+	})
+	if err != nil {
+		t.Fatalf("BatchWriteItem failed: %v", err)
+	}
+	if len(writeOutput.UnprocessedItems) != 0 {
+		t.Errorf("expected no unprocessed items, got %v", writeOutput.UnprocessedItems)
+	}
+
+	// Delete one item and read back a mix of present and missing keys.
+	_, err = dbClient.BatchWriteItem(context.TODO(), &dynamodb.BatchWriteItemInput{
+		RequestItems: map[string][]awstypes.WriteRequest{tableName: {
+			{DeleteRequest: &awstypes.DeleteRequest{Key: map[string]awstypes.AttributeValue{
+				"ID": &awstypes.AttributeValueMemberS{Value: "item0"},
+			}}},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("BatchWriteItem failed: %v", err)
+	}
+
+	getOutput, err := dbClient.BatchGetItem(context.TODO(), &dynamodb.BatchGetItemInput{
+		RequestItems: map[string]awstypes.KeysAndAttributes{
+			tableName: {
+				Keys: []map[string]awstypes.AttributeValue{
+					{"ID": &awstypes.AttributeValueMemberS{Value: "item0"}},
+					{"ID": &awstypes.AttributeValueMemberS{Value: "item1"}},
+					{"ID": &awstypes.AttributeValueMemberS{Value: "item24"}},
+				},
+				ProjectionExpression: aws.String("#v"),
+				ExpressionAttributeNames: map[string]string{
+					"#v": "Value",
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("BatchGetItem failed: %v", err)
+	}
+	items := getOutput.Responses[tableName]
+	if len(items) != 2 {
+		t.Fatalf("expected 2 items, got %d", len(items))
+	}
+	for _, item := range items {
+		if len(item) != 1 {
+			t.Errorf("expected only the Value attribute, got %v", item)
+		}
+	}
+
+	// More than 25 writes are rejected.
+	writes = append(writes, writes[0])
+	_, err = dbClient.BatchWriteItem(context.TODO(), &dynamodb.BatchWriteItemInput{
+		RequestItems: map[string][]awstypes.WriteRequest{tableName: writes},
+	})
+	if err == nil {
+		t.Error("expected BatchWriteItem with 26 writes to fail")
+	}
+}
+
+func TestTransactWriteGetItems(t *testing.T) {
+	dbClient, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	tableName := "TestTransactTable"
+	_, err := dbClient.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		KeySchema: []awstypes.KeySchemaElement{
+			{AttributeName: aws.String("ID"), KeyType: awstypes.KeyTypeHash},
+		},
+		AttributeDefinitions: []awstypes.AttributeDefinition{
+			{AttributeName: aws.String("ID"), AttributeType: awstypes.ScalarAttributeTypeS},
+		},
+		ProvisionedThroughput: &awstypes.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(1),
+			WriteCapacityUnits: aws.Int64(1),
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateTable failed: %v", err)
+	}
+
+	key := func(id string) map[string]awstypes.AttributeValue {
+		return map[string]awstypes.AttributeValue{"ID": &awstypes.AttributeValueMemberS{Value: id}}
+	}
+
+	_, err = dbClient.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: []awstypes.TransactWriteItem{
+			{Put: &awstypes.Put{
+				TableName: aws.String(tableName),
+				Item: map[string]awstypes.AttributeValue{
+					"ID":    &awstypes.AttributeValueMemberS{Value: "item1"},
+					"Stock": &awstypes.AttributeValueMemberN{Value: "1"},
+				},
+			}},
+			{Put: &awstypes.Put{
+				TableName:           aws.String(tableName),
+				Item:                key("item2"),
+				ConditionExpression: aws.String("attribute_not_exists(ID)"),
+			}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("TransactWriteItems failed: %v", err)
+	}
+
+	// The second action fails its condition, so the first is not applied.
+	_, err = dbClient.TransactWriteItems(context.TODO(), &dynamodb.TransactWriteItemsInput{
+		TransactItems: []awstypes.TransactWriteItem{
+			{Update: &awstypes.Update{
+				TableName:                 aws.String(tableName),
+				Key:                       key("item1"),
+				UpdateExpression:          aws.String("SET Stock = Stock - :one"),
+				ExpressionAttributeValues: map[string]awstypes.AttributeValue{":one": &awstypes.AttributeValueMemberN{Value: "1"}},
+			}},
+			{ConditionCheck: &awstypes.ConditionCheck{
+				TableName:           aws.String(tableName),
+				Key:                 key("item2"),
+				ConditionExpression: aws.String("attribute_not_exists(ID)"),
+			}},
+		},
+	})
+	var cancelled *awstypes.TransactionCanceledException
+	if !errors.As(err, &cancelled) {
+		t.Fatalf("expected TransactionCanceledException, got %v", err)
+	}
+	if len(cancelled.CancellationReasons) != 2 ||
+		aws.ToString(cancelled.CancellationReasons[0].Code) != "None" ||
+		aws.ToString(cancelled.CancellationReasons[1].Code) != "ConditionalCheckFailed" {
+		t.Errorf("unexpected cancellation reasons: %+v", cancelled.CancellationReasons)
+	}
+
+	getOutput, err := dbClient.TransactGetItems(context.TODO(), &dynamodb.TransactGetItemsInput{
+		TransactItems: []awstypes.TransactGetItem{
+			{Get: &awstypes.Get{TableName: aws.String(tableName), Key: key("item1")}},
+			{Get: &awstypes.Get{TableName: aws.String(tableName), Key: key("missing")}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("TransactGetItems failed: %v", err)
+	}
+	if len(getOutput.Responses) != 2 {
+		t.Fatalf("expected 2 responses, got %d", len(getOutput.Responses))
+	}
+	if stock, ok := getOutput.Responses[0].Item["Stock"].(*awstypes.AttributeValueMemberN); !ok || stock.Value != "1" {
+		t.Errorf("expected Stock 1, got %v", getOutput.Responses[0].Item["Stock"])
+	}
+	if getOutput.Responses[1].Item != nil {
+		t.Errorf("expected no item for a missing key, got %v", getOutput.Responses[1].Item)
+	}
+}
+
+func TestGlobalSecondaryIndex(t *testing.T) {
+	dbClient, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	tableName := "TestIndexTable"
+	_, err := dbClient.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		KeySchema: []awstypes.KeySchemaElement{
+			{AttributeName: aws.String("ID"), KeyType: awstypes.KeyTypeHash},
+		},
+		AttributeDefinitions: []awstypes.AttributeDefinition{
+			{AttributeName: aws.String("ID"), AttributeType: awstypes.ScalarAttributeTypeS},
+			{AttributeName: aws.String("Email"), AttributeType: awstypes.ScalarAttributeTypeS},
+		},
+		GlobalSecondaryIndexes: []awstypes.GlobalSecondaryIndex{{
+			IndexName:  aws.String("ByEmail"),
+			KeySchema:  []awstypes.KeySchemaElement{{AttributeName: aws.String("Email"), KeyType: awstypes.KeyTypeHash}},
+			Projection: &awstypes.Projection{ProjectionType: awstypes.ProjectionTypeAll},
+		}},
+		ProvisionedThroughput: &awstypes.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(1),
+			WriteCapacityUnits: aws.Int64(1),
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateTable failed: %v", err)
+	}
+
+	for i, email := range []string{"a@example.com", "b@example.com", "a@example.com"} {
+		_, err := dbClient.PutItem(context.TODO(), &dynamodb.PutItemInput{
+			TableName: aws.String(tableName),
+			Item: map[string]awstypes.AttributeValue{
+				"ID":    &awstypes.AttributeValueMemberS{Value: fmt.Sprintf("user%d", i)},
+				"Email": &awstypes.AttributeValueMemberS{Value: email},
+				"Age":   &awstypes.AttributeValueMemberN{Value: fmt.Sprint(20 + i)},
+			},
+		})
+		if err != nil {
+			t.Fatalf("PutItem failed: %v", err)
+		}
+	}
+
+	queryOutput, err := dbClient.Query(context.TODO(), &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String("ByEmail"),
+		KeyConditionExpression: aws.String("Email = :email"),
+		ExpressionAttributeValues: map[string]awstypes.AttributeValue{
+			":email": &awstypes.AttributeValueMemberS{Value: "a@example.com"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Query on index failed: %v", err)
+	}
+	if len(queryOutput.Items) != 2 {
+		t.Errorf("expected 2 items for a@example.com, got %d", len(queryOutput.Items))
+	}
+
+	// Add an index over existing items.
+	updateOutput, err := dbClient.UpdateTable(context.TODO(), &dynamodb.UpdateTableInput{
+		TableName: aws.String(tableName),
+		AttributeDefinitions: []awstypes.AttributeDefinition{
+			{AttributeName: aws.String("Age"), AttributeType: awstypes.ScalarAttributeTypeN},
+		},
+		GlobalSecondaryIndexUpdates: []awstypes.GlobalSecondaryIndexUpdate{{
+			Create: &awstypes.CreateGlobalSecondaryIndexAction{
+				IndexName:  aws.String("ByAge"),
+				KeySchema:  []awstypes.KeySchemaElement{{AttributeName: aws.String("Age"), KeyType: awstypes.KeyTypeHash}},
+				Projection: &awstypes.Projection{ProjectionType: awstypes.ProjectionTypeKeysOnly},
+			},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("UpdateTable failed: %v", err)
+	}
+	if n := len(updateOutput.TableDescription.GlobalSecondaryIndexes); n != 2 {
+		t.Errorf("expected 2 indexes, got %d", n)
+	}
+
+	scanOutput, err := dbClient.Scan(context.TODO(), &dynamodb.ScanInput{
+		TableName: aws.String(tableName),
+		IndexName: aws.String("ByAge"),
+	})
+	if err != nil {
+		t.Fatalf("Scan on index failed: %v", err)
+	}
+	if len(scanOutput.Items) != 3 {
+		t.Errorf("expected 3 items in the backfilled index, got %d", len(scanOutput.Items))
+	}
+	for _, item := range scanOutput.Items {
+		if _, ok := item["Email"]; ok {
+			t.Errorf("expected a KEYS_ONLY projection, got %v", item)
+		}
+	}
+}
+
+func TestLocalSecondaryIndex(t *testing.T) {
+	dbClient, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	tableName := "TestLocalIndexTable"
+	_, err := dbClient.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		KeySchema: []awstypes.KeySchemaElement{
+			{AttributeName: aws.String("UserID"), KeyType: awstypes.KeyTypeHash},
+			{AttributeName: aws.String("TaskID"), KeyType: awstypes.KeyTypeRange},
+		},
+		AttributeDefinitions: []awstypes.AttributeDefinition{
+			{AttributeName: aws.String("UserID"), AttributeType: awstypes.ScalarAttributeTypeS},
+			{AttributeName: aws.String("TaskID"), AttributeType: awstypes.ScalarAttributeTypeS},
+			{AttributeName: aws.String("CreatedAt"), AttributeType: awstypes.ScalarAttributeTypeN},
+		},
+		LocalSecondaryIndexes: []awstypes.LocalSecondaryIndex{{
+			IndexName: aws.String("ByCreatedAt"),
+			KeySchema: []awstypes.KeySchemaElement{
+				{AttributeName: aws.String("UserID"), KeyType: awstypes.KeyTypeHash},
+				{AttributeName: aws.String("CreatedAt"), KeyType: awstypes.KeyTypeRange},
+			},
+			Projection: &awstypes.Projection{ProjectionType: awstypes.ProjectionTypeAll},
+		}},
+		ProvisionedThroughput: &awstypes.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(1),
+			WriteCapacityUnits: aws.Int64(1),
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateTable failed: %v", err)
+	}
+
+	for i, createdAt := range []string{"30", "10", "20"} {
+		_, err := dbClient.PutItem(context.TODO(), &dynamodb.PutItemInput{
+			TableName: aws.String(tableName),
+			Item: map[string]awstypes.AttributeValue{
+				"UserID":    &awstypes.AttributeValueMemberS{Value: "userA"},
+				"TaskID":    &awstypes.AttributeValueMemberS{Value: fmt.Sprintf("task%d", i)},
+				"CreatedAt": &awstypes.AttributeValueMemberN{Value: createdAt},
+			},
+		})
+		if err != nil {
+			t.Fatalf("PutItem failed: %v", err)
+		}
+	}
+
+	queryOutput, err := dbClient.Query(context.TODO(), &dynamodb.QueryInput{
+		TableName:              aws.String(tableName),
+		IndexName:              aws.String("ByCreatedAt"),
+		KeyConditionExpression: aws.String("UserID = :uid AND CreatedAt >= :since"),
+		ExpressionAttributeValues: map[string]awstypes.AttributeValue{
+			":uid":   &awstypes.AttributeValueMemberS{Value: "userA"},
+			":since": &awstypes.AttributeValueMemberN{Value: "15"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Query on local index failed: %v", err)
+	}
+	var taskIDs []string
+	for _, item := range queryOutput.Items {
+		taskIDs = append(taskIDs, item["TaskID"].(*awstypes.AttributeValueMemberS).Value)
+	}
+	if fmt.Sprint(taskIDs) != "[task2 task0]" {
+		t.Errorf("expected tasks ordered by CreatedAt, got %v", taskIDs)
+	}
+}
+
+func TestTimeToLive(t *testing.T) {
+	dbClient, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	tableName := "TestTTLTable"
+	_, err := dbClient.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		KeySchema: []awstypes.KeySchemaElement{
+			{AttributeName: aws.String("ID"), KeyType: awstypes.KeyTypeHash},
+		},
+		AttributeDefinitions: []awstypes.AttributeDefinition{
+			{AttributeName: aws.String("ID"), AttributeType: awstypes.ScalarAttributeTypeS},
+		},
+		ProvisionedThroughput: &awstypes.ProvisionedThroughput{
+			ReadCapacityUnits:  aws.Int64(1),
+			WriteCapacityUnits: aws.Int64(1),
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateTable failed: %v", err)
+	}
+
+	_, err = dbClient.UpdateTimeToLive(context.TODO(), &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(tableName),
+		TimeToLiveSpecification: &awstypes.TimeToLiveSpecification{
+			AttributeName: aws.String("ExpiresAt"),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		t.Fatalf("UpdateTimeToLive failed: %v", err)
+	}
+
+	describeOutput, err := dbClient.DescribeTimeToLive(context.TODO(), &dynamodb.DescribeTimeToLiveInput{
+		TableName: aws.String(tableName),
+	})
+	if err != nil {
+		t.Fatalf("DescribeTimeToLive failed: %v", err)
+	}
+	if describeOutput.TimeToLiveDescription.TimeToLiveStatus != awstypes.TimeToLiveStatusEnabled ||
+		aws.ToString(describeOutput.TimeToLiveDescription.AttributeName) != "ExpiresAt" {
+		t.Errorf("unexpected time to live description: %+v", describeOutput.TimeToLiveDescription)
+	}
+
+	_, err = dbClient.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item: map[string]awstypes.AttributeValue{
+			"ID":        &awstypes.AttributeValueMemberS{Value: "session1"},
+			"ExpiresAt": &awstypes.AttributeValueMemberN{Value: "1000"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("PutItem failed: %v", err)
+	}
+
+	getOutput, err := dbClient.GetItem(context.TODO(), &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]awstypes.AttributeValue{
+			"ID": &awstypes.AttributeValueMemberS{Value: "session1"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("GetItem failed: %v", err)
+	}
+	if getOutput.Item != nil {
+		t.Errorf("expected the expired item to be hidden, got %v", getOutput.Item)
+	}
+}
+
 func TestQuery(t *testing.T) {
 	dbClient, cleanup := setupTestServer(t)
 	defer cleanup()
@@ -414,6 +1033,41 @@ func TestQuery(t *testing.T) {
 	if !foundTimestamps["100"] || !foundTimestamps["200"] {
 		t.Errorf("expected timestamps 100 and 200, got %v", foundTimestamps)
 	}
+
+	// Page through userA newest first, one item at a time
+	var pagedTimestamps []string
+	var lastEvaluatedKey map[string]awstypes.AttributeValue
+	for i := 0; i < 3; i++ {
+		pageOutput, err := dbClient.Query(context.TODO(), &dynamodb.QueryInput{
+			TableName:              aws.String(tableName),
+			KeyConditionExpression: aws.String("UserID = :uid"),
+			ExpressionAttributeValues: map[string]awstypes.AttributeValue{
+				":uid": &awstypes.AttributeValueMemberS{Value: "userA"},
+			},
+			Limit:             aws.Int32(1),
+			ScanIndexForward:  aws.Bool(false),
+			ExclusiveStartKey: lastEvaluatedKey,
+		})
+		if err != nil {
+			t.Fatalf("Paginated Query failed on page %d: %v", i+1, err)
+		}
+		if pageOutput.Count != int32(len(pageOutput.Items)) {
+			t.Errorf("expected Count %d, got %d", len(pageOutput.Items), pageOutput.Count)
+		}
+
+		for _, item := range pageOutput.Items {
+			pagedTimestamps = append(pagedTimestamps, item["Timestamp"].(*awstypes.AttributeValueMemberN).Value)
+		}
+
+		lastEvaluatedKey = pageOutput.LastEvaluatedKey
+		if lastEvaluatedKey == nil {
+			break // No more pages
+		}
+	}
+
+	if len(pagedTimestamps) != 2 || pagedTimestamps[0] != "200" || pagedTimestamps[1] != "100" {
+		t.Errorf("expected timestamps [200 100] from paginated query, got %v", pagedTimestamps)
+	}
 }
 
 func TestScan(t *testing.T) {
@@ -536,4 +1190,176 @@ func TestScan(t *testing.T) {
 			}
 		}
 	}
-}
\ No newline at end of file
+}
+
+// streamsRequest calls a DynamoDB Streams operation, for which the test
+// module has no SDK client, and decodes the response into resp.
+func streamsRequest(t *testing.T, url, action string, req, resp interface{}) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		t.Fatalf("failed to marshal %s request: %v", action, err)
+	}
+	httpReq, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to create %s request: %v", action, err)
+	}
+	httpReq.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	httpReq.Header.Set("X-Amz-Target", "DynamoDBStreams_20120810."+action)
+	httpResp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		t.Fatalf("%s failed: %v", action, err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		t.Fatalf("%s failed with status %s", action, httpResp.Status)
+	}
+	if err := json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		t.Fatalf("failed to decode %s response: %v", action, err)
+	}
+}
+
+func TestStreams(t *testing.T) {
+	dbPath := t.TempDir() + "/streams.db"
+	storage, err := bbolt.NewBBoltStorage(dbPath)
+	if err != nil {
+		t.Fatalf("failed to create bbolt storage: %v", err)
+	}
+	defer storage.Close()
+	testServer := httptest.NewServer(api.NewServer(storage).Router())
+	defer testServer.Close()
+
+	dbClient := dynamodb.New(dynamodb.Options{
+		BaseEndpoint: aws.String(testServer.URL),
+		Region:       "us-east-1",
+		Credentials:  credentials.NewStaticCredentialsProvider("test", "test", ""),
+	})
+
+	tableName := "TestStreamTable"
+	createOutput, err := dbClient.CreateTable(context.TODO(), &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		KeySchema: []awstypes.KeySchemaElement{
+			{AttributeName: aws.String("ID"), KeyType: awstypes.KeyTypeHash},
+		},
+		AttributeDefinitions: []awstypes.AttributeDefinition{
+			{AttributeName: aws.String("ID"), AttributeType: awstypes.ScalarAttributeTypeS},
+		},
+		StreamSpecification: &awstypes.StreamSpecification{
+			StreamEnabled:  aws.Bool(true),
+			StreamViewType: awstypes.StreamViewTypeNewImage,
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateTable failed: %v", err)
+	}
+	streamArn := aws.ToString(createOutput.TableDescription.LatestStreamArn)
+	if streamArn == "" {
+		t.Fatalf("expected CreateTable to return the stream ARN")
+	}
+
+	_, err = dbClient.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item: map[string]awstypes.AttributeValue{
+			"ID":   &awstypes.AttributeValueMemberS{Value: "1"},
+			"Name": &awstypes.AttributeValueMemberS{Value: "Alice"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("PutItem failed: %v", err)
+	}
+
+	var listOutput struct {
+		Streams []struct{ StreamArn, TableName string }
+	}
+	streamsRequest(t, testServer.URL, "ListStreams", map[string]string{"TableName": tableName}, &listOutput)
+	if len(listOutput.Streams) != 1 || listOutput.Streams[0].StreamArn != streamArn {
+		t.Fatalf("expected stream %s, got %+v", streamArn, listOutput.Streams)
+	}
+
+	var describeOutput struct {
+		StreamDescription struct {
+			StreamStatus string
+			Shards       []struct{ ShardId string }
+		}
+	}
+	streamsRequest(t, testServer.URL, "DescribeStream", map[string]string{"StreamArn": streamArn}, &describeOutput)
+	if describeOutput.StreamDescription.StreamStatus != "ENABLED" || len(describeOutput.StreamDescription.Shards) != 1 {
+		t.Fatalf("unexpected stream description: %+v", describeOutput.StreamDescription)
+	}
+
+	var iteratorOutput struct{ ShardIterator string }
+	streamsRequest(t, testServer.URL, "GetShardIterator", map[string]string{
+		"StreamArn":         streamArn,
+		"ShardId":           describeOutput.StreamDescription.Shards[0].ShardId,
+		"ShardIteratorType": "TRIM_HORIZON",
+	}, &iteratorOutput)
+
+	var recordsOutput struct {
+		Records []struct {
+			EventName string `json:"eventName"`
+			Dynamodb  struct {
+				Keys     map[string]map[string]string
+				NewImage map[string]map[string]string
+			} `json:"dynamodb"`
+		}
+		NextShardIterator string
+	}
+	streamsRequest(t, testServer.URL, "GetRecords", map[string]string{"ShardIterator": iteratorOutput.ShardIterator}, &recordsOutput)
+	if len(recordsOutput.Records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(recordsOutput.Records))
+	}
+	record := recordsOutput.Records[0]
+	if record.EventName != "INSERT" || record.Dynamodb.Keys["ID"]["S"] != "1" || record.Dynamodb.NewImage["Name"]["S"] != "Alice" {
+		t.Errorf("unexpected record: %+v", record)
+	}
+	if recordsOutput.NextShardIterator == "" {
+		t.Errorf("expected a next shard iterator for an open shard")
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	dbClient, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	tableName := "TestErrorTable"
+	createInput := &dynamodb.CreateTableInput{
+		TableName: aws.String(tableName),
+		KeySchema: []awstypes.KeySchemaElement{
+			{AttributeName: aws.String("ID"), KeyType: awstypes.KeyTypeHash},
+		},
+		AttributeDefinitions: []awstypes.AttributeDefinition{
+			{AttributeName: aws.String("ID"), AttributeType: awstypes.ScalarAttributeTypeS},
+		},
+	}
+	if _, err := dbClient.CreateTable(context.TODO(), createInput); err != nil {
+		t.Fatalf("CreateTable failed: %v", err)
+	}
+
+	_, err := dbClient.CreateTable(context.TODO(), createInput)
+	var inUse *awstypes.ResourceInUseException
+	if !errors.As(err, &inUse) {
+		t.Errorf("expected ResourceInUseException for an existing table, got %v", err)
+	}
+
+	_, err = dbClient.DescribeTable(context.TODO(), &dynamodb.DescribeTableInput{TableName: aws.String("Missing")})
+	var notFound *awstypes.ResourceNotFoundException
+	if !errors.As(err, &notFound) {
+		t.Errorf("expected ResourceNotFoundException for a missing table, got %v", err)
+	} else if aws.ToString(notFound.Message) != "table not found: Missing" {
+		t.Errorf("unexpected message: %q", aws.ToString(notFound.Message))
+	}
+
+	_, err = dbClient.PutItem(context.TODO(), &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item: map[string]awstypes.AttributeValue{
+			"ID": &awstypes.AttributeValueMemberN{Value: "1"},
+		},
+	})
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode() != "ValidationException" {
+		t.Errorf("expected ValidationException for a key of the wrong type, got %v", err)
+	}
+	var respErr interface{ HTTPStatusCode() int }
+	if !errors.As(err, &respErr) || respErr.HTTPStatusCode() != 400 {
+		t.Errorf("expected status 400 for a ValidationException, got %v", err)
+	}
+}
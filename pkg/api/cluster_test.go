@@ -0,0 +1,1358 @@
+package api_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	api "zagreb/pkg/api"
+	"zagreb/pkg/nodeapi"
+	"zagreb/pkg/router"
+	"zagreb/pkg/routerapi"
+	"zagreb/pkg/storage"
+	bbolt "zagreb/pkg/storage/bbolt"
+	"zagreb/pkg/types"
+)
+
+// setupTestCluster starts nodes, each serving its own bbolt database over
+// HTTP, and returns a router with every node added, so that every request
+// to the router goes over the node protocol.
+func setupTestCluster(t *testing.T, nodes int) (*router.Router, []*httptest.Server) {
+	r := router.NewRouter(nil)
+	var servers []*httptest.Server
+	for i := 0; i < nodes; i++ {
+		store, err := bbolt.NewBBoltStorage(t.TempDir() + "/node.db")
+		if err != nil {
+			t.Fatalf("failed to create bbolt storage: %v", err)
+		}
+		server := httptest.NewServer(api.NewServer(store).Router())
+		t.Cleanup(func() {
+			server.Close()
+			store.Close()
+		})
+		servers = append(servers, server)
+		r.AddNode(router.Node{
+			ID:   "node" + string(rune('1'+i)),
+			Addr: strings.TrimPrefix(server.URL, "http://"),
+		})
+	}
+	return r, servers
+}
+
+// nodeForKey returns the node holding the items of a table with the given
+// hash key value.
+func nodeForKey(t *testing.T, r *router.Router, tableName string, hashKey *types.AttributeValue) router.Node {
+	partitionKey, err := storage.PartitionKey(tableName, hashKey)
+	if err != nil {
+		t.Fatalf("PartitionKey failed: %v", err)
+	}
+	node, err := r.GetNode(partitionKey)
+	if err != nil {
+		t.Fatalf("GetNode failed: %v", err)
+	}
+	return node
+}
+
+func sValue(s string) *types.AttributeValue {
+	return &types.AttributeValue{S: &s}
+}
+
+func nValue(n string) *types.AttributeValue {
+	return &types.AttributeValue{N: &n}
+}
+
+func TestCluster(t *testing.T) {
+	r, _ := setupTestCluster(t, 3)
+
+	users, orders := "Users", "Orders"
+
+	t.Run("CreateTable", func(t *testing.T) {
+		if _, err := r.CreateTable(&types.CreateTableRequest{
+			TableName:            users,
+			KeySchema:            []*types.KeySchemaElement{{AttributeName: "ID", KeyType: "HASH"}},
+			AttributeDefinitions: []*types.AttributeDefinition{{AttributeName: "ID", AttributeType: "S"}},
+		}); err != nil {
+			t.Fatalf("CreateTable failed: %v", err)
+		}
+		resp, err := r.CreateTable(&types.CreateTableRequest{
+			TableName: orders,
+			KeySchema: []*types.KeySchemaElement{
+				{AttributeName: "Customer", KeyType: "HASH"},
+				{AttributeName: "OrderID", KeyType: "RANGE"},
+			},
+			AttributeDefinitions: []*types.AttributeDefinition{
+				{AttributeName: "Customer", AttributeType: "S"},
+				{AttributeName: "OrderID", AttributeType: "N"},
+			},
+			StreamSpecification: &types.StreamSpecification{StreamEnabled: true, StreamViewType: types.StreamViewTypeNewAndOldImages},
+		})
+		if err != nil {
+			t.Fatalf("CreateTable failed: %v", err)
+		}
+		if resp.TableDescription.LatestStreamArn == "" {
+			t.Errorf("expected a stream ARN for %s", orders)
+		}
+
+		_, err = r.CreateTable(&types.CreateTableRequest{
+			TableName:            users,
+			KeySchema:            []*types.KeySchemaElement{{AttributeName: "ID", KeyType: "HASH"}},
+			AttributeDefinitions: []*types.AttributeDefinition{{AttributeName: "ID", AttributeType: "S"}},
+		})
+		if !errors.Is(err, storage.ErrResourceInUse) {
+			t.Errorf("expected ErrResourceInUse creating %s twice, got %v", users, err)
+		}
+	})
+
+	t.Run("DescribeTable", func(t *testing.T) {
+		resp, err := r.DescribeTable(&types.DescribeTableRequest{TableName: orders})
+		if err != nil {
+			t.Fatalf("DescribeTable failed: %v", err)
+		}
+		if len(resp.Table.KeySchema) != 2 {
+			t.Errorf("expected 2 key attributes, got %d", len(resp.Table.KeySchema))
+		}
+		_, err = r.DescribeTable(&types.DescribeTableRequest{TableName: "Missing"})
+		if !errors.Is(err, storage.ErrResourceNotFound) {
+			t.Errorf("expected ErrResourceNotFound, got %v", err)
+		}
+	})
+
+	t.Run("ListTables", func(t *testing.T) {
+		resp, err := r.ListTables(&types.ListTablesRequest{})
+		if err != nil {
+			t.Fatalf("ListTables failed: %v", err)
+		}
+		if len(resp.TableNames) != 2 {
+			t.Errorf("expected 2 tables, got %v", resp.TableNames)
+		}
+	})
+
+	t.Run("UpdateTable", func(t *testing.T) {
+		resp, err := r.UpdateTable(&types.UpdateTableRequest{
+			TableName:            users,
+			AttributeDefinitions: []*types.AttributeDefinition{{AttributeName: "Email", AttributeType: "S"}},
+			GlobalSecondaryIndexUpdates: []*types.GlobalSecondaryIndexUpdate{{
+				Create: &types.GlobalSecondaryIndex{
+					IndexName:  "ByEmail",
+					KeySchema:  []*types.KeySchemaElement{{AttributeName: "Email", KeyType: "HASH"}},
+					Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+				},
+			}},
+		})
+		if err != nil {
+			t.Fatalf("UpdateTable failed: %v", err)
+		}
+		if len(resp.TableDescription.GlobalSecondaryIndexes) != 1 {
+			t.Errorf("expected 1 global secondary index, got %d", len(resp.TableDescription.GlobalSecondaryIndexes))
+		}
+	})
+
+	t.Run("TimeToLive", func(t *testing.T) {
+		if _, err := r.UpdateTimeToLive(&types.UpdateTimeToLiveRequest{
+			TableName:               users,
+			TimeToLiveSpecification: &types.TimeToLiveSpecification{AttributeName: "ExpiresAt", Enabled: true},
+		}); err != nil {
+			t.Fatalf("UpdateTimeToLive failed: %v", err)
+		}
+		resp, err := r.DescribeTimeToLive(&types.DescribeTimeToLiveRequest{TableName: users})
+		if err != nil {
+			t.Fatalf("DescribeTimeToLive failed: %v", err)
+		}
+		if resp.TimeToLiveDescription.TimeToLiveStatus != types.TimeToLiveStatusEnabled {
+			t.Errorf("expected time to live to be enabled, got %s", resp.TimeToLiveDescription.TimeToLiveStatus)
+		}
+	})
+
+	t.Run("PutGetItem", func(t *testing.T) {
+		if _, err := r.Put(&types.PutRequest{
+			TableName: users,
+			Item:      map[string]*types.AttributeValue{"ID": sValue("u1"), "Email": sValue("a@example.com")},
+		}); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+		item, err := r.Get(&types.GetRequest{TableName: users, Key: map[string]*types.AttributeValue{"ID": sValue("u1")}})
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if item["Email"] == nil || *item["Email"].S != "a@example.com" {
+			t.Errorf("unexpected item: %v", item)
+		}
+
+		item, err = r.Get(&types.GetRequest{TableName: users, Key: map[string]*types.AttributeValue{"ID": sValue("missing")}})
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if item != nil {
+			t.Errorf("expected no item, got %v", item)
+		}
+
+		_, err = r.Put(&types.PutRequest{
+			TableName:           users,
+			Item:                map[string]*types.AttributeValue{"ID": sValue("u1")},
+			ConditionExpression: "attribute_not_exists(ID)",
+		})
+		if !errors.Is(err, storage.ErrConditionalCheckFailed) {
+			t.Errorf("expected ErrConditionalCheckFailed, got %v", err)
+		}
+	})
+
+	t.Run("UpdateItem", func(t *testing.T) {
+		resp, err := r.Update(&types.UpdateRequest{
+			TableName:                 users,
+			Key:                       map[string]*types.AttributeValue{"ID": sValue("u1")},
+			UpdateExpression:          "SET Visits = :v",
+			ExpressionAttributeValues: map[string]*types.AttributeValue{":v": nValue("1")},
+			ReturnValues:              types.ReturnValuesAllNew,
+		})
+		if err != nil {
+			t.Fatalf("Update failed: %v", err)
+		}
+		if resp.Attributes["Visits"] == nil || *resp.Attributes["Visits"].N != "1" {
+			t.Errorf("unexpected attributes: %v", resp.Attributes)
+		}
+	})
+
+	t.Run("BatchWriteGetItem", func(t *testing.T) {
+		writeResp, err := r.BatchWriteItem(&types.BatchWriteItemRequest{
+			RequestItems: map[string][]*types.WriteRequest{
+				users: {{PutRequest: &types.BatchPutRequest{Item: map[string]*types.AttributeValue{"ID": sValue("u2")}}}},
+				orders: {
+					{PutRequest: &types.BatchPutRequest{Item: map[string]*types.AttributeValue{"Customer": sValue("u1"), "OrderID": nValue("1")}}},
+					{PutRequest: &types.BatchPutRequest{Item: map[string]*types.AttributeValue{"Customer": sValue("u1"), "OrderID": nValue("2")}}},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatalf("BatchWriteItem failed: %v", err)
+		}
+		if len(writeResp.UnprocessedItems) != 0 {
+			t.Errorf("expected no unprocessed items, got %v", writeResp.UnprocessedItems)
+		}
+
+		getResp, err := r.BatchGetItem(&types.BatchGetItemRequest{
+			RequestItems: map[string]*types.KeysAndAttributes{
+				users:  {Keys: []map[string]*types.AttributeValue{{"ID": sValue("u1")}, {"ID": sValue("u2")}}},
+				orders: {Keys: []map[string]*types.AttributeValue{{"Customer": sValue("u1"), "OrderID": nValue("2")}}},
+			},
+		})
+		if err != nil {
+			t.Fatalf("BatchGetItem failed: %v", err)
+		}
+		if len(getResp.Responses[users]) != 2 || len(getResp.Responses[orders]) != 1 {
+			t.Errorf("unexpected responses: %v", getResp.Responses)
+		}
+	})
+
+	t.Run("Query", func(t *testing.T) {
+		resp, err := r.Query(&types.QueryRequest{
+			TableName:                 orders,
+			KeyConditionExpression:    "Customer = :c",
+			ExpressionAttributeValues: map[string]*types.AttributeValue{":c": sValue("u1")},
+		})
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		if resp.Count != 2 {
+			t.Errorf("expected 2 orders, got %d", resp.Count)
+		}
+
+		resp, err = r.Query(&types.QueryRequest{
+			TableName:                 users,
+			IndexName:                 "ByEmail",
+			KeyConditionExpression:    "Email = :e",
+			ExpressionAttributeValues: map[string]*types.AttributeValue{":e": sValue("a@example.com")},
+		})
+		if err != nil {
+			t.Fatalf("Query on index failed: %v", err)
+		}
+		if resp.Count != 1 {
+			t.Errorf("expected 1 user, got %d", resp.Count)
+		}
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		resp, err := r.Scan(&types.ScanRequest{TableName: orders})
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		if resp.Count != 2 {
+			t.Errorf("expected 2 orders, got %d", resp.Count)
+		}
+		resp, err = r.InternalScan(&types.ScanRequest{TableName: users})
+		if err != nil {
+			t.Fatalf("InternalScan failed: %v", err)
+		}
+		if len(resp.Items) != 2 {
+			t.Errorf("expected 2 users, got %d", len(resp.Items))
+		}
+	})
+
+	// TransactWriteItems prepares, and then commits or aborts, the part of
+	// the transaction held by each node.
+	t.Run("Transactions", func(t *testing.T) {
+		// The order is placed by a customer whose orders are held by
+		// another node than user u3, so that the transaction is committed
+		// in two phases.
+		customer := ""
+		userNode := nodeForKey(t, r, users, sValue("u3"))
+		for _, candidate := range []string{"u3", "c1", "c2", "c3", "c4", "c5"} {
+			if nodeForKey(t, r, orders, sValue(candidate)).ID != userNode.ID {
+				customer = candidate
+				break
+			}
+		}
+		if customer == "" {
+			t.Fatalf("no customer whose orders are held by a node other than %s", userNode.ID)
+		}
+
+		if _, err := r.TransactWriteItems(&types.TransactWriteItemsRequest{
+			TransactItems: []*types.TransactWriteItem{
+				{Put: &types.PutRequest{TableName: users, Item: map[string]*types.AttributeValue{"ID": sValue("u3")}}},
+				{Put: &types.PutRequest{TableName: orders, Item: map[string]*types.AttributeValue{"Customer": sValue(customer), "OrderID": nValue("1")}}},
+			},
+		}); err != nil {
+			t.Fatalf("TransactWriteItems failed: %v", err)
+		}
+
+		_, err := r.TransactWriteItems(&types.TransactWriteItemsRequest{
+			TransactItems: []*types.TransactWriteItem{
+				{Put: &types.PutRequest{TableName: users, Item: map[string]*types.AttributeValue{"ID": sValue("u4")}}},
+				{Put: &types.PutRequest{
+					TableName:           orders,
+					Item:                map[string]*types.AttributeValue{"Customer": sValue(customer), "OrderID": nValue("1")},
+					ConditionExpression: "attribute_not_exists(Customer)",
+				}},
+			},
+		})
+		var cancelled *storage.TransactionCanceledError
+		if !errors.As(err, &cancelled) {
+			t.Fatalf("expected TransactionCanceledError, got %v", err)
+		}
+		if len(cancelled.Reasons) != 2 || cancelled.Reasons[1].Code != types.CancellationReasonConditionalCheckFailed {
+			t.Errorf("unexpected cancellation reasons: %v", cancelled.Reasons)
+		}
+
+		resp, err := r.TransactGetItems(&types.TransactGetItemsRequest{
+			TransactItems: []*types.TransactGetItem{
+				{Get: &types.GetRequest{TableName: users, Key: map[string]*types.AttributeValue{"ID": sValue("u3")}}},
+				{Get: &types.GetRequest{TableName: users, Key: map[string]*types.AttributeValue{"ID": sValue("u4")}}},
+			},
+		})
+		if err != nil {
+			t.Fatalf("TransactGetItems failed: %v", err)
+		}
+		if resp.Responses[0].Item == nil || resp.Responses[1].Item != nil {
+			t.Errorf("expected only the committed item, got %v and %v", resp.Responses[0].Item, resp.Responses[1].Item)
+		}
+	})
+
+	t.Run("DeleteItem", func(t *testing.T) {
+		resp, err := r.Delete(&types.DeleteRequest{
+			TableName:    users,
+			Key:          map[string]*types.AttributeValue{"ID": sValue("u2")},
+			ReturnValues: types.ReturnValuesAllOld,
+		})
+		if err != nil {
+			t.Fatalf("Delete failed: %v", err)
+		}
+		if resp.Attributes["ID"] == nil || *resp.Attributes["ID"].S != "u2" {
+			t.Errorf("unexpected attributes: %v", resp.Attributes)
+		}
+	})
+
+	t.Run("Streams", func(t *testing.T) {
+		listResp, err := r.ListStreams(&types.ListStreamsRequest{})
+		if err != nil {
+			t.Fatalf("ListStreams failed: %v", err)
+		}
+		if len(listResp.Streams) != 1 || listResp.Streams[0].TableName != orders {
+			t.Fatalf("expected the stream of %s, got %v", orders, listResp.Streams)
+		}
+		streamArn := listResp.Streams[0].StreamArn
+
+		// Each node records the changes to the items it holds in a shard
+		// of its own.
+		describeResp, err := r.DescribeStream(&types.DescribeStreamRequest{StreamArn: streamArn})
+		if err != nil {
+			t.Fatalf("DescribeStream failed: %v", err)
+		}
+		if len(describeResp.StreamDescription.Shards) != 3 {
+			t.Fatalf("expected 3 shards, got %d", len(describeResp.StreamDescription.Shards))
+		}
+
+		pageResp, err := r.DescribeStream(&types.DescribeStreamRequest{StreamArn: streamArn, Limit: 2})
+		if err != nil {
+			t.Fatalf("DescribeStream failed: %v", err)
+		}
+		if len(pageResp.StreamDescription.Shards) != 2 || pageResp.StreamDescription.LastEvaluatedShardId != pageResp.StreamDescription.Shards[1].ShardId {
+			t.Errorf("expected a page of 2 shards, got %v", pageResp.StreamDescription)
+		}
+
+		var records []*types.Record
+		for _, shard := range describeResp.StreamDescription.Shards {
+			iteratorResp, err := r.GetShardIterator(&types.GetShardIteratorRequest{
+				StreamArn:         streamArn,
+				ShardId:           shard.ShardId,
+				ShardIteratorType: types.ShardIteratorTypeTrimHorizon,
+			})
+			if err != nil {
+				t.Fatalf("GetShardIterator failed: %v", err)
+			}
+			recordsResp, err := r.GetRecords(&types.GetRecordsRequest{ShardIterator: iteratorResp.ShardIterator})
+			if err != nil {
+				t.Fatalf("GetRecords failed: %v", err)
+			}
+			records = append(records, recordsResp.Records...)
+
+			// The next iterator reads on from the same shard.
+			if _, err := r.GetRecords(&types.GetRecordsRequest{ShardIterator: recordsResp.NextShardIterator}); err != nil {
+				t.Fatalf("GetRecords with the next iterator failed: %v", err)
+			}
+		}
+		if len(records) != 3 {
+			t.Errorf("expected 3 records, got %d", len(records))
+		}
+		for _, record := range records {
+			if record.EventName != types.StreamEventInsert {
+				t.Errorf("expected an INSERT record, got %s", record.EventName)
+			}
+		}
+	})
+
+	// The router only coordinates transactions, and takes no part in them.
+	t.Run("TransactionProtocol", func(t *testing.T) {
+		if _, err := r.PrepareTransaction(&types.PrepareTransactionRequest{TransactionID: "t1"}); err == nil {
+			t.Errorf("expected PrepareTransaction to fail on the router")
+		}
+		if err := r.CommitTransaction(&types.CommitTransactionRequest{TransactionID: "t1"}); err == nil {
+			t.Errorf("expected CommitTransaction to fail on the router")
+		}
+		if err := r.AbortTransaction(&types.AbortTransactionRequest{TransactionID: "t1"}); err == nil {
+			t.Errorf("expected AbortTransaction to fail on the router")
+		}
+	})
+
+	t.Run("DeleteTable", func(t *testing.T) {
+		for _, tableName := range []string{users, orders} {
+			if _, err := r.DeleteTable(&types.DeleteTableRequest{TableName: tableName}); err != nil {
+				t.Fatalf("DeleteTable failed: %v", err)
+			}
+		}
+		resp, err := r.ListTables(&types.ListTablesRequest{})
+		if err != nil {
+			t.Fatalf("ListTables failed: %v", err)
+		}
+		if len(resp.TableNames) != 0 {
+			t.Errorf("expected no tables, got %v", resp.TableNames)
+		}
+	})
+}
+
+// TestClusterPartitioning checks that the items of a table are spread over
+// the nodes by hash key, and that requests reading every partition page
+// through them all.
+func TestClusterPartitioning(t *testing.T) {
+	r, servers := setupTestCluster(t, 3)
+
+	if _, err := r.CreateTable(&types.CreateTableRequest{
+		TableName: "Players",
+		KeySchema: []*types.KeySchemaElement{{AttributeName: "ID", KeyType: "HASH"}},
+		AttributeDefinitions: []*types.AttributeDefinition{
+			{AttributeName: "ID", AttributeType: "S"},
+			{AttributeName: "Team", AttributeType: "S"},
+			{AttributeName: "Rank", AttributeType: "N"},
+		},
+		GlobalSecondaryIndexes: []*types.GlobalSecondaryIndex{{
+			IndexName: "ByRank",
+			KeySchema: []*types.KeySchemaElement{
+				{AttributeName: "Team", KeyType: "HASH"},
+				{AttributeName: "Rank", KeyType: "RANGE"},
+			},
+			Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+		}},
+	}); err != nil {
+		t.Fatalf("CreateTable failed: %v", err)
+	}
+
+	const players = 30
+	for i := 0; i < players; i++ {
+		if _, err := r.Put(&types.PutRequest{
+			TableName: "Players",
+			Item: map[string]*types.AttributeValue{
+				"ID":   sValue(fmt.Sprintf("p%02d", i)),
+				"Team": sValue("red"),
+				"Rank": nValue(fmt.Sprint(i % 10)),
+			},
+		}); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	t.Run("Placement", func(t *testing.T) {
+		total, holding := 0, 0
+		for _, server := range servers {
+			client := nodeapi.NewNodeClient(strings.TrimPrefix(server.URL, "http://"))
+			resp, err := client.Scan(&types.ScanRequest{TableName: "Players"})
+			if err != nil {
+				t.Fatalf("Scan failed: %v", err)
+			}
+			total += len(resp.Items)
+			if len(resp.Items) > 0 {
+				holding++
+			}
+		}
+		if total != players {
+			t.Errorf("expected %d items over all nodes, got %d", players, total)
+		}
+		if holding < 2 {
+			t.Errorf("expected the items to be spread over the nodes, %d held them", holding)
+		}
+	})
+
+	t.Run("ScanPages", func(t *testing.T) {
+		seen := make(map[string]bool)
+		limit := 4
+		req := &types.ScanRequest{TableName: "Players", Limit: &limit}
+		for pages := 0; ; pages++ {
+			if pages > players {
+				t.Fatalf("scan did not end")
+			}
+			resp, err := r.Scan(req)
+			if err != nil {
+				t.Fatalf("Scan failed: %v", err)
+			}
+			if len(resp.Items) > limit {
+				t.Errorf("expected at most %d items, got %d", limit, len(resp.Items))
+			}
+			for _, item := range resp.Items {
+				id := *item["ID"].S
+				if seen[id] {
+					t.Errorf("item %s returned twice", id)
+				}
+				seen[id] = true
+			}
+			if resp.LastEvaluatedKey == nil {
+				break
+			}
+			req.ExclusiveStartKey = resp.LastEvaluatedKey
+		}
+		if len(seen) != players {
+			t.Errorf("expected %d items, got %d", players, len(seen))
+		}
+	})
+
+	t.Run("NumberKeys", func(t *testing.T) {
+		one, err := storage.PartitionKey("Players", nValue("1"))
+		if err != nil {
+			t.Fatalf("PartitionKey failed: %v", err)
+		}
+		if same, err := storage.PartitionKey("Players", nValue("1.0")); err != nil || same != one {
+			t.Errorf("expected 1.0 in the partition of 1, got %q, %v", same, err)
+		}
+		// Numbers the nodes cannot store have no partition.
+		for _, n := range []string{"1/2", "1e1000", "1" + strings.Repeat("1", 38)} {
+			if _, err := storage.PartitionKey("Players", nValue(n)); !errors.Is(err, storage.ErrValidation) {
+				t.Errorf("expected ErrValidation for %s, got %v", n, err)
+			}
+		}
+	})
+
+	// The entries of a global index are merged from every node in index
+	// order: by Rank, then by ID.
+	for _, forward := range []bool{true, false} {
+		t.Run(fmt.Sprintf("QueryGlobalIndex/forward=%v", forward), func(t *testing.T) {
+			var keys []string
+			limit := 4
+			req := &types.QueryRequest{
+				TableName:                 "Players",
+				IndexName:                 "ByRank",
+				KeyConditionExpression:    "Team = :t",
+				ExpressionAttributeValues: map[string]*types.AttributeValue{":t": sValue("red")},
+				ProjectionExpression:      "ID",
+				ScanIndexForward:          &forward,
+				Limit:                     &limit,
+			}
+			for pages := 0; ; pages++ {
+				if pages > players {
+					t.Fatalf("query did not end")
+				}
+				resp, err := r.Query(req)
+				if err != nil {
+					t.Fatalf("Query failed: %v", err)
+				}
+				if len(resp.Items) > limit {
+					t.Errorf("expected at most %d items, got %d", limit, len(resp.Items))
+				}
+				for _, item := range resp.Items {
+					if len(item) != 1 {
+						t.Errorf("expected only the projected ID, got %v", item)
+					}
+					id := *item["ID"].S
+					var n int
+					fmt.Sscanf(id, "p%d", &n)
+					keys = append(keys, fmt.Sprintf("%d/%s", n%10, id))
+				}
+				if resp.LastEvaluatedKey == nil {
+					break
+				}
+				req.ExclusiveStartKey = resp.LastEvaluatedKey
+			}
+
+			if len(keys) != players {
+				t.Fatalf("expected %d items, got %d", players, len(keys))
+			}
+			sorted := sort.StringsAreSorted(keys)
+			if !forward {
+				sorted = sort.SliceIsSorted(keys, func(i, j int) bool { return keys[i] > keys[j] })
+			}
+			if !sorted {
+				t.Errorf("items out of index order: %v", keys)
+			}
+		})
+	}
+}
+
+// TestClusterReplication checks that with a replication factor of 2 every
+// item is kept on two nodes, that requests spanning every partition return
+// each item once, and that an item stays readable when its primary is down.
+func TestClusterReplication(t *testing.T) {
+	r, servers := setupTestCluster(t, 3)
+	if err := r.SetReplicationFactor(2); err != nil {
+		t.Fatalf("SetReplicationFactor failed: %v", err)
+	}
+
+	if _, err := r.CreateTable(&types.CreateTableRequest{
+		TableName: "Accounts",
+		KeySchema: []*types.KeySchemaElement{{AttributeName: "ID", KeyType: "HASH"}},
+		AttributeDefinitions: []*types.AttributeDefinition{
+			{AttributeName: "ID", AttributeType: "S"},
+			{AttributeName: "Owner", AttributeType: "S"},
+		},
+		GlobalSecondaryIndexes: []*types.GlobalSecondaryIndex{{
+			IndexName:  "ByOwner",
+			KeySchema:  []*types.KeySchemaElement{{AttributeName: "Owner", KeyType: "HASH"}},
+			Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+		}},
+		StreamSpecification: &types.StreamSpecification{StreamEnabled: true, StreamViewType: types.StreamViewTypeKeysOnly},
+	}); err != nil {
+		t.Fatalf("CreateTable failed: %v", err)
+	}
+
+	const accounts = 10
+	for i := 0; i < accounts; i++ {
+		if _, err := r.Put(&types.PutRequest{
+			TableName: "Accounts",
+			Item:      map[string]*types.AttributeValue{"ID": sValue(fmt.Sprintf("a%02d", i)), "Owner": sValue("o")},
+		}); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	t.Run("Placement", func(t *testing.T) {
+		copies := 0
+		for _, server := range servers {
+			client := nodeapi.NewNodeClient(strings.TrimPrefix(server.URL, "http://"))
+			resp, err := client.Scan(&types.ScanRequest{TableName: "Accounts"})
+			if err != nil {
+				t.Fatalf("Scan failed: %v", err)
+			}
+			copies += len(resp.Items)
+		}
+		if copies != 2*accounts {
+			t.Errorf("expected %d copies, got %d", 2*accounts, copies)
+		}
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		seen := make(map[string]int)
+		limit := 3
+		req := &types.ScanRequest{TableName: "Accounts", Limit: &limit}
+		for pages := 0; ; pages++ {
+			if pages > 2*accounts {
+				t.Fatalf("scan did not end")
+			}
+			resp, err := r.Scan(req)
+			if err != nil {
+				t.Fatalf("Scan failed: %v", err)
+			}
+			for _, item := range resp.Items {
+				seen[*item["ID"].S]++
+			}
+			if resp.LastEvaluatedKey == nil {
+				break
+			}
+			req.ExclusiveStartKey = resp.LastEvaluatedKey
+		}
+		if len(seen) != accounts {
+			t.Errorf("expected %d items, got %d", accounts, len(seen))
+		}
+		for id, n := range seen {
+			if n != 1 {
+				t.Errorf("expected %s once, got it %d times", id, n)
+			}
+		}
+
+		resp, err := r.Scan(&types.ScanRequest{TableName: "Accounts", ProjectionExpression: "Owner"})
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		if resp.Count != accounts {
+			t.Errorf("expected %d items, got %d", accounts, resp.Count)
+		}
+		for _, item := range resp.Items {
+			if item["ID"] != nil || item["Owner"] == nil {
+				t.Errorf("expected only the projected Owner, got %v", item)
+			}
+		}
+	})
+
+	t.Run("QueryGlobalIndex", func(t *testing.T) {
+		resp, err := r.Query(&types.QueryRequest{
+			TableName:                 "Accounts",
+			IndexName:                 "ByOwner",
+			KeyConditionExpression:    "Owner = :o",
+			ExpressionAttributeValues: map[string]*types.AttributeValue{":o": sValue("o")},
+		})
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		if resp.Count != accounts {
+			t.Errorf("expected %d items, got %d", accounts, resp.Count)
+		}
+	})
+
+	t.Run("Streams", func(t *testing.T) {
+		listResp, err := r.ListStreams(&types.ListStreamsRequest{TableName: "Accounts"})
+		if err != nil || len(listResp.Streams) != 1 {
+			t.Fatalf("ListStreams failed: %v, %v", listResp, err)
+		}
+		describeResp, err := r.DescribeStream(&types.DescribeStreamRequest{StreamArn: listResp.Streams[0].StreamArn})
+		if err != nil {
+			t.Fatalf("DescribeStream failed: %v", err)
+		}
+		records := 0
+		for _, shard := range describeResp.StreamDescription.Shards {
+			iteratorResp, err := r.GetShardIterator(&types.GetShardIteratorRequest{
+				StreamArn:         listResp.Streams[0].StreamArn,
+				ShardId:           shard.ShardId,
+				ShardIteratorType: types.ShardIteratorTypeTrimHorizon,
+			})
+			if err != nil {
+				t.Fatalf("GetShardIterator failed: %v", err)
+			}
+			recordsResp, err := r.GetRecords(&types.GetRecordsRequest{ShardIterator: iteratorResp.ShardIterator})
+			if err != nil {
+				t.Fatalf("GetRecords failed: %v", err)
+			}
+			records += len(recordsResp.Records)
+		}
+		if records != accounts {
+			t.Errorf("expected a record per item, got %d", records)
+		}
+	})
+
+	t.Run("AdminEndpoint", func(t *testing.T) {
+		admin := httptest.NewServer(api.NewRouterServer(r).Router())
+		defer admin.Close()
+
+		resp, err := http.Get(admin.URL + "/replicas?table=Accounts&key=" + url.QueryEscape(`{"S":"a00"}`))
+		if err != nil {
+			t.Fatalf("GET /replicas failed: %v", err)
+		}
+		defer resp.Body.Close()
+		var replicasResp routerapi.ReplicasResponse
+		if err := json.NewDecoder(resp.Body).Decode(&replicasResp); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+		expected, err := r.ReplicasForKey("Accounts", sValue("a00"))
+		if err != nil {
+			t.Fatalf("ReplicasForKey failed: %v", err)
+		}
+		if replicasResp.ReplicationFactor != 2 || !reflect.DeepEqual(replicasResp.Replicas, expected) {
+			t.Errorf("expected replicas %v with a replication factor of 2, got %+v", expected, replicasResp)
+		}
+		if replicasResp.WriteQuorum != 0 || replicasResp.ReadQuorum != 1 {
+			t.Errorf("expected the default quorums of 0 and 1, got %d and %d", replicasResp.WriteQuorum, replicasResp.ReadQuorum)
+		}
+
+		resp, err = http.Get(admin.URL + "/replicas?table=Accounts")
+		if err != nil {
+			t.Fatalf("GET /replicas failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("expected status 400 without a key, got %d", resp.StatusCode)
+		}
+	})
+
+	// This runs last, as it stops a node.
+	t.Run("PrimaryDown", func(t *testing.T) {
+		key := map[string]*types.AttributeValue{"ID": sValue("a00")}
+		primary := nodeForKey(t, r, "Accounts", key["ID"])
+		for i, server := range servers {
+			if "node"+string(rune('1'+i)) == primary.ID {
+				server.Close()
+			}
+		}
+
+		item, err := r.Get(&types.GetRequest{TableName: "Accounts", Key: key})
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if item == nil || *item["ID"].S != "a00" {
+			t.Errorf("expected the item from its other replica, got %v", item)
+		}
+	})
+}
+
+func TestClusterQuorums(t *testing.T) {
+	r, servers := setupTestCluster(t, 3)
+	if err := r.SetReplicationFactor(3); err != nil {
+		t.Fatalf("SetReplicationFactor failed: %v", err)
+	}
+
+	if _, err := r.CreateTable(&types.CreateTableRequest{
+		TableName: "Events",
+		KeySchema: []*types.KeySchemaElement{
+			{AttributeName: "User", KeyType: "HASH"},
+			{AttributeName: "Seq", KeyType: "RANGE"},
+		},
+		AttributeDefinitions: []*types.AttributeDefinition{
+			{AttributeName: "User", AttributeType: "S"},
+			{AttributeName: "Seq", AttributeType: "N"},
+		},
+	}); err != nil {
+		t.Fatalf("CreateTable failed: %v", err)
+	}
+
+	if _, err := r.Put(&types.PutRequest{
+		TableName: "Events",
+		Item:      map[string]*types.AttributeValue{"User": sValue("u"), "Seq": nValue("1"), "State": sValue("new")},
+	}); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	// The primary alone keeps stale copies, of an item that was overwritten
+	// and of one that was deleted, as if it had missed the writes that the
+	// other replicas applied.
+	primary := nodeForKey(t, r, "Events", sValue("u"))
+	var client storage.Storage
+	for i, server := range servers {
+		replica := nodeapi.NewNodeClient(strings.TrimPrefix(server.URL, "http://"))
+		isPrimary := "node"+string(rune('1'+i)) == primary.ID
+		if isPrimary {
+			client = replica
+		}
+		for _, seq := range []string{"2", "3"} {
+			var err error
+			switch {
+			case isPrimary:
+				_, err = replica.Put(&types.PutRequest{
+					TableName: "Events",
+					Item:      map[string]*types.AttributeValue{"User": sValue("u"), "Seq": nValue(seq), "State": sValue("old")},
+					Version:   1,
+				})
+			case seq == "2":
+				_, err = replica.Put(&types.PutRequest{
+					TableName: "Events",
+					Item:      map[string]*types.AttributeValue{"User": sValue("u"), "Seq": nValue(seq), "State": sValue("new")},
+					Version:   2,
+				})
+			default:
+				_, err = replica.Delete(&types.DeleteRequest{
+					TableName: "Events",
+					Key:       map[string]*types.AttributeValue{"User": sValue("u"), "Seq": nValue(seq)},
+					Version:   2,
+				})
+			}
+			if err != nil {
+				t.Fatalf("write to node%d failed: %v", i+1, err)
+			}
+		}
+	}
+
+	if err := r.SetQuorums(2, 1); err != nil {
+		t.Fatalf("SetQuorums failed: %v", err)
+	}
+	key := map[string]*types.AttributeValue{"User": sValue("u"), "Seq": nValue("2")}
+	deletedKey := map[string]*types.AttributeValue{"User": sValue("u"), "Seq": nValue("3")}
+
+	t.Run("EventuallyConsistentRead", func(t *testing.T) {
+		item, err := r.Get(&types.GetRequest{TableName: "Events", Key: key})
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if item == nil || *item["State"].S != "old" {
+			t.Errorf("expected the primary's stale copy, got %v", item)
+		}
+	})
+
+	t.Run("Get", func(t *testing.T) {
+		item, err := r.Get(&types.GetRequest{TableName: "Events", Key: key, ConsistentRead: true, ProjectionExpression: "State"})
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if item == nil || *item["State"].S != "new" || item["Seq"] != nil {
+			t.Errorf("expected the projected newest copy, got %v", item)
+		}
+
+		item, err = r.Get(&types.GetRequest{TableName: "Events", Key: deletedKey, ConsistentRead: true})
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if item != nil {
+			t.Errorf("expected the deleted item to stay deleted, got %v", item)
+		}
+	})
+
+	t.Run("Query", func(t *testing.T) {
+		resp, err := r.Query(&types.QueryRequest{
+			TableName:                 "Events",
+			KeyConditionExpression:    "#u = :u",
+			ExpressionAttributeNames:  map[string]string{"#u": "User"},
+			ExpressionAttributeValues: map[string]*types.AttributeValue{":u": sValue("u")},
+			ConsistentRead:            true,
+		})
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		if resp.Count != 2 {
+			t.Fatalf("expected 2 items, got %d: %v", resp.Count, resp.Items)
+		}
+		for i, seq := range []string{"1", "2"} {
+			if item := resp.Items[i]; *item["Seq"].N != seq || *item["State"].S != "new" {
+				t.Errorf("expected item %s with its newest copy at %d, got %v", seq, i, item)
+			}
+		}
+	})
+
+	t.Run("Scan", func(t *testing.T) {
+		req := &types.ScanRequest{
+			TableName:                 "Events",
+			FilterExpression:          "#s = :s",
+			ExpressionAttributeNames:  map[string]string{"#s": "State"},
+			ExpressionAttributeValues: map[string]*types.AttributeValue{":s": sValue("old")},
+		}
+		resp, err := r.Scan(req)
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		if resp.Count != 2 {
+			t.Errorf("expected the 2 stale copies, got %v", resp.Items)
+		}
+
+		req.ConsistentRead = true
+		resp, err = r.Scan(req)
+		if err != nil {
+			t.Fatalf("Scan failed: %v", err)
+		}
+		if resp.Count != 0 {
+			t.Errorf("expected no stale copies, got %v", resp.Items)
+		}
+	})
+
+	t.Run("ConditionalWrite", func(t *testing.T) {
+		resp, err := r.Update(&types.UpdateRequest{
+			TableName:                 "Events",
+			Key:                       key,
+			UpdateExpression:          "SET Visits = :one",
+			ConditionExpression:       "#s = :new",
+			ExpressionAttributeNames:  map[string]string{"#s": "State"},
+			ExpressionAttributeValues: map[string]*types.AttributeValue{":one": nValue("1"), ":new": sValue("new")},
+			ReturnValues:              types.ReturnValuesAllNew,
+		})
+		if err != nil {
+			t.Fatalf("Update failed: %v", err)
+		}
+		if *resp.Attributes["State"].S != "new" || *resp.Attributes["Visits"].N != "1" {
+			t.Errorf("expected the newest copy updated, got %v", resp.Attributes)
+		}
+
+		// The primary, whose stale copy fails the condition, is written the
+		// updated item all the same, possibly after Update returns.
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			item, err := client.Get(&types.GetRequest{TableName: "Events", Key: key})
+			if err != nil {
+				t.Fatalf("Get on the primary failed: %v", err)
+			}
+			if item != nil && *item["State"].S == "new" && item["Visits"] != nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected the primary to hold the updated item, got %v", item)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// The deleted item's stale copy on the primary does not satisfy a
+		// condition that the item exists.
+		_, err = r.Delete(&types.DeleteRequest{TableName: "Events", Key: deletedKey, ConditionExpression: "attribute_exists(#s)", ExpressionAttributeNames: map[string]string{"#s": "State"}})
+		if err != storage.ErrConditionalCheckFailed {
+			t.Errorf("expected the conditional check to fail, got %v", err)
+		}
+	})
+
+	// This runs last, as it stops the replicas other than the primary.
+	t.Run("BatchWrite", func(t *testing.T) {
+		versionsReq := &types.GetItemVersionsRequest{TableName: "Events", Keys: []map[string]*types.AttributeValue{key}}
+		var newest int64
+		for i, server := range servers {
+			versions, err := nodeapi.NewNodeClient(strings.TrimPrefix(server.URL, "http://")).GetItemVersions(versionsReq)
+			if err != nil {
+				t.Fatalf("GetItemVersions failed: %v", err)
+			}
+			newest = max(newest, versions.Items[0].Version)
+			if "node"+string(rune('1'+i)) != primary.ID {
+				server.Close()
+			}
+		}
+
+		// The primary, behind the other replicas, alone applies the batch,
+		// whose write must still be the newest copy of the item.
+		if err := r.SetQuorums(1, 1); err != nil {
+			t.Fatalf("SetQuorums failed: %v", err)
+		}
+		resp, err := r.BatchWriteItem(&types.BatchWriteItemRequest{RequestItems: map[string][]*types.WriteRequest{
+			"Events": {{PutRequest: &types.BatchPutRequest{Item: map[string]*types.AttributeValue{"User": sValue("u"), "Seq": nValue("2"), "State": sValue("batch")}}}},
+		}})
+		if err != nil {
+			t.Fatalf("BatchWriteItem failed: %v", err)
+		}
+		if len(resp.UnprocessedItems) != 0 {
+			t.Fatalf("expected the write to be processed, got %v", resp.UnprocessedItems)
+		}
+		versions, err := client.GetItemVersions(versionsReq)
+		if err != nil {
+			t.Fatalf("GetItemVersions failed: %v", err)
+		}
+		if got := versions.Items[0].Version; got <= newest {
+			t.Errorf("expected the batch write to be newer than %d, got %d", newest, got)
+		}
+	})
+}
+
+func TestClusterHealth(t *testing.T) {
+	r, servers := setupTestCluster(t, 3)
+	if err := r.SetReplicationFactor(2); err != nil {
+		t.Fatalf("SetReplicationFactor failed: %v", err)
+	}
+	if err := r.SetHealthConfig(router.HealthConfig{
+		ProbeInterval: 20 * time.Millisecond,
+		SuspectAfter:  60 * time.Millisecond,
+		FailAfter:     150 * time.Millisecond,
+	}); err != nil {
+		t.Fatalf("SetHealthConfig failed: %v", err)
+	}
+	r.StartHealthChecks()
+	t.Cleanup(r.StopHealthChecks)
+	admin := httptest.NewServer(api.NewRouterServer(r).Router())
+	defer admin.Close()
+
+	// waitForState polls the status endpoint until a node is in the state.
+	waitForState := func(t *testing.T, nodeID, state string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			resp, err := http.Get(admin.URL + "/nodes")
+			if err != nil {
+				t.Fatalf("GET /nodes failed: %v", err)
+			}
+			var nodesResp routerapi.NodesResponse
+			err = json.NewDecoder(resp.Body).Decode(&nodesResp)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			for _, status := range nodesResp.Nodes {
+				if status.ID == nodeID && status.State == state {
+					return
+				}
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("node %s did not become %s: %+v", nodeID, state, nodesResp.Nodes)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	createTable := func(t *testing.T, tableName string) {
+		t.Helper()
+		if _, err := r.CreateTable(&types.CreateTableRequest{
+			TableName:            tableName,
+			KeySchema:            []*types.KeySchemaElement{{AttributeName: "ID", KeyType: "HASH"}},
+			AttributeDefinitions: []*types.AttributeDefinition{{AttributeName: "ID", AttributeType: "S"}},
+		}); err != nil {
+			t.Fatalf("CreateTable failed: %v", err)
+		}
+	}
+	createTable(t, "Items")
+
+	t.Run("Heartbeat", func(t *testing.T) {
+		for id, expected := range map[string]int{"node1": http.StatusOK, "node9": http.StatusNotFound} {
+			resp, err := http.Post(admin.URL+"/heartbeat", "application/json", strings.NewReader(`{"id":"`+id+`"}`))
+			if err != nil {
+				t.Fatalf("POST /heartbeat failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != expected {
+				t.Errorf("expected status %d for a heartbeat of %s, got %d", expected, id, resp.StatusCode)
+			}
+		}
+	})
+
+	// These items are deleted while node2 is down, and must stay deleted
+	// once it is back.
+	deletedKey := func(i int) map[string]*types.AttributeValue {
+		return map[string]*types.AttributeValue{"ID": sValue(fmt.Sprintf("d%d", i))}
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := r.Put(&types.PutRequest{TableName: "Items", Item: deletedKey(i)}); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	down := servers[1]
+	addr := down.Listener.Addr().String()
+	down.Close()
+
+	t.Run("Failover", func(t *testing.T) {
+		waitForState(t, "node2", string(router.NodeFailed))
+		for _, node := range r.GetActiveNodes() {
+			if node.ID == "node2" {
+				t.Fatalf("expected node2 to be out of the ring")
+			}
+		}
+		for i := 0; i < 10; i++ {
+			key := map[string]*types.AttributeValue{"ID": sValue(fmt.Sprintf("i%d", i))}
+			if _, err := r.Put(&types.PutRequest{TableName: "Items", Item: key}); err != nil {
+				t.Fatalf("Put failed: %v", err)
+			}
+			item, err := r.Get(&types.GetRequest{TableName: "Items", Key: key})
+			if err != nil {
+				t.Fatalf("Get failed: %v", err)
+			}
+			if item == nil {
+				t.Errorf("expected item %v", key)
+			}
+		}
+		for i := 0; i < 10; i++ {
+			if _, err := r.Delete(&types.DeleteRequest{TableName: "Items", Key: deletedKey(i)}); err != nil {
+				t.Fatalf("Delete failed: %v", err)
+			}
+		}
+		createTable(t, "Later")
+	})
+
+	t.Run("Recovery", func(t *testing.T) {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to listen on %s again: %v", addr, err)
+		}
+		restarted := httptest.NewUnstartedServer(down.Config.Handler)
+		restarted.Listener.Close()
+		restarted.Listener = listener
+		restarted.Start()
+		defer restarted.Close()
+
+		waitForState(t, "node2", string(router.NodeAlive))
+		if len(r.GetActiveNodes()) != 3 {
+			t.Errorf("expected node2 back in the ring, got %v", r.GetActiveNodes())
+		}
+		client := nodeapi.NewNodeClient(addr)
+		if _, err := client.DescribeTable(&types.DescribeTableRequest{TableName: "Later"}); err != nil {
+			t.Errorf("expected the table created while node2 was down on it: %v", err)
+		}
+		for i := 0; i < 10; i++ {
+			if item, err := client.Get(&types.GetRequest{TableName: "Items", Key: deletedKey(i)}); err != nil || item != nil {
+				t.Errorf("expected item %v deleted on node2, got %v, %v", deletedKey(i), item, err)
+			}
+			if item, err := r.Get(&types.GetRequest{TableName: "Items", Key: deletedKey(i)}); err != nil || item != nil {
+				t.Errorf("expected item %v deleted, got %v, %v", deletedKey(i), item, err)
+			}
+		}
+	})
+}
+
+func TestClusterRebalancing(t *testing.T) {
+	r, servers := setupTestCluster(t, 3)
+	// node3 joins later, once the table holds items.
+	r.RemoveNode("node3")
+	if err := r.SetReplicationFactor(2); err != nil {
+		t.Fatalf("SetReplicationFactor failed: %v", err)
+	}
+	if err := r.SetRebalanceBatchSize(3); err != nil {
+		t.Fatalf("SetRebalanceBatchSize failed: %v", err)
+	}
+	if _, err := r.CreateTable(&types.CreateTableRequest{
+		TableName:            "Items",
+		KeySchema:            []*types.KeySchemaElement{{AttributeName: "ID", KeyType: "HASH"}},
+		AttributeDefinitions: []*types.AttributeDefinition{{AttributeName: "ID", AttributeType: "S"}},
+	}); err != nil {
+		t.Fatalf("CreateTable failed: %v", err)
+	}
+
+	const items = 40
+	key := func(i int) map[string]*types.AttributeValue {
+		return map[string]*types.AttributeValue{"ID": sValue(fmt.Sprintf("i%02d", i))}
+	}
+	put := func(t *testing.T, i int, value string) {
+		item := key(i)
+		item["Value"] = sValue(value)
+		if _, err := r.Put(&types.PutRequest{TableName: "Items", Item: item}); err != nil {
+			t.Errorf("Put failed: %v", err)
+		}
+	}
+	for i := 0; i < items; i++ {
+		put(t, i, "v1")
+	}
+
+	// checkReplicas checks that every replica of every item holds the value
+	// the router returns, and none holds a deleted item.
+	checkReplicas := func(t *testing.T, deleted map[int]bool) {
+		t.Helper()
+		for i := 0; i < items; i++ {
+			expected, err := r.Get(&types.GetRequest{TableName: "Items", Key: key(i), ConsistentRead: true})
+			if err != nil {
+				t.Fatalf("Get failed: %v", err)
+			}
+			if deleted[i] != (expected == nil) {
+				t.Fatalf("expected item %d to be deleted: %v, got %v", i, deleted[i], expected)
+			}
+			replicas, err := r.ReplicasForKey("Items", key(i)["ID"])
+			if err != nil {
+				t.Fatalf("ReplicasForKey failed: %v", err)
+			}
+			for _, node := range replicas {
+				item, err := nodeapi.NewNodeClient(node.Addr).Get(&types.GetRequest{TableName: "Items", Key: key(i)})
+				if err != nil {
+					t.Fatalf("Get from %s failed: %v", node.ID, err)
+				}
+				if !reflect.DeepEqual(item, expected) {
+					t.Errorf("expected %v on %s, got %v", expected, node.ID, item)
+				}
+			}
+		}
+	}
+
+	deleted := make(map[int]bool)
+
+	t.Run("Join", func(t *testing.T) {
+		// Items are written while the partitions move.
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < items; i++ {
+				if i%4 == 0 {
+					if _, err := r.Delete(&types.DeleteRequest{TableName: "Items", Key: key(i)}); err != nil {
+						t.Errorf("Delete failed: %v", err)
+					}
+					continue
+				}
+				put(t, i, "v2")
+			}
+		}()
+		if err := r.JoinNode(router.Node{ID: "node3", Addr: strings.TrimPrefix(servers[2].URL, "http://")}); err != nil {
+			t.Fatalf("JoinNode failed: %v", err)
+		}
+		<-done
+		for i := 0; i < items; i += 4 {
+			deleted[i] = true
+		}
+
+		if len(r.GetActiveNodes()) != 3 {
+			t.Fatalf("expected node3 in the ring, got %v", r.GetActiveNodes())
+		}
+		held := 0
+		for i := 0; i < items; i++ {
+			replicas, err := r.ReplicasForKey("Items", key(i)["ID"])
+			if err != nil {
+				t.Fatalf("ReplicasForKey failed: %v", err)
+			}
+			for _, node := range replicas {
+				if node.ID == "node3" {
+					held++
+				}
+			}
+		}
+		if held == 0 {
+			t.Fatalf("expected node3 to hold some items")
+		}
+		checkReplicas(t, deleted)
+		for _, status := range r.NodeStatuses() {
+			if status.State != router.NodeAlive {
+				t.Errorf("expected %s to be alive, got %s", status.ID, status.State)
+			}
+		}
+	})
+
+	t.Run("Leave", func(t *testing.T) {
+		if err := r.LeaveNode("node1"); err != nil {
+			t.Fatalf("LeaveNode failed: %v", err)
+		}
+		for _, status := range r.NodeStatuses() {
+			if status.ID == "node1" {
+				t.Fatalf("expected node1 to be gone, got %+v", status)
+			}
+		}
+		if len(r.GetActiveNodes()) != 2 {
+			t.Fatalf("expected 2 nodes in the ring, got %v", r.GetActiveNodes())
+		}
+		checkReplicas(t, deleted)
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		if err := r.LeaveNode("node1"); err != nil {
+			t.Errorf("expected leaving twice to do nothing, got %v", err)
+		}
+		if err := r.JoinNode(router.Node{ID: "node9", Addr: "127.0.0.1:1"}); err == nil {
+			t.Errorf("expected joining an unreachable node to fail")
+		}
+		if len(r.GetActiveNodes()) != 2 || len(r.NodeStatuses()) != 2 {
+			t.Errorf("expected a failed join to leave the cluster as it was, got %v", r.NodeStatuses())
+		}
+	})
+}
+
+func TestNodeProtocolTargets(t *testing.T) {
+	_, servers := setupTestCluster(t, 1)
+
+	tests := []struct {
+		name   string
+		target string
+		status int
+	}{
+		{"current version", nodeapi.Target("ListTables"), http.StatusOK},
+		{"other version", "ZagrebNode_v0.ListTables", http.StatusBadRequest},
+		{"internal operation", nodeapi.Target("AbortTransaction"), http.StatusOK},
+		{"internal operation under a DynamoDB target", "DynamoDB_20120810.AbortTransaction", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpReq, err := http.NewRequest("POST", servers[0].URL, bytes.NewReader([]byte(`{"TransactionId":"t1"}`)))
+			if err != nil {
+				t.Fatalf("failed to create request: %v", err)
+			}
+			httpReq.Header.Set("Content-Type", nodeapi.ContentType)
+			httpReq.Header.Set("X-Amz-Target", tt.target)
+			httpResp, err := http.DefaultClient.Do(httpReq)
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			httpResp.Body.Close()
+			if httpResp.StatusCode != tt.status {
+				t.Errorf("expected status %d, got %s", tt.status, httpResp.Status)
+			}
+		})
+	}
+}
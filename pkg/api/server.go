@@ -2,13 +2,13 @@ package api
 
 import (
 	"encoding/json"
-	"fmt"
+	"errors"
 	"log"
 	"net/http"
 	"strings"
 
 	"github.com/gorilla/mux"
-	"zagreb/pkg/expression"
+	"zagreb/pkg/nodeapi"
 	"zagreb/pkg/router"
 	"zagreb/pkg/routerapi"
 	"zagreb/pkg/storage"
@@ -42,6 +42,9 @@ func NewRouterServer(r *router.Router) *Server {
 	server.routes()
 	server.router.HandleFunc("/register-node", server.handleRegisterNode).Methods("POST")
 	server.router.HandleFunc("/deregister-node", server.handleDeregisterNode).Methods("POST")
+	server.router.HandleFunc("/replicas", server.handleReplicas).Methods("GET")
+	server.router.HandleFunc("/heartbeat", server.handleHeartbeat).Methods("POST")
+	server.router.HandleFunc("/nodes", server.handleNodes).Methods("GET")
 	return server
 }
 
@@ -59,24 +62,38 @@ func (s *Server) Run(addr string) {
 func (s *Server) routes() {
 	// DynamoDB-like API endpoints
 	s.router.HandleFunc("/", s.handleRequest).Methods("POST")
+	s.router.HandleFunc(nodeapi.HealthPath, s.handleHealth).Methods("GET")
+}
 
-	// Internal API for node-to-node communication
-	s.router.HandleFunc("/internal-scan", s.handleInternalScan).Methods("POST")
+// handleHealth answers the health probes of the router.
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
 }
 
-// handleRequest is a generic handler for all DynamoDB-like operations.
+// handleRequest is a generic handler for all DynamoDB-like operations. The
+// DynamoDB Streams operations are served on the same endpoint, as their
+// X-Amz-Target differs only in its service prefix, and so are the
+// operations of the router, as described in pkg/nodeapi.
 func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
 	target, ok := r.Header["X-Amz-Target"]
 	if !ok || len(target) == 0 {
-		s.writeError(w, "missing X-Amz-Target header", http.StatusBadRequest)
+		s.writeError(w, errorTypeUnknownOperation, "missing X-Amz-Target header", http.StatusBadRequest)
+		return
+	}
+	prefix, action, ok := strings.Cut(target[0], ".")
+	if !ok {
+		s.writeError(w, errorTypeUnknownOperation, "invalid X-Amz-Target header: "+target[0], http.StatusBadRequest)
+		return
+	}
+	if err := nodeapi.CheckTarget(prefix, action); err != nil {
+		s.writeError(w, errorTypeUnknownOperation, err.Error(), http.StatusBadRequest)
 		return
 	}
-	action := strings.Split(target[0], ".")[1]
 
 	var body json.RawMessage
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		s.writeError(w, "failed to decode request body", http.StatusBadRequest)
+		s.writeError(w, errorTypeSerialization, "failed to decode request body", http.StatusBadRequest)
 		return
 	}
 
@@ -84,12 +101,12 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 	case "CreateTable":
 		var req types.CreateTableRequest
 		if err := json.Unmarshal(body, &req); err != nil {
-			s.writeError(w, err.Error(), http.StatusBadRequest)
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
 			return
 		}
 		resp, err := s.storage.CreateTable(&req)
 		if err != nil {
-			s.writeError(w, err.Error(), http.StatusInternalServerError)
+			s.writeStorageError(w, err)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
@@ -97,12 +114,12 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 	case "DeleteTable":
 		var req types.DeleteTableRequest
 		if err := json.Unmarshal(body, &req); err != nil {
-			s.writeError(w, err.Error(), http.StatusBadRequest)
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
 			return
 		}
 		resp, err := s.storage.DeleteTable(&req)
 		if err != nil {
-			s.writeError(w, err.Error(), http.StatusInternalServerError)
+			s.writeStorageError(w, err)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
@@ -110,12 +127,51 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 	case "DescribeTable":
 		var req types.DescribeTableRequest
 		if err := json.Unmarshal(body, &req); err != nil {
-			s.writeError(w, err.Error(), http.StatusBadRequest)
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
 			return
 		}
 		resp, err := s.storage.DescribeTable(&req)
 		if err != nil {
-			s.writeError(w, err.Error(), http.StatusInternalServerError)
+			s.writeStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	case "UpdateTable":
+		var req types.UpdateTableRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := s.storage.UpdateTable(&req)
+		if err != nil {
+			s.writeStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	case "UpdateTimeToLive":
+		var req types.UpdateTimeToLiveRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := s.storage.UpdateTimeToLive(&req)
+		if err != nil {
+			s.writeStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	case "DescribeTimeToLive":
+		var req types.DescribeTimeToLiveRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := s.storage.DescribeTimeToLive(&req)
+		if err != nil {
+			s.writeStorageError(w, err)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
@@ -123,12 +179,12 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 	case "ListTables":
 		var req types.ListTablesRequest
 		if err := json.Unmarshal(body, &req); err != nil {
-			s.writeError(w, err.Error(), http.StatusBadRequest)
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
 			return
 		}
 		resp, err := s.storage.ListTables(&req)
 		if err != nil {
-			s.writeError(w, err.Error(), http.StatusInternalServerError)
+			s.writeStorageError(w, err)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
@@ -136,24 +192,25 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 	case "PutItem":
 		var putReq types.PutRequest
 		if err := json.Unmarshal(body, &putReq); err != nil {
-			s.writeError(w, err.Error(), http.StatusBadRequest)
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if err := s.storage.Put(&putReq); err != nil {
-			s.writeError(w, err.Error(), http.StatusInternalServerError)
+		resp, err := s.storage.Put(&putReq)
+		if err != nil {
+			s.writeStorageError(w, err)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]interface{}{}) // Empty object for success
+		json.NewEncoder(w).Encode(resp)
 	case "GetItem":
 		var getReq types.GetRequest
 		if err := json.Unmarshal(body, &getReq); err != nil {
-			s.writeError(w, err.Error(), http.StatusBadRequest)
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
 			return
 		}
 		item, err := s.storage.Get(&getReq)
 		if err != nil {
-			s.writeError(w, err.Error(), http.StatusInternalServerError)
+			s.writeStorageError(w, err)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
@@ -161,100 +218,301 @@ func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
 	case "DeleteItem":
 		var deleteReq types.DeleteRequest
 		if err := json.Unmarshal(body, &deleteReq); err != nil {
-			s.writeError(w, err.Error(), http.StatusBadRequest)
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
 			return
 		}
-		if err := s.storage.Delete(&deleteReq); err != nil {
-			s.writeError(w, err.Error(), http.StatusInternalServerError)
+		resp, err := s.storage.Delete(&deleteReq)
+		if err != nil {
+			s.writeStorageError(w, err)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]interface{}{}) // Empty object for success
+		json.NewEncoder(w).Encode(resp)
 	case "UpdateItem":
 		var updateReq types.UpdateRequest
 		if err := json.Unmarshal(body, &updateReq); err != nil {
-			s.writeError(w, err.Error(), http.StatusBadRequest)
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
 			return
 		}
-		item, err := s.storage.Update(&updateReq)
+		resp, err := s.storage.Update(&updateReq)
 		if err != nil {
-			s.writeError(w, err.Error(), http.StatusInternalServerError)
+			s.writeStorageError(w, err)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(types.UpdateItemResponse{Attributes: item})
+		json.NewEncoder(w).Encode(resp)
 	case "Query":
 		var queryReq types.QueryRequest
 		if err := json.Unmarshal(body, &queryReq); err != nil {
-			s.writeError(w, err.Error(), http.StatusBadRequest)
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
 			return
 		}
-		items, err := s.storage.Query(&queryReq)
+		resp, err := s.storage.Query(&queryReq)
 		if err != nil {
-			s.writeError(w, err.Error(), http.StatusInternalServerError)
+			s.writeStorageError(w, err)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(types.QueryResponse{Items: items})
-	case "Scan":
-		var rawScanReq struct {
-			TableName         string                     `json:"TableName"`
-			Limit             *int                       `json:"Limit,omitempty"`
-			ExclusiveStartKey map[string]interface{} `json:"ExclusiveStartKey,omitempty"`
+		json.NewEncoder(w).Encode(resp)
+	case "BatchWriteItem":
+		var batchReq types.BatchWriteItemRequest
+		if err := json.Unmarshal(body, &batchReq); err != nil {
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
+			return
 		}
-		if err := json.Unmarshal(body, &rawScanReq); err != nil {
-			s.writeError(w, err.Error(), http.StatusBadRequest)
+		resp, err := s.storage.BatchWriteItem(&batchReq)
+		if err != nil {
+			s.writeStorageError(w, err)
 			return
 		}
-
-		scanReq := types.ScanRequest{
-			TableName: rawScanReq.TableName,
-			Limit:     rawScanReq.Limit,
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	case "BatchGetItem":
+		var batchReq types.BatchGetItemRequest
+		if err := json.Unmarshal(body, &batchReq); err != nil {
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
+			return
 		}
-
-		if rawScanReq.ExclusiveStartKey != nil {
-			exclusiveStartKey, err := convertAWSToExpressionAttributeValue(rawScanReq.ExclusiveStartKey)
-			if err != nil {
-				s.writeError(w, err.Error(), http.StatusBadRequest)
-				return
-			}
-			scanReq.ExclusiveStartKey = exclusiveStartKey
+		resp, err := s.storage.BatchGetItem(&batchReq)
+		if err != nil {
+			s.writeStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	case "TransactWriteItems":
+		var transactReq types.TransactWriteItemsRequest
+		if err := json.Unmarshal(body, &transactReq); err != nil {
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := s.storage.TransactWriteItems(&transactReq)
+		if err != nil {
+			s.writeStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	case "TransactGetItems":
+		var transactReq types.TransactGetItemsRequest
+		if err := json.Unmarshal(body, &transactReq); err != nil {
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := s.storage.TransactGetItems(&transactReq)
+		if err != nil {
+			s.writeStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	case "PrepareTransaction":
+		var prepareReq types.PrepareTransactionRequest
+		if err := json.Unmarshal(body, &prepareReq); err != nil {
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := s.storage.PrepareTransaction(&prepareReq)
+		if err != nil {
+			s.writeStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	case "CommitTransaction":
+		var commitReq types.CommitTransactionRequest
+		if err := json.Unmarshal(body, &commitReq); err != nil {
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.storage.CommitTransaction(&commitReq); err != nil {
+			s.writeStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{})
+	case "AbortTransaction":
+		var abortReq types.AbortTransactionRequest
+		if err := json.Unmarshal(body, &abortReq); err != nil {
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.storage.AbortTransaction(&abortReq); err != nil {
+			s.writeStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]interface{}{})
+	case "GetItemVersions":
+		var versionsReq types.GetItemVersionsRequest
+		if err := json.Unmarshal(body, &versionsReq); err != nil {
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := s.storage.GetItemVersions(&versionsReq)
+		if err != nil {
+			s.writeStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	case "ScanItemVersions":
+		var scanReq types.ScanItemVersionsRequest
+		if err := json.Unmarshal(body, &scanReq); err != nil {
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := s.storage.ScanItemVersions(&scanReq)
+		if err != nil {
+			s.writeStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	case "ImportItems":
+		var importReq types.ImportItemsRequest
+		if err := json.Unmarshal(body, &importReq); err != nil {
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := s.storage.ImportItems(&importReq)
+		if err != nil {
+			s.writeStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	case "ListStreams":
+		var req types.ListStreamsRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := s.storage.ListStreams(&req)
+		if err != nil {
+			s.writeStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	case "DescribeStream":
+		var req types.DescribeStreamRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := s.storage.DescribeStream(&req)
+		if err != nil {
+			s.writeStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	case "GetShardIterator":
+		var req types.GetShardIteratorRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := s.storage.GetShardIterator(&req)
+		if err != nil {
+			s.writeStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	case "GetRecords":
+		var req types.GetRecordsRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := s.storage.GetRecords(&req)
+		if err != nil {
+			s.writeStorageError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	case "Scan":
+		var scanReq types.ScanRequest
+		if err := json.Unmarshal(body, &scanReq); err != nil {
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
+			return
 		}
-
 		resp, err := s.storage.Scan(&scanReq)
 		if err != nil {
-			s.writeError(w, err.Error(), http.StatusInternalServerError)
+			s.writeStorageError(w, err)
 			return
 		}
-
-		awsScanResp := struct {
-			Items            []map[string]*expression.AttributeValue `json:"Items"`
-			LastEvaluatedKey map[string]interface{}            `json:"LastEvaluatedKey,omitempty"`
-			ScannedCount     int                               `json:"ScannedCount"`
-		}{
-			Items:        resp.Items,
-			ScannedCount: resp.ScannedCount,
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(resp)
+	case "InternalScan":
+		var scanReq types.ScanRequest
+		if err := json.Unmarshal(body, &scanReq); err != nil {
+			s.writeError(w, errorTypeSerialization, err.Error(), http.StatusBadRequest)
+			return
 		}
-
-		if resp.LastEvaluatedKey != nil {
-			convertedLastEvaluatedKey, err := convertExpressionToAWSAttributeValue(resp.LastEvaluatedKey)
-			if err != nil {
-				s.writeError(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			awsScanResp.LastEvaluatedKey = convertedLastEvaluatedKey
+		resp, err := s.storage.InternalScan(&scanReq)
+		if err != nil {
+			s.writeStorageError(w, err)
+			return
 		}
-
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(awsScanResp)
+		json.NewEncoder(w).Encode(resp)
 	default:
-		s.writeError(w, "unknown action: "+action, http.StatusBadRequest)
+		s.writeError(w, errorTypeUnknownOperation, "unknown action: "+action, http.StatusBadRequest)
 	}
 }
 
-func (s *Server) writeError(w http.ResponseWriter, message string, statusCode int) {
+// Error types of the failures that are not reported by storage. DynamoDB
+// clients read the exception name after the '#'.
+const (
+	errorTypeSerialization    = "com.amazon.coral.service#SerializationException"
+	errorTypeUnknownOperation = "com.amazon.coral.service#UnknownOperationException"
+	errorTypeInternal         = "com.amazonaws.dynamodb.v20120810#InternalServerError"
+)
+
+// exceptionMessages are the fixed messages DynamoDB gives some exceptions.
+var exceptionMessages = map[string]string{
+	"ConditionalCheckFailedException": "The conditional request failed",
+	"TransactionConflictException":    "Transaction is ongoing for the item",
+}
+
+// writeError writes an error response with the given __type.
+func (s *Server) writeError(w http.ResponseWriter, errorType, message string, statusCode int) {
 	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(map[string]string{"message": message})
+	json.NewEncoder(w).Encode(map[string]string{"__type": errorType, "message": message})
+}
+
+// writeStorageError reports a failed storage operation as the exception
+// DynamoDB clients expect, with status 400, so that they neither retry a bad
+// request nor mistake one exception for another. Any other error is an
+// internal error, with status 500, which clients retry.
+func (s *Server) writeStorageError(w http.ResponseWriter, err error) {
+	name := storage.ExceptionName(err)
+	if name == "" {
+		s.writeError(w, errorTypeInternal, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	errorType := "com.amazonaws.dynamodb.v20120810#" + name
+	if name == "ValidationException" {
+		errorType = "com.amazon.coral.validate#" + name
+	}
+	message, ok := exceptionMessages[name]
+	if !ok {
+		message = strings.Replace(err.Error(), name+": ", "", 1)
+	}
+	resp := map[string]interface{}{"__type": errorType, "message": message}
+
+	var cancelled *storage.TransactionCanceledError
+	if errors.As(err, &cancelled) {
+		resp["CancellationReasons"] = cancelled.Reasons
+	}
+
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(resp)
 }
 
 func (s *Server) handleRegisterNode(w http.ResponseWriter, r *http.Request) {
@@ -269,7 +527,10 @@ func (s *Server) handleRegisterNode(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.routerInstance.AddNode(router.Node{ID: req.ID, Addr: req.Addr})
+	if err := s.routerInstance.JoinNode(router.Node{ID: req.ID, Addr: req.Addr}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
 	resp := routerapi.RegisterNodeResponse{
 		ActiveNodes: s.routerInstance.GetActiveNodes(),
@@ -291,135 +552,87 @@ func (s *Server) handleDeregisterNode(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.routerInstance.RemoveNode(req.ID)
+	if err := s.routerInstance.LeaveNode(req.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 }
 
-func (s *Server) handleInternalScan(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	var rawScanReq struct {
-		TableName         string                     `json:"TableName"`
-		Limit             *int                       `json:"Limit,omitempty"`
-		ExclusiveStartKey map[string]interface{} `json:"ExclusiveStartKey,omitempty"`
-	}
-	if err := json.NewDecoder(r.Body).Decode(&rawScanReq); err != nil {
-		s.writeError(w, "failed to decode request body: "+err.Error(), http.StatusBadRequest)
+// handleHeartbeat records that a node is up. A node the router does not
+// know, as after a restart of the router or once the node deregistered, is
+// answered with 404 Not Found, and has to register again.
+func (s *Server) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if s.routerInstance == nil {
+		http.Error(w, "router instance not set", http.StatusInternalServerError)
 		return
 	}
 
-	scanReq := types.ScanRequest{
-		TableName: rawScanReq.TableName,
-		Limit:     rawScanReq.Limit,
+	var req routerapi.HeartbeatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	if rawScanReq.ExclusiveStartKey != nil {
-		exclusiveStartKey, err := convertAWSToExpressionAttributeValue(rawScanReq.ExclusiveStartKey)
-		if err != nil {
-			s.writeError(w, err.Error(), http.StatusBadRequest)
+	if err := s.routerInstance.Heartbeat(req.ID); err != nil {
+		if errors.Is(err, router.ErrUnknownNode) {
+			http.Error(w, err.Error(), http.StatusNotFound)
 			return
 		}
-		scanReq.ExclusiveStartKey = exclusiveStartKey
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+	w.WriteHeader(http.StatusOK)
+}
 
-	resp, err := s.storage.InternalScan(&scanReq)
-	if err != nil {
-		s.writeError(w, "failed to perform internal scan: "+err.Error(), http.StatusInternalServerError)
+// handleNodes reports the health of every node the router knows.
+func (s *Server) handleNodes(w http.ResponseWriter, r *http.Request) {
+	if s.routerInstance == nil {
+		http.Error(w, "router instance not set", http.StatusInternalServerError)
 		return
 	}
 
-	awsScanResp := struct {
-		Items            []map[string]*expression.AttributeValue `json:"Items"`
-		LastEvaluatedKey map[string]interface{}            `json:"LastEvaluatedKey,omitempty"`
-		ScannedCount     int                               `json:"ScannedCount"`
-	}{
-		Items:        resp.Items,
-		ScannedCount: resp.ScannedCount,
+	resp := routerapi.NodesResponse{Nodes: make([]routerapi.NodeStatus, 0)}
+	for _, status := range s.routerInstance.NodeStatuses() {
+		resp.Nodes = append(resp.Nodes, routerapi.NodeStatus{
+			ID:       status.ID,
+			Addr:     status.Addr,
+			State:    string(status.State),
+			LastSeen: status.LastSeen,
+			Since:    status.Since,
+		})
 	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
 
-	if resp.LastEvaluatedKey != nil {
-		convertedLastEvaluatedKey, err := convertExpressionToAWSAttributeValue(resp.LastEvaluatedKey)
-		if err != nil {
-			s.writeError(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		awsScanResp.LastEvaluatedKey = convertedLastEvaluatedKey
+// handleReplicas reports the nodes holding a partition, given by the table
+// and key query parameters, the key being the hash key value as an attribute
+// value in JSON, such as {"S":"u1"}.
+func (s *Server) handleReplicas(w http.ResponseWriter, r *http.Request) {
+	if s.routerInstance == nil {
+		http.Error(w, "router instance not set", http.StatusInternalServerError)
+		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(awsScanResp)
-}
+	tableName := r.URL.Query().Get("table")
+	var hashKey types.AttributeValue
+	if err := json.Unmarshal([]byte(r.URL.Query().Get("key")), &hashKey); tableName == "" || err != nil {
+		http.Error(w, "table and key query parameters are required, the key as an attribute value in JSON", http.StatusBadRequest)
+		return
+	}
 
-// convertAWSToExpressionAttributeValue converts a map of AWS SDK AttributeValue (represented as map[string]interface{})
-// to our internal expression.AttributeValue.
-// convertAWSToExpressionAttributeValue converts a map of AWS SDK AttributeValue (represented as map[string]interface{})
-// to our internal expression.AttributeValue.
-func convertAWSToExpressionAttributeValue(awsMap map[string]interface{}) (map[string]*expression.AttributeValue, error) {
-	expMap := make(map[string]*expression.AttributeValue)
-	for k, v := range awsMap {
-		// Each value 'v' is expected to be a map with a single key representing the type (e.g., "S", "N")
-		// and its corresponding value.
-		attrMap, ok := v.(map[string]interface{})
-		if !ok || len(attrMap) != 1 {
-			return nil, fmt.Errorf("invalid AWS attribute value format for key %s: expected a map with single type key", k)
-		}
-
-		for typeKey, typeVal := range attrMap {
-			var exprAttrVal expression.AttributeValue
-			switch typeKey {
-			case "S":
-				strVal, ok := typeVal.(string)
-				if !ok {
-					return nil, fmt.Errorf("invalid type for S attribute for key %s: expected string", k)
-				}
-				exprAttrVal.S = &strVal
-			case "N":
-				// Numbers are often unmarshaled as string in AWS SDK for DynamoDB
-				strVal, ok := typeVal.(string)
-				if !ok {
-					return nil, fmt.Errorf("invalid type for N attribute for key %s: expected string", k)
-				}
-				exprAttrVal.N = &strVal
-			case "BOOL":
-				boolVal, ok := typeVal.(bool)
-				if !ok {
-					return nil, fmt.Errorf("invalid type for BOOL attribute for key %s: expected bool", k)
-				}
-				exprAttrVal.BOOL = &boolVal
-			case "NULL":
-				nullVal, ok := typeVal.(bool)
-				if !ok {
-					return nil, fmt.Errorf("invalid type for NULL attribute for key %s: expected bool", k)
-				}
-				exprAttrVal.NULL = &nullVal
-			default:
-				return nil, fmt.Errorf("unsupported AWS attribute type '%s' for key %s", typeKey, k)
-			}
-			expMap[k] = &exprAttrVal
-		}
+	replicas, err := s.routerInstance.ReplicasForKey(tableName, &hashKey)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	return expMap, nil
-}
 
-// convertExpressionToAWSAttributeValue converts our internal expression.AttributeValue to a map suitable for AWS SDK JSON marshalling.
-func convertExpressionToAWSAttributeValue(expMap map[string]*expression.AttributeValue) (map[string]interface{}, error) {
-	awsMap := make(map[string]interface{})
-	for k, v := range expMap {
-		if v == nil {
-			continue
-		}
-		// Determine the type and create the corresponding AWS SDK-like structure
-		if v.S != nil {
-			awsMap[k] = map[string]interface{}{"S": *v.S}
-		} else if v.N != nil {
-			awsMap[k] = map[string]interface{}{"N": *v.N}
-		} else if v.BOOL != nil {
-			awsMap[k] = map[string]interface{}{"BOOL": *v.BOOL}
-		} else if v.NULL != nil {
-			awsMap[k] = map[string]interface{}{"NULL": *v.NULL}
-		} else {
-			return nil, fmt.Errorf("unsupported expression attribute type for key %s", k)
-		}
+	resp := routerapi.ReplicasResponse{
+		ReplicationFactor: s.routerInstance.ReplicationFactor(),
+		Replicas:          replicas,
 	}
-	return awsMap, nil
+	resp.WriteQuorum, resp.ReadQuorum = s.routerInstance.Quorums()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
 }
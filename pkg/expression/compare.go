@@ -0,0 +1,123 @@
+package expression
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// CompareAttributeValues orders two scalar attribute values of the same type
+// the way DynamoDB does: strings and binaries by their bytes and numbers by
+// their decimal value. It returns -1, 0 or 1.
+func CompareAttributeValues(a, b *AttributeValue) (int, error) {
+	typeA, typeB := GetAttributeValueType(a), GetAttributeValueType(b)
+	if typeA != typeB {
+		return 0, fmt.Errorf("cannot compare %s with %s", typeA, typeB)
+	}
+
+	switch typeA {
+	case "S":
+		return strings.Compare(*a.S, *b.S), nil
+	case "B":
+		return bytes.Compare(a.B, b.B), nil
+	case "N":
+		ra, err := parseNumber(*a.N)
+		if err != nil {
+			return 0, err
+		}
+		rb, err := parseNumber(*b.N)
+		if err != nil {
+			return 0, err
+		}
+		return ra.Cmp(rb), nil
+	default:
+		return 0, fmt.Errorf("type %s is not comparable", typeA)
+	}
+}
+
+// parseNumber parses the string form of an N attribute value.
+func parseNumber(s string) (*big.Rat, error) {
+	if strings.Contains(s, "/") {
+		return nil, fmt.Errorf("invalid number: %s", s)
+	}
+	r, ok := new(big.Rat).SetString(s)
+	if !ok {
+		return nil, fmt.Errorf("invalid number: %s", s)
+	}
+	return r, nil
+}
+
+// EqualAttributeValues reports whether two attribute values of any type are
+// equal. Numbers compare by value, sets ignore element order, and lists and
+// maps compare element by element.
+func EqualAttributeValues(a, b *AttributeValue) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	typeA := GetAttributeValueType(a)
+	if typeA != GetAttributeValueType(b) {
+		return false
+	}
+
+	switch typeA {
+	case "S", "N", "B":
+		cmp, err := CompareAttributeValues(a, b)
+		return err == nil && cmp == 0
+	case "BOOL":
+		return *a.BOOL == *b.BOOL
+	case "NULL":
+		return *a.NULL == *b.NULL
+	case "SS":
+		return equalSets(len(a.SS), len(b.SS), func(i, j int) bool { return a.SS[i] == b.SS[j] })
+	case "NS":
+		return equalSets(len(a.NS), len(b.NS), func(i, j int) bool {
+			return EqualAttributeValues(&AttributeValue{N: &a.NS[i]}, &AttributeValue{N: &b.NS[j]})
+		})
+	case "BS":
+		return equalSets(len(a.BS), len(b.BS), func(i, j int) bool { return bytes.Equal(a.BS[i], b.BS[j]) })
+	case "L":
+		if len(a.L) != len(b.L) {
+			return false
+		}
+		for i := range a.L {
+			if !EqualAttributeValues(a.L[i], b.L[i]) {
+				return false
+			}
+		}
+		return true
+	case "M":
+		if len(a.M) != len(b.M) {
+			return false
+		}
+		for k, v := range a.M {
+			if !EqualAttributeValues(v, b.M[k]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+// equalSets reports whether two sets of the given sizes hold the same
+// elements, using eq to compare element i of the first with element j of the second.
+func equalSets(lenA, lenB int, eq func(i, j int) bool) bool {
+	if lenA != lenB {
+		return false
+	}
+	for i := 0; i < lenA; i++ {
+		found := false
+		for j := 0; j < lenB; j++ {
+			if eq(i, j) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
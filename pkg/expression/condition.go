@@ -0,0 +1,530 @@
+package expression
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Condition functions.
+const (
+	FunctionAttributeExists    = "attribute_exists"
+	FunctionAttributeNotExists = "attribute_not_exists"
+	FunctionAttributeType      = "attribute_type"
+	FunctionBeginsWith         = "begins_with"
+	FunctionContains           = "contains"
+	FunctionSize               = "size"
+)
+
+// maxInOperands is the largest number of values DynamoDB accepts in an IN list.
+const maxInOperands = 100
+
+// Condition is a parsed condition expression, as used by FilterExpression and
+// ConditionExpression. It is parsed once and can then be evaluated against any
+// number of items.
+type Condition struct {
+	root conditionNode
+}
+
+// ParseConditionExpression parses a condition expression such as
+// "price < :max AND (attribute_not_exists(discontinued) OR stock > :zero)".
+// Every #name placeholder must be present in names and every :value
+// placeholder in values.
+func ParseConditionExpression(expr string, names map[string]string, values map[string]*AttributeValue) (*Condition, error) {
+	p, err := newParser(expr, names, values)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectEOF(); err != nil {
+		return nil, err
+	}
+	return &Condition{root: root}, nil
+}
+
+// Matches reports whether an item satisfies the condition. A nil condition
+// matches every item.
+func (c *Condition) Matches(item map[string]*AttributeValue) (bool, error) {
+	if c == nil {
+		return true, nil
+	}
+	return c.root.evaluate(item)
+}
+
+// conditionNode is a node of a parsed condition expression.
+type conditionNode interface {
+	evaluate(item map[string]*AttributeValue) (bool, error)
+}
+
+// operand is one side of a comparison. resolve returns nil when the operand
+// refers to an attribute the item does not have.
+type operand interface {
+	resolve(item map[string]*AttributeValue) *AttributeValue
+}
+
+type valueOperand struct {
+	value *AttributeValue
+}
+
+func (o *valueOperand) resolve(map[string]*AttributeValue) *AttributeValue {
+	return o.value
+}
+
+type pathOperand struct {
+	path documentPath
+}
+
+func (o *pathOperand) resolve(item map[string]*AttributeValue) *AttributeValue {
+	return o.path.get(item)
+}
+
+func (o *pathOperand) String() string {
+	return o.path.String()
+}
+
+type sizeOperand struct {
+	path *pathOperand
+}
+
+func (o *sizeOperand) resolve(item map[string]*AttributeValue) *AttributeValue {
+	v := o.path.resolve(item)
+	if v == nil {
+		return nil
+	}
+
+	var size int
+	switch GetAttributeValueType(v) {
+	case "S":
+		size = utf8.RuneCountInString(*v.S)
+	case "B":
+		size = len(v.B)
+	case "SS":
+		size = len(v.SS)
+	case "NS":
+		size = len(v.NS)
+	case "BS":
+		size = len(v.BS)
+	case "L":
+		size = len(v.L)
+	case "M":
+		size = len(v.M)
+	default:
+		return nil
+	}
+	n := fmt.Sprint(size)
+	return &AttributeValue{N: &n}
+}
+
+type andNode struct {
+	left, right conditionNode
+}
+
+func (n *andNode) evaluate(item map[string]*AttributeValue) (bool, error) {
+	ok, err := n.left.evaluate(item)
+	if err != nil || !ok {
+		return false, err
+	}
+	return n.right.evaluate(item)
+}
+
+type orNode struct {
+	left, right conditionNode
+}
+
+func (n *orNode) evaluate(item map[string]*AttributeValue) (bool, error) {
+	ok, err := n.left.evaluate(item)
+	if err != nil || ok {
+		return ok, err
+	}
+	return n.right.evaluate(item)
+}
+
+type notNode struct {
+	operand conditionNode
+}
+
+func (n *notNode) evaluate(item map[string]*AttributeValue) (bool, error) {
+	ok, err := n.operand.evaluate(item)
+	return !ok, err
+}
+
+type comparisonNode struct {
+	operator    string
+	left, right operand
+}
+
+func (n *comparisonNode) evaluate(item map[string]*AttributeValue) (bool, error) {
+	left, right := n.left.resolve(item), n.right.resolve(item)
+
+	switch n.operator {
+	case "=":
+		return left != nil && right != nil && EqualAttributeValues(left, right), nil
+	case "<>":
+		return left == nil || right == nil || !EqualAttributeValues(left, right), nil
+	}
+
+	cmp, ok := compareOrdered(left, right)
+	if !ok {
+		return false, nil
+	}
+	switch n.operator {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	case ">=":
+		return cmp >= 0, nil
+	default:
+		return false, fmt.Errorf("unsupported comparator: %s", n.operator)
+	}
+}
+
+type betweenNode struct {
+	operand      operand
+	lower, upper operand
+}
+
+func (n *betweenNode) evaluate(item map[string]*AttributeValue) (bool, error) {
+	v := n.operand.resolve(item)
+	lower, ok := compareOrdered(v, n.lower.resolve(item))
+	if !ok {
+		return false, nil
+	}
+	upper, ok := compareOrdered(v, n.upper.resolve(item))
+	if !ok {
+		return false, nil
+	}
+	return lower >= 0 && upper <= 0, nil
+}
+
+type inNode struct {
+	operand operand
+	list    []operand
+}
+
+func (n *inNode) evaluate(item map[string]*AttributeValue) (bool, error) {
+	v := n.operand.resolve(item)
+	if v == nil {
+		return false, nil
+	}
+	for _, candidate := range n.list {
+		if c := candidate.resolve(item); c != nil && EqualAttributeValues(v, c) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type functionNode struct {
+	name string
+	path *pathOperand
+	arg  operand
+}
+
+func (n *functionNode) evaluate(item map[string]*AttributeValue) (bool, error) {
+	v := n.path.resolve(item)
+
+	switch n.name {
+	case FunctionAttributeExists:
+		return v != nil, nil
+	case FunctionAttributeNotExists:
+		return v == nil, nil
+	case FunctionAttributeType:
+		want := n.arg.resolve(item)
+		if want == nil || want.S == nil || !isAttributeType(*want.S) {
+			return false, fmt.Errorf("invalid type for %s: must be one of S, SS, N, NS, B, BS, BOOL, NULL, L, M", FunctionAttributeType)
+		}
+		return v != nil && GetAttributeValueType(v) == *want.S, nil
+	case FunctionBeginsWith:
+		prefix := n.arg.resolve(item)
+		if v == nil || prefix == nil {
+			return false, nil
+		}
+		switch {
+		case v.S != nil && prefix.S != nil:
+			return strings.HasPrefix(*v.S, *prefix.S), nil
+		case v.B != nil && prefix.B != nil:
+			return strings.HasPrefix(string(v.B), string(prefix.B)), nil
+		default:
+			return false, nil
+		}
+	case FunctionContains:
+		return contains(v, n.arg.resolve(item)), nil
+	default:
+		return false, fmt.Errorf("unsupported function: %s", n.name)
+	}
+}
+
+// contains implements the contains function: a substring test for strings
+// and binaries, and a membership test for sets and lists.
+func contains(v, operand *AttributeValue) bool {
+	if v == nil || operand == nil {
+		return false
+	}
+
+	switch GetAttributeValueType(v) {
+	case "S":
+		return operand.S != nil && strings.Contains(*v.S, *operand.S)
+	case "B":
+		return operand.B != nil && strings.Contains(string(v.B), string(operand.B))
+	case "SS":
+		if operand.S == nil {
+			return false
+		}
+		for _, s := range v.SS {
+			if s == *operand.S {
+				return true
+			}
+		}
+	case "NS":
+		if operand.N == nil {
+			return false
+		}
+		for _, n := range v.NS {
+			if EqualAttributeValues(&AttributeValue{N: &n}, operand) {
+				return true
+			}
+		}
+	case "BS":
+		if operand.B == nil {
+			return false
+		}
+		for _, b := range v.BS {
+			if string(b) == string(operand.B) {
+				return true
+			}
+		}
+	case "L":
+		for _, elem := range v.L {
+			if EqualAttributeValues(elem, operand) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compareOrdered orders two values for <, <=, >, >= and BETWEEN. Values that
+// are missing, of different types or of a type without an order cannot be
+// compared, which makes the comparison false rather than an error.
+func compareOrdered(a, b *AttributeValue) (int, bool) {
+	if a == nil || b == nil {
+		return 0, false
+	}
+	cmp, err := CompareAttributeValues(a, b)
+	if err != nil {
+		return 0, false
+	}
+	return cmp, true
+}
+
+func isAttributeType(t string) bool {
+	switch t {
+	case "S", "SS", "N", "NS", "B", "BS", "BOOL", "NULL", "L", "M":
+		return true
+	default:
+		return false
+	}
+}
+
+// parseOr parses a condition, the lowest precedence level of the grammar:
+// OR binds looser than AND, which binds looser than NOT.
+func (p *parser) parseOr() (conditionNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (conditionNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("AND") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (conditionNode, error) {
+	if p.peekKeyword("NOT") {
+		p.next()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (conditionNode, error) {
+	if p.peek().kind == tokenLParen {
+		p.next()
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenRParen); err != nil {
+			return nil, err
+		}
+		return node, nil
+	}
+
+	if p.peekFunction() && !p.peekKeyword(FunctionSize) {
+		return p.parseFunction()
+	}
+
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case p.peekKeyword("BETWEEN"):
+		p.next()
+		lower, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("AND"); err != nil {
+			return nil, err
+		}
+		upper, err := p.parseOperand()
+		if err != nil {
+			return nil, err
+		}
+		return &betweenNode{operand: left, lower: lower, upper: upper}, nil
+	case p.peekKeyword("IN"):
+		in := p.next()
+		if _, err := p.expect(tokenLParen); err != nil {
+			return nil, err
+		}
+		var list []operand
+		for {
+			o, err := p.parseOperand()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, o)
+			if p.peek().kind != tokenComma {
+				break
+			}
+			p.next()
+		}
+		if _, err := p.expect(tokenRParen); err != nil {
+			return nil, err
+		}
+		if len(list) > maxInOperands {
+			return nil, p.errorf(in, "IN accepts at most %d values, got %d", maxInOperands, len(list))
+		}
+		return &inNode{operand: left, list: list}, nil
+	}
+
+	op, err := p.expect(tokenComparator)
+	if err != nil {
+		return nil, err
+	}
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return &comparisonNode{operator: op.text, left: left, right: right}, nil
+}
+
+// peekFunction reports whether the next tokens are a function call.
+func (p *parser) peekFunction() bool {
+	return p.peek().kind == tokenIdent && p.tokens[p.pos+1].kind == tokenLParen
+}
+
+func (p *parser) parseFunction() (conditionNode, error) {
+	name := p.next()
+	p.next()
+
+	fn := strings.ToLower(name.text)
+	var wantArgs int
+	switch fn {
+	case FunctionAttributeExists, FunctionAttributeNotExists:
+		wantArgs = 1
+	case FunctionAttributeType, FunctionBeginsWith, FunctionContains:
+		wantArgs = 2
+	default:
+		return nil, p.errorf(name, "unknown function %q", name.text)
+	}
+
+	path, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+	node := &functionNode{name: fn, path: path}
+	if wantArgs == 2 {
+		if _, err := p.expect(tokenComma); err != nil {
+			return nil, err
+		}
+		if node.arg, err = p.parseOperand(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := p.expect(tokenRParen); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// parseOperand parses an attribute path, a value, or a size() call.
+func (p *parser) parseOperand() (operand, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokenValueRef || t.kind == tokenString || t.kind == tokenNumber:
+		v, err := p.value(p.next())
+		if err != nil {
+			return nil, err
+		}
+		return &valueOperand{value: v}, nil
+	case p.peekFunction():
+		if !p.peekKeyword(FunctionSize) {
+			return nil, p.errorf(t, "function %q cannot be used as an operand", t.text)
+		}
+		p.next()
+		p.next()
+		path, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenRParen); err != nil {
+			return nil, err
+		}
+		return &sizeOperand{path: path}, nil
+	default:
+		return p.parsePath()
+	}
+}
+
+func (p *parser) parsePath() (*pathOperand, error) {
+	path, err := p.parseDocumentPath()
+	if err != nil {
+		return nil, err
+	}
+	return &pathOperand{path: path}, nil
+}
@@ -18,7 +18,7 @@ func TestUpdate(t *testing.T) {
 		item := map[string]*AttributeValue{
 			"name": {S: stringPtr("old-name")},
 		}
-		updatedItem, err := Update(item, "SET name = :newname", map[string]*AttributeValue{":newname": {S: stringPtr("new-name")}})
+		updatedItem, err := Update(item, "SET name = :newname", nil, map[string]*AttributeValue{":newname": {S: stringPtr("new-name")}})
 		if err != nil {
 			t.Fatalf("expected no error, got %v", err)
 		}
@@ -32,7 +32,7 @@ func TestUpdate(t *testing.T) {
 		item := map[string]*AttributeValue{
 			"age": {N: stringPtr("30")},
 		}
-		updatedItem, err := Update(item, "SET age = :newage", map[string]*AttributeValue{":newage": {N: stringPtr("40")}})
+		updatedItem, err := Update(item, "SET age = :newage", nil, map[string]*AttributeValue{":newage": {N: stringPtr("40")}})
 		if err != nil {
 			t.Fatalf("expected no error, got %v", err)
 		}
@@ -46,7 +46,7 @@ func TestUpdate(t *testing.T) {
 		item := map[string]*AttributeValue{
 			"isActive": {BOOL: boolPtr(true)},
 		}
-		updatedItem, err := Update(item, "SET isActive = :active", map[string]*AttributeValue{":active": {BOOL: boolPtr(false)}})
+		updatedItem, err := Update(item, "SET isActive = :active", nil, map[string]*AttributeValue{":active": {BOOL: boolPtr(false)}})
 		if err != nil {
 			t.Fatalf("expected no error, got %v", err)
 		}
@@ -58,7 +58,7 @@ func TestUpdate(t *testing.T) {
 	// Test adding a new attribute with SET
 	t.Run("SET_new_attribute", func(t *testing.T) {
 		item := map[string]*AttributeValue{}
-		updatedItem, err := Update(item, "SET city = :city", map[string]*AttributeValue{":city": {S: stringPtr("NewYork")}})
+		updatedItem, err := Update(item, "SET city = :city", nil, map[string]*AttributeValue{":city": {S: stringPtr("NewYork")}})
 		if err != nil {
 			t.Fatalf("expected no error, got %v", err)
 		}
@@ -73,7 +73,7 @@ func TestUpdate(t *testing.T) {
 			"name": {S: stringPtr("old-name")},
 			"age":  {N: stringPtr("30")},
 		}
-		updatedItem, err := Update(item, "REMOVE age", nil)
+		updatedItem, err := Update(item, "REMOVE age", nil, nil)
 		if err != nil {
 			t.Fatalf("expected no error, got %v", err)
 		}
@@ -92,7 +92,7 @@ func TestUpdate(t *testing.T) {
 			"age":      {N: stringPtr("30")},
 			"isActive": {BOOL: boolPtr(true)},
 		}
-		updatedItem, err := Update(item, "SET name = :newname REMOVE age", map[string]*AttributeValue{":newname": {S: stringPtr("new-name")}})
+		updatedItem, err := Update(item, "SET name = :newname REMOVE age", nil, map[string]*AttributeValue{":newname": {S: stringPtr("new-name")}})
 		if err != nil {
 			t.Fatalf("expected no error, got %v", err)
 		}
@@ -110,7 +110,7 @@ func TestUpdate(t *testing.T) {
 	// Test invalid expression format
 	t.Run("Invalid_expression", func(t *testing.T) {
 		item := map[string]*AttributeValue{}
-		_, err := Update(item, "INVALID expression", nil)
+		_, err := Update(item, "INVALID expression", nil, nil)
 		if err == nil {
 			t.Fatal("expected error, got no error")
 		}
@@ -119,7 +119,7 @@ func TestUpdate(t *testing.T) {
 	// Test invalid SET clause
 	t.Run("Invalid_SET_clause", func(t *testing.T) {
 		item := map[string]*AttributeValue{}
-		_, err := Update(item, "SET name new-name", nil)
+		_, err := Update(item, "SET name new-name", nil, nil)
 		if err == nil {
 			t.Fatal("expected error, got no error")
 		}
@@ -128,7 +128,7 @@ func TestUpdate(t *testing.T) {
 	// Test invalid REMOVE clause
 	t.Run("Invalid_REMOVE_clause", func(t *testing.T) {
 		item := map[string]*AttributeValue{}
-		_, err := Update(item, "REMOVE", nil)
+		_, err := Update(item, "REMOVE", nil, nil)
 		if err == nil {
 			t.Fatal("expected error, got no error")
 		}
@@ -278,3 +278,784 @@ func TestGetAttributeValueType(t *testing.T) {
 		}
 	})
 }
+
+func TestParseKeyConditionExpression(t *testing.T) {
+	values := map[string]*AttributeValue{
+		":id": {S: stringPtr("123")},
+		":lo": {N: stringPtr("1")},
+		":hi": {N: stringPtr("9")},
+		":p":  {S: stringPtr("pre")},
+	}
+
+	t.Run("hash_key_only", func(t *testing.T) {
+		conds, err := ParseKeyConditionExpression("id = :id", nil, values)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(conds) != 1 || conds[0].AttributeName != "id" || conds[0].Operator != KeyConditionEqual {
+			t.Errorf("unexpected conditions: %+v", conds)
+		}
+	})
+
+	t.Run("between", func(t *testing.T) {
+		conds, err := ParseKeyConditionExpression("id = :id AND ts BETWEEN :lo AND :hi", nil, values)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(conds) != 2 || conds[1].Operator != KeyConditionBetween || len(conds[1].Values) != 2 {
+			t.Fatalf("unexpected conditions: %+v", conds)
+		}
+		if *conds[1].Values[0].N != "1" || *conds[1].Values[1].N != "9" {
+			t.Errorf("unexpected BETWEEN bounds: %v, %v", *conds[1].Values[0].N, *conds[1].Values[1].N)
+		}
+	})
+
+	t.Run("begins_with", func(t *testing.T) {
+		conds, err := ParseKeyConditionExpression("id = :id and begins_with(sk, :p)", nil, values)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(conds) != 2 || conds[1].AttributeName != "sk" || conds[1].Operator != KeyConditionBeginsWith {
+			t.Errorf("unexpected conditions: %+v", conds)
+		}
+	})
+
+	t.Run("comparators_without_spaces", func(t *testing.T) {
+		for _, op := range []string{"<", "<=", ">", ">="} {
+			conds, err := ParseKeyConditionExpression("id=:id AND ts"+op+":lo", nil, values)
+			if err != nil {
+				t.Fatalf("expected no error for %s, got %v", op, err)
+			}
+			if conds[1].Operator != op {
+				t.Errorf("expected operator %s, got %s", op, conds[1].Operator)
+			}
+		}
+	})
+
+	t.Run("missing_value", func(t *testing.T) {
+		_, err := ParseKeyConditionExpression("id = :missing", nil, values)
+		if err == nil {
+			t.Fatal("expected error, got no error")
+		}
+	})
+
+	t.Run("syntax_errors", func(t *testing.T) {
+		for _, expr := range []string{"id :id", "id = :id extra", "id = :id AND", "id <> :id", "begins_with(sk :p)"} {
+			_, err := ParseKeyConditionExpression(expr, nil, values)
+			if _, ok := err.(*SyntaxError); !ok {
+				t.Errorf("expected syntax error for %q, got %v", expr, err)
+			}
+		}
+	})
+}
+
+func TestKeyConditionMatches(t *testing.T) {
+	cond := &KeyCondition{
+		AttributeName: "ts",
+		Operator:      KeyConditionBetween,
+		Values:        []*AttributeValue{{N: stringPtr("9")}, {N: stringPtr("10")}},
+	}
+	for value, expected := range map[string]bool{"8": false, "9": true, "9.5": true, "10": true, "100": false} {
+		ok, err := cond.Matches(&AttributeValue{N: stringPtr(value)})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if ok != expected {
+			t.Errorf("expected Matches(%s) to be %t", value, expected)
+		}
+	}
+}
+
+func TestConditionMatches(t *testing.T) {
+	item := map[string]*AttributeValue{
+		"name":   {S: stringPtr("widget")},
+		"price":  {N: stringPtr("25")},
+		"stock":  {N: stringPtr("0")},
+		"active": {BOOL: boolPtr(true)},
+		"tags":   {SS: []string{"red", "blue"}},
+		"sizes":  {NS: []string{"1", "2.5"}},
+		"parts":  {L: []*AttributeValue{{S: stringPtr("bolt")}, {N: stringPtr("3")}}},
+		"meta":   {M: map[string]*AttributeValue{"a": {S: stringPtr("b")}}},
+	}
+	values := map[string]*AttributeValue{
+		":name":   {S: stringPtr("widget")},
+		":other":  {S: stringPtr("gadget")},
+		":ten":    {N: stringPtr("10")},
+		":fifty":  {N: stringPtr("50")},
+		":25":     {N: stringPtr("25.0")},
+		":two":    {N: stringPtr("2")},
+		":wid":    {S: stringPtr("wid")},
+		":dge":    {S: stringPtr("dge")},
+		":red":    {S: stringPtr("red")},
+		":bolt":   {S: stringPtr("bolt")},
+		":twoish": {N: stringPtr("2.5")},
+		":true":   {BOOL: boolPtr(true)},
+		":tags":   {SS: []string{"blue", "red"}},
+		":typeS":  {S: stringPtr("S")},
+		":typeM":  {S: stringPtr("M")},
+	}
+
+	tests := []struct {
+		expr     string
+		expected bool
+	}{
+		{"name = :name", true},
+		{"name <> :name", false},
+		{"missing <> :name", true},
+		{"missing = :name", false},
+		{"price = :25", true},
+		{"price > :ten", true},
+		{"price >= :fifty", false},
+		{"price < name", false},
+		{"price BETWEEN :ten AND :fifty", true},
+		{"stock BETWEEN :ten AND :fifty", false},
+		{"name IN (:other, :name)", true},
+		{"name IN (:other)", false},
+		{"active = :true", true},
+		{"tags = :tags", true},
+		{"price > :ten AND stock > :ten", false},
+		{"price > :ten OR stock > :ten", true},
+		{"NOT price > :ten", false},
+		{"NOT (price > :ten AND stock > :ten)", true},
+		{"price > :fifty OR stock = :ten OR name = :name", true},
+		{"price > :fifty OR name = :name AND stock = :ten", false},
+		{"attribute_exists(name)", true},
+		{"attribute_exists(missing)", false},
+		{"attribute_not_exists(missing)", true},
+		{"attribute_type(name, :typeS)", true},
+		{"attribute_type(meta, :typeS)", false},
+		{"attribute_type(meta, :typeM)", true},
+		{"begins_with(name, :wid)", true},
+		{"begins_with(name, :dge)", false},
+		{"contains(name, :dge)", true},
+		{"contains(tags, :red)", true},
+		{"contains(tags, :wid)", false},
+		{"contains(sizes, :twoish)", true},
+		{"contains(parts, :bolt)", true},
+		{"size(name) > :two", true},
+		{"size(tags) = :two", true},
+		{"size(parts) = :two AND size(meta) < :two", true},
+		{"size(missing) = :two", false},
+		{"(name = :other OR name = :name) AND price < :fifty", true},
+	}
+
+	for _, tt := range tests {
+		cond, err := ParseConditionExpression(tt.expr, nil, values)
+		if err != nil {
+			t.Fatalf("expected no error for %q, got %v", tt.expr, err)
+		}
+		ok, err := cond.Matches(item)
+		if err != nil {
+			t.Fatalf("expected no error evaluating %q, got %v", tt.expr, err)
+		}
+		if ok != tt.expected {
+			t.Errorf("expected %q to be %t", tt.expr, tt.expected)
+		}
+	}
+
+	t.Run("invalid_attribute_type", func(t *testing.T) {
+		cond, err := ParseConditionExpression("attribute_type(name, :name)", nil, values)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if _, err := cond.Matches(item); err == nil {
+			t.Error("expected error, got no error")
+		}
+	})
+
+	t.Run("missing_value", func(t *testing.T) {
+		if _, err := ParseConditionExpression("name = :missing", nil, values); err == nil {
+			t.Error("expected error, got no error")
+		}
+	})
+
+	t.Run("syntax_errors", func(t *testing.T) {
+		for _, expr := range []string{
+			"name",
+			"name = ",
+			"name = :name AND",
+			"(name = :name",
+			"name IN ()",
+			"unknown(name)",
+			"size(name)",
+			"name = begins_with(name, :wid)",
+			"price BETWEEN :ten",
+		} {
+			_, err := ParseConditionExpression(expr, nil, values)
+			if _, ok := err.(*SyntaxError); !ok {
+				t.Errorf("expected syntax error for %q, got %v", expr, err)
+			}
+		}
+	})
+}
+
+func TestExpressionAttributeNames(t *testing.T) {
+	names := map[string]string{
+		"#name":   "Name",
+		"#status": "Status",
+		"#dotted": "a.b",
+		"#dashed": "a-b",
+	}
+	values := map[string]*AttributeValue{
+		":id":     {S: stringPtr("123")},
+		":name":   {S: stringPtr("widget")},
+		":status": {S: stringPtr("active")},
+	}
+
+	t.Run("update", func(t *testing.T) {
+		item := map[string]*AttributeValue{
+			"a.b": {S: stringPtr("old")},
+			"a-b": {S: stringPtr("old")},
+		}
+		updatedItem, err := Update(item, "SET #name = :name, #status = :status REMOVE #dotted, #dashed", names, values)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if *updatedItem["Name"].S != "widget" || *updatedItem["Status"].S != "active" {
+			t.Errorf("unexpected item: %v", updatedItem)
+		}
+		if _, ok := updatedItem["a.b"]; ok {
+			t.Error("expected attribute 'a.b' to be removed")
+		}
+		if _, ok := updatedItem["a-b"]; ok {
+			t.Error("expected attribute 'a-b' to be removed")
+		}
+	})
+
+	t.Run("key_condition", func(t *testing.T) {
+		conds, err := ParseKeyConditionExpression("#name = :id AND begins_with(#status, :status)", names, values)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if conds[0].AttributeName != "Name" || conds[1].AttributeName != "Status" {
+			t.Errorf("unexpected conditions: %+v", conds)
+		}
+	})
+
+	t.Run("condition", func(t *testing.T) {
+		cond, err := ParseConditionExpression("#status = :status AND attribute_exists(#dotted)", names, values)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		ok, err := cond.Matches(map[string]*AttributeValue{
+			"Status": {S: stringPtr("active")},
+			"a.b":    {S: stringPtr("x")},
+		})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if !ok {
+			t.Error("expected condition to match")
+		}
+	})
+
+	t.Run("missing_name", func(t *testing.T) {
+		if _, err := Update(map[string]*AttributeValue{}, "SET #missing = :name", names, values); err == nil {
+			t.Error("expected error from Update, got no error")
+		}
+		if _, err := ParseKeyConditionExpression("#missing = :id", names, values); err == nil {
+			t.Error("expected error from ParseKeyConditionExpression, got no error")
+		}
+		if _, err := ParseConditionExpression("attribute_exists(#missing)", names, values); err == nil {
+			t.Error("expected error from ParseConditionExpression, got no error")
+		}
+	})
+}
+
+func TestParseUpdateExpression(t *testing.T) {
+	values := map[string]*AttributeValue{
+		":a": {S: stringPtr("a")},
+		":b": {S: stringPtr("b")},
+		":n": {N: stringPtr("1")},
+	}
+
+	t.Run("without_spaces", func(t *testing.T) {
+		item := map[string]*AttributeValue{}
+		updatedItem, err := Update(item, "SET x=:a,y=:b", nil, values)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if *updatedItem["x"].S != "a" || *updatedItem["y"].S != "b" {
+			t.Errorf("unexpected item: %v", updatedItem)
+		}
+	})
+
+	t.Run("clauses_in_any_order", func(t *testing.T) {
+		item := map[string]*AttributeValue{
+			"old":   {S: stringPtr("old")},
+			"count": {N: stringPtr("1")},
+		}
+		updatedItem, err := Update(item, "remove old add count :n set x = :a", nil, values)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if _, ok := updatedItem["old"]; ok {
+			t.Error("expected old to be removed")
+		}
+		if *updatedItem["count"].N != "2" || *updatedItem["x"].S != "a" {
+			t.Errorf("unexpected item: %v", updatedItem)
+		}
+	})
+
+	t.Run("value_containing_keyword", func(t *testing.T) {
+		item := map[string]*AttributeValue{}
+		updatedItem, err := Update(item, `SET note = "SET x REMOVE y"`, nil, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if *updatedItem["note"].S != "SET x REMOVE y" {
+			t.Errorf("expected note to be 'SET x REMOVE y', got '%s'", *updatedItem["note"].S)
+		}
+	})
+
+	t.Run("operands_use_original_item", func(t *testing.T) {
+		item := map[string]*AttributeValue{
+			"a": {S: stringPtr("first")},
+			"b": {S: stringPtr("second")},
+		}
+		updatedItem, err := Update(item, "SET a = b, b = a", nil, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if *updatedItem["a"].S != "second" || *updatedItem["b"].S != "first" {
+			t.Errorf("expected a and b to be swapped, got %v", updatedItem)
+		}
+	})
+
+	t.Run("syntax_errors", func(t *testing.T) {
+		for expr, pos := range map[string]int{
+			"SET":              3,
+			"SET a = :a,":      11,
+			"SET a :a":         6,
+			"SET a = :a SET b": 11,
+			"UPSERT a = :a":    0,
+			"SET a[x] = :a":    6,
+			"SET a. = :a":      7,
+			"REMOVE a b":       9,
+		} {
+			_, err := ParseUpdateExpression(expr, nil, values)
+			syntaxErr, ok := err.(*SyntaxError)
+			if !ok {
+				t.Errorf("expected syntax error for %q, got %v", expr, err)
+				continue
+			}
+			if syntaxErr.Pos != pos {
+				t.Errorf("expected syntax error for %q at position %d, got %d", expr, pos, syntaxErr.Pos)
+			}
+		}
+	})
+}
+
+func TestUpdateDocumentPaths(t *testing.T) {
+	newItem := func() map[string]*AttributeValue {
+		return map[string]*AttributeValue{
+			"m": {M: map[string]*AttributeValue{
+				"inner": {L: []*AttributeValue{
+					{S: stringPtr("zero")},
+					{S: stringPtr("one")},
+					{S: stringPtr("two")},
+				}},
+			}},
+		}
+	}
+	names := map[string]string{"#m": "m"}
+	values := map[string]*AttributeValue{":v": {S: stringPtr("new")}}
+
+	t.Run("set_list_element", func(t *testing.T) {
+		updatedItem, err := Update(newItem(), "SET #m.inner[2] = :v", names, values)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if got := *updatedItem["m"].M["inner"].L[2].S; got != "new" {
+			t.Errorf("expected m.inner[2] to be 'new', got '%s'", got)
+		}
+	})
+
+	t.Run("set_past_end_appends", func(t *testing.T) {
+		updatedItem, err := Update(newItem(), "SET m.inner[10] = :v", nil, values)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if l := updatedItem["m"].M["inner"].L; len(l) != 4 || *l[3].S != "new" {
+			t.Errorf("expected 'new' to be appended, got %v", l)
+		}
+	})
+
+	t.Run("set_map_key", func(t *testing.T) {
+		updatedItem, err := Update(newItem(), "SET m.other = m.inner[0]", nil, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if got := *updatedItem["m"].M["other"].S; got != "zero" {
+			t.Errorf("expected m.other to be 'zero', got '%s'", got)
+		}
+	})
+
+	t.Run("remove_list_element", func(t *testing.T) {
+		updatedItem, err := Update(newItem(), "REMOVE m.inner[0]", nil, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if l := updatedItem["m"].M["inner"].L; len(l) != 2 || *l[0].S != "one" {
+			t.Errorf("expected first element to be removed, got %v", l)
+		}
+	})
+
+	t.Run("remove_list_elements", func(t *testing.T) {
+		item := map[string]*AttributeValue{
+			"l": {L: []*AttributeValue{{S: stringPtr("a")}, {S: stringPtr("b")}, {S: stringPtr("c")}, {S: stringPtr("d")}}},
+		}
+		updatedItem, err := Update(item, "REMOVE l[1], l[2]", nil, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if l := updatedItem["l"].L; len(l) != 2 || *l[0].S != "a" || *l[1].S != "d" {
+			t.Errorf("expected [a d], got %v", l)
+		}
+	})
+
+	t.Run("overlapping_paths", func(t *testing.T) {
+		for _, expr := range []string{"SET m = :v, m = :v", "SET m = :v, m.inner = :v", "SET m.inner[0] = :v REMOVE m.inner", "REMOVE m.inner[1], m.inner[1]"} {
+			if _, err := Update(newItem(), expr, nil, values); err == nil {
+				t.Errorf("expected error for %q, got no error", expr)
+			}
+		}
+	})
+
+	t.Run("set_copies_value", func(t *testing.T) {
+		updatedItem, err := Update(newItem(), "SET copy = m", nil, nil)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		updatedItem, err = Update(updatedItem, "SET copy.inner[0] = :v", nil, values)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if got := *updatedItem["m"].M["inner"].L[0].S; got != "zero" {
+			t.Errorf("expected m.inner[0] to be left 'zero', got '%s'", got)
+		}
+	})
+
+	t.Run("missing_parent", func(t *testing.T) {
+		if _, err := Update(newItem(), "SET missing.inner = :v", nil, values); err == nil {
+			t.Error("expected error, got no error")
+		}
+		if _, err := Update(newItem(), "SET m.inner.key = :v", nil, values); err == nil {
+			t.Error("expected error, got no error")
+		}
+	})
+
+	t.Run("condition_on_nested_path", func(t *testing.T) {
+		cond, err := ParseConditionExpression("#m.inner[1] = :one AND size(m.inner) = :three", names, map[string]*AttributeValue{
+			":one":   {S: stringPtr("one")},
+			":three": {N: stringPtr("3")},
+		})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		ok, err := cond.Matches(newItem())
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if !ok {
+			t.Error("expected condition to match")
+		}
+	})
+}
+
+func TestUpdateFunctions(t *testing.T) {
+	values := map[string]*AttributeValue{
+		":zero": {N: stringPtr("0")},
+		":inc":  {N: stringPtr("5")},
+		":x":    {N: stringPtr("1.5")},
+		":new":  {L: []*AttributeValue{{S: stringPtr("c")}}},
+		":s":    {S: stringPtr("s")},
+	}
+
+	t.Run("if_not_exists_counter", func(t *testing.T) {
+		item := map[string]*AttributeValue{}
+		for _, expected := range []string{"5", "10"} {
+			updatedItem, err := Update(item, "SET c = if_not_exists(c, :zero) + :inc", nil, values)
+			if err != nil {
+				t.Fatalf("expected no error, got %v", err)
+			}
+			if *updatedItem["c"].N != expected {
+				t.Errorf("expected c to be '%s', got '%s'", expected, *updatedItem["c"].N)
+			}
+		}
+	})
+
+	t.Run("list_append", func(t *testing.T) {
+		item := map[string]*AttributeValue{
+			"l": {L: []*AttributeValue{{S: stringPtr("a")}, {S: stringPtr("b")}}},
+		}
+		updatedItem, err := Update(item, "SET l = list_append(l, :new), first = list_append(:new, l)", nil, values)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		var got, first []string
+		for _, v := range updatedItem["l"].L {
+			got = append(got, *v.S)
+		}
+		for _, v := range updatedItem["first"].L {
+			first = append(first, *v.S)
+		}
+		if len(got) != 3 || got[2] != "c" {
+			t.Errorf("expected [a b c], got %v", got)
+		}
+		if len(first) != 3 || first[0] != "c" {
+			t.Errorf("expected [c a b], got %v", first)
+		}
+	})
+
+	t.Run("list_append_if_not_exists", func(t *testing.T) {
+		item := map[string]*AttributeValue{}
+		updatedItem, err := Update(item, "SET feed = list_append(if_not_exists(feed, :empty), :new)", nil, map[string]*AttributeValue{
+			":empty": {L: []*AttributeValue{}},
+			":new":   values[":new"],
+		})
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if len(updatedItem["feed"].L) != 1 {
+			t.Errorf("expected feed to hold one element, got %v", updatedItem["feed"].L)
+		}
+	})
+
+	t.Run("subtraction", func(t *testing.T) {
+		item := map[string]*AttributeValue{"b": {N: stringPtr("4")}}
+		updatedItem, err := Update(item, "SET a = b - :x, b = b+:inc", nil, values)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if *updatedItem["a"].N != "2.5" || *updatedItem["b"].N != "9" {
+			t.Errorf("expected a = 2.5 and b = 9, got a = %s and b = %s", *updatedItem["a"].N, *updatedItem["b"].N)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		item := map[string]*AttributeValue{"s": {S: stringPtr("text")}}
+		for _, expr := range []string{
+			"SET a = missing + :inc",
+			"SET a = s + :inc",
+			"SET a = list_append(s, :new)",
+			"SET a = unknown(s)",
+			"SET a = :inc + ",
+		} {
+			if _, err := Update(item, expr, nil, values); err == nil {
+				t.Errorf("expected error for %q, got no error", expr)
+			}
+		}
+	})
+}
+
+func TestUpdateAddDelete(t *testing.T) {
+	values := map[string]*AttributeValue{
+		":one":   {N: stringPtr("1")},
+		":tenth": {N: stringPtr("0.1")},
+		":big":   {N: stringPtr("99999999999999999999999999999999999999")},
+		":ss":    {SS: []string{"b", "c"}},
+		":ns":    {NS: []string{"2", "3.0"}},
+		":bs":    {BS: [][]byte{[]byte("y")}},
+		":s":     {S: stringPtr("s")},
+	}
+
+	t.Run("ADD_creates_missing_number", func(t *testing.T) {
+		updatedItem, err := Update(map[string]*AttributeValue{}, "ADD counter :one", nil, values)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if *updatedItem["counter"].N != "1" {
+			t.Errorf("expected counter to be '1', got '%s'", *updatedItem["counter"].N)
+		}
+	})
+
+	t.Run("ADD_exact_decimal", func(t *testing.T) {
+		item := map[string]*AttributeValue{
+			"f": {N: stringPtr("0.2")},
+			"i": {N: stringPtr("9007199254740993")},
+		}
+		updatedItem, err := Update(item, "ADD f :tenth, i :one", nil, values)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if *updatedItem["f"].N != "0.3" {
+			t.Errorf("expected f to be '0.3', got '%s'", *updatedItem["f"].N)
+		}
+		if *updatedItem["i"].N != "9007199254740994" {
+			t.Errorf("expected i to be '9007199254740994', got '%s'", *updatedItem["i"].N)
+		}
+	})
+
+	t.Run("ADD_overflow", func(t *testing.T) {
+		item := map[string]*AttributeValue{"n": {N: stringPtr("1")}}
+		updatedItem, err := Update(item, "ADD n :big", nil, values)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if *updatedItem["n"].N != "100000000000000000000000000000000000000" {
+			t.Errorf("expected n to be 10^38, got '%s'", *updatedItem["n"].N)
+		}
+		item = map[string]*AttributeValue{"n": {N: stringPtr("0.1")}}
+		if _, err := Update(item, "ADD n :big", nil, values); err == nil {
+			t.Error("expected overflow error, got no error")
+		}
+	})
+
+	t.Run("invalid_numbers", func(t *testing.T) {
+		for _, v := range []*AttributeValue{
+			{N: stringPtr("1e1000")},
+			{N: stringPtr("1e-131")},
+			{NS: []string{"1", "1.000000000000000000000000000000000000001"}},
+			{M: map[string]*AttributeValue{"l": {L: []*AttributeValue{{N: stringPtr("1e126")}}}}},
+		} {
+			invalid := map[string]*AttributeValue{":v": v}
+			if _, err := Update(map[string]*AttributeValue{}, "SET n = :v", nil, invalid); err == nil {
+				t.Errorf("expected error for %v, got no error", v)
+			}
+			if _, err := ParseConditionExpression("n = :v", nil, invalid); err == nil {
+				t.Errorf("expected error for %v in a condition, got no error", v)
+			}
+		}
+		item := map[string]*AttributeValue{"n": {N: stringPtr("9e125")}}
+		if _, err := Update(item, "SET n = n + n", nil, nil); err == nil {
+			t.Error("expected out of range error, got no error")
+		}
+	})
+
+	t.Run("ADD_set_union", func(t *testing.T) {
+		item := map[string]*AttributeValue{
+			"ss": {SS: []string{"a", "b"}},
+			"ns": {NS: []string{"1", "2"}},
+		}
+		updatedItem, err := Update(item, "ADD ss :ss, ns :ns, bs :bs", nil, values)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if got := updatedItem["ss"].SS; len(got) != 3 || got[2] != "c" {
+			t.Errorf("expected [a b c], got %v", got)
+		}
+		if got := updatedItem["ns"].NS; len(got) != 3 || got[2] != "3.0" {
+			t.Errorf("expected [1 2 3.0], got %v", got)
+		}
+		if got := updatedItem["bs"].BS; len(got) != 1 || string(got[0]) != "y" {
+			t.Errorf("expected [y], got %v", got)
+		}
+	})
+
+	t.Run("DELETE_from_sets", func(t *testing.T) {
+		item := map[string]*AttributeValue{
+			"ss": {SS: []string{"a", "b", "c"}},
+			"ns": {NS: []string{"2", "3"}},
+		}
+		updatedItem, err := Update(item, "DELETE ss :ss, ns :ns, missing :ss", nil, values)
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if got := updatedItem["ss"].SS; len(got) != 1 || got[0] != "a" {
+			t.Errorf("expected [a], got %v", got)
+		}
+		if _, ok := updatedItem["ns"]; ok {
+			t.Errorf("expected emptied set ns to be removed, got %v", updatedItem["ns"].NS)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		item := map[string]*AttributeValue{
+			"s":  {S: stringPtr("text")},
+			"n":  {N: stringPtr("1")},
+			"ss": {SS: []string{"a"}},
+			"m":  {M: map[string]*AttributeValue{"n": {N: stringPtr("1")}}},
+		}
+		for _, expr := range []string{
+			"ADD s :one",
+			"ADD n :ss",
+			"ADD ss :ns",
+			"ADD x :s",
+			"ADD m.n :one",
+			"DELETE s :ss",
+			"DELETE n :one",
+			"DELETE ss :ns",
+			"DELETE ss",
+		} {
+			if _, err := Update(item, expr, nil, values); err == nil {
+				t.Errorf("expected error for %q, got no error", expr)
+			}
+		}
+	})
+}
+
+func TestUpdatedAttributes(t *testing.T) {
+	item := map[string]*AttributeValue{
+		"id":    {S: stringPtr("1")},
+		"count": {N: stringPtr("1")},
+		"info": {M: map[string]*AttributeValue{
+			"name": {S: stringPtr("a")},
+			"tags": {L: []*AttributeValue{{S: stringPtr("x")}, {S: stringPtr("y")}, {S: stringPtr("z")}}},
+		}},
+	}
+
+	update, err := ParseUpdateExpression("SET info.tags[2] = :v, info.tags[0] = :v ADD #c :one REMOVE missing", map[string]string{"#c": "count"}, map[string]*AttributeValue{
+		":v":   {S: stringPtr("new")},
+		":one": {N: stringPtr("1")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := update.UpdatedAttributes(item)
+	expected := map[string]*AttributeValue{
+		"count": {N: stringPtr("1")},
+		"info": {M: map[string]*AttributeValue{
+			"tags": {L: []*AttributeValue{{S: stringPtr("x")}, {S: stringPtr("z")}}},
+		}},
+	}
+	if !EqualAttributeValues(&AttributeValue{M: old}, &AttributeValue{M: expected}) {
+		t.Errorf("expected count and info.tags [x z], got %v", old)
+	}
+}
+
+func TestProjectionExpression(t *testing.T) {
+	item := map[string]*AttributeValue{
+		"id":    {S: stringPtr("1")},
+		"title": {S: stringPtr("Dune")},
+		"info": {M: map[string]*AttributeValue{
+			"year":    {N: stringPtr("1965")},
+			"authors": {L: []*AttributeValue{{S: stringPtr("Frank Herbert")}}},
+		}},
+		"ratings": {L: []*AttributeValue{{N: stringPtr("5")}, {N: stringPtr("4")}}},
+	}
+
+	t.Run("Top-level and nested paths", func(t *testing.T) {
+		projection, err := ParseProjectionExpression("title, #i.authors[0], ratings[1], missing", map[string]string{"#i": "info"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := map[string]*AttributeValue{
+			"title": {S: stringPtr("Dune")},
+			"info": {M: map[string]*AttributeValue{
+				"authors": {L: []*AttributeValue{{S: stringPtr("Frank Herbert")}}},
+			}},
+			"ratings": {L: []*AttributeValue{{N: stringPtr("4")}}},
+		}
+		got := projection.Apply(item)
+		if !EqualAttributeValues(&AttributeValue{M: got}, &AttributeValue{M: expected}) {
+			t.Errorf("expected title, info.authors[0] and ratings[1], got %v", got)
+		}
+	})
+
+	t.Run("Nil projection keeps the item", func(t *testing.T) {
+		var projection *Projection
+		if got := projection.Apply(item); len(got) != len(item) {
+			t.Errorf("expected the whole item, got %v", got)
+		}
+	})
+
+	t.Run("Invalid expressions", func(t *testing.T) {
+		for _, expr := range []string{"", "title,", "info, info.year", "ratings[0], ratings", "#missing", "title = :v"} {
+			if _, err := ParseProjectionExpression(expr, nil); err == nil {
+				t.Errorf("expected error for %q, got no error", expr)
+			}
+		}
+	})
+}
@@ -0,0 +1,163 @@
+package expression
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Key condition operators.
+const (
+	KeyConditionEqual        = "="
+	KeyConditionLess         = "<"
+	KeyConditionLessEqual    = "<="
+	KeyConditionGreater      = ">"
+	KeyConditionGreaterEqual = ">="
+	KeyConditionBetween      = "BETWEEN"
+	KeyConditionBeginsWith   = "begins_with"
+)
+
+// KeyCondition is a single condition on a key attribute taken from a
+// KeyConditionExpression, such as "id = :id" or "ts BETWEEN :lo AND :hi".
+// BETWEEN carries two values, every other operator carries one.
+type KeyCondition struct {
+	AttributeName string
+	Operator      string
+	Values        []*AttributeValue
+}
+
+// ParseKeyConditionExpression parses a KeyConditionExpression into its
+// conditions. A valid expression holds one condition, or two joined by AND;
+// deciding which one applies to the hash key is left to the caller, which
+// knows the table's key schema. Attribute names may be given as #name
+// placeholders resolved through names.
+func ParseKeyConditionExpression(expr string, names map[string]string, values map[string]*AttributeValue) ([]*KeyCondition, error) {
+	p, err := newParser(expr, names, values)
+	if err != nil {
+		return nil, err
+	}
+
+	first, err := p.parseKeyCondition()
+	if err != nil {
+		return nil, err
+	}
+	conditions := []*KeyCondition{first}
+
+	if p.peekKeyword("AND") {
+		p.next()
+		second, err := p.parseKeyCondition()
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, second)
+	}
+
+	if err := p.expectEOF(); err != nil {
+		return nil, err
+	}
+	return conditions, nil
+}
+
+func (p *parser) parseKeyCondition() (*KeyCondition, error) {
+	if p.peekKeyword(KeyConditionBeginsWith) && p.tokens[p.pos+1].kind == tokenLParen {
+		p.next()
+		p.next()
+		name, err := p.attributeName()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenComma); err != nil {
+			return nil, err
+		}
+		prefix, err := p.value(p.next())
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(tokenRParen); err != nil {
+			return nil, err
+		}
+		return &KeyCondition{AttributeName: name, Operator: KeyConditionBeginsWith, Values: []*AttributeValue{prefix}}, nil
+	}
+
+	name, err := p.attributeName()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peekKeyword("BETWEEN") {
+		p.next()
+		lower, err := p.value(p.next())
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectKeyword("AND"); err != nil {
+			return nil, err
+		}
+		upper, err := p.value(p.next())
+		if err != nil {
+			return nil, err
+		}
+		return &KeyCondition{AttributeName: name, Operator: KeyConditionBetween, Values: []*AttributeValue{lower, upper}}, nil
+	}
+
+	op, err := p.expect(tokenComparator)
+	if err != nil {
+		return nil, err
+	}
+	if op.text == "<>" {
+		return nil, p.errorf(op, "operator <> is not supported in a key condition")
+	}
+	val, err := p.value(p.next())
+	if err != nil {
+		return nil, err
+	}
+	return &KeyCondition{AttributeName: name, Operator: op.text, Values: []*AttributeValue{val}}, nil
+}
+
+// Matches reports whether an attribute value satisfies the condition.
+func (c *KeyCondition) Matches(v *AttributeValue) (bool, error) {
+	if v == nil {
+		return false, nil
+	}
+
+	if c.Operator == KeyConditionBeginsWith {
+		switch GetAttributeValueType(v) {
+		case "S":
+			if c.Values[0].S == nil {
+				return false, fmt.Errorf("begins_with operand must be a string")
+			}
+			return strings.HasPrefix(*v.S, *c.Values[0].S), nil
+		case "B":
+			if c.Values[0].B == nil {
+				return false, fmt.Errorf("begins_with operand must be binary")
+			}
+			return strings.HasPrefix(string(v.B), string(c.Values[0].B)), nil
+		default:
+			return false, fmt.Errorf("begins_with is not supported for type %s", GetAttributeValueType(v))
+		}
+	}
+
+	cmp, err := CompareAttributeValues(v, c.Values[0])
+	if err != nil {
+		return false, err
+	}
+	switch c.Operator {
+	case KeyConditionEqual:
+		return cmp == 0, nil
+	case KeyConditionLess:
+		return cmp < 0, nil
+	case KeyConditionLessEqual:
+		return cmp <= 0, nil
+	case KeyConditionGreater:
+		return cmp > 0, nil
+	case KeyConditionGreaterEqual:
+		return cmp >= 0, nil
+	case KeyConditionBetween:
+		upper, err := CompareAttributeValues(v, c.Values[1])
+		if err != nil {
+			return false, err
+		}
+		return cmp >= 0 && upper <= 0, nil
+	default:
+		return false, fmt.Errorf("unsupported key condition operator: %s", c.Operator)
+	}
+}
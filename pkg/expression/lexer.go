@@ -0,0 +1,303 @@
+package expression
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenValueRef
+	tokenNameRef
+	tokenString
+	tokenNumber
+	tokenComparator
+	tokenLParen
+	tokenRParen
+	tokenComma
+	tokenDot
+	tokenLBracket
+	tokenRBracket
+	tokenPlus
+	tokenMinus
+)
+
+func (k tokenKind) String() string {
+	switch k {
+	case tokenEOF:
+		return "end of expression"
+	case tokenIdent:
+		return "identifier"
+	case tokenValueRef:
+		return "expression attribute value"
+	case tokenNameRef:
+		return "expression attribute name"
+	case tokenString:
+		return "string literal"
+	case tokenNumber:
+		return "number literal"
+	case tokenComparator:
+		return "comparator"
+	case tokenLParen:
+		return "'('"
+	case tokenRParen:
+		return "')'"
+	case tokenComma:
+		return "','"
+	case tokenDot:
+		return "'.'"
+	case tokenLBracket:
+		return "'['"
+	case tokenRBracket:
+		return "']'"
+	case tokenPlus:
+		return "'+'"
+	case tokenMinus:
+		return "'-'"
+	default:
+		return "unknown token"
+	}
+}
+
+// token is a single lexical element of an expression. pos is the byte offset
+// of the token in the original input and is used for error reporting.
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// SyntaxError describes a malformed expression and where it went wrong.
+type SyntaxError struct {
+	Pos     int
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at position %d: %s", e.Pos, e.Message)
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// tokenize splits an expression into tokens. The final token is always tokenEOF.
+func tokenize(input string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(input) {
+		c := input[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, token{kind: tokenLParen, text: "(", pos: i})
+			i++
+		case c == ')':
+			tokens = append(tokens, token{kind: tokenRParen, text: ")", pos: i})
+			i++
+		case c == ',':
+			tokens = append(tokens, token{kind: tokenComma, text: ",", pos: i})
+			i++
+		case c == '.':
+			tokens = append(tokens, token{kind: tokenDot, text: ".", pos: i})
+			i++
+		case c == '[':
+			tokens = append(tokens, token{kind: tokenLBracket, text: "[", pos: i})
+			i++
+		case c == ']':
+			tokens = append(tokens, token{kind: tokenRBracket, text: "]", pos: i})
+			i++
+		case c == '+':
+			tokens = append(tokens, token{kind: tokenPlus, text: "+", pos: i})
+			i++
+		case c == '-':
+			tokens = append(tokens, token{kind: tokenMinus, text: "-", pos: i})
+			i++
+		case c == '=':
+			tokens = append(tokens, token{kind: tokenComparator, text: "=", pos: i})
+			i++
+		case c == '<':
+			if i+1 < len(input) && (input[i+1] == '=' || input[i+1] == '>') {
+				tokens = append(tokens, token{kind: tokenComparator, text: input[i : i+2], pos: i})
+				i += 2
+			} else {
+				tokens = append(tokens, token{kind: tokenComparator, text: "<", pos: i})
+				i++
+			}
+		case c == '>':
+			if i+1 < len(input) && input[i+1] == '=' {
+				tokens = append(tokens, token{kind: tokenComparator, text: ">=", pos: i})
+				i += 2
+			} else {
+				tokens = append(tokens, token{kind: tokenComparator, text: ">", pos: i})
+				i++
+			}
+		case c == ':' || c == '#':
+			start := i
+			i++
+			for i < len(input) && isIdentPart(input[i]) {
+				i++
+			}
+			if i == start+1 {
+				return nil, &SyntaxError{Pos: start, Message: fmt.Sprintf("expected a name after '%c'", c)}
+			}
+			kind := tokenValueRef
+			if c == '#' {
+				kind = tokenNameRef
+			}
+			tokens = append(tokens, token{kind: kind, text: input[start:i], pos: start})
+		case c == '"':
+			start := i
+			i++
+			for i < len(input) && input[i] != '"' {
+				i++
+			}
+			if i >= len(input) {
+				return nil, &SyntaxError{Pos: start, Message: "unterminated string literal"}
+			}
+			i++
+			tokens = append(tokens, token{kind: tokenString, text: input[start:i], pos: start})
+		case isDigit(c):
+			start := i
+			for i < len(input) && (isDigit(input[i]) || input[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: input[start:i], pos: start})
+		case isIdentStart(c):
+			start := i
+			for i < len(input) && isIdentPart(input[i]) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: input[start:i], pos: start})
+		default:
+			return nil, &SyntaxError{Pos: i, Message: fmt.Sprintf("unexpected character %q", c)}
+		}
+	}
+	tokens = append(tokens, token{kind: tokenEOF, pos: len(input)})
+	return tokens, nil
+}
+
+// parser is a small recursive-descent helper over a token stream.
+type parser struct {
+	tokens []token
+	pos    int
+	names  map[string]string
+	values map[string]*AttributeValue
+}
+
+func newParser(input string, names map[string]string, values map[string]*AttributeValue) (*parser, error) {
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+	for ref, v := range values {
+		if err := validateNumbers(v); err != nil {
+			return nil, fmt.Errorf("invalid expression attribute value %s: %w", ref, err)
+		}
+	}
+	return &parser{tokens: tokens, names: names, values: values}, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// peekKeyword reports whether the next token is the given keyword (case-insensitive).
+func (p *parser) peekKeyword(keyword string) bool {
+	t := p.peek()
+	return t.kind == tokenIdent && strings.EqualFold(t.text, keyword)
+}
+
+func (p *parser) expect(kind tokenKind) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, p.errorf(t, "expected %s, got %s", kind, describeToken(t))
+	}
+	return t, nil
+}
+
+func (p *parser) expectKeyword(keyword string) error {
+	t := p.next()
+	if t.kind != tokenIdent || !strings.EqualFold(t.text, keyword) {
+		return p.errorf(t, "expected %s, got %s", keyword, describeToken(t))
+	}
+	return nil
+}
+
+func (p *parser) expectEOF() error {
+	if t := p.peek(); t.kind != tokenEOF {
+		return p.errorf(t, "unexpected %s", describeToken(t))
+	}
+	return nil
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return &SyntaxError{Pos: t.pos, Message: fmt.Sprintf(format, args...)}
+}
+
+// value resolves a value token, either an expression attribute value placeholder
+// or an inline literal, to an AttributeValue.
+func (p *parser) value(t token) (*AttributeValue, error) {
+	switch t.kind {
+	case tokenValueRef:
+		val, ok := p.values[t.text]
+		if !ok {
+			return nil, fmt.Errorf("expression attribute value not found: %s", t.text)
+		}
+		return val, nil
+	case tokenString, tokenNumber:
+		return StringToAttributeValue(t.text)
+	default:
+		return nil, p.errorf(t, "expected a value, got %s", describeToken(t))
+	}
+}
+
+// attributeName reads an attribute name, either written out or as an
+// expression attribute name placeholder such as #n.
+func (p *parser) attributeName() (string, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenIdent:
+		return t.text, nil
+	case tokenNameRef:
+		return resolveName(t.text, p.names)
+	default:
+		return "", p.errorf(t, "expected an attribute name, got %s", describeToken(t))
+	}
+}
+
+// resolveName looks up an expression attribute name placeholder.
+func resolveName(placeholder string, names map[string]string) (string, error) {
+	name, ok := names[placeholder]
+	if !ok {
+		return "", fmt.Errorf("expression attribute name not found: %s", placeholder)
+	}
+	return name, nil
+}
+
+func describeToken(t token) string {
+	if t.kind == tokenEOF {
+		return t.kind.String()
+	}
+	return fmt.Sprintf("%q", t.text)
+}
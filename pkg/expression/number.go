@@ -0,0 +1,153 @@
+package expression
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// maxNumberDigits is the number of significant digits DynamoDB keeps for a number.
+const maxNumberDigits = 38
+
+// addNumbers returns a + b, or a - b when subtract is set. The arithmetic is
+// exact; a result DynamoDB could not store, with more than 38 significant
+// digits or out of range, is an error, as it is in DynamoDB.
+func addNumbers(a, b string, subtract bool) (*AttributeValue, error) {
+	x, err := parseNumber(a)
+	if err != nil {
+		return nil, err
+	}
+	y, err := parseNumber(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var sum big.Rat
+	if subtract {
+		sum.Sub(x, y)
+	} else {
+		sum.Add(x, y)
+	}
+
+	result := formatNumber(&sum)
+	if _, _, _, err := ParseDecimal(result); err != nil {
+		return nil, fmt.Errorf("number overflow: %w", err)
+	}
+	return &AttributeValue{N: &result}, nil
+}
+
+// ParseDecimal splits the string form of a number into its sign, its
+// significant digits without leading or trailing zeros and the exponent exp
+// such that the value is 0.digits x 10^exp. Zero has no digits. It is the
+// one check of the numbers DynamoDB accepts: a decimal of at most 38
+// significant digits, with a magnitude from 1E-130 to 9.99E+125.
+func ParseDecimal(n string) (negative bool, digits string, exp int, err error) {
+	s := n
+	if strings.HasPrefix(s, "-") {
+		negative = true
+		s = s[1:]
+	} else if strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+
+	mantissa := s
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		mantissa = s[:i]
+		e, convErr := strconv.Atoi(s[i+1:])
+		if convErr != nil {
+			return false, "", 0, fmt.Errorf("invalid number: %s", n)
+		}
+		exp = e
+	}
+
+	intPart, fracPart := mantissa, ""
+	if i := strings.IndexByte(mantissa, '.'); i >= 0 {
+		intPart, fracPart = mantissa[:i], mantissa[i+1:]
+	}
+	if intPart == "" && fracPart == "" || !isDigits(intPart) || !isDigits(fracPart) {
+		return false, "", 0, fmt.Errorf("invalid number: %s", n)
+	}
+
+	all := intPart + fracPart
+	exp += len(intPart)
+	trimmed := strings.TrimLeft(all, "0")
+	exp -= len(all) - len(trimmed)
+	digits = strings.TrimRight(trimmed, "0")
+	if digits == "" {
+		return false, "", 0, nil
+	}
+	if len(digits) > maxNumberDigits {
+		return false, "", 0, fmt.Errorf("number %s exceeds 38 digits of precision", n)
+	}
+	// DynamoDB numbers range from 1E-130 to 9.99E+125 in magnitude.
+	if exp < -129 || exp > 126 {
+		return false, "", 0, fmt.Errorf("number %s is out of range", n)
+	}
+	return negative, digits, exp, nil
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// validateNumbers checks every number in v, including the elements of
+// number sets and the values nested in lists and maps.
+func validateNumbers(v *AttributeValue) error {
+	if v == nil {
+		return nil
+	}
+	if v.N != nil {
+		if _, _, _, err := ParseDecimal(*v.N); err != nil {
+			return err
+		}
+	}
+	for _, n := range v.NS {
+		if _, _, _, err := ParseDecimal(n); err != nil {
+			return err
+		}
+	}
+	for _, elem := range v.L {
+		if err := validateNumbers(elem); err != nil {
+			return err
+		}
+	}
+	for _, elem := range v.M {
+		if err := validateNumbers(elem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatNumber writes a number parsed from decimal strings back out in plain
+// decimal notation, with no trailing zeros after the point.
+func formatNumber(r *big.Rat) string {
+	if r.IsInt() {
+		return r.Num().String()
+	}
+
+	// The denominator of a sum of decimals is 2^i * 5^j, so max(i, j)
+	// fractional digits represent the value exactly.
+	denom := new(big.Int).Set(r.Denom())
+	twos, fives := 0, 0
+	for two := big.NewInt(2); new(big.Int).Mod(denom, two).Sign() == 0; twos++ {
+		denom.Quo(denom, two)
+	}
+	for five := big.NewInt(5); new(big.Int).Mod(denom, five).Sign() == 0; fives++ {
+		denom.Quo(denom, five)
+	}
+	scale := twos
+	if fives > scale {
+		scale = fives
+	}
+
+	s := r.FloatString(scale)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
@@ -0,0 +1,305 @@
+package expression
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// pathElement is one step of a document path: a map key or a list index.
+type pathElement struct {
+	name    string
+	index   int
+	isIndex bool
+}
+
+// documentPath addresses an attribute, or a value nested inside map and list
+// attributes, such as "a.b[2].c". The first element is always a name.
+type documentPath []pathElement
+
+func (p documentPath) String() string {
+	var sb strings.Builder
+	for i, elem := range p {
+		switch {
+		case elem.isIndex:
+			fmt.Fprintf(&sb, "[%d]", elem.index)
+		case i > 0:
+			sb.WriteString(".")
+			sb.WriteString(elem.name)
+		default:
+			sb.WriteString(elem.name)
+		}
+	}
+	return sb.String()
+}
+
+// get returns the value at the path, or nil if any step of it is missing.
+func (p documentPath) get(item map[string]*AttributeValue) *AttributeValue {
+	cur := item[p[0].name]
+	for _, elem := range p[1:] {
+		cur = child(cur, elem)
+		if cur == nil {
+			return nil
+		}
+	}
+	return cur
+}
+
+// set stores v at the path. Every step but the last must already exist. An
+// index past the end of a list appends to the list.
+func (p documentPath) set(item map[string]*AttributeValue, v *AttributeValue) error {
+	if len(p) == 1 {
+		item[p[0].name] = v
+		return nil
+	}
+
+	parent := p[:len(p)-1].get(item)
+	last := p[len(p)-1]
+	switch {
+	case parent == nil:
+		return fmt.Errorf("the document path %s is invalid for update: %s does not exist", p, p[:len(p)-1])
+	case last.isIndex && parent.L != nil:
+		if last.index < len(parent.L) {
+			parent.L[last.index] = v
+		} else {
+			parent.L = append(parent.L, v)
+		}
+	case !last.isIndex && parent.M != nil:
+		parent.M[last.name] = v
+	default:
+		return fmt.Errorf("the document path %s is invalid for update: %s is of type %s", p, p[:len(p)-1], GetAttributeValueType(parent))
+	}
+	return nil
+}
+
+// remove deletes the value at the path. Removing a missing value is a no-op,
+// and removing a list element shifts the elements after it down.
+func (p documentPath) remove(item map[string]*AttributeValue) {
+	if len(p) == 1 {
+		delete(item, p[0].name)
+		return
+	}
+
+	parent := p[:len(p)-1].get(item)
+	if parent == nil {
+		return
+	}
+	last := p[len(p)-1]
+	switch {
+	case last.isIndex && parent.L != nil:
+		if last.index < len(parent.L) {
+			parent.L = append(parent.L[:last.index], parent.L[last.index+1:]...)
+		}
+	case !last.isIndex && parent.M != nil:
+		delete(parent.M, last.name)
+	}
+}
+
+// compareDocumentPaths orders paths step by step, list indexes by their
+// value and map keys by their bytes. A path sorts before the paths nested
+// inside it.
+func compareDocumentPaths(a, b documentPath) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		switch {
+		case a[i].isIndex && b[i].isIndex:
+			if a[i].index != b[i].index {
+				return a[i].index - b[i].index
+			}
+		case a[i].isIndex != b[i].isIndex:
+			if a[i].isIndex {
+				return -1
+			}
+			return 1
+		default:
+			if c := strings.Compare(a[i].name, b[i].name); c != 0 {
+				return c
+			}
+		}
+	}
+	return len(a) - len(b)
+}
+
+// copyValue returns a deep copy of v, so that a value copied from one path
+// to another is not shared between them.
+func copyValue(v *AttributeValue) *AttributeValue {
+	if v == nil {
+		return nil
+	}
+	c := *v
+	if v.B != nil {
+		c.B = append([]byte{}, v.B...)
+	}
+	if v.SS != nil {
+		c.SS = append([]string{}, v.SS...)
+	}
+	if v.NS != nil {
+		c.NS = append([]string{}, v.NS...)
+	}
+	if v.BS != nil {
+		c.BS = make([][]byte, len(v.BS))
+		for i, b := range v.BS {
+			c.BS[i] = append([]byte{}, b...)
+		}
+	}
+	if v.M != nil {
+		c.M = make(map[string]*AttributeValue, len(v.M))
+		for k, elem := range v.M {
+			c.M[k] = copyValue(elem)
+		}
+	}
+	if v.L != nil {
+		c.L = make([]*AttributeValue, len(v.L))
+		for i, elem := range v.L {
+			c.L[i] = copyValue(elem)
+		}
+	}
+	return &c
+}
+
+// CopyItem returns a deep copy of item, which Apply can change without
+// changing item. The copy of a nil item is nil.
+func CopyItem(item map[string]*AttributeValue) map[string]*AttributeValue {
+	if item == nil {
+		return nil
+	}
+	c := make(map[string]*AttributeValue, len(item))
+	for name, v := range item {
+		c[name] = copyValue(v)
+	}
+	return c
+}
+
+// child steps from v into a map key or list index, returning nil if v has no
+// such child.
+func child(v *AttributeValue, elem pathElement) *AttributeValue {
+	if v == nil {
+		return nil
+	}
+	if elem.isIndex {
+		if v.L == nil || elem.index >= len(v.L) {
+			return nil
+		}
+		return v.L[elem.index]
+	}
+	if v.M == nil {
+		return nil
+	}
+	return v.M[elem.name]
+}
+
+// parseDocumentPath parses a document path: an attribute name followed by
+// any number of ".name" and "[index]" steps.
+func (p *parser) parseDocumentPath() (documentPath, error) {
+	name, err := p.attributeName()
+	if err != nil {
+		return nil, err
+	}
+	path := documentPath{{name: name}}
+
+	for {
+		switch p.peek().kind {
+		case tokenDot:
+			p.next()
+			name, err := p.attributeName()
+			if err != nil {
+				return nil, err
+			}
+			path = append(path, pathElement{name: name})
+		case tokenLBracket:
+			p.next()
+			t, err := p.expect(tokenNumber)
+			if err != nil {
+				return nil, err
+			}
+			index, err := strconv.Atoi(t.text)
+			if err != nil {
+				return nil, p.errorf(t, "invalid list index %s", t.text)
+			}
+			if _, err := p.expect(tokenRBracket); err != nil {
+				return nil, err
+			}
+			path = append(path, pathElement{index: index, isIndex: true})
+		default:
+			return path, nil
+		}
+	}
+}
+
+// projectItem copies the values addressed by paths out of item, keeping each
+// one at its place in the document. Elements of a projected list are packed
+// together in index order, and paths that address nothing are left out.
+func projectItem(item map[string]*AttributeValue, paths []documentPath) map[string]*AttributeValue {
+	result := make(map[string]*AttributeValue)
+	for name, rests := range groupByName(paths) {
+		if v := project(item[name], rests); v != nil {
+			result[name] = v
+		}
+	}
+	return result
+}
+
+// project copies the parts of v addressed by the remaining path steps. An
+// empty remainder selects the whole of v.
+func project(v *AttributeValue, paths []documentPath) *AttributeValue {
+	if v == nil {
+		return nil
+	}
+	for _, p := range paths {
+		if len(p) == 0 {
+			return v
+		}
+	}
+
+	switch {
+	case v.M != nil && !paths[0][0].isIndex:
+		m := make(map[string]*AttributeValue)
+		for name, rests := range groupByName(paths) {
+			if child := project(v.M[name], rests); child != nil {
+				m[name] = child
+			}
+		}
+		if len(m) > 0 {
+			return &AttributeValue{M: m}
+		}
+	case v.L != nil && paths[0][0].isIndex:
+		byIndex := make(map[int][]documentPath)
+		var indexes []int
+		for _, p := range paths {
+			if !p[0].isIndex {
+				continue
+			}
+			if _, ok := byIndex[p[0].index]; !ok {
+				indexes = append(indexes, p[0].index)
+			}
+			byIndex[p[0].index] = append(byIndex[p[0].index], p[1:])
+		}
+		sort.Ints(indexes)
+
+		var l []*AttributeValue
+		for _, i := range indexes {
+			if i >= len(v.L) {
+				continue
+			}
+			if child := project(v.L[i], byIndex[i]); child != nil {
+				l = append(l, child)
+			}
+		}
+		if len(l) > 0 {
+			return &AttributeValue{L: l}
+		}
+	}
+	return nil
+}
+
+// groupByName groups paths that start with a name step by that name, keeping
+// the remaining steps of each.
+func groupByName(paths []documentPath) map[string][]documentPath {
+	groups := make(map[string][]documentPath)
+	for _, p := range paths {
+		if !p[0].isIndex {
+			groups[p[0].name] = append(groups[p[0].name], p[1:])
+		}
+	}
+	return groups
+}
@@ -0,0 +1,65 @@
+package expression
+
+import "fmt"
+
+// Projection is a parsed projection expression: the attributes, or values
+// nested inside them, that a read returns.
+type Projection struct {
+	paths []documentPath
+}
+
+// ParseProjectionExpression parses a comma-separated list of document paths
+// such as "title, #info.authors[0], ratings". Every #name placeholder must be
+// present in names. As in DynamoDB, paths may not overlap.
+func ParseProjectionExpression(expr string, names map[string]string) (*Projection, error) {
+	p, err := newParser(expr, names, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	projection := &Projection{}
+	for {
+		path, err := p.parseDocumentPath()
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range projection.paths {
+			if overlaps(path, other) {
+				return nil, fmt.Errorf("two document paths overlap with each other: %s and %s", other, path)
+			}
+		}
+		projection.paths = append(projection.paths, path)
+
+		if p.peek().kind != tokenComma {
+			break
+		}
+		p.next()
+	}
+	if err := p.expectEOF(); err != nil {
+		return nil, err
+	}
+	return projection, nil
+}
+
+// Apply returns the projected parts of item. A nil projection returns the
+// item unchanged.
+func (pr *Projection) Apply(item map[string]*AttributeValue) map[string]*AttributeValue {
+	if pr == nil || item == nil {
+		return item
+	}
+	return projectItem(item, pr.paths)
+}
+
+// overlaps reports whether one path is the same as, or nested inside, the
+// other.
+func overlaps(a, b documentPath) bool {
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,481 @@
+package expression
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Update clauses.
+const (
+	UpdateSet    = "SET"
+	UpdateRemove = "REMOVE"
+	UpdateAdd    = "ADD"
+	UpdateDelete = "DELETE"
+)
+
+// Update functions.
+const (
+	FunctionIfNotExists = "if_not_exists"
+	FunctionListAppend  = "list_append"
+)
+
+// updateAction is a single action of an update expression, such as
+// "a.b = :v" in a SET clause or "tags :t" in an ADD clause.
+type updateAction struct {
+	clause string
+	path   documentPath
+	value  updateOperand
+}
+
+// updateOperand is the value side of an update action. It is evaluated
+// against the item as it was before the update.
+type updateOperand interface {
+	evaluate(item map[string]*AttributeValue) (*AttributeValue, error)
+}
+
+// termOperand is a plain value or document path.
+type termOperand struct {
+	operand operand
+}
+
+func (o *termOperand) evaluate(item map[string]*AttributeValue) (*AttributeValue, error) {
+	v := o.operand.resolve(item)
+	if v == nil {
+		return nil, fmt.Errorf("the provided expression refers to an attribute that does not exist in the item: %v", o.operand)
+	}
+	return v, nil
+}
+
+// ifNotExistsOperand is if_not_exists(path, fallback): the value at path if
+// there is one, otherwise the fallback.
+type ifNotExistsOperand struct {
+	path     documentPath
+	fallback updateOperand
+}
+
+func (o *ifNotExistsOperand) evaluate(item map[string]*AttributeValue) (*AttributeValue, error) {
+	if v := o.path.get(item); v != nil {
+		return v, nil
+	}
+	return o.fallback.evaluate(item)
+}
+
+// listAppendOperand is list_append(a, b): the elements of list a followed by
+// those of list b.
+type listAppendOperand struct {
+	first, second updateOperand
+}
+
+func (o *listAppendOperand) evaluate(item map[string]*AttributeValue) (*AttributeValue, error) {
+	first, err := o.first.evaluate(item)
+	if err != nil {
+		return nil, err
+	}
+	second, err := o.second.evaluate(item)
+	if err != nil {
+		return nil, err
+	}
+	if first.L == nil || second.L == nil {
+		return nil, fmt.Errorf("invalid operands for %s: expected two lists, got %s and %s", FunctionListAppend, GetAttributeValueType(first), GetAttributeValueType(second))
+	}
+
+	list := make([]*AttributeValue, 0, len(first.L)+len(second.L))
+	list = append(list, first.L...)
+	list = append(list, second.L...)
+	return &AttributeValue{L: list}, nil
+}
+
+// arithmeticOperand is "left + right" or "left - right" on numbers.
+type arithmeticOperand struct {
+	subtract    bool
+	left, right updateOperand
+}
+
+func (o *arithmeticOperand) evaluate(item map[string]*AttributeValue) (*AttributeValue, error) {
+	left, err := o.left.evaluate(item)
+	if err != nil {
+		return nil, err
+	}
+	right, err := o.right.evaluate(item)
+	if err != nil {
+		return nil, err
+	}
+	if left.N == nil || right.N == nil {
+		return nil, fmt.Errorf("invalid operands for arithmetic: expected two numbers, got %s and %s", GetAttributeValueType(left), GetAttributeValueType(right))
+	}
+	return addNumbers(*left.N, *right.N, o.subtract)
+}
+
+// UpdateExpression is a parsed update expression.
+type UpdateExpression struct {
+	actions []*updateAction
+}
+
+// Update applies an update expression to an item. Attribute names written as
+// #name placeholders are resolved through expressionAttributeNames.
+func Update(item map[string]*AttributeValue, updateExpression string, expressionAttributeNames map[string]string, expressionAttributeValues map[string]*AttributeValue) (map[string]*AttributeValue, error) {
+	expr, err := ParseUpdateExpression(updateExpression, expressionAttributeNames, expressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+	if err := expr.Apply(item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// ParseUpdateExpression parses an update expression made of SET, REMOVE, ADD
+// and DELETE clauses, each holding a comma-separated list of actions, such as
+// "SET a = :a, #m.inner[2] = :v REMOVE old".
+func ParseUpdateExpression(expr string, names map[string]string, values map[string]*AttributeValue) (*UpdateExpression, error) {
+	p, err := newParser(expr, names, values)
+	if err != nil {
+		return nil, err
+	}
+
+	update := &UpdateExpression{}
+	seen := make(map[string]bool)
+	for p.peek().kind != tokenEOF {
+		t := p.next()
+		clause := strings.ToUpper(t.text)
+		if t.kind != tokenIdent || !isUpdateClause(clause) {
+			return nil, p.errorf(t, "expected SET, REMOVE, ADD or DELETE, got %s", describeToken(t))
+		}
+		if seen[clause] {
+			return nil, p.errorf(t, "the %s clause may only appear once", clause)
+		}
+		seen[clause] = true
+
+		for {
+			action, err := p.parseUpdateAction(clause)
+			if err != nil {
+				return nil, err
+			}
+			for _, other := range update.actions {
+				if overlaps(action.path, other.path) {
+					return nil, fmt.Errorf("two document paths overlap with each other: %s and %s", other.path, action.path)
+				}
+			}
+			update.actions = append(update.actions, action)
+			if p.peek().kind != tokenComma {
+				break
+			}
+			p.next()
+		}
+	}
+
+	if len(update.actions) == 0 {
+		return nil, p.errorf(p.peek(), "expected SET, REMOVE, ADD or DELETE, got %s", describeToken(p.peek()))
+	}
+	return update, nil
+}
+
+// Modifies reports whether any action of the update writes to the top-level
+// attribute name, or to a value nested inside it.
+func (u *UpdateExpression) Modifies(name string) bool {
+	for _, action := range u.actions {
+		if action.path[0].name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdatedAttributes returns the values of item at the paths written by the
+// update. Given the item from before or after Apply, it gives DynamoDB's
+// UPDATED_OLD or UPDATED_NEW attributes.
+func (u *UpdateExpression) UpdatedAttributes(item map[string]*AttributeValue) map[string]*AttributeValue {
+	paths := make([]documentPath, 0, len(u.actions))
+	for _, action := range u.actions {
+		paths = append(paths, action.path)
+	}
+	return projectItem(item, paths)
+}
+
+func isUpdateClause(s string) bool {
+	return s == UpdateSet || s == UpdateRemove || s == UpdateAdd || s == UpdateDelete
+}
+
+func (p *parser) parseUpdateAction(clause string) (*updateAction, error) {
+	path, err := p.parseDocumentPath()
+	if err != nil {
+		return nil, err
+	}
+	action := &updateAction{clause: clause, path: path}
+
+	switch clause {
+	case UpdateSet:
+		if t := p.next(); t.kind != tokenComparator || t.text != "=" {
+			return nil, p.errorf(t, "expected '=', got %s", describeToken(t))
+		}
+		action.value, err = p.parseSetValue()
+	case UpdateAdd, UpdateDelete:
+		if len(path) > 1 {
+			return nil, p.errorf(p.peek(), "%s can only be used on top-level attributes, got %s", clause, path)
+		}
+		action.value, err = p.parseValueOperand()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return action, nil
+}
+
+// parseSetValue parses the right-hand side of a SET action: an operand,
+// optionally added to or subtracted from a second one.
+func (p *parser) parseSetValue() (updateOperand, error) {
+	left, err := p.parseUpdateOperand()
+	if err != nil {
+		return nil, err
+	}
+
+	kind := p.peek().kind
+	if kind != tokenPlus && kind != tokenMinus {
+		return left, nil
+	}
+	p.next()
+	right, err := p.parseUpdateOperand()
+	if err != nil {
+		return nil, err
+	}
+	return &arithmeticOperand{subtract: kind == tokenMinus, left: left, right: right}, nil
+}
+
+// parseUpdateOperand parses a value, a document path to copy from, or a call
+// to if_not_exists or list_append.
+func (p *parser) parseUpdateOperand() (updateOperand, error) {
+	if p.peekFunction() {
+		name := p.next()
+		p.next()
+
+		var fn updateOperand
+		switch strings.ToLower(name.text) {
+		case FunctionIfNotExists:
+			path, err := p.parseDocumentPath()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect(tokenComma); err != nil {
+				return nil, err
+			}
+			fallback, err := p.parseUpdateOperand()
+			if err != nil {
+				return nil, err
+			}
+			fn = &ifNotExistsOperand{path: path, fallback: fallback}
+		case FunctionListAppend:
+			first, err := p.parseUpdateOperand()
+			if err != nil {
+				return nil, err
+			}
+			if _, err := p.expect(tokenComma); err != nil {
+				return nil, err
+			}
+			second, err := p.parseUpdateOperand()
+			if err != nil {
+				return nil, err
+			}
+			fn = &listAppendOperand{first: first, second: second}
+		default:
+			return nil, p.errorf(name, "unknown function %q in update expression", name.text)
+		}
+
+		if _, err := p.expect(tokenRParen); err != nil {
+			return nil, err
+		}
+		return fn, nil
+	}
+
+	switch p.peek().kind {
+	case tokenIdent, tokenNameRef:
+		path, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		return &termOperand{operand: path}, nil
+	default:
+		return p.parseValueOperand()
+	}
+}
+
+func (p *parser) parseValueOperand() (updateOperand, error) {
+	v, err := p.value(p.next())
+	if err != nil {
+		return nil, err
+	}
+	return &termOperand{operand: &valueOperand{value: v}}, nil
+}
+
+// Apply applies the update to item in place. Every operand and path is
+// resolved against the item as it was before the update, so "SET a = b,
+// b = a" swaps the two attributes and "REMOVE l[1], l[2]" removes the second
+// and third elements of l.
+func (u *UpdateExpression) Apply(item map[string]*AttributeValue) error {
+	resolved := make([]*AttributeValue, len(u.actions))
+	for i, action := range u.actions {
+		if action.value == nil {
+			continue
+		}
+		v, err := action.value.evaluate(item)
+		if err != nil {
+			return err
+		}
+		resolved[i] = copyValue(v)
+	}
+
+	// Removals go last, the highest list indexes first, so that removing an
+	// element does not shift the ones the other actions address.
+	var removals []documentPath
+	for i, action := range u.actions {
+		var err error
+		switch action.clause {
+		case UpdateSet:
+			err = action.path.set(item, resolved[i])
+		case UpdateRemove:
+			removals = append(removals, action.path)
+		case UpdateAdd:
+			err = applyAdd(item, action.path, resolved[i])
+		case UpdateDelete:
+			err = applyDelete(item, action.path, resolved[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	sort.Slice(removals, func(i, j int) bool { return compareDocumentPaths(removals[i], removals[j]) > 0 })
+	for _, path := range removals {
+		path.remove(item)
+	}
+	return nil
+}
+
+// applyAdd implements ADD: numbers are added to, sets are unioned with, and a
+// missing attribute is created with the given value.
+func applyAdd(item map[string]*AttributeValue, path documentPath, addValue *AttributeValue) error {
+	addType := GetAttributeValueType(addValue)
+	if !isSetType(addType) && addType != "N" {
+		return fmt.Errorf("invalid operand for ADD on %s: expected a number or a set, got %s", path, addType)
+	}
+
+	existing := path.get(item)
+	if existing == nil {
+		return path.set(item, addValue)
+	}
+	if existingType := GetAttributeValueType(existing); existingType != addType {
+		return fmt.Errorf("type mismatch for ADD on %s: the attribute is %s but the operand is %s", path, existingType, addType)
+	}
+
+	if addType == "N" {
+		result, err := addNumbers(*existing.N, *addValue.N, false)
+		if err != nil {
+			return err
+		}
+		return path.set(item, result)
+	}
+	return path.set(item, setUnion(existing, addValue))
+}
+
+// applyDelete implements DELETE, which removes the elements of a set from a
+// set attribute. A set left empty is removed, since DynamoDB has no empty sets.
+func applyDelete(item map[string]*AttributeValue, path documentPath, valuesToDelete *AttributeValue) error {
+	deleteType := GetAttributeValueType(valuesToDelete)
+	if !isSetType(deleteType) {
+		return fmt.Errorf("invalid operand for DELETE on %s: expected a set, got %s", path, deleteType)
+	}
+
+	existing := path.get(item)
+	if existing == nil {
+		// If attribute doesn't exist, nothing to delete from, so it's a no-op.
+		return nil
+	}
+	if existingType := GetAttributeValueType(existing); existingType != deleteType {
+		return fmt.Errorf("type mismatch for DELETE on %s: the attribute is %s but the operand is %s", path, existingType, deleteType)
+	}
+
+	remaining := setDifference(existing, valuesToDelete)
+	if setLen(remaining) == 0 {
+		path.remove(item)
+		return nil
+	}
+	return path.set(item, remaining)
+}
+
+func isSetType(t string) bool {
+	return t == "SS" || t == "NS" || t == "BS"
+}
+
+func setLen(v *AttributeValue) int {
+	return len(v.SS) + len(v.NS) + len(v.BS)
+}
+
+// setElements splits a set into one attribute value per element, so that
+// elements of every set type can be compared with EqualAttributeValues.
+func setElements(v *AttributeValue) []*AttributeValue {
+	var elems []*AttributeValue
+	for i := range v.SS {
+		elems = append(elems, &AttributeValue{S: &v.SS[i]})
+	}
+	for i := range v.NS {
+		elems = append(elems, &AttributeValue{N: &v.NS[i]})
+	}
+	for i := range v.BS {
+		elems = append(elems, &AttributeValue{B: v.BS[i]})
+	}
+	return elems
+}
+
+// newSet builds a set of the given type from single-element values.
+func newSet(setType string, elems []*AttributeValue) *AttributeValue {
+	set := &AttributeValue{}
+	switch setType {
+	case "SS":
+		set.SS = make([]string, 0, len(elems))
+		for _, e := range elems {
+			set.SS = append(set.SS, *e.S)
+		}
+	case "NS":
+		set.NS = make([]string, 0, len(elems))
+		for _, e := range elems {
+			set.NS = append(set.NS, *e.N)
+		}
+	case "BS":
+		set.BS = make([][]byte, 0, len(elems))
+		for _, e := range elems {
+			set.BS = append(set.BS, e.B)
+		}
+	}
+	return set
+}
+
+func setContains(elems []*AttributeValue, v *AttributeValue) bool {
+	for _, e := range elems {
+		if EqualAttributeValues(e, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// setUnion returns the elements of a followed by those of b that a lacks.
+func setUnion(a, b *AttributeValue) *AttributeValue {
+	elems := setElements(a)
+	for _, e := range setElements(b) {
+		if !setContains(elems, e) {
+			elems = append(elems, e)
+		}
+	}
+	return newSet(GetAttributeValueType(a), elems)
+}
+
+// setDifference returns the elements of a that b lacks.
+func setDifference(a, b *AttributeValue) *AttributeValue {
+	toRemove := setElements(b)
+	var elems []*AttributeValue
+	for _, e := range setElements(a) {
+		if !setContains(toRemove, e) {
+			elems = append(elems, e)
+		}
+	}
+	return newSet(GetAttributeValueType(a), elems)
+}
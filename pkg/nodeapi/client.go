@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"zagreb/pkg/expression"
@@ -28,31 +29,11 @@ func NewNodeClient(addr string) storage.Storage {
 	}
 }
 
+// doRequest calls an operation of the node, as described in protocol.go.
 func (c *NodeClient) doRequest(action string, reqBody interface{}, respBody interface{}) error {
-	requestPayload := map[string]interface{}{
-		"Action": action,
-	}
-
-	// Marshal the specific request body into the generic payload
-	// This is a bit hacky, but necessary to embed the specific request type
-	// into the generic map expected by the server.
-	jsonBytes, err := json.Marshal(reqBody)
-	if err != nil {
-		return fmt.Errorf("failed to marshal request body: %w", err)
-	}
-
-	var specificReqMap map[string]interface{}
-	if err := json.Unmarshal(jsonBytes, &specificReqMap); err != nil {
-		return fmt.Errorf("failed to unmarshal specific request to map: %w", err)
-	}
-
-	for k, v := range specificReqMap {
-		requestPayload[k] = v
-	}
-
 	var buf bytes.Buffer
-	if err := json.NewEncoder(&buf).Encode(requestPayload); err != nil {
-		return fmt.Errorf("failed to encode request payload: %w", err)
+	if err := json.NewEncoder(&buf).Encode(reqBody); err != nil {
+		return fmt.Errorf("failed to encode request body: %w", err)
 	}
 
 	url := fmt.Sprintf("http://%s/", c.Addr) // Always POST to root
@@ -60,7 +41,8 @@ func (c *NodeClient) doRequest(action string, reqBody interface{}, respBody inte
 	if err != nil {
 		return fmt.Errorf("failed to create HTTP request: %w", err)
 	}
-	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Content-Type", ContentType)
+	httpReq.Header.Set("X-Amz-Target", Target(action))
 
 	httpResp, err := c.client.Do(httpReq)
 	if err != nil {
@@ -69,7 +51,7 @@ func (c *NodeClient) doRequest(action string, reqBody interface{}, respBody inte
 	defer httpResp.Body.Close()
 
 	if httpResp.StatusCode != http.StatusOK {
-		return fmt.Errorf("node responded with status: %s", httpResp.Status)
+		return decodeError(httpResp)
 	}
 
 	if respBody != nil {
@@ -81,6 +63,29 @@ func (c *NodeClient) doRequest(action string, reqBody interface{}, respBody inte
 	return nil
 }
 
+// decodeError turns the error response of a node back into the storage
+// error that caused it, so that the router and its clients can tell a bad
+// request or a failed condition from a failure of the node.
+func decodeError(httpResp *http.Response) error {
+	var body struct {
+		Type                string                      `json:"__type"`
+		Message             string                      `json:"message"`
+		CancellationReasons []*types.CancellationReason `json:"CancellationReasons,omitempty"`
+	}
+	if err := json.NewDecoder(httpResp.Body).Decode(&body); err != nil || body.Type == "" {
+		return fmt.Errorf("node responded with status: %s", httpResp.Status)
+	}
+
+	name := body.Type[strings.LastIndex(body.Type, "#")+1:]
+	if name == "TransactionCanceledException" {
+		return &storage.TransactionCanceledError{Reasons: body.CancellationReasons}
+	}
+	if err := storage.ExceptionError(name, body.Message); err != nil {
+		return err
+	}
+	return fmt.Errorf("node responded with status %s: %s: %s", httpResp.Status, name, body.Message)
+}
+
 // CreateTable sends a CreateTable request to the node.
 func (c *NodeClient) CreateTable(req *types.CreateTableRequest) (*types.CreateTableResponse, error) {
 	var resp types.CreateTableResponse
@@ -102,6 +107,27 @@ func (c *NodeClient) DescribeTable(req *types.DescribeTableRequest) (*types.Desc
 	return &resp, err
 }
 
+// UpdateTable sends an UpdateTable request to the node.
+func (c *NodeClient) UpdateTable(req *types.UpdateTableRequest) (*types.UpdateTableResponse, error) {
+	var resp types.UpdateTableResponse
+	err := c.doRequest("UpdateTable", req, &resp)
+	return &resp, err
+}
+
+// UpdateTimeToLive sends an UpdateTimeToLive request to the node.
+func (c *NodeClient) UpdateTimeToLive(req *types.UpdateTimeToLiveRequest) (*types.UpdateTimeToLiveResponse, error) {
+	var resp types.UpdateTimeToLiveResponse
+	err := c.doRequest("UpdateTimeToLive", req, &resp)
+	return &resp, err
+}
+
+// DescribeTimeToLive sends a DescribeTimeToLive request to the node.
+func (c *NodeClient) DescribeTimeToLive(req *types.DescribeTimeToLiveRequest) (*types.DescribeTimeToLiveResponse, error) {
+	var resp types.DescribeTimeToLiveResponse
+	err := c.doRequest("DescribeTimeToLive", req, &resp)
+	return &resp, err
+}
+
 // ListTables sends a ListTables request to the node.
 func (c *NodeClient) ListTables(req *types.ListTablesRequest) (*types.ListTablesResponse, error) {
 	var resp types.ListTablesResponse
@@ -110,34 +136,38 @@ func (c *NodeClient) ListTables(req *types.ListTablesRequest) (*types.ListTables
 }
 
 // Put sends a Put request to the node.
-func (c *NodeClient) Put(req *types.PutRequest) error {
-	return c.doRequest("PutItem", req, nil)
+func (c *NodeClient) Put(req *types.PutRequest) (*types.PutItemResponse, error) {
+	var resp types.PutItemResponse
+	err := c.doRequest("PutItem", req, &resp)
+	return &resp, err
 }
 
 // Get sends a Get request to the node and returns the item.
 func (c *NodeClient) Get(req *types.GetRequest) (map[string]*expression.AttributeValue, error) {
-	var item map[string]*expression.AttributeValue
-	err := c.doRequest("GetItem", req, &item)
-	return item, err
+	var resp types.GetItemResponse
+	err := c.doRequest("GetItem", req, &resp)
+	return resp.Item, err
 }
 
 // Delete sends a Delete request to the node.
-func (c *NodeClient) Delete(req *types.DeleteRequest) error {
-	return c.doRequest("DeleteItem", req, nil)
+func (c *NodeClient) Delete(req *types.DeleteRequest) (*types.DeleteItemResponse, error) {
+	var resp types.DeleteItemResponse
+	err := c.doRequest("DeleteItem", req, &resp)
+	return &resp, err
 }
 
-// Update sends an Update request to the node and returns the updated item.
-func (c *NodeClient) Update(req *types.UpdateRequest) (map[string]*expression.AttributeValue, error) {
-	var item map[string]*expression.AttributeValue
-	err := c.doRequest("UpdateItem", req, &item)
-	return item, err
+// Update sends an Update request to the node and returns the requested attributes.
+func (c *NodeClient) Update(req *types.UpdateRequest) (*types.UpdateItemResponse, error) {
+	var resp types.UpdateItemResponse
+	err := c.doRequest("UpdateItem", req, &resp)
+	return &resp, err
 }
 
-// Query sends a Query request to the node and returns the items.
-func (c *NodeClient) Query(req *types.QueryRequest) ([]map[string]*expression.AttributeValue, error) {
-	var items []map[string]*expression.AttributeValue
-	err := c.doRequest("Query", req, &items)
-	return items, err
+// Query sends a Query request to the node and returns a page of items.
+func (c *NodeClient) Query(req *types.QueryRequest) (*types.QueryResponse, error) {
+	var resp types.QueryResponse
+	err := c.doRequest("Query", req, &resp)
+	return &resp, err
 }
 
 // Scan sends a Scan request to the node and returns the items.
@@ -152,4 +182,114 @@ func (c *NodeClient) InternalScan(req *types.ScanRequest) (*types.ScanResponse,
 	var resp types.ScanResponse
 	err := c.doRequest("InternalScan", req, &resp)
 	return &resp, err
-}
\ No newline at end of file
+}
+
+// BatchWriteItem sends a BatchWriteItem request to the node.
+func (c *NodeClient) BatchWriteItem(req *types.BatchWriteItemRequest) (*types.BatchWriteItemResponse, error) {
+	var resp types.BatchWriteItemResponse
+	err := c.doRequest("BatchWriteItem", req, &resp)
+	return &resp, err
+}
+
+// BatchGetItem sends a BatchGetItem request to the node and returns the items.
+func (c *NodeClient) BatchGetItem(req *types.BatchGetItemRequest) (*types.BatchGetItemResponse, error) {
+	var resp types.BatchGetItemResponse
+	err := c.doRequest("BatchGetItem", req, &resp)
+	return &resp, err
+}
+
+// TransactWriteItems sends a TransactWriteItems request to the node.
+func (c *NodeClient) TransactWriteItems(req *types.TransactWriteItemsRequest) (*types.TransactWriteItemsResponse, error) {
+	var resp types.TransactWriteItemsResponse
+	err := c.doRequest("TransactWriteItems", req, &resp)
+	return &resp, err
+}
+
+// TransactGetItems sends a TransactGetItems request to the node and returns the items.
+func (c *NodeClient) TransactGetItems(req *types.TransactGetItemsRequest) (*types.TransactGetItemsResponse, error) {
+	var resp types.TransactGetItemsResponse
+	err := c.doRequest("TransactGetItems", req, &resp)
+	return &resp, err
+}
+
+// PrepareTransaction asks the node to check and lock its part of a transaction.
+func (c *NodeClient) PrepareTransaction(req *types.PrepareTransactionRequest) (*types.PrepareTransactionResponse, error) {
+	var resp types.PrepareTransactionResponse
+	err := c.doRequest("PrepareTransaction", req, &resp)
+	return &resp, err
+}
+
+// CommitTransaction asks the node to apply a prepared transaction.
+func (c *NodeClient) CommitTransaction(req *types.CommitTransactionRequest) error {
+	return c.doRequest("CommitTransaction", req, nil)
+}
+
+// AbortTransaction asks the node to drop a prepared transaction.
+func (c *NodeClient) AbortTransaction(req *types.AbortTransactionRequest) error {
+	return c.doRequest("AbortTransaction", req, nil)
+}
+
+// GetItemVersions asks the node for its copies of items and their versions.
+func (c *NodeClient) GetItemVersions(req *types.GetItemVersionsRequest) (*types.GetItemVersionsResponse, error) {
+	var resp types.GetItemVersionsResponse
+	err := c.doRequest("GetItemVersions", req, &resp)
+	return &resp, err
+}
+
+// ScanItemVersions asks the node for a page of its copies of a table's items
+// and their versions.
+func (c *NodeClient) ScanItemVersions(req *types.ScanItemVersionsRequest) (*types.ScanItemVersionsResponse, error) {
+	var resp types.ScanItemVersionsResponse
+	err := c.doRequest("ScanItemVersions", req, &resp)
+	return &resp, err
+}
+
+// ImportItems sends the node copies of items to store.
+func (c *NodeClient) ImportItems(req *types.ImportItemsRequest) (*types.ImportItemsResponse, error) {
+	var resp types.ImportItemsResponse
+	err := c.doRequest("ImportItems", req, &resp)
+	return &resp, err
+}
+
+// Ping checks that the node is up, waiting at most timeout for its answer.
+func (c *NodeClient) Ping(timeout time.Duration) error {
+	client := &http.Client{Transport: c.client.Transport, Timeout: timeout}
+	httpResp, err := client.Get(fmt.Sprintf("http://%s%s", c.Addr, HealthPath))
+	if err != nil {
+		return fmt.Errorf("failed to send HTTP request: %w", err)
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("node responded with status: %s", httpResp.Status)
+	}
+	return nil
+}
+
+// ListStreams sends a ListStreams request to the node.
+func (c *NodeClient) ListStreams(req *types.ListStreamsRequest) (*types.ListStreamsResponse, error) {
+	var resp types.ListStreamsResponse
+	err := c.doRequest("ListStreams", req, &resp)
+	return &resp, err
+}
+
+// DescribeStream sends a DescribeStream request to the node.
+func (c *NodeClient) DescribeStream(req *types.DescribeStreamRequest) (*types.DescribeStreamResponse, error) {
+	var resp types.DescribeStreamResponse
+	err := c.doRequest("DescribeStream", req, &resp)
+	return &resp, err
+}
+
+// GetShardIterator sends a GetShardIterator request to the node.
+func (c *NodeClient) GetShardIterator(req *types.GetShardIteratorRequest) (*types.GetShardIteratorResponse, error) {
+	var resp types.GetShardIteratorResponse
+	err := c.doRequest("GetShardIterator", req, &resp)
+	return &resp, err
+}
+
+// GetRecords sends a GetRecords request to the node.
+func (c *NodeClient) GetRecords(req *types.GetRecordsRequest) (*types.GetRecordsResponse, error) {
+	var resp types.GetRecordsResponse
+	err := c.doRequest("GetRecords", req, &resp)
+	return &resp, err
+}
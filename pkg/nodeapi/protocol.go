@@ -0,0 +1,70 @@
+package nodeapi
+
+import (
+	"fmt"
+	"strings"
+)
+
+// The router talks to nodes over the JSON protocol DynamoDB clients use: a
+// POST to / naming the operation in the X-Amz-Target header, with a request
+// type of pkg/types as the body. A node answers with the matching response
+// type, or with a DynamoDB error body that decodeError turns back into the
+// storage error the node returned. Every storage.Storage method is an
+// operation of the same name, except Put, Get, Delete and Update, which are
+// PutItem, GetItem, DeleteItem and UpdateItem.
+//
+// The service prefix of the target carries the version of the contract, so
+// that a node refuses requests from a router speaking another version
+// rather than misreading them.
+//
+// Outside of the protocol, a node answers a GET of HealthPath with 200 OK
+// while it is up, which is how the router probes it.
+
+// ProtocolVersion is the version of the contract between the router and
+// nodes. It changes whenever a request or response changes incompatibly.
+const ProtocolVersion = 5
+
+// servicePrefix is the service prefix of internal targets, before the version.
+const servicePrefix = "ZagrebNode_v"
+
+// TargetPrefix is the service prefix of the targets of this version.
+var TargetPrefix = fmt.Sprintf("%s%d", servicePrefix, ProtocolVersion)
+
+// HealthPath is the path of the health check of a node.
+const HealthPath = "/health"
+
+// ContentType is the content type of requests and responses.
+const ContentType = "application/x-amz-json-1.0"
+
+// internalActions are the operations only the router may call, which are
+// refused under a DynamoDB target.
+var internalActions = map[string]bool{
+	"InternalScan":       true,
+	"PrepareTransaction": true,
+	"CommitTransaction":  true,
+	"AbortTransaction":   true,
+	"GetItemVersions":    true,
+	"ScanItemVersions":   true,
+	"ImportItems":        true,
+}
+
+// Target returns the X-Amz-Target header of an operation.
+func Target(action string) string {
+	return TargetPrefix + "." + action
+}
+
+// CheckTarget validates the service prefix and action of a target: an
+// internal target must be of this version, and an internal operation must
+// come with an internal target.
+func CheckTarget(prefix, action string) error {
+	if strings.HasPrefix(prefix, servicePrefix) {
+		if prefix != TargetPrefix {
+			return fmt.Errorf("unsupported node protocol %s, expected %s", prefix, TargetPrefix)
+		}
+		return nil
+	}
+	if internalActions[action] {
+		return fmt.Errorf("unknown action: %s", action)
+	}
+	return nil
+}
@@ -0,0 +1,383 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"zagreb/pkg/storage"
+	"zagreb/pkg/types"
+)
+
+// The router keeps track of whether the nodes it knows are up. A node is
+// heard from when a probe of the router reaches it or when it sends a
+// heartbeat. A node not heard from for a while is suspected, and stays in
+// the ring, so that a slow probe or a lost heartbeat does not move its
+// partitions; one not heard from for longer has failed, and is removed from
+// the ring, its partitions falling to the next nodes. The router goes on
+// probing a failed node, and adds it back to the ring once it is heard from
+// again, moving its partitions back to it as for a node joining (see
+// rebalance.go). The state of a node whose partitions are moving is left to
+// the move.
+
+// NodeState is the health of a node, as the router sees it.
+type NodeState string
+
+const (
+	// NodeAlive is the state of a node heard from recently.
+	NodeAlive NodeState = "alive"
+	// NodeSuspect is the state of a node not heard from for the suspicion
+	// timeout, which is still in the ring.
+	NodeSuspect NodeState = "suspect"
+	// NodeFailed is the state of a node not heard from for the failure
+	// timeout, which has been removed from the ring.
+	NodeFailed NodeState = "failed"
+	// NodeJoining is the state of a node the partitions it is to hold are
+	// being copied to, before it enters the ring.
+	NodeJoining NodeState = "joining"
+	// NodeLeaving is the state of a node whose partitions are being copied
+	// to the nodes taking them over, before it leaves the ring.
+	NodeLeaving NodeState = "leaving"
+)
+
+// HealthConfig sets how the router checks the health of nodes.
+type HealthConfig struct {
+	// ProbeInterval is the time between probes of every node, and the
+	// longest a probe waits for an answer.
+	ProbeInterval time.Duration
+	// SuspectAfter is the time after which a node not heard from is
+	// suspected.
+	SuspectAfter time.Duration
+	// FailAfter is the time after which a node not heard from has failed.
+	FailAfter time.Duration
+}
+
+// DefaultHealthConfig is the health configuration of a new router.
+var DefaultHealthConfig = HealthConfig{
+	ProbeInterval: time.Second,
+	SuspectAfter:  3 * time.Second,
+	FailAfter:     10 * time.Second,
+}
+
+// ErrUnknownNode is returned for a heartbeat of a node that is not
+// registered, which has to register again.
+var ErrUnknownNode = errors.New("unknown node")
+
+// NodeStatus is the health of a node.
+type NodeStatus struct {
+	Node
+	State    NodeState
+	LastSeen time.Time // When the node was last heard from
+	Since    time.Time // When the node entered its state
+}
+
+// member is a node the router knows, in the ring or not.
+type member struct {
+	node     Node
+	client   storage.Storage
+	state    NodeState
+	lastSeen time.Time
+	since    time.Time
+}
+
+// pinger is implemented by the node clients that can check that their node
+// is up. The nodes of other clients are only heard from by heartbeats.
+type pinger interface {
+	Ping(timeout time.Duration) error
+}
+
+// SetHealthConfig sets how the router checks the health of nodes. The
+// suspicion timeout must not be longer than the failure timeout.
+func (r *Router) SetHealthConfig(cfg HealthConfig) error {
+	if cfg.ProbeInterval <= 0 || cfg.SuspectAfter <= 0 || cfg.FailAfter <= 0 {
+		return fmt.Errorf("health check intervals must be positive, got %+v", cfg)
+	}
+	if cfg.SuspectAfter > cfg.FailAfter {
+		return fmt.Errorf("suspicion timeout %v is longer than failure timeout %v", cfg.SuspectAfter, cfg.FailAfter)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.health = cfg
+	return nil
+}
+
+// HealthConfig returns how the router checks the health of nodes.
+func (r *Router) HealthConfig() HealthConfig {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.health
+}
+
+// StartHealthChecks starts probing nodes every probe interval and updating
+// their states, until StopHealthChecks is called.
+func (r *Router) StartHealthChecks() {
+	r.healthMu.Lock()
+	defer r.healthMu.Unlock()
+	if r.stopHealth != nil {
+		return
+	}
+	r.stopHealth = make(chan struct{})
+	r.healthDone = make(chan struct{})
+	go r.checkHealthLoop(r.stopHealth, r.healthDone)
+}
+
+// StopHealthChecks stops the health checks and waits for the one running to
+// end.
+func (r *Router) StopHealthChecks() {
+	r.healthMu.Lock()
+	defer r.healthMu.Unlock()
+	if r.stopHealth == nil {
+		return
+	}
+	close(r.stopHealth)
+	<-r.healthDone
+	r.stopHealth, r.healthDone = nil, nil
+}
+
+// checkHealthLoop checks the health of nodes every probe interval, and
+// resolves the transactions left unfinished, until stop is closed, then
+// closes done.
+func (r *Router) checkHealthLoop(stop, done chan struct{}) {
+	defer close(done)
+
+	// The interval is read again after every check, as it may be changed.
+	timer := time.NewTimer(r.HealthConfig().ProbeInterval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-timer.C:
+			r.checkHealth()
+			r.resolveTransactions()
+			timer.Reset(r.HealthConfig().ProbeInterval)
+		}
+	}
+}
+
+// Heartbeat records that a node is up. It returns ErrUnknownNode if the node
+// is not registered.
+func (r *Router) Heartbeat(nodeID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.members[nodeID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownNode, nodeID)
+	}
+	m.lastSeen = r.now()
+	return nil
+}
+
+// NodeStatuses returns the health of every node the router knows, in ID
+// order.
+func (r *Router) NodeStatuses() []NodeStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	statuses := make([]NodeStatus, 0, len(r.members))
+	for _, m := range r.members {
+		statuses = append(statuses, NodeStatus{Node: m.node, State: m.state, LastSeen: m.lastSeen, Since: m.since})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	return statuses
+}
+
+// checkHealth probes every node and moves the nodes whose state changed
+// into or out of the ring.
+func (r *Router) checkHealth() {
+	r.mu.RLock()
+	cfg := r.health
+	members := make([]*member, 0, len(r.members))
+	for _, m := range r.members {
+		members = append(members, m)
+	}
+	r.mu.RUnlock()
+
+	// Probes run without the lock, which heartbeats and requests need.
+	reached := make([]bool, len(members))
+	var wg sync.WaitGroup
+	for i, m := range members {
+		p, ok := m.client.(pinger)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, m *member, p pinger) {
+			defer wg.Done()
+			reached[i] = p.Ping(cfg.ProbeInterval) == nil
+		}(i, m, p)
+	}
+	wg.Wait()
+
+	var failed, recovered []*member
+	r.mu.Lock()
+	now := r.now()
+	for i, m := range members {
+		if r.members[m.node.ID] != m {
+			// The node left or registered again during the probes.
+			continue
+		}
+		if reached[i] {
+			m.lastSeen = now
+		}
+		if m.state == NodeJoining || m.state == NodeLeaving {
+			// The move of its partitions fails if the node does.
+			continue
+		}
+		state := NodeAlive
+		switch silence := now.Sub(m.lastSeen); {
+		case silence >= cfg.FailAfter:
+			state = NodeFailed
+		case silence >= cfg.SuspectAfter:
+			state = NodeSuspect
+		}
+		switch {
+		case m.state == NodeFailed && state != NodeFailed:
+			recovered = append(recovered, m)
+		case m.state != NodeFailed && state == NodeFailed:
+			failed = append(failed, m)
+		case state != m.state:
+			log.Printf("node %s is %s, was %s", m.node.ID, state, m.state)
+			m.state, m.since = state, now
+		}
+	}
+	r.mu.Unlock()
+
+	if len(failed) == 0 && len(recovered) == 0 {
+		return
+	}
+	// The ring changes one move at a time; a change that has to wait for
+	// another move is made by a later check.
+	if !r.rebalanceMu.TryLock() {
+		return
+	}
+	defer r.rebalanceMu.Unlock()
+
+	if len(failed) > 0 {
+		r.mu.Lock()
+		from := r.ring()
+		for _, m := range failed {
+			if r.members[m.node.ID] == m {
+				log.Printf("node %s is %s, was %s", m.node.ID, NodeFailed, m.state)
+				m.state, m.since = NodeFailed, now
+				r.leaveRing(m.node.ID)
+			}
+		}
+		to := r.ring()
+		r.mu.Unlock()
+		if err := r.transfer(from, to); err != nil {
+			log.Printf("failed to copy the partitions of failed nodes to their new replicas: %v", err)
+		}
+	}
+
+	for _, m := range recovered {
+		r.mu.RLock()
+		current := r.members[m.node.ID] == m
+		r.mu.RUnlock()
+		if !current {
+			continue
+		}
+		if err := r.join(m); err != nil {
+			log.Printf("failed to add recovered node %s back to the ring: %v", m.node.ID, err)
+			continue
+		}
+		log.Printf("node %s is %s, was %s", m.node.ID, NodeAlive, NodeFailed)
+	}
+}
+
+// joinRing adds a member to the ring. r.mu must be held.
+func (r *Router) joinRing(m *member) {
+	r.consistent.Add(m.node.ID)
+	r.nodes[m.node.ID] = m.node
+	r.nodeClients[m.node.ID] = m.client
+}
+
+// leaveRing removes a node from the ring, leaving it a member. r.mu must be
+// held.
+func (r *Router) leaveRing(nodeID string) {
+	r.consistent.Remove(nodeID)
+	delete(r.nodes, nodeID)
+	delete(r.nodeClients, nodeID)
+}
+
+// syncTables creates on to the tables of from that it lacks, with their
+// indexes, streams and time to live, and deletes from to the tables from
+// does not have. It is how a node joining the cluster, or coming back to it
+// after missing table changes, gets the definition of every table.
+func syncTables(from, to storage.Storage) error {
+	listTablesResp, err := from.ListTables(&types.ListTablesRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to list tables: %w", err)
+	}
+
+	current, err := to.ListTables(&types.ListTablesRequest{})
+	if err != nil {
+		return fmt.Errorf("failed to list tables of the node: %w", err)
+	}
+	kept := make(map[string]bool, len(listTablesResp.TableNames))
+	for _, tableName := range listTablesResp.TableNames {
+		kept[tableName] = true
+	}
+	for _, tableName := range current.TableNames {
+		if kept[tableName] {
+			continue
+		}
+		if _, err := to.DeleteTable(&types.DeleteTableRequest{TableName: tableName}); err != nil && !errors.Is(err, storage.ErrResourceNotFound) {
+			return fmt.Errorf("failed to delete table %s: %w", tableName, err)
+		}
+		log.Printf("Dropped table %s", tableName)
+	}
+
+	for _, tableName := range listTablesResp.TableNames {
+		descResp, err := from.DescribeTable(&types.DescribeTableRequest{TableName: tableName})
+		if err != nil {
+			return fmt.Errorf("failed to describe table %s: %w", tableName, err)
+		}
+		desc := descResp.Table
+		createReq := &types.CreateTableRequest{
+			TableName:            desc.TableName,
+			KeySchema:            desc.KeySchema,
+			AttributeDefinitions: desc.AttributeDefinitions,
+			StreamSpecification:  desc.StreamSpecification,
+			LatestStreamLabel:    desc.LatestStreamLabel,
+		}
+		for _, gsi := range desc.GlobalSecondaryIndexes {
+			createReq.GlobalSecondaryIndexes = append(createReq.GlobalSecondaryIndexes, &types.GlobalSecondaryIndex{
+				IndexName:  gsi.IndexName,
+				KeySchema:  gsi.KeySchema,
+				Projection: gsi.Projection,
+			})
+		}
+		for _, lsi := range desc.LocalSecondaryIndexes {
+			createReq.LocalSecondaryIndexes = append(createReq.LocalSecondaryIndexes, &types.LocalSecondaryIndex{
+				IndexName:  lsi.IndexName,
+				KeySchema:  lsi.KeySchema,
+				Projection: lsi.Projection,
+			})
+		}
+		if _, err := to.CreateTable(createReq); err != nil && !errors.Is(err, storage.ErrResourceInUse) {
+			return fmt.Errorf("failed to create table %s: %w", tableName, err)
+		}
+
+		ttlResp, err := from.DescribeTimeToLive(&types.DescribeTimeToLiveRequest{TableName: tableName})
+		if err != nil {
+			return fmt.Errorf("failed to describe time to live of table %s: %w", tableName, err)
+		}
+		if ttl := ttlResp.TimeToLiveDescription; ttl.TimeToLiveStatus == types.TimeToLiveStatusEnabled {
+			if _, err := to.UpdateTimeToLive(&types.UpdateTimeToLiveRequest{
+				TableName: tableName,
+				TimeToLiveSpecification: &types.TimeToLiveSpecification{
+					AttributeName: ttl.AttributeName,
+					Enabled:       true,
+				},
+			}); err != nil {
+				return fmt.Errorf("failed to enable time to live of table %s: %w", tableName, err)
+			}
+		}
+		log.Printf("Synced table %s", tableName)
+	}
+	return nil
+}
@@ -0,0 +1,437 @@
+package router
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"zagreb/pkg/expression"
+	"zagreb/pkg/storage"
+	"zagreb/pkg/types"
+)
+
+// Items are partitioned by the value of their hash key: the nodes holding an
+// item are those the consistent hash ring gives for the table name and hash
+// key value together, so that the items of a table spread over every node.
+// Table definitions are kept on every node, as requests that create, update
+// or delete a table are sent to all of them.
+
+// tableKeys is what the router needs to know of a table to route requests
+// for its items: the names of its key attributes and the key attributes of
+// each of its secondary indexes.
+type tableKeys struct {
+	hashKey, rangeKey string
+	// localIndexes map the name of each local index to its range key. A
+	// local index shares the table's hash key, so every entry of a local
+	// index is on the node holding the item it indexes.
+	localIndexes map[string]string
+	// globalIndexes map the name of each global index to its hash and
+	// range key. A global index has entries on every node.
+	globalIndexes map[string][2]string
+}
+
+func newTableKeys(desc *types.TableDescription) *tableKeys {
+	keys := &tableKeys{
+		localIndexes:  make(map[string]string),
+		globalIndexes: make(map[string][2]string),
+	}
+	keys.hashKey, keys.rangeKey = keyNames(desc.KeySchema)
+	for _, lsi := range desc.LocalSecondaryIndexes {
+		_, keys.localIndexes[lsi.IndexName] = keyNames(lsi.KeySchema)
+	}
+	for _, gsi := range desc.GlobalSecondaryIndexes {
+		hashKey, rangeKey := keyNames(gsi.KeySchema)
+		keys.globalIndexes[gsi.IndexName] = [2]string{hashKey, rangeKey}
+	}
+	return keys
+}
+
+// keyNames returns the hash and range key attributes of a key schema.
+func keyNames(keySchema []*types.KeySchemaElement) (hashKey, rangeKey string) {
+	for _, ks := range keySchema {
+		if ks.KeyType == "HASH" {
+			hashKey = ks.AttributeName
+		} else if ks.KeyType == "RANGE" {
+			rangeKey = ks.AttributeName
+		}
+	}
+	return hashKey, rangeKey
+}
+
+// primaryKey returns the primary key attributes of an item.
+func (keys *tableKeys) primaryKey(item map[string]*types.AttributeValue) map[string]*types.AttributeValue {
+	key := map[string]*types.AttributeValue{keys.hashKey: item[keys.hashKey]}
+	if keys.rangeKey != "" {
+		key[keys.rangeKey] = item[keys.rangeKey]
+	}
+	return key
+}
+
+// tableKeys returns the keys of a table, asking a node for the table's
+// definition the first time.
+func (r *Router) tableKeys(tableName string) (*tableKeys, error) {
+	r.tablesMu.Lock()
+	keys, ok := r.tables[tableName]
+	r.tablesMu.Unlock()
+	if ok {
+		return keys, nil
+	}
+
+	client, err := r.metadataClient(tableName)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.DescribeTable(&types.DescribeTableRequest{TableName: tableName})
+	if err != nil {
+		return nil, err
+	}
+	keys = newTableKeys(&resp.Table)
+	r.tablesMu.Lock()
+	r.tables[tableName] = keys
+	r.tablesMu.Unlock()
+	return keys, nil
+}
+
+// forgetTable drops the cached keys of a table that was deleted or whose
+// indexes changed.
+func (r *Router) forgetTable(tableName string) {
+	r.tablesMu.Lock()
+	delete(r.tables, tableName)
+	r.tablesMu.Unlock()
+}
+
+// replicasForKey returns the replicas of the partition holding the item
+// with the given key, or the item itself, primary first.
+func (r *Router) replicasForKey(tableName string, key map[string]*types.AttributeValue) ([]Node, error) {
+	keys, err := r.tableKeys(tableName)
+	if err != nil {
+		return nil, err
+	}
+	hashKey := key[keys.hashKey]
+	if hashKey == nil {
+		return nil, storage.NewValidationError("missing key attribute %s in item", keys.hashKey)
+	}
+	return r.ReplicasForKey(tableName, hashKey)
+}
+
+// nodeForKey returns the primary of the partition holding the item with the
+// given key, or the item itself.
+func (r *Router) nodeForKey(tableName string, key map[string]*types.AttributeValue) (Node, error) {
+	replicas, err := r.replicasForKey(tableName, key)
+	if err != nil {
+		return Node{}, err
+	}
+	return replicas[0], nil
+}
+
+// metadataClient returns the client of a node to ask about a table. Every
+// node holds every table definition, so the node is only chosen by the
+// table name to spread the requests.
+func (r *Router) metadataClient(tableName string) (storage.Storage, error) {
+	node, err := r.GetNode(tableName)
+	if err != nil {
+		return nil, err
+	}
+	return r.getClientForNode(node)
+}
+
+// sortedNodes returns the nodes in ID order, the order in which requests
+// spanning every partition visit them.
+func (r *Router) sortedNodes() []Node {
+	nodes := r.GetActiveNodes()
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+	return nodes
+}
+
+// queryPartition returns the hash key value a query is limited to, or nil
+// for a query of a global index, whose entries for one index hash key are
+// spread over every node.
+func (r *Router) queryPartition(req *types.QueryRequest) (map[string]*types.AttributeValue, *tableKeys, error) {
+	keys, err := r.tableKeys(req.TableName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, ok := keys.globalIndexes[req.IndexName]; ok {
+		return nil, keys, nil
+	}
+	if _, ok := keys.localIndexes[req.IndexName]; req.IndexName != "" && !ok {
+		// The index may have been created since the table was cached.
+		r.forgetTable(req.TableName)
+		if keys, err = r.tableKeys(req.TableName); err != nil {
+			return nil, nil, err
+		}
+		if _, ok := keys.globalIndexes[req.IndexName]; ok {
+			return nil, keys, nil
+		}
+		if _, ok := keys.localIndexes[req.IndexName]; !ok {
+			return nil, nil, storage.NewValidationError("the table %s does not have the specified index: %s", req.TableName, req.IndexName)
+		}
+	}
+
+	conditions, err := expression.ParseKeyConditionExpression(req.KeyConditionExpression, req.ExpressionAttributeNames, req.ExpressionAttributeValues)
+	if err != nil {
+		return nil, nil, storage.NewValidationError("invalid KeyConditionExpression: %w", err)
+	}
+	for _, cond := range conditions {
+		if cond.AttributeName == keys.hashKey && cond.Operator == expression.KeyConditionEqual {
+			return map[string]*types.AttributeValue{keys.hashKey: cond.Values[0]}, keys, nil
+		}
+	}
+	return nil, nil, storage.NewValidationError("query condition missed key schema element: %s", keys.hashKey)
+}
+
+// scanNodes scans the nodes in turn with scan, keeping the items each node
+// is the primary of. A page ends where the page of a node does, and the
+// LastEvaluatedKey it returns, which holds the hash key of the last item
+// read, tells the next page on which node to resume. Nodes return whole
+// items, whose keys tell their primary, and the projection is applied to
+// the items kept. When a read needs several replicas, the items kept are
+// reconciled with their other replicas before the router filters them, so
+// an item missing from its primary is not found.
+func (r *Router) scanNodes(nodes []Node, req *types.ScanRequest, scan func(storage.Storage, *types.ScanRequest) (*types.ScanResponse, error)) (*types.ScanResponse, error) {
+	projection, err := parseProjection(req.ProjectionExpression, req.ExpressionAttributeNames)
+	if err != nil {
+		return nil, err
+	}
+	reads := r.readsNeeded(req.ConsistentRead)
+	var filter *expression.Condition
+	if reads > 1 {
+		if filter, err = parseFilter(req.FilterExpression, req.ExpressionAttributeNames, req.ExpressionAttributeValues); err != nil {
+			return nil, err
+		}
+	}
+
+	first := 0
+	if req.ExclusiveStartKey != nil {
+		node, err := r.nodeForKey(req.TableName, req.ExclusiveStartKey)
+		if err != nil {
+			return nil, err
+		}
+		for i := range nodes {
+			if nodes[i].ID == node.ID {
+				first = i
+			}
+		}
+	}
+
+	resp := &types.ScanResponse{Items: make([]map[string]*expression.AttributeValue, 0)}
+	var items []map[string]*types.AttributeValue
+	start := req.ExclusiveStartKey
+scanning:
+	for i := first; i < len(nodes); i++ {
+		client, err := r.getClientForNode(nodes[i])
+		if err != nil {
+			return nil, err
+		}
+		for {
+			nodeReq := *req
+			nodeReq.ProjectionExpression = ""
+			if filter != nil {
+				nodeReq.FilterExpression = ""
+			}
+			nodeReq.ExclusiveStartKey = start
+			if req.Limit != nil {
+				remaining := *req.Limit - resp.ScannedCount
+				if remaining < 1 {
+					remaining = 1
+				}
+				nodeReq.Limit = &remaining
+			}
+
+			nodeResp, err := scan(client, &nodeReq)
+			if err != nil {
+				return nil, fmt.Errorf("failed to scan on node %s: %w", nodes[i].ID, err)
+			}
+			resp.ScannedCount += nodeResp.ScannedCount
+			for _, item := range nodeResp.Items {
+				primary, err := r.nodeForKey(req.TableName, item)
+				if err != nil {
+					return nil, err
+				}
+				if primary.ID == nodes[i].ID {
+					items = append(items, item)
+				}
+			}
+			if nodeResp.LastEvaluatedKey == nil {
+				break
+			}
+
+			primary, err := r.nodeForKey(req.TableName, nodeResp.LastEvaluatedKey)
+			if err != nil {
+				return nil, err
+			}
+			if primary.ID == nodes[i].ID {
+				resp.LastEvaluatedKey = nodeResp.LastEvaluatedKey
+				break scanning
+			}
+			// The node stopped at a copy of an item of another primary,
+			// which would resume the next page on that node, so the scan
+			// goes on here.
+			start = nodeResp.LastEvaluatedKey
+		}
+		start = nil
+	}
+
+	if reads > 1 {
+		if items, err = r.reconcileItems(req.TableName, req.IndexName != "", items, reads); err != nil {
+			return nil, err
+		}
+	}
+	for _, item := range items {
+		ok, err := filter.Matches(item)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			resp.Items = append(resp.Items, projection.Apply(item))
+		}
+	}
+	resp.Count = len(resp.Items)
+	return resp, nil
+}
+
+// parseProjection parses the projection expression of a request spanning
+// every partition, which the router applies to the items the nodes return.
+func parseProjection(projectionExpression string, names map[string]string) (*expression.Projection, error) {
+	if projectionExpression == "" {
+		return nil, nil
+	}
+	projection, err := expression.ParseProjectionExpression(projectionExpression, names)
+	if err != nil {
+		return nil, storage.NewValidationError("invalid ProjectionExpression: %w", err)
+	}
+	return projection, nil
+}
+
+// parseFilter parses the filter expression of a request whose items the
+// router filters.
+func parseFilter(filterExpression string, names map[string]string, values map[string]*types.AttributeValue) (*expression.Condition, error) {
+	if filterExpression == "" {
+		return nil, nil
+	}
+	filter, err := expression.ParseConditionExpression(filterExpression, names, values)
+	if err != nil {
+		return nil, storage.NewValidationError("invalid FilterExpression: %w", err)
+	}
+	return filter, nil
+}
+
+// queryGlobalIndex queries a global index on every node and merges the
+// entries each node is the primary of in index order. A node that stopped
+// early may hold entries past the point where it stopped that come before
+// those the other nodes returned, so the merged page ends at the earliest
+// such point, and the next page resumes from there on every node. Limit
+// bounds the entries each node reads, and the number of items returned.
+func (r *Router) queryGlobalIndex(req *types.QueryRequest, keys *tableKeys) (*types.QueryResponse, error) {
+	// Nodes return whole items, whose keys order the merge and tell their
+	// primary, and the projection is applied to the merged page.
+	projection, err := parseProjection(req.ProjectionExpression, req.ExpressionAttributeNames)
+	if err != nil {
+		return nil, err
+	}
+	nodeReq := *req
+	nodeReq.ProjectionExpression = ""
+
+	nodes := r.sortedNodes()
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no nodes in the ring to perform query")
+	}
+	responses := make([]*types.QueryResponse, len(nodes))
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node Node) {
+			defer wg.Done()
+			client, err := r.getClientForNode(node)
+			if err == nil {
+				responses[i], err = client.Query(&nodeReq)
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("failed to query on node %s: %w", node.ID, err)
+			}
+		}(i, node)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Index entries are ordered by the index range key and then by the
+	// table's primary key.
+	index := keys.globalIndexes[req.IndexName]
+	compare := itemOrder([]string{index[1], keys.hashKey, keys.rangeKey}, req.ScanIndexForward == nil || *req.ScanIndexForward)
+
+	resp := &types.QueryResponse{Items: make([]map[string]*expression.AttributeValue, 0)}
+	var items []map[string]*types.AttributeValue
+	var bound map[string]*types.AttributeValue
+	for i, nodeResp := range responses {
+		// Every replica of a partition returns its entries, and only the
+		// primary's are kept.
+		for _, item := range nodeResp.Items {
+			primary, err := r.nodeForKey(req.TableName, item)
+			if err != nil {
+				return nil, err
+			}
+			if primary.ID == nodes[i].ID {
+				items = append(items, item)
+			}
+		}
+		resp.ScannedCount += nodeResp.ScannedCount
+		if last := nodeResp.LastEvaluatedKey; last != nil && (bound == nil || compare(last, bound) < 0) {
+			bound = last
+		}
+	}
+	items, bound = boundPage(items, bound, req.Limit, compare, []string{index[0], index[1], keys.hashKey, keys.rangeKey})
+
+	for _, item := range items {
+		resp.Items = append(resp.Items, projection.Apply(item))
+	}
+	resp.Count = len(resp.Items)
+	resp.LastEvaluatedKey = bound
+	return resp, nil
+}
+
+// itemOrder returns a function comparing items by the given attributes in
+// turn, in the direction a query reads. Empty names are skipped.
+func itemOrder(order []string, forward bool) func(a, b map[string]*types.AttributeValue) int {
+	return func(a, b map[string]*types.AttributeValue) int {
+		for _, name := range order {
+			if name == "" {
+				continue
+			}
+			if c, _ := expression.CompareAttributeValues(a[name], b[name]); c != 0 {
+				if !forward {
+					return -c
+				}
+				return c
+			}
+		}
+		return 0
+	}
+}
+
+// boundPage sorts the items merged from the pages of several nodes and ends
+// the merged page at bound, the earliest point where one of the pages ended,
+// and after limit items. It returns the items kept and the LastEvaluatedKey
+// of the merged page, which is made of the attributes keyNames of the last
+// item when the limit ends the page.
+func boundPage(items []map[string]*types.AttributeValue, bound map[string]*types.AttributeValue, limit *int, compare func(a, b map[string]*types.AttributeValue) int, keyNames []string) ([]map[string]*types.AttributeValue, map[string]*types.AttributeValue) {
+	sort.SliceStable(items, func(i, j int) bool { return compare(items[i], items[j]) < 0 })
+	if bound != nil {
+		items = items[:sort.Search(len(items), func(i int) bool { return compare(items[i], bound) > 0 })]
+	}
+	if limit != nil && len(items) > *limit {
+		items = items[:*limit]
+		last := items[len(items)-1]
+		bound = make(map[string]*types.AttributeValue)
+		for _, name := range keyNames {
+			if name != "" && last[name] != nil {
+				bound[name] = last[name]
+			}
+		}
+	}
+	return items, bound
+}
@@ -0,0 +1,326 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"zagreb/pkg/expression"
+	"zagreb/pkg/storage"
+	"zagreb/pkg/types"
+)
+
+// A write is acknowledged once the write quorum of the item's replicas has
+// applied it, and a read reconciles the copies of the read quorum of them,
+// keeping the newest. Copies are told apart by the version each replica
+// records for the last write to an item: the router stamps every write it
+// sends with a version, the time of the write in nanoseconds, later than any
+// it gave before. A consistent read reads enough replicas to overlap every
+// write quorum, so that it sees the last acknowledged write.
+
+// SetQuorums sets the number of replicas that must acknowledge a write, w,
+// and the number whose copies an eventually consistent read reconciles, rq.
+// A w of 0 waits for every replica, which is the default, as is an rq of 1.
+// Quorums larger than the replication factor are capped by it.
+func (r *Router) SetQuorums(w, rq int) error {
+	if w < 0 {
+		return fmt.Errorf("write quorum must not be negative, got %d", w)
+	}
+	if rq < 1 {
+		return fmt.Errorf("read quorum must be at least 1, got %d", rq)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writeQuorum, r.readQuorum = w, rq
+	return nil
+}
+
+// Quorums returns the write and read quorums, as set by SetQuorums.
+func (r *Router) Quorums() (w, rq int) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.writeQuorum, r.readQuorum
+}
+
+// acksNeeded returns the number of acknowledgements a write to n replicas
+// waits for.
+func (r *Router) acksNeeded(n int) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.writeQuorum == 0 {
+		return n
+	}
+	return min(r.writeQuorum, n)
+}
+
+// readsNeeded returns the number of replicas whose copies a read
+// reconciles. A consistent read takes enough of them that at least one has
+// acknowledged the last write.
+func (r *Router) readsNeeded(consistentRead bool) int {
+	r.mu.RLock()
+	// A node joining the cluster is up but not yet in the ring.
+	n := min(r.replicationFactor, len(r.consistent.Members()))
+	rq := r.readQuorum
+	r.mu.RUnlock()
+
+	reads := rq
+	if consistentRead {
+		reads = max(reads, n-r.acksNeeded(n)+1)
+	}
+	return max(min(reads, n), 1)
+}
+
+// newVersion returns the version of a new write.
+func (r *Router) newVersion() int64 {
+	r.versionMu.Lock()
+	defer r.versionMu.Unlock()
+	version := time.Now().UnixNano()
+	if version <= r.lastVersion {
+		version = r.lastVersion + 1
+	}
+	r.lastVersion = version
+	return version
+}
+
+// GetItemVersions is part of the node protocol for reading the copies of
+// items, which the router drives rather than answers.
+func (r *Router) GetItemVersions(req *types.GetItemVersionsRequest) (*types.GetItemVersionsResponse, error) {
+	return nil, fmt.Errorf("GetItemVersions is not supported by the router")
+}
+
+// getNewest reads an item from the number of replicas a read needs and
+// returns the newest copy, or nil if the newest is a delete.
+func (r *Router) getNewest(req *types.GetRequest, replicas []Node, k int) (map[string]*expression.AttributeValue, error) {
+	projection, err := parseProjection(req.ProjectionExpression, req.ExpressionAttributeNames)
+	if err != nil {
+		return nil, err
+	}
+	versionsReq := &types.GetItemVersionsRequest{TableName: req.TableName, Keys: []map[string]*types.AttributeValue{req.Key}}
+	copies, answered, err := r.readVersions(versionsReq, replicas, k)
+	if err != nil {
+		return nil, err
+	}
+	return projection.Apply(copies[newestReplica(copies, answered, 0)].Items[0].Item), nil
+}
+
+// readVersions reads the copies of items from k of their replicas, and
+// returns the responses of those that answered, by replica index, and their
+// indexes.
+func (r *Router) readVersions(req *types.GetItemVersionsRequest, replicas []Node, k int) ([]*types.GetItemVersionsResponse, []int, error) {
+	copies := make([]*types.GetItemVersionsResponse, len(replicas))
+	answered, err := r.readReplicas(replicas, k, func(i int, client storage.Storage) error {
+		resp, err := client.GetItemVersions(req)
+		if err != nil {
+			return err
+		}
+		if len(resp.Items) != len(req.Keys) {
+			return fmt.Errorf("node %s returned %d item versions for %d keys", replicas[i].ID, len(resp.Items), len(req.Keys))
+		}
+		copies[i] = resp
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return copies, answered, nil
+}
+
+// newestReplica returns the index of the replica holding the newest copy of
+// the j-th item among those that answered. Of copies of the same version,
+// that of the first replica in order wins.
+func newestReplica(copies []*types.GetItemVersionsResponse, answered []int, j int) int {
+	newest := answered[0]
+	for _, i := range answered[1:] {
+		if copies[i].Items[j].Version > copies[newest].Items[j].Version {
+			newest = i
+		}
+	}
+	return newest
+}
+
+// queryReplicas queries a partition on k of its replicas, and merges their
+// pages in the order of the query. Of each item, the copy kept is that of the
+// replica holding the newest version, which every replica is asked for: an
+// item missing from that replica's page, because it was deleted or filtered
+// out there, is left out. As for a global index, the merged page ends at the
+// earliest point where a replica's page did.
+func (r *Router) queryReplicas(req *types.QueryRequest, keys *tableKeys, replicas []Node, k int) (*types.QueryResponse, error) {
+	// Replicas return items whole, so that their keys can be read, and the
+	// projection is applied to the merged page.
+	projection, err := parseProjection(req.ProjectionExpression, req.ExpressionAttributeNames)
+	if err != nil {
+		return nil, err
+	}
+	nodeReq := *req
+	nodeReq.ProjectionExpression = ""
+
+	responses := make([]*types.QueryResponse, len(replicas))
+	answered, err := r.readReplicas(replicas, k, func(i int, client storage.Storage) error {
+		var err error
+		responses[i], err = client.Query(&nodeReq)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Items are named by their primary key, in the order they were first
+	// seen.
+	pages := make([]map[string]map[string]*types.AttributeValue, len(replicas))
+	versionsReq := &types.GetItemVersionsRequest{TableName: req.TableName}
+	var names []string
+	seen := make(map[string]bool)
+	resp := &types.QueryResponse{Items: make([]map[string]*expression.AttributeValue, 0)}
+	for _, i := range answered {
+		pages[i] = make(map[string]map[string]*types.AttributeValue)
+		for _, item := range responses[i].Items {
+			key := keys.primaryKey(item)
+			name, err := keyName(key)
+			if err != nil {
+				return nil, err
+			}
+			pages[i][name] = item
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+				versionsReq.Keys = append(versionsReq.Keys, key)
+			}
+		}
+		resp.ScannedCount = max(resp.ScannedCount, responses[i].ScannedCount)
+	}
+
+	var items []map[string]*types.AttributeValue
+	if len(names) > 0 {
+		copies, err := r.readVersionsFrom(versionsReq, replicas, answered)
+		if err != nil {
+			return nil, err
+		}
+		for j, name := range names {
+			if item, ok := pages[newestReplica(copies, answered, j)][name]; ok {
+				items = append(items, item)
+			}
+		}
+	}
+
+	// Items of one partition are ordered by the range key of the index
+	// queried, and then by the table's range key.
+	order := []string{keys.localIndexes[req.IndexName], keys.rangeKey}
+	compare := itemOrder(order, req.ScanIndexForward == nil || *req.ScanIndexForward)
+	var bound map[string]*types.AttributeValue
+	for _, i := range answered {
+		if last := responses[i].LastEvaluatedKey; last != nil && (bound == nil || compare(last, bound) < 0) {
+			bound = last
+		}
+	}
+	items, bound = boundPage(items, bound, req.Limit, compare, append([]string{keys.hashKey}, order...))
+
+	for _, item := range items {
+		resp.Items = append(resp.Items, projection.Apply(item))
+	}
+	resp.Count = len(resp.Items)
+	resp.LastEvaluatedKey = bound
+	return resp, nil
+}
+
+// readVersionsFrom reads the copies of items from the given replicas, which
+// must all answer.
+func (r *Router) readVersionsFrom(req *types.GetItemVersionsRequest, replicas []Node, from []int) ([]*types.GetItemVersionsResponse, error) {
+	copies := make([]*types.GetItemVersionsResponse, len(replicas))
+	errs := make([]error, len(replicas))
+	var wg sync.WaitGroup
+	for _, i := range from {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client, err := r.getClientForNode(replicas[i])
+			if err == nil {
+				copies[i], err = client.GetItemVersions(req)
+			}
+			if err == nil && len(copies[i].Items) != len(req.Keys) {
+				err = fmt.Errorf("got %d item versions for %d keys", len(copies[i].Items), len(req.Keys))
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("failed to read item versions on node %s: %w", replicas[i].ID, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return copies, nil
+}
+
+// reconcileItems replaces the items of a page with their newest copies among
+// k replicas of each, leaving out the items whose newest copy is a delete.
+// Items held by the same replicas are read together. The entries of an
+// index are kept as they are, unless deleted, as a copy is a whole item.
+func (r *Router) reconcileItems(tableName string, index bool, items []map[string]*types.AttributeValue, k int) ([]map[string]*types.AttributeValue, error) {
+	keys, err := r.tableKeys(tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	type group struct {
+		replicas []Node
+		indexes  []int
+		req      *types.GetItemVersionsRequest
+	}
+	groups := make(map[string]*group)
+	var order []*group
+	for i, item := range items {
+		replicas, err := r.replicasForKey(tableName, item)
+		if err != nil {
+			return nil, err
+		}
+		ids := make([]string, len(replicas))
+		for j, node := range replicas {
+			ids[j] = node.ID
+		}
+		name := strings.Join(ids, "\x00")
+		g, ok := groups[name]
+		if !ok {
+			g = &group{replicas: replicas, req: &types.GetItemVersionsRequest{TableName: tableName}}
+			groups[name] = g
+			order = append(order, g)
+		}
+		g.indexes = append(g.indexes, i)
+		g.req.Keys = append(g.req.Keys, keys.primaryKey(item))
+	}
+
+	newest := make([]map[string]*types.AttributeValue, len(items))
+	for _, g := range order {
+		copies, answered, err := r.readVersions(g.req, g.replicas, k)
+		if err != nil {
+			return nil, err
+		}
+		for j, i := range g.indexes {
+			newest[i] = copies[newestReplica(copies, answered, j)].Items[j].Item
+			if index && newest[i] != nil {
+				newest[i] = items[i]
+			}
+		}
+	}
+
+	kept := items[:0]
+	for _, item := range newest {
+		if item != nil {
+			kept = append(kept, item)
+		}
+	}
+	return kept, nil
+}
+
+// keyName returns a string naming a primary key, to tell items apart.
+func keyName(key map[string]*types.AttributeValue) (string, error) {
+	// Maps are encoded with sorted keys.
+	name, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+	return string(name), nil
+}
@@ -0,0 +1,406 @@
+package router
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+
+	"github.com/stathat/consistent"
+	"zagreb/pkg/storage"
+	"zagreb/pkg/types"
+)
+
+// When a node joins the ring or leaves it, partitions move: each item is to
+// be held by the replicas the new ring gives for it. Before the ring
+// changes, the router copies every item to the nodes that are to hold it and
+// do not yet, reading it from the first of its current replicas that is up,
+// one batch of items at a time, and the ring only changes once every item is
+// copied. Until then, the current replicas keep serving reads and writes, and
+// every item written is copied again once the write is acknowledged. Copies
+// keep their versions, and a node keeps the newer of a copy and what it
+// holds, so that the two kinds of copies can arrive in any order.
+//
+// A node that fails cannot hand anything off: it leaves the ring at once,
+// and its partitions are then copied from their other replicas to the nodes
+// that took its place. Copies left on nodes that no longer hold a partition
+// are not deleted, as only a partition's replicas are read. A node that
+// comes back has the writes it missed copied to it, deletes included: nodes
+// keep the versions of the items they delete, and these are copied too.
+
+// DefaultRebalanceBatchSize is the number of items a new router reads from
+// a node at a time when moving partitions.
+const DefaultRebalanceBatchSize = 100
+
+// move is a change of the ring in progress.
+type move struct {
+	to  *consistent.Consistent // The ring being moved to
+	err error                  // The first write that could not be copied, which fails the move
+}
+
+// SetRebalanceBatchSize sets the number of items read from a node at a time
+// when moving partitions.
+func (r *Router) SetRebalanceBatchSize(n int) error {
+	if n < 1 {
+		return fmt.Errorf("rebalance batch size must be at least 1, got %d", n)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rebalanceBatchSize = n
+	return nil
+}
+
+// RebalanceBatchSize returns the number of items read from a node at a time
+// when moving partitions.
+func (r *Router) RebalanceBatchSize() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.rebalanceBatchSize
+}
+
+// JoinNode adds a node to the ring once the partitions it is to hold have
+// been copied to it, together with the definition of every table. The node
+// is sent table changes as soon as the move starts, but is only read from
+// once it is in the ring. If the move fails, the node is forgotten.
+func (r *Router) JoinNode(node Node) error {
+	r.rebalanceMu.Lock()
+	defer r.rebalanceMu.Unlock()
+
+	r.mu.Lock()
+	if _, ok := r.nodes[node.ID]; ok {
+		// A node registering again, as after a restart, holds its partitions.
+		r.mu.Unlock()
+		r.AddNode(node)
+		return nil
+	}
+	m := &member{node: node, client: r.nodeClientFactory.NewNodeClient(node.Addr)}
+	r.members[node.ID] = m
+	r.mu.Unlock()
+
+	return r.join(m)
+}
+
+// LeaveNode removes a node from the ring once the partitions it held have
+// been copied to the nodes taking them over, which the node hands off
+// itself. If the move fails, the node stays in the ring.
+func (r *Router) LeaveNode(nodeID string) error {
+	r.rebalanceMu.Lock()
+	defer r.rebalanceMu.Unlock()
+
+	r.mu.Lock()
+	m, ok := r.members[nodeID]
+	if !ok || m.state == NodeFailed {
+		// A failed node already left the ring.
+		delete(r.members, nodeID)
+		r.mu.Unlock()
+		return nil
+	}
+	from := r.ring()
+	to := r.ring()
+	to.Remove(nodeID)
+	state := m.state
+	m.state, m.since = NodeLeaving, r.now()
+	r.move = &move{to: to}
+	r.mu.Unlock()
+
+	err := r.transfer(from, to)
+
+	r.moveMu.Lock()
+	defer r.moveMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil {
+		err = r.move.err
+	}
+	r.move = nil
+	if err != nil {
+		m.state, m.since = state, r.now()
+		return fmt.Errorf("failed to move the partitions of node %s: %w", nodeID, err)
+	}
+	r.leaveRing(nodeID)
+	delete(r.members, nodeID)
+	return nil
+}
+
+// join moves the partitions a member is to hold to it, then adds it to the
+// ring. r.rebalanceMu must be held.
+func (r *Router) join(m *member) error {
+	r.mu.Lock()
+	from := r.ring()
+	to := r.ring()
+	to.Add(m.node.ID)
+	state, since := m.state, m.since
+	m.state, m.since = NodeJoining, r.now()
+	m.lastSeen = m.since
+	// The node is sent table changes from now on.
+	r.nodes[m.node.ID] = m.node
+	r.nodeClients[m.node.ID] = m.client
+	r.mu.Unlock()
+
+	var err error
+	if members := from.Members(); len(members) > 0 {
+		// Writes are only copied to the node once it has every table. The
+		// tables are read from a node already in the ring, as the router
+		// would list the node's own, deleted while it was away.
+		sort.Strings(members)
+		var source storage.Storage
+		if source, err = r.getClientForNode(Node{ID: members[0]}); err == nil {
+			err = syncTables(source, m.client)
+		}
+		if err == nil {
+			r.mu.Lock()
+			r.move = &move{to: to}
+			r.mu.Unlock()
+			err = r.transfer(from, to)
+		}
+	}
+
+	r.moveMu.Lock()
+	defer r.moveMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err == nil && r.move != nil {
+		err = r.move.err
+	}
+	r.move = nil
+	if err != nil {
+		delete(r.nodes, m.node.ID)
+		delete(r.nodeClients, m.node.ID)
+		if state == NodeFailed {
+			m.state, m.since = state, since
+		} else {
+			delete(r.members, m.node.ID)
+		}
+		return fmt.Errorf("failed to move partitions to node %s: %w", m.node.ID, err)
+	}
+	r.consistent.Add(m.node.ID)
+	m.state, m.since = NodeAlive, r.now()
+	return nil
+}
+
+// ring returns a copy of the ring. r.mu must be held.
+func (r *Router) ring() *consistent.Consistent {
+	ring := consistent.New()
+	ring.Set(r.consistent.Members())
+	return ring
+}
+
+// transfer copies the items of every table to the nodes the ring to gives
+// them and the ring from does not, or gives but are down. Each item is read
+// from the first of its replicas in from that is up, the nodes the router
+// has clients for.
+func (r *Router) transfer(from, to *consistent.Consistent) error {
+	if len(to.Members()) == 0 {
+		return nil
+	}
+	r.mu.RLock()
+	up := make(map[string]storage.Storage, len(r.nodeClients))
+	for id, client := range r.nodeClients {
+		up[id] = client
+	}
+	r.mu.RUnlock()
+
+	tables, err := r.ListTables(&types.ListTablesRequest{})
+	if err != nil {
+		return err
+	}
+	sort.Strings(tables.TableNames)
+	sources := from.Members()
+	sort.Strings(sources)
+	for _, tableName := range tables.TableNames {
+		for _, source := range sources {
+			if up[source] == nil {
+				continue
+			}
+			if err := r.transferTable(tableName, source, from, to, up); err != nil {
+				return fmt.Errorf("failed to move items of table %s from node %s: %w", tableName, source, err)
+			}
+		}
+	}
+	return nil
+}
+
+// transferTable copies the items of a table that source is to hand off,
+// one batch at a time. The items source deleted are copied as deletes, so
+// that a node that missed them, having been down, does not keep them.
+func (r *Router) transferTable(tableName, source string, from, to *consistent.Consistent, up map[string]storage.Storage) error {
+	keys, err := r.tableKeys(tableName)
+	if err != nil {
+		return err
+	}
+	factor := r.ReplicationFactor()
+	scanReq := &types.ScanItemVersionsRequest{TableName: tableName, Limit: r.RebalanceBatchSize()}
+	for {
+		scanResp, err := up[source].ScanItemVersions(scanReq)
+		if err != nil {
+			return err
+		}
+		if len(scanResp.Items) != len(scanResp.Keys) {
+			return fmt.Errorf("got %d item versions for %d keys", len(scanResp.Items), len(scanResp.Keys))
+		}
+
+		// The items to copy, grouped by the node to copy them to.
+		imports := make(map[string]*types.ImportItemsRequest)
+		var importOrder []string
+		for i, key := range scanResp.Keys {
+			partitionKey, err := storage.PartitionKey(tableName, key[keys.hashKey])
+			if err != nil {
+				return err
+			}
+			holders, err := from.GetN(partitionKey, factor)
+			if err != nil {
+				return err
+			}
+			replicas, err := to.GetN(partitionKey, factor)
+			if err != nil {
+				return err
+			}
+			var upHolders []string
+			for _, id := range holders {
+				if up[id] != nil {
+					upHolders = append(upHolders, id)
+				}
+			}
+			if len(upHolders) == 0 || upHolders[0] != source {
+				continue
+			}
+			for _, id := range replicas {
+				if slices.Contains(upHolders, id) {
+					continue
+				}
+				importReq, ok := imports[id]
+				if !ok {
+					importReq = &types.ImportItemsRequest{TableName: tableName}
+					imports[id] = importReq
+					importOrder = append(importOrder, id)
+				}
+				importReq.Keys = append(importReq.Keys, key)
+				importReq.Items = append(importReq.Items, scanResp.Items[i])
+			}
+		}
+
+		for _, id := range importOrder {
+			if up[id] == nil {
+				return fmt.Errorf("node %s is not up", id)
+			}
+			if _, err := up[id].ImportItems(imports[id]); err != nil {
+				return fmt.Errorf("failed to import items on node %s: %w", id, err)
+			}
+		}
+
+		if scanResp.LastEvaluatedKey == nil {
+			return nil
+		}
+		scanReq.ExclusiveStartKey = scanResp.LastEvaluatedKey
+	}
+}
+
+// beginWrite is called before a write, and the function it returns once
+// the write is done, with the items written. The ring does not change while
+// writes are in progress, so that those made before it changes are copied
+// to the nodes being moved to.
+func (r *Router) beginWrite() func(written ...itemKey) {
+	r.moveMu.RLock()
+	return func(written ...itemKey) {
+		defer r.moveMu.RUnlock()
+		r.copyWrites(written)
+	}
+}
+
+// copyWrites copies the items just written to the nodes that are to hold
+// them once the move in progress ends. These nodes are not sent the writes
+// themselves, which could go differently on a node that does not have the
+// item yet, such as an update or a conditional put. A write that cannot be
+// copied fails the move, as the nodes would miss it.
+func (r *Router) copyWrites(written []itemKey) {
+	r.mu.RLock()
+	m := r.move
+	r.mu.RUnlock()
+	if m == nil {
+		return
+	}
+	for _, item := range written {
+		if err := r.copyWrite(m, item.tableName, item.key); err != nil {
+			log.Printf("failed to copy a write to table %s during a move: %v", item.tableName, err)
+			r.mu.Lock()
+			if m.err == nil {
+				m.err = err
+			}
+			r.mu.Unlock()
+			return
+		}
+	}
+}
+
+// copyWrite copies the newest copy of an item to the nodes the ring being
+// moved to gives it and the ring does not.
+func (r *Router) copyWrite(m *move, tableName string, key map[string]*types.AttributeValue) error {
+	keys, err := r.tableKeys(tableName)
+	if err != nil {
+		return err
+	}
+	partitionKey, err := storage.PartitionKey(tableName, key[keys.hashKey])
+	if err != nil {
+		return err
+	}
+	replicas, err := r.GetReplicas(partitionKey)
+	if err != nil {
+		return err
+	}
+	targets, err := m.to.GetN(partitionKey, r.ReplicationFactor())
+	if err != nil {
+		return err
+	}
+
+	versionsReq := &types.GetItemVersionsRequest{TableName: tableName, Keys: []map[string]*types.AttributeValue{keys.primaryKey(key)}}
+	var newest *types.ItemVersion
+	for _, id := range targets {
+		if containsNode(replicas, id) {
+			continue
+		}
+		if newest == nil {
+			copies, answered, err := r.readVersions(versionsReq, replicas, r.readsNeeded(true))
+			if err != nil {
+				return err
+			}
+			newest = copies[newestReplica(copies, answered, 0)].Items[0]
+			if newest.Item == nil && newest.Version == 0 {
+				// The write was not applied anywhere.
+				return nil
+			}
+		}
+		client, err := r.getClientForNode(Node{ID: id})
+		if err != nil {
+			return err
+		}
+		if _, err := client.ImportItems(&types.ImportItemsRequest{
+			TableName: tableName,
+			Keys:      versionsReq.Keys,
+			Items:     []*types.ItemVersion{newest},
+		}); err != nil {
+			return fmt.Errorf("failed to import item on node %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+// ScanItemVersions is part of the node protocol for moving partitions,
+// which the router drives rather than answers.
+func (r *Router) ScanItemVersions(req *types.ScanItemVersionsRequest) (*types.ScanItemVersionsResponse, error) {
+	return nil, fmt.Errorf("ScanItemVersions is not supported by the router")
+}
+
+// ImportItems is part of the node protocol for moving partitions, which
+// the router drives rather than answers.
+func (r *Router) ImportItems(req *types.ImportItemsRequest) (*types.ImportItemsResponse, error) {
+	return nil, fmt.Errorf("ImportItems is not supported by the router")
+}
+
+func containsNode(nodes []Node, id string) bool {
+	for _, node := range nodes {
+		if node.ID == id {
+			return true
+		}
+	}
+	return false
+}
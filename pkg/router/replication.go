@@ -0,0 +1,320 @@
+package router
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+
+	"zagreb/pkg/expression"
+	"zagreb/pkg/storage"
+	"zagreb/pkg/types"
+)
+
+// Each partition is held by several nodes, its replicas: the first distinct
+// nodes the consistent hash ring gives for its partition key, as many as the
+// replication factor. The first replica is the partition's primary. Writes
+// are applied on every replica, and reads are served by the first replica
+// that answers, so that a partition stays readable while one of its nodes is
+// down. Requests spanning every partition read each one from its primary,
+// dropping the copies that the other replicas return.
+
+// DefaultReplicationFactor is the number of copies of each item a new router
+// keeps.
+const DefaultReplicationFactor = 1
+
+// SetReplicationFactor sets the number of nodes holding a copy of each item.
+// A ring with fewer nodes keeps a copy on every node.
+func (r *Router) SetReplicationFactor(n int) error {
+	if n < 1 {
+		return fmt.Errorf("replication factor must be at least 1, got %d", n)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.replicationFactor = n
+	return nil
+}
+
+// ReplicationFactor returns the number of nodes holding a copy of each item.
+func (r *Router) ReplicationFactor() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.replicationFactor
+}
+
+// GetReplicas returns the nodes holding copies of the given key, primary
+// first.
+func (r *Router) GetReplicas(key string) ([]Node, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.consistent.Members()) == 0 {
+		return nil, fmt.Errorf("no nodes in the ring")
+	}
+
+	nodeIDs, err := r.consistent.GetN(key, r.replicationFactor)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get nodes from consistent hash ring: %w", err)
+	}
+
+	replicas := make([]Node, len(nodeIDs))
+	for i, nodeID := range nodeIDs {
+		node, ok := r.nodes[nodeID]
+		if !ok {
+			return nil, fmt.Errorf("node %s found in ring but not in node map", nodeID)
+		}
+		replicas[i] = node
+	}
+	return replicas, nil
+}
+
+// ReplicasForKey returns the nodes holding the partition of a table with the
+// given hash key value, primary first.
+func (r *Router) ReplicasForKey(tableName string, hashKey *types.AttributeValue) ([]Node, error) {
+	partitionKey, err := storage.PartitionKey(tableName, hashKey)
+	if err != nil {
+		return nil, err
+	}
+	return r.GetReplicas(partitionKey)
+}
+
+// writeReplicas applies a write to every replica of an item in parallel,
+// and returns once as many replicas as the write quorum have acknowledged
+// it, with the response of the first of them in replica order. The writes
+// to the other replicas go on in the background. When the quorum cannot be
+// reached, writeReplicas waits for every replica and returns the error of
+// the first that failed: the primary's error as is, so that the caller sees
+// the exception the write raised. While partitions move, the item written
+// is then copied to the nodes taking its partition over.
+func (r *Router) writeReplicas(tableName string, key map[string]*types.AttributeValue, write func(client storage.Storage) (interface{}, error)) (interface{}, error) {
+	done := r.beginWrite()
+	resp, err := r.applyToReplicas(tableName, key, write)
+	if err != nil && storage.ExceptionName(err) != "" {
+		// Every replica refuses a write storage refuses.
+		done()
+	} else {
+		done(itemKey{tableName: tableName, key: key})
+	}
+	return resp, err
+}
+
+// applyToReplicas applies a write to the replicas of an item, as described
+// for writeReplicas.
+func (r *Router) applyToReplicas(tableName string, key map[string]*types.AttributeValue, write func(client storage.Storage) (interface{}, error)) (interface{}, error) {
+	replicas, err := r.replicasForKey(tableName, key)
+	if err != nil {
+		return nil, err
+	}
+	acks := r.acksNeeded(len(replicas))
+
+	type result struct {
+		i    int
+		resp interface{}
+		err  error
+	}
+	results := make(chan result, len(replicas))
+	for i, node := range replicas {
+		go func(i int, node Node) {
+			client, err := r.getClientForNode(node)
+			var resp interface{}
+			if err == nil {
+				resp, err = write(client)
+			}
+			results <- result{i, resp, err}
+		}(i, node)
+	}
+
+	responses := make([]interface{}, len(replicas))
+	ackedBy := make([]bool, len(replicas))
+	errs := make([]error, len(replicas))
+	acked := 0
+	for range replicas {
+		res := <-results
+		if res.err != nil {
+			errs[res.i] = res.err
+			continue
+		}
+		responses[res.i], ackedBy[res.i] = res.resp, true
+		acked++
+		if acked == acks {
+			for i := range replicas {
+				if ackedBy[i] {
+					return responses[i], nil
+				}
+			}
+		}
+	}
+
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		if i == 0 {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to write to replica %s: %w", replicas[i].ID, err)
+	}
+	return nil, fmt.Errorf("%d of %d replicas acknowledged the write", acked, acks)
+}
+
+// writeNewest applies a write whose outcome depends on the item it
+// replaces: a Put or a Delete with a condition, or an Update. Rather than
+// each replica judging the write against its own copy, which may be
+// missing writes the others have, the router reads the copies of as many
+// replicas as a consistent read, and compute derives from the newest the
+// item to write, or nil to delete it. That result is then written to every
+// replica, as writeReplicas does, unconditionally and with a new version.
+// The item stays locked from the read to the write, so that no other write
+// to it comes in between. writeNewest returns the item
+// replaced and the item written.
+func (r *Router) writeNewest(tableName string, key map[string]*types.AttributeValue, compute func(old map[string]*types.AttributeValue) (map[string]*types.AttributeValue, error)) (old, item map[string]*types.AttributeValue, err error) {
+	unlock, err := r.lockItems([]itemKey{{tableName: tableName, key: key}})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer unlock()
+
+	replicas, err := r.replicasForKey(tableName, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	versionsReq := &types.GetItemVersionsRequest{TableName: tableName, Keys: []map[string]*types.AttributeValue{key}}
+	copies, answered, err := r.readVersions(versionsReq, replicas, r.readsNeeded(true))
+	if err != nil {
+		return nil, nil, err
+	}
+	old = copies[newestReplica(copies, answered, 0)].Items[0].Item
+	item, err = compute(old)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	version := r.newVersion()
+	_, err = r.writeReplicas(tableName, key, func(client storage.Storage) (interface{}, error) {
+		if item == nil {
+			return client.Delete(&types.DeleteRequest{TableName: tableName, Key: key, Version: version})
+		}
+		return client.Put(&types.PutRequest{TableName: tableName, Item: item, Version: version})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return old, item, nil
+}
+
+// lockItems takes the locks serializing the writes to the given items, and
+// returns the function releasing them. Every write the router applies takes
+// the locks of its items, so that writeNewest judges a write against a copy
+// no other write is replacing. Items share a fixed set of locks, taken in
+// order so that writes of several items cannot deadlock.
+func (r *Router) lockItems(items []itemKey) (func(), error) {
+	stripes := make(map[int]bool, len(items))
+	for _, item := range items {
+		keys, err := r.tableKeys(item.tableName)
+		if err != nil {
+			return nil, err
+		}
+		name, err := keyName(keys.primaryKey(item.key))
+		if err != nil {
+			return nil, err
+		}
+		h := fnv.New32a()
+		h.Write([]byte(item.tableName + "\x00" + name))
+		stripes[int(h.Sum32()%uint32(len(r.itemLocks)))] = true
+	}
+	order := make([]int, 0, len(stripes))
+	for i := range stripes {
+		order = append(order, i)
+	}
+	sort.Ints(order)
+	for _, i := range order {
+		r.itemLocks[i].Lock()
+	}
+	return func() {
+		for _, i := range order {
+			r.itemLocks[i].Unlock()
+		}
+	}, nil
+}
+
+// matchCondition evaluates a write's condition against the item it
+// replaces, which is nil if there is none.
+func matchCondition(cond *expression.Condition, item map[string]*types.AttributeValue) error {
+	if item == nil {
+		item = map[string]*types.AttributeValue{}
+	}
+	ok, err := cond.Matches(item)
+	if err != nil {
+		return storage.NewValidationError("invalid ConditionExpression: %w", err)
+	}
+	if !ok {
+		return storage.ErrConditionalCheckFailed
+	}
+	return nil
+}
+
+// parseCondition parses an optional ConditionExpression. An empty
+// expression yields a nil condition, which every item matches.
+func parseCondition(expr string, names map[string]string, values map[string]*types.AttributeValue) (*expression.Condition, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	cond, err := expression.ParseConditionExpression(expr, names, values)
+	if err != nil {
+		return nil, storage.NewValidationError("invalid ConditionExpression: %w", err)
+	}
+	return cond, nil
+}
+
+// readReplicas reads from k of the given replicas in parallel, replacing a
+// replica that fails by the next one in replica order, and returns the
+// indexes of those that answered, in order. An error raised by storage is
+// an answer, as every replica would give it, and is returned as is.
+func (r *Router) readReplicas(replicas []Node, k int, read func(i int, client storage.Storage) error) ([]int, error) {
+	k = min(k, len(replicas))
+	var answered []int
+	var firstErr error
+	next := 0
+	for len(answered) < k && next < len(replicas) {
+		var batch []int
+		for len(answered)+len(batch) < k && next < len(replicas) {
+			batch = append(batch, next)
+			next++
+		}
+
+		errs := make([]error, len(batch))
+		var wg sync.WaitGroup
+		for j, i := range batch {
+			wg.Add(1)
+			go func(j, i int) {
+				defer wg.Done()
+				client, err := r.getClientForNode(replicas[i])
+				if err == nil {
+					err = read(i, client)
+				}
+				errs[j] = err
+			}(j, i)
+		}
+		wg.Wait()
+
+		for j, i := range batch {
+			switch err := errs[j]; {
+			case err == nil:
+				answered = append(answered, i)
+			case storage.ExceptionName(err) != "":
+				return nil, err
+			case firstErr == nil:
+				firstErr = fmt.Errorf("failed to read from replica %s: %w", replicas[i].ID, err)
+			}
+		}
+	}
+
+	if len(answered) < k {
+		if len(answered) == 0 {
+			return nil, firstErr
+		}
+		return nil, fmt.Errorf("%d of %d replicas answered: %w", len(answered), k, firstErr)
+	}
+	sort.Ints(answered)
+	return answered, nil
+}
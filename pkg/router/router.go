@@ -2,7 +2,9 @@ package router
 
 import (
 	"fmt"
+	"reflect"
 	"sync"
+	"time"
 
 	"github.com/stathat/consistent"
 	"zagreb/pkg/expression"
@@ -35,6 +37,33 @@ type Router struct {
 	mu                sync.RWMutex
 	nodeClients       map[string]storage.Storage // Map node ID to its storage client
 	nodeClientFactory NodeClientFactory
+	replicationFactor int // Number of nodes holding a copy of each item
+	writeQuorum       int // Number of replicas acknowledging a write, 0 for all
+	readQuorum        int // Number of replicas a read reconciles
+
+	members map[string]*member // Map node ID to every registered node, in the ring or not
+	health  HealthConfig
+	now     func() time.Time // Clock of the health checks
+
+	healthMu   sync.Mutex
+	stopHealth chan struct{} // Closed to stop the health checks
+	healthDone chan struct{} // Closed when the health checks have stopped
+
+	rebalanceBatchSize int          // Number of items read at a time when moving partitions
+	rebalanceMu        sync.Mutex   // Held while the ring changes
+	moveMu             sync.RWMutex // Held for reading by writes, which the end of a move waits for
+	move               *move        // The change of the ring in progress, if any
+
+	versionMu   sync.Mutex
+	lastVersion int64 // Version of the last write
+
+	itemLocks [64]sync.Mutex // Serialize the writes to an item, by hash of the item
+
+	txLogMu sync.Mutex
+	txLog   *transactionLog // Two-phase commits not yet committed or aborted on every node
+
+	tablesMu sync.Mutex
+	tables   map[string]*tableKeys // Map table name to its cached keys
 }
 
 // NewRouter creates a new Router instance.
@@ -43,32 +72,46 @@ func NewRouter(factory NodeClientFactory) *Router {
 		factory = &defaultNodeClientFactory{}
 	}
 	return &Router{
-		consistent:        consistent.New(),
-		nodes:             make(map[string]Node),
-		nodeClients:       make(map[string]storage.Storage),
-		nodeClientFactory: factory,
+		consistent:         consistent.New(),
+		nodes:              make(map[string]Node),
+		nodeClients:        make(map[string]storage.Storage),
+		nodeClientFactory:  factory,
+		replicationFactor:  DefaultReplicationFactor,
+		readQuorum:         1,
+		members:            make(map[string]*member),
+		health:             DefaultHealthConfig,
+		now:                time.Now,
+		rebalanceBatchSize: DefaultRebalanceBatchSize,
+		tables:             make(map[string]*tableKeys),
+		txLog:              newTransactionLog(),
 	}
 }
 
-// AddNode adds a new node to the consistent hash ring.
+// AddNode adds a new node to the consistent hash ring, as alive.
 func (r *Router) AddNode(node Node) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	r.consistent.Add(node.ID)
-	r.nodes[node.ID] = node
-	client := r.nodeClientFactory.NewNodeClient(node.Addr)
-	r.nodeClients[node.ID] = client
+	now := r.now()
+	m := &member{
+		node:     node,
+		client:   r.nodeClientFactory.NewNodeClient(node.Addr),
+		state:    NodeAlive,
+		lastSeen: now,
+		since:    now,
+	}
+	r.members[node.ID] = m
+	r.joinRing(m)
 }
 
-// RemoveNode removes a node from the consistent hash ring.
+// RemoveNode removes a node from the consistent hash ring, and stops
+// checking its health.
 func (r *Router) RemoveNode(nodeID string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	r.consistent.Remove(nodeID)
-	delete(r.nodes, nodeID)
-	delete(r.nodeClients, nodeID)
+	r.leaveRing(nodeID)
+	delete(r.members, nodeID)
 }
 
 // GetActiveNodes returns a slice of all currently active nodes.
@@ -108,6 +151,11 @@ func (r *Router) GetNode(key string) (Node, error) {
 func (r *Router) getClientForNode(node Node) (storage.Storage, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
+	return r.clientForNodeLocked(node)
+}
+
+// clientForNodeLocked is getClientForNode for callers holding r.mu.
+func (r *Router) clientForNodeLocked(node Node) (storage.Storage, error) {
 	client, ok := r.nodeClients[node.ID]
 	if !ok {
 		return nil, fmt.Errorf("no client found for node %s", node.ID)
@@ -115,20 +163,46 @@ func (r *Router) getClientForNode(node Node) (storage.Storage, error) {
 	return client, nil
 }
 
-// CreateTable routes the CreateTable request to the appropriate node.
-func (r *Router) CreateTable(req *types.CreateTableRequest) (*types.CreateTableResponse, error) {
+// ringClient is a node in the ring with its client, or the error getting it.
+type ringClient struct {
+	node   Node
+	client storage.Storage
+	err    error
+}
+
+// ringClients returns every node in the ring with its client. The nodes are
+// then called without r.mu, which heartbeats and health checks wait on.
+func (r *Router) ringClients() []ringClient {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
+	clients := make([]ringClient, 0, len(r.nodes))
+	for _, node := range r.nodes {
+		client, err := r.clientForNodeLocked(node)
+		clients = append(clients, ringClient{node: node, client: client, err: err})
+	}
+	return clients
+}
 
-	if len(r.nodes) == 0 {
+// CreateTable routes the CreateTable request to all nodes, as every node
+// holds the definition of every table.
+func (r *Router) CreateTable(req *types.CreateTableRequest) (*types.CreateTableResponse, error) {
+	r.forgetTable(req.TableName)
+	if spec := req.StreamSpecification; spec != nil && spec.StreamEnabled {
+		labelled := *req
+		labelled.LatestStreamLabel = newStreamLabel()
+		req = &labelled
+	}
+
+	nodes := r.ringClients()
+	if len(nodes) == 0 {
 		return nil, fmt.Errorf("no nodes in the ring to create table")
 	}
 
 	var firstResp *types.CreateTableResponse
 	var firstErr error
 
-	for _, node := range r.nodes {
-		client, err := r.getClientForNode(node)
+	for _, rc := range nodes {
+		node, client, err := rc.node, rc.client, rc.err
 		if err != nil {
 			if firstErr == nil {
 				firstErr = fmt.Errorf("failed to get client for node %s: %w", node.ID, err)
@@ -154,20 +228,20 @@ func (r *Router) CreateTable(req *types.CreateTableRequest) (*types.CreateTableR
 	return firstResp, nil
 }
 
-// DeleteTable routes the DeleteTable request to the appropriate node.
+// DeleteTable routes the DeleteTable request to all nodes.
 func (r *Router) DeleteTable(req *types.DeleteTableRequest) (*types.DeleteTableResponse, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+	r.forgetTable(req.TableName)
 
-	if len(r.nodes) == 0 {
+	nodes := r.ringClients()
+	if len(nodes) == 0 {
 		return nil, fmt.Errorf("no nodes in the ring to delete table")
 	}
 
 	var firstResp *types.DeleteTableResponse
 	var firstErr error
 
-	for _, node := range r.nodes {
-		client, err := r.getClientForNode(node)
+	for _, rc := range nodes {
+		node, client, err := rc.node, rc.client, rc.err
 		if err != nil {
 			if firstErr == nil {
 				firstErr = fmt.Errorf("failed to get client for node %s: %w", node.ID, err)
@@ -206,22 +280,116 @@ func (r *Router) DescribeTable(req *types.DescribeTableRequest) (*types.Describe
 	return client.DescribeTable(req)
 }
 
+// UpdateTable routes the UpdateTable request to all nodes, as every node
+// holds the definition of every table.
+func (r *Router) UpdateTable(req *types.UpdateTableRequest) (*types.UpdateTableResponse, error) {
+	// The table's indexes may change.
+	r.forgetTable(req.TableName)
+	if spec := req.StreamSpecification; spec != nil && spec.StreamEnabled {
+		labelled := *req
+		labelled.LatestStreamLabel = newStreamLabel()
+		req = &labelled
+	}
+
+	nodes := r.ringClients()
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no nodes in the ring to update table")
+	}
+
+	var firstResp *types.UpdateTableResponse
+	var firstErr error
+
+	for _, rc := range nodes {
+		node, client, err := rc.node, rc.client, rc.err
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to get client for node %s: %w", node.ID, err)
+			}
+			continue
+		}
+		resp, err := client.UpdateTable(req)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to update table on node %s: %w", node.ID, err)
+			}
+		} else if firstResp == nil {
+			firstResp = resp
+		}
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if firstResp == nil {
+		return nil, fmt.Errorf("no successful responses from nodes for UpdateTable")
+	}
+	return firstResp, nil
+}
+
+// UpdateTimeToLive routes the UpdateTimeToLive request to all nodes, as
+// every node holds the definition of every table.
+func (r *Router) UpdateTimeToLive(req *types.UpdateTimeToLiveRequest) (*types.UpdateTimeToLiveResponse, error) {
+	nodes := r.ringClients()
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no nodes in the ring to update time to live")
+	}
+
+	var firstResp *types.UpdateTimeToLiveResponse
+	var firstErr error
+
+	for _, rc := range nodes {
+		node, client, err := rc.node, rc.client, rc.err
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to get client for node %s: %w", node.ID, err)
+			}
+			continue
+		}
+		resp, err := client.UpdateTimeToLive(req)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to update time to live on node %s: %w", node.ID, err)
+			}
+		} else if firstResp == nil {
+			firstResp = resp
+		}
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if firstResp == nil {
+		return nil, fmt.Errorf("no successful responses from nodes for UpdateTimeToLive")
+	}
+	return firstResp, nil
+}
+
+// DescribeTimeToLive routes the DescribeTimeToLive request to the appropriate node.
+func (r *Router) DescribeTimeToLive(req *types.DescribeTimeToLiveRequest) (*types.DescribeTimeToLiveResponse, error) {
+	node, err := r.GetNode(req.TableName)
+	if err != nil {
+		return nil, err
+	}
+	client, err := r.getClientForNode(node)
+	if err != nil {
+		return nil, err
+	}
+	return client.DescribeTimeToLive(req)
+}
+
 // ListTables routes the ListTables request to all nodes and aggregates the results.
 func (r *Router) ListTables(req *types.ListTablesRequest) (*types.ListTablesResponse, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-
-	if len(r.nodes) == 0 {
+	nodes := r.ringClients()
+	if len(nodes) == 0 {
 		return nil, fmt.Errorf("no nodes in the ring")
 	}
 
 	allTableNames := make(map[string]struct{})
-	for _, node := range r.nodes {
-		client, err := r.getClientForNode(node)
-		if err != nil {
-			return nil, err
+	for _, rc := range nodes {
+		if rc.err != nil {
+			return nil, rc.err
 		}
-		resp, err := client.ListTables(req)
+		resp, err := rc.client.ListTables(req)
 		if err != nil {
 			return nil, err
 		}
@@ -238,161 +406,541 @@ func (r *Router) ListTables(req *types.ListTablesRequest) (*types.ListTablesResp
 	return &types.ListTablesResponse{TableNames: result}, nil
 }
 
-// Put routes the Put request to the appropriate node.
-func (r *Router) Put(req *types.PutRequest) error {
-	node, err := r.GetNode(req.TableName)
+// Put applies the Put request on every replica of the item, stamped with a
+// new version. A conditional Put is applied as writeNewest describes.
+func (r *Router) Put(req *types.PutRequest) (*types.PutItemResponse, error) {
+	if req.ConditionExpression != "" {
+		return r.putNewest(req)
+	}
+	unlock, err := r.lockItems([]itemKey{{tableName: req.TableName, key: req.Item}})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	client, err := r.getClientForNode(node)
+	defer unlock()
+
+	nodeReq := *req
+	nodeReq.Version = r.newVersion()
+	resp, err := r.writeReplicas(req.TableName, req.Item, func(client storage.Storage) (interface{}, error) {
+		return client.Put(&nodeReq)
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return client.Put(req)
+	return resp.(*types.PutItemResponse), nil
 }
 
-// Get routes the Get request to the appropriate node.
-func (r *Router) Get(req *types.GetRequest) (map[string]*expression.AttributeValue, error) {
-	node, err := r.GetNode(req.TableName)
+// putNewest applies a conditional Put, checking its condition against the
+// newest copy of the item.
+func (r *Router) putNewest(req *types.PutRequest) (*types.PutItemResponse, error) {
+	if err := storage.ValidateReturnValues(req.ReturnValues, types.ReturnValuesNone, types.ReturnValuesAllOld); err != nil {
+		return nil, err
+	}
+	keys, err := r.tableKeys(req.TableName)
 	if err != nil {
 		return nil, err
 	}
-	client, err := r.getClientForNode(node)
+	for _, name := range []string{keys.hashKey, keys.rangeKey} {
+		if _, ok := req.Item[name]; name != "" && !ok {
+			return nil, storage.NewValidationError("missing key attribute: %s", name)
+		}
+	}
+	cond, err := parseCondition(req.ConditionExpression, req.ExpressionAttributeNames, req.ExpressionAttributeValues)
 	if err != nil {
 		return nil, err
 	}
-	return client.Get(req)
+
+	old, _, err := r.writeNewest(req.TableName, keys.primaryKey(req.Item), func(old map[string]*types.AttributeValue) (map[string]*types.AttributeValue, error) {
+		if err := matchCondition(cond, old); err != nil {
+			return nil, err
+		}
+		return req.Item, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp := &types.PutItemResponse{}
+	if req.ReturnValues == types.ReturnValuesAllOld {
+		resp.Attributes = old
+	}
+	return resp, nil
 }
 
-// Delete routes the Delete request to the appropriate node.
-func (r *Router) Delete(req *types.DeleteRequest) error {
-	node, err := r.GetNode(req.TableName)
+// Get reads the item from the first of its replicas that answers, or, when
+// a read needs several replicas, returns the newest of their copies.
+func (r *Router) Get(req *types.GetRequest) (map[string]*expression.AttributeValue, error) {
+	replicas, err := r.replicasForKey(req.TableName, req.Key)
 	if err != nil {
+		return nil, err
+	}
+	if reads := r.readsNeeded(req.ConsistentRead); reads > 1 {
+		return r.getNewest(req, replicas, reads)
+	}
+
+	var item map[string]*expression.AttributeValue
+	_, err = r.readReplicas(replicas, 1, func(i int, client storage.Storage) error {
+		var err error
+		item, err = client.Get(req)
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	client, err := r.getClientForNode(node)
+	return item, nil
+}
+
+// Delete applies the Delete request on every replica of the item, stamped
+// with a new version. A conditional Delete is applied as writeNewest
+// describes.
+func (r *Router) Delete(req *types.DeleteRequest) (*types.DeleteItemResponse, error) {
+	if req.ConditionExpression != "" {
+		return r.deleteNewest(req)
+	}
+	unlock, err := r.lockItems([]itemKey{{tableName: req.TableName, key: req.Key}})
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer unlock()
+
+	nodeReq := *req
+	nodeReq.Version = r.newVersion()
+	resp, err := r.writeReplicas(req.TableName, req.Key, func(client storage.Storage) (interface{}, error) {
+		return client.Delete(&nodeReq)
+	})
+	if err != nil {
+		return nil, err
 	}
-	return client.Delete(req)
+	return resp.(*types.DeleteItemResponse), nil
 }
 
-// Update routes the Update request to the appropriate node.
-func (r *Router) Update(req *types.UpdateRequest) (map[string]*expression.AttributeValue, error) {
-	node, err := r.GetNode(req.TableName)
+// deleteNewest applies a conditional Delete, checking its condition against
+// the newest copy of the item.
+func (r *Router) deleteNewest(req *types.DeleteRequest) (*types.DeleteItemResponse, error) {
+	if err := storage.ValidateReturnValues(req.ReturnValues, types.ReturnValuesNone, types.ReturnValuesAllOld); err != nil {
+		return nil, err
+	}
+	cond, err := parseCondition(req.ConditionExpression, req.ExpressionAttributeNames, req.ExpressionAttributeValues)
 	if err != nil {
 		return nil, err
 	}
-	client, err := r.getClientForNode(node)
+
+	old, _, err := r.writeNewest(req.TableName, req.Key, func(old map[string]*types.AttributeValue) (map[string]*types.AttributeValue, error) {
+		return nil, matchCondition(cond, old)
+	})
 	if err != nil {
 		return nil, err
 	}
-	return client.Update(req)
+	resp := &types.DeleteItemResponse{}
+	if req.ReturnValues == types.ReturnValuesAllOld {
+		resp.Attributes = old
+	}
+	return resp, nil
 }
 
-// Query routes the Query request to the appropriate node.
-func (r *Router) Query(req *types.QueryRequest) ([]map[string]*expression.AttributeValue, error) {
-	node, err := r.GetNode(req.TableName)
+// Update applies the Update request to the newest copy of the item, as
+// writeNewest describes, and writes the updated item to every replica.
+func (r *Router) Update(req *types.UpdateRequest) (*types.UpdateItemResponse, error) {
+	if err := storage.ValidateReturnValues(req.ReturnValues, types.ReturnValuesNone, types.ReturnValuesAllOld, types.ReturnValuesUpdatedOld, types.ReturnValuesAllNew, types.ReturnValuesUpdatedNew); err != nil {
+		return nil, err
+	}
+	update, cond, err := r.parseUpdate(req)
 	if err != nil {
 		return nil, err
 	}
-	client, err := r.getClientForNode(node)
+
+	old, item, err := r.writeNewest(req.TableName, req.Key, func(old map[string]*types.AttributeValue) (map[string]*types.AttributeValue, error) {
+		if err := matchCondition(cond, old); err != nil {
+			return nil, err
+		}
+		return updatedItem(update, req.Key, old)
+	})
 	if err != nil {
 		return nil, err
 	}
-	return client.Query(req)
+
+	resp := &types.UpdateItemResponse{}
+	switch req.ReturnValues {
+	case types.ReturnValuesAllOld:
+		resp.Attributes = old
+	case types.ReturnValuesUpdatedOld:
+		resp.Attributes = update.UpdatedAttributes(old)
+	case types.ReturnValuesAllNew:
+		resp.Attributes = item
+	case types.ReturnValuesUpdatedNew:
+		resp.Attributes = update.UpdatedAttributes(item)
+	}
+	if len(resp.Attributes) == 0 {
+		resp.Attributes = nil
+	}
+	return resp, nil
 }
 
-// Scan routes the Scan request to all nodes and aggregates the results.
-func (r *Router) Scan(req *types.ScanRequest) (*types.ScanResponse, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+// parseUpdate parses the update and the condition of an Update, which must
+// not modify the item's key.
+func (r *Router) parseUpdate(req *types.UpdateRequest) (*expression.UpdateExpression, *expression.Condition, error) {
+	keys, err := r.tableKeys(req.TableName)
+	if err != nil {
+		return nil, nil, err
+	}
+	update, err := expression.ParseUpdateExpression(req.UpdateExpression, req.ExpressionAttributeNames, req.ExpressionAttributeValues)
+	if err != nil {
+		return nil, nil, storage.NewValidationError("invalid UpdateExpression: %w", err)
+	}
+	for _, name := range []string{keys.hashKey, keys.rangeKey} {
+		if name != "" && update.Modifies(name) {
+			return nil, nil, storage.NewValidationError("cannot update attribute %s: this attribute is part of the key", name)
+		}
+	}
+	cond, err := parseCondition(req.ConditionExpression, req.ExpressionAttributeNames, req.ExpressionAttributeValues)
+	if err != nil {
+		return nil, nil, err
+	}
+	return update, cond, nil
+}
+
+// updatedItem applies an update to a copy of the item it replaces.
+func updatedItem(update *expression.UpdateExpression, key, old map[string]*types.AttributeValue) (map[string]*types.AttributeValue, error) {
+	item := expression.CopyItem(old)
+	if item == nil {
+		// Like DynamoDB, updating a missing item creates it from its key.
+		item = make(map[string]*types.AttributeValue)
+		for name, v := range key {
+			item[name] = v
+		}
+	}
+	if err := update.Apply(item); err != nil {
+		return nil, storage.NewValidationError("invalid UpdateExpression: %w", err)
+	}
+	return item, nil
+}
 
-	if len(r.nodes) == 0 {
+// Query reads the partition it queries from the first of its replicas that
+// answers, or merges the pages of several when a read needs them. A query
+// of a global index is sent to every node, and the pages they return are
+// merged.
+func (r *Router) Query(req *types.QueryRequest) (*types.QueryResponse, error) {
+	partition, keys, err := r.queryPartition(req)
+	if err != nil {
+		return nil, err
+	}
+	if partition == nil {
+		return r.queryGlobalIndex(req, keys)
+	}
+	replicas, err := r.replicasForKey(req.TableName, partition)
+	if err != nil {
+		return nil, err
+	}
+	if reads := r.readsNeeded(req.ConsistentRead); reads > 1 {
+		return r.queryReplicas(req, keys, replicas, reads)
+	}
+
+	var resp *types.QueryResponse
+	_, err = r.readReplicas(replicas, 1, func(i int, client storage.Storage) error {
+		var err error
+		resp, err = client.Query(req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Scan reads the partitions of every node, one node after the other.
+func (r *Router) Scan(req *types.ScanRequest) (*types.ScanResponse, error) {
+	nodes := r.sortedNodes()
+	if len(nodes) == 0 {
 		return nil, fmt.Errorf("no nodes in the ring to perform scan")
 	}
+	return r.scanNodes(nodes, req, func(client storage.Storage, req *types.ScanRequest) (*types.ScanResponse, error) {
+		return client.Scan(req)
+	})
+}
 
-	var allItems []map[string]*expression.AttributeValue
-	var totalScannedCount int
-	var lastEvaluatedKey map[string]*expression.AttributeValue // Simplified: last one processed
-	var firstErr error
+// InternalScan reads the partitions of every node, one node after the
+// other, as Scan does.
+func (r *Router) InternalScan(req *types.ScanRequest) (*types.ScanResponse, error) {
+	nodes := r.sortedNodes()
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no nodes in the ring to perform internal scan")
+	}
+	return r.scanNodes(nodes, req, func(client storage.Storage, req *types.ScanRequest) (*types.ScanResponse, error) {
+		return client.InternalScan(req)
+	})
+}
 
-	for _, node := range r.nodes {
-		client, err := r.getClientForNode(node)
-		if err != nil {
-			if firstErr == nil {
-				firstErr = fmt.Errorf("failed to get client for node %s: %w", node.ID, err)
+// BatchWriteItem stamps every write with a version, as Put and Delete do,
+// splits the batch by node, each write going to every replica of its item,
+// and sends the parts to the nodes in parallel. A write is processed once
+// the write quorum of its replicas has applied it, and BatchWriteItem
+// returns as soon as every write is processed or can no longer be, the
+// parts still running going on in the background. The other writes come
+// back as unprocessed items for the caller to retry; the batch only fails
+// as a whole when none is processed. While partitions move, the items are
+// then copied as for writeReplicas.
+func (r *Router) BatchWriteItem(req *types.BatchWriteItemRequest) (*types.BatchWriteItemResponse, error) {
+	if err := storage.ValidateBatchWriteItem(req); err != nil {
+		return nil, err
+	}
+
+	var items []itemKey
+	for tableName, tableWrites := range req.RequestItems {
+		for _, write := range tableWrites {
+			if write.PutRequest != nil {
+				items = append(items, itemKey{tableName: tableName, key: write.PutRequest.Item})
+			} else {
+				items = append(items, itemKey{tableName: tableName, key: write.DeleteRequest.Key})
 			}
-			continue
 		}
-		resp, err := client.Scan(req)
-		if err != nil {
-			if firstErr == nil {
-				firstErr = fmt.Errorf("failed to scan on node %s: %w", node.ID, err)
+	}
+	unlock, err := r.lockItems(items)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var written []itemKey
+	done := r.beginWrite()
+	defer func() { done(written...) }()
+
+	// batchWrite is a write of the batch, as the caller sent it and as the
+	// replicas of its item are sent it, with how many of them applied it and
+	// how many failed to.
+	type batchWrite struct {
+		tableName         string
+		original, stamped *types.WriteRequest
+		replicas, needed  int
+		acked, failed     int
+	}
+	var writes []*batchWrite
+	nodes := make(map[string]Node)
+	parts := make(map[string]*types.BatchWriteItemRequest)
+	partWrites := make(map[string][]*batchWrite)
+	for tableName, tableWrites := range req.RequestItems {
+		for _, write := range tableWrites {
+			stamped := &types.WriteRequest{}
+			var key map[string]*types.AttributeValue
+			if write.PutRequest != nil {
+				put := *write.PutRequest
+				put.Version = r.newVersion()
+				stamped.PutRequest, key = &put, put.Item
+			} else {
+				del := *write.DeleteRequest
+				del.Version = r.newVersion()
+				stamped.DeleteRequest, key = &del, del.Key
+			}
+			written = append(written, itemKey{tableName: tableName, key: key})
+			replicas, err := r.replicasForKey(tableName, key)
+			if err != nil {
+				return nil, err
+			}
+			w := &batchWrite{
+				tableName: tableName,
+				original:  write,
+				stamped:   stamped,
+				replicas:  len(replicas),
+				needed:    r.acksNeeded(len(replicas)),
+			}
+			writes = append(writes, w)
+			for _, node := range replicas {
+				part, ok := parts[node.ID]
+				if !ok {
+					part = &types.BatchWriteItemRequest{RequestItems: make(map[string][]*types.WriteRequest)}
+					parts[node.ID] = part
+					nodes[node.ID] = node
+				}
+				part.RequestItems[tableName] = append(part.RequestItems[tableName], stamped)
+				partWrites[node.ID] = append(partWrites[node.ID], w)
 			}
-			continue
 		}
-		allItems = append(allItems, resp.Items...)
-		totalScannedCount += resp.ScannedCount
-		if resp.LastEvaluatedKey != nil {
-			lastEvaluatedKey = resp.LastEvaluatedKey
+	}
+
+	type partResult struct {
+		nodeID      string
+		unprocessed map[string][]*types.WriteRequest
+		err         error
+	}
+	results := make(chan partResult, len(parts))
+	for nodeID, part := range parts {
+		go func(node Node, part *types.BatchWriteItemRequest) {
+			res := partResult{nodeID: node.ID}
+			client, err := r.getClientForNode(node)
+			if err == nil {
+				var nodeResp *types.BatchWriteItemResponse
+				nodeResp, err = client.BatchWriteItem(part)
+				if err == nil {
+					res.unprocessed = nodeResp.UnprocessedItems
+				}
+			}
+			if err != nil {
+				res.err = fmt.Errorf("failed to write batch on node %s: %w", node.ID, err)
+			}
+			results <- res
+		}(nodes[nodeID], part)
+	}
+
+	// A write is decided once its quorum is reached, or once too many of
+	// its replicas failed for it to be.
+	undecided := len(writes)
+	var firstErr error
+	for received := 0; received < len(parts) && undecided > 0; received++ {
+		res := <-results
+		if res.err != nil && firstErr == nil {
+			firstErr = res.err
+		}
+		for _, w := range partWrites[res.nodeID] {
+			applied := res.err == nil
+			for _, unprocessed := range res.unprocessed[w.tableName] {
+				if reflect.DeepEqual(unprocessed, w.stamped) {
+					applied = false
+				}
+			}
+			if applied {
+				if w.acked++; w.acked == w.needed {
+					undecided--
+				}
+			} else if w.failed++; w.failed == w.replicas-w.needed+1 {
+				undecided--
+			}
 		}
 	}
 
-	if firstErr != nil {
+	resp := &types.BatchWriteItemResponse{UnprocessedItems: make(map[string][]*types.WriteRequest)}
+	processed := 0
+	for _, w := range writes {
+		if w.acked >= w.needed {
+			processed++
+			continue
+		}
+		resp.UnprocessedItems[w.tableName] = append(resp.UnprocessedItems[w.tableName], w.original)
+	}
+	if processed == 0 && firstErr != nil {
 		return nil, firstErr
 	}
-
-	return &types.ScanResponse{
-		Items:            allItems,
-		LastEvaluatedKey: lastEvaluatedKey,
-		ScannedCount:     totalScannedCount,
-	}, nil
+	return resp, nil
 }
 
-// InternalScan routes the InternalScan request to all nodes and aggregates the results.
-func (r *Router) InternalScan(req *types.ScanRequest) (*types.ScanResponse, error) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+// batchKey is a key of a BatchGetItem request, with the replicas it may
+// still be read from.
+type batchKey struct {
+	tableName string
+	key       map[string]*types.AttributeValue
+	replicas  []Node
+}
 
-	if len(r.nodes) == 0 {
-		return nil, fmt.Errorf("no nodes in the ring to perform internal scan")
+// BatchGetItem reads each key from the first of its replicas that answers.
+// The keys are grouped by node and the parts read in parallel, and the keys
+// of a part whose node fails are read again from their next replica. Keys
+// that no replica could read come back as unprocessed keys for the caller to
+// retry; the batch only fails as a whole when no node answers.
+func (r *Router) BatchGetItem(req *types.BatchGetItemRequest) (*types.BatchGetItemResponse, error) {
+	if err := storage.ValidateBatchGetItem(req); err != nil {
+		return nil, err
 	}
 
-	var allItems []map[string]*expression.AttributeValue
-	var totalScannedCount int
-	var lastEvaluatedKey map[string]*expression.AttributeValue // Simplified: last one processed
-	var firstErr error
-
-	for _, node := range r.nodes {
-		client, err := r.getClientForNode(node)
-		if err != nil {
-			if firstErr == nil {
-				firstErr = fmt.Errorf("failed to get client for node %s: %w", node.ID, err)
+	var pending []*batchKey
+	for tableName, ka := range req.RequestItems {
+		for _, key := range ka.Keys {
+			replicas, err := r.replicasForKey(tableName, key)
+			if err != nil {
+				return nil, err
 			}
-			continue
+			pending = append(pending, &batchKey{tableName: tableName, key: key, replicas: replicas})
 		}
-		resp, err := client.InternalScan(req)
-		if err != nil {
-			if firstErr == nil {
-				firstErr = fmt.Errorf("failed to internal scan on node %s: %w", node.ID, err)
+	}
+
+	resp := &types.BatchGetItemResponse{
+		Responses:       make(map[string][]map[string]*expression.AttributeValue),
+		UnprocessedKeys: make(map[string]*types.KeysAndAttributes),
+	}
+	var mu sync.Mutex
+	var firstErr error
+	answered := false
+
+	for len(pending) > 0 {
+		nodes := make(map[string]Node)
+		parts := make(map[string]*types.BatchGetItemRequest)
+		partKeys := make(map[string][]*batchKey)
+		for _, bk := range pending {
+			node := bk.replicas[0]
+			part, ok := parts[node.ID]
+			if !ok {
+				part = &types.BatchGetItemRequest{RequestItems: make(map[string]*types.KeysAndAttributes)}
+				parts[node.ID] = part
+				nodes[node.ID] = node
 			}
-			continue
+			addBatchKeys(part.RequestItems, req, bk)
+			partKeys[node.ID] = append(partKeys[node.ID], bk)
 		}
-		allItems = append(allItems, resp.Items...)
-		totalScannedCount += resp.ScannedCount
-		if resp.LastEvaluatedKey != nil {
-			lastEvaluatedKey = resp.LastEvaluatedKey
+		pending = nil
+
+		var wg sync.WaitGroup
+		for nodeID, part := range parts {
+			wg.Add(1)
+			go func(node Node, part *types.BatchGetItemRequest, keys []*batchKey) {
+				defer wg.Done()
+
+				var nodeResp *types.BatchGetItemResponse
+				client, err := r.getClientForNode(node)
+				if err == nil {
+					nodeResp, err = client.BatchGetItem(part)
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = fmt.Errorf("failed to read batch on node %s: %w", node.ID, err)
+					}
+					for _, bk := range keys {
+						bk.replicas = bk.replicas[1:]
+						if len(bk.replicas) > 0 {
+							pending = append(pending, bk)
+						} else {
+							addBatchKeys(resp.UnprocessedKeys, req, bk)
+						}
+					}
+					return
+				}
+				answered = true
+				for tableName, items := range nodeResp.Responses {
+					resp.Responses[tableName] = append(resp.Responses[tableName], items...)
+				}
+				addUnprocessedKeys(resp.UnprocessedKeys, nodeResp.UnprocessedKeys)
+			}(nodes[nodeID], part, partKeys[nodeID])
 		}
+		wg.Wait()
 	}
 
-	if firstErr != nil {
+	if !answered {
 		return nil, firstErr
 	}
+	return resp, nil
+}
 
-	return &types.ScanResponse{
-		Items:            allItems,
-		LastEvaluatedKey: lastEvaluatedKey,
-		ScannedCount:     totalScannedCount,
-	}, nil
+// addBatchKeys adds a key of a BatchGetItem request to a batch of keys, with
+// the projection of its table in the request.
+func addBatchKeys(dst map[string]*types.KeysAndAttributes, req *types.BatchGetItemRequest, bk *batchKey) {
+	ka, ok := dst[bk.tableName]
+	if !ok {
+		ka = &types.KeysAndAttributes{
+			ProjectionExpression:     req.RequestItems[bk.tableName].ProjectionExpression,
+			ExpressionAttributeNames: req.RequestItems[bk.tableName].ExpressionAttributeNames,
+		}
+		dst[bk.tableName] = ka
+	}
+	ka.Keys = append(ka.Keys, bk.key)
+}
+
+// addUnprocessedKeys adds the keys a node did not read to those of the
+// batch, as the keys of a table may be spread over several nodes.
+func addUnprocessedKeys(dst, src map[string]*types.KeysAndAttributes) {
+	for tableName, ka := range src {
+		if existing, ok := dst[tableName]; ok {
+			merged := *existing
+			merged.Keys = append(append([]map[string]*types.AttributeValue(nil), existing.Keys...), ka.Keys...)
+			dst[tableName] = &merged
+			continue
+		}
+		dst[tableName] = ka
+	}
 }
@@ -2,7 +2,11 @@ package router
 
 import (
 	"errors"
+	"fmt"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -31,14 +35,29 @@ func (m *MockStorage) DescribeTable(req *types.DescribeTableRequest) (*types.Des
 	return args.Get(0).(*types.DescribeTableResponse), args.Error(1)
 }
 
+func (m *MockStorage) UpdateTable(req *types.UpdateTableRequest) (*types.UpdateTableResponse, error) {
+	args := m.Called(req)
+	return args.Get(0).(*types.UpdateTableResponse), args.Error(1)
+}
+
+func (m *MockStorage) UpdateTimeToLive(req *types.UpdateTimeToLiveRequest) (*types.UpdateTimeToLiveResponse, error) {
+	args := m.Called(req)
+	return args.Get(0).(*types.UpdateTimeToLiveResponse), args.Error(1)
+}
+
+func (m *MockStorage) DescribeTimeToLive(req *types.DescribeTimeToLiveRequest) (*types.DescribeTimeToLiveResponse, error) {
+	args := m.Called(req)
+	return args.Get(0).(*types.DescribeTimeToLiveResponse), args.Error(1)
+}
+
 func (m *MockStorage) ListTables(req *types.ListTablesRequest) (*types.ListTablesResponse, error) {
 	args := m.Called(req)
 	return args.Get(0).(*types.ListTablesResponse), args.Error(1)
 }
 
-func (m *MockStorage) Put(req *types.PutRequest) error {
+func (m *MockStorage) Put(req *types.PutRequest) (*types.PutItemResponse, error) {
 	args := m.Called(req)
-	return args.Error(0)
+	return args.Get(0).(*types.PutItemResponse), args.Error(1)
 }
 
 func (m *MockStorage) Get(req *types.GetRequest) (map[string]*expression.AttributeValue, error) {
@@ -46,19 +65,19 @@ func (m *MockStorage) Get(req *types.GetRequest) (map[string]*expression.Attribu
 	return args.Get(0).(map[string]*expression.AttributeValue), args.Error(1)
 }
 
-func (m *MockStorage) Delete(req *types.DeleteRequest) error {
+func (m *MockStorage) Delete(req *types.DeleteRequest) (*types.DeleteItemResponse, error) {
 	args := m.Called(req)
-	return args.Error(0)
+	return args.Get(0).(*types.DeleteItemResponse), args.Error(1)
 }
 
-func (m *MockStorage) Update(req *types.UpdateRequest) (map[string]*expression.AttributeValue, error) {
+func (m *MockStorage) Update(req *types.UpdateRequest) (*types.UpdateItemResponse, error) {
 	args := m.Called(req)
-	return args.Get(0).(map[string]*expression.AttributeValue), args.Error(1)
+	return args.Get(0).(*types.UpdateItemResponse), args.Error(1)
 }
 
-func (m *MockStorage) Query(req *types.QueryRequest) ([]map[string]*expression.AttributeValue, error) {
+func (m *MockStorage) Query(req *types.QueryRequest) (*types.QueryResponse, error) {
 	args := m.Called(req)
-	return args.Get(0).([]map[string]*expression.AttributeValue), args.Error(1)
+	return args.Get(0).(*types.QueryResponse), args.Error(1)
 }
 
 func (m *MockStorage) Scan(req *types.ScanRequest) (*types.ScanResponse, error) {
@@ -71,6 +90,81 @@ func (m *MockStorage) InternalScan(req *types.ScanRequest) (*types.ScanResponse,
 	return args.Get(0).(*types.ScanResponse), args.Error(1)
 }
 
+func (m *MockStorage) BatchWriteItem(req *types.BatchWriteItemRequest) (*types.BatchWriteItemResponse, error) {
+	args := m.Called(req)
+	return args.Get(0).(*types.BatchWriteItemResponse), args.Error(1)
+}
+
+func (m *MockStorage) BatchGetItem(req *types.BatchGetItemRequest) (*types.BatchGetItemResponse, error) {
+	args := m.Called(req)
+	return args.Get(0).(*types.BatchGetItemResponse), args.Error(1)
+}
+
+func (m *MockStorage) TransactWriteItems(req *types.TransactWriteItemsRequest) (*types.TransactWriteItemsResponse, error) {
+	args := m.Called(req)
+	return args.Get(0).(*types.TransactWriteItemsResponse), args.Error(1)
+}
+
+func (m *MockStorage) TransactGetItems(req *types.TransactGetItemsRequest) (*types.TransactGetItemsResponse, error) {
+	args := m.Called(req)
+	return args.Get(0).(*types.TransactGetItemsResponse), args.Error(1)
+}
+
+func (m *MockStorage) PrepareTransaction(req *types.PrepareTransactionRequest) (*types.PrepareTransactionResponse, error) {
+	args := m.Called(req)
+	return args.Get(0).(*types.PrepareTransactionResponse), args.Error(1)
+}
+
+func (m *MockStorage) CommitTransaction(req *types.CommitTransactionRequest) error {
+	args := m.Called(req)
+	return args.Error(0)
+}
+
+func (m *MockStorage) AbortTransaction(req *types.AbortTransactionRequest) error {
+	args := m.Called(req)
+	return args.Error(0)
+}
+
+func (m *MockStorage) GetItemVersions(req *types.GetItemVersionsRequest) (*types.GetItemVersionsResponse, error) {
+	args := m.Called(req)
+	return args.Get(0).(*types.GetItemVersionsResponse), args.Error(1)
+}
+
+func (m *MockStorage) ScanItemVersions(req *types.ScanItemVersionsRequest) (*types.ScanItemVersionsResponse, error) {
+	args := m.Called(req)
+	return args.Get(0).(*types.ScanItemVersionsResponse), args.Error(1)
+}
+
+func (m *MockStorage) ImportItems(req *types.ImportItemsRequest) (*types.ImportItemsResponse, error) {
+	args := m.Called(req)
+	return args.Get(0).(*types.ImportItemsResponse), args.Error(1)
+}
+
+func (m *MockStorage) Ping(timeout time.Duration) error {
+	args := m.Called(timeout)
+	return args.Error(0)
+}
+
+func (m *MockStorage) ListStreams(req *types.ListStreamsRequest) (*types.ListStreamsResponse, error) {
+	args := m.Called(req)
+	return args.Get(0).(*types.ListStreamsResponse), args.Error(1)
+}
+
+func (m *MockStorage) DescribeStream(req *types.DescribeStreamRequest) (*types.DescribeStreamResponse, error) {
+	args := m.Called(req)
+	return args.Get(0).(*types.DescribeStreamResponse), args.Error(1)
+}
+
+func (m *MockStorage) GetShardIterator(req *types.GetShardIteratorRequest) (*types.GetShardIteratorResponse, error) {
+	args := m.Called(req)
+	return args.Get(0).(*types.GetShardIteratorResponse), args.Error(1)
+}
+
+func (m *MockStorage) GetRecords(req *types.GetRecordsRequest) (*types.GetRecordsResponse, error) {
+	args := m.Called(req)
+	return args.Get(0).(*types.GetRecordsResponse), args.Error(1)
+}
+
 // MockNodeClientFactory is a function type to mock nodeapi.NewNodeClient
 type MockNodeClientFactory struct {
 	mock.Mock
@@ -81,6 +175,87 @@ func (m *MockNodeClientFactory) NewNodeClient(addr string) storage.Storage {
 	return args.Get(0).(storage.Storage)
 }
 
+// expectTableKeys makes the mocks describe every table as keyed by a hash
+// key named id, as the router asks a node for the keys of a table before
+// routing requests for its items.
+func expectTableKeys(clients ...*MockStorage) {
+	for _, client := range clients {
+		client.On("DescribeTable", mock.Anything).Return(&types.DescribeTableResponse{
+			Table: types.TableDescription{KeySchema: []*types.KeySchemaElement{{AttributeName: "id", KeyType: "HASH"}}},
+		}, nil).Maybe()
+	}
+}
+
+// idsByNode returns, for each node, n values of the id hash key whose items
+// of the table are held by that node.
+func idsByNode(t *testing.T, r *Router, tableName string, n int) map[string][]string {
+	ids := make(map[string][]string)
+	for i, found := 0, 0; found < n*len(r.GetActiveNodes()); i++ {
+		id := fmt.Sprint(i)
+		partitionKey, err := storage.PartitionKey(tableName, &expression.AttributeValue{S: &id})
+		assert.NoError(t, err)
+		node, err := r.GetNode(partitionKey)
+		assert.NoError(t, err)
+		if len(ids[node.ID]) < n {
+			ids[node.ID] = append(ids[node.ID], id)
+			found++
+		}
+	}
+	return ids
+}
+
+// stamped matches the write request the router sends to a node for req:
+// a copy of it stamped with a version.
+func stamped(req interface{}) interface{} {
+	return mock.MatchedBy(func(got interface{}) bool {
+		v := reflect.ValueOf(got)
+		if v.Type() != reflect.TypeOf(req) {
+			return false
+		}
+		unstamped := reflect.New(v.Elem().Type())
+		unstamped.Elem().Set(v.Elem())
+		unstamped.Elem().FieldByName("Version").SetInt(0)
+		return v.Elem().FieldByName("Version").Int() != 0 && reflect.DeepEqual(unstamped.Interface(), req)
+	})
+}
+
+// stampedBatch matches the part of a batch the router sends to a node for
+// want: its writes, each stamped with a version.
+func stampedBatch(want *types.BatchWriteItemRequest) interface{} {
+	return mock.MatchedBy(func(got *types.BatchWriteItemRequest) bool {
+		if len(got.RequestItems) != len(want.RequestItems) {
+			return false
+		}
+		for tableName, writes := range want.RequestItems {
+			if len(got.RequestItems[tableName]) != len(writes) {
+				return false
+			}
+			for i, w := range writes {
+				g := got.RequestItems[tableName][i]
+				switch {
+				case g.PutRequest != nil && w.PutRequest != nil:
+					if g.PutRequest.Version == 0 || !reflect.DeepEqual(g.PutRequest.Item, w.PutRequest.Item) {
+						return false
+					}
+				case g.DeleteRequest != nil && w.DeleteRequest != nil:
+					if g.DeleteRequest.Version == 0 || !reflect.DeepEqual(g.DeleteRequest.Key, w.DeleteRequest.Key) {
+						return false
+					}
+				default:
+					return false
+				}
+			}
+		}
+		return true
+	})
+}
+
+// stampedAs reports whether a transaction action the router sends to a
+// node is want stamped with a version.
+func stampedAs(got, want *types.TransactWriteItem) bool {
+	return got.Put != nil && got.Put.Version != 0 && reflect.DeepEqual(got, withVersion(want, got.Put.Version))
+}
+
 func TestNewRouter(t *testing.T) {
 	r := NewRouter(nil)
 	assert.NotNil(t, r)
@@ -185,6 +360,42 @@ func TestCreateTable_Success(t *testing.T) {
 	mockClient2.AssertExpectations(t)
 }
 
+func TestUpdateTable(t *testing.T) {
+	mockFactory := new(MockNodeClientFactory)
+	r := NewRouter(mockFactory)
+
+	mockClient1 := new(MockStorage)
+	mockFactory.On("NewNodeClient", "localhost:8001").Return(mockClient1).Once()
+	r.AddNode(Node{ID: "node1", Addr: "localhost:8001"})
+
+	mockClient2 := new(MockStorage)
+	mockFactory.On("NewNodeClient", "localhost:8002").Return(mockClient2).Once()
+	r.AddNode(Node{ID: "node2", Addr: "localhost:8002"})
+
+	req := &types.UpdateTableRequest{
+		TableName: "test_table",
+		GlobalSecondaryIndexUpdates: []*types.GlobalSecondaryIndexUpdate{
+			{Delete: &types.DeleteGlobalSecondaryIndexAction{IndexName: "idx"}},
+		},
+	}
+	expectedResp := &types.UpdateTableResponse{TableDescription: types.TableDescription{TableName: "test_table"}}
+
+	// Every node holds the table definition, so every node is updated.
+	mockClient1.On("UpdateTable", req).Return(expectedResp, nil).Once()
+	mockClient2.On("UpdateTable", req).Return(expectedResp, nil).Once()
+	resp, err := r.UpdateTable(req)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedResp, resp)
+
+	mockClient1.On("UpdateTable", req).Return(expectedResp, nil).Once()
+	mockClient2.On("UpdateTable", req).Return((*types.UpdateTableResponse)(nil), errors.New("client 2 error")).Once()
+	_, err = r.UpdateTable(req)
+	assert.Error(t, err)
+
+	mockClient1.AssertExpectations(t)
+	mockClient2.AssertExpectations(t)
+}
+
 func TestCreateTable_ErrorFromOneClient(t *testing.T) {
 	mockFactory := new(MockNodeClientFactory)
 	r := NewRouter(mockFactory)
@@ -387,6 +598,8 @@ func TestListTables_ErrorFromClient(t *testing.T) {
 
 	// Error case from one client
 	mockClient1.On("ListTables", req).Return(&types.ListTablesResponse{}, errors.New("client 1 error")).Once()
+	// Node 2 is only asked if the router visits it before node 1.
+	mockClient2.On("ListTables", req).Return(&types.ListTablesResponse{TableNames: []string{}}, nil).Maybe()
 	_, err := r.ListTables(req)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "client 1 error")
@@ -410,6 +623,7 @@ func TestPut(t *testing.T) {
 
 	node1 := Node{ID: "node1", Addr: "localhost:8001"}
 	r.AddNode(node1)
+	expectTableKeys(mockClient)
 
 	req := &types.PutRequest{
 		TableName: "test_table",
@@ -419,14 +633,14 @@ func TestPut(t *testing.T) {
 	}
 
 	// Success case
-	mockClient.On("Put", req).Return(nil).Once()
-	err := r.Put(req)
+	mockClient.On("Put", stamped(req)).Return(&types.PutItemResponse{}, nil).Once()
+	_, err := r.Put(req)
 	assert.NoError(t, err)
 	mockClient.AssertExpectations(t)
 
 	// Error case from client
-	mockClient.On("Put", req).Return(errors.New("client error")).Once()
-	err = r.Put(req)
+	mockClient.On("Put", stamped(req)).Return((*types.PutItemResponse)(nil), errors.New("client error")).Once()
+	_, err = r.Put(req)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "client error")
 	mockClient.AssertExpectations(t)
@@ -440,6 +654,7 @@ func TestGet(t *testing.T) {
 
 	node1 := Node{ID: "node1", Addr: "localhost:8001"}
 	r.AddNode(node1)
+	expectTableKeys(mockClient)
 
 	req := &types.GetRequest{
 		TableName: "test_table",
@@ -472,6 +687,7 @@ func TestDelete(t *testing.T) {
 
 	node1 := Node{ID: "node1", Addr: "localhost:8001"}
 	r.AddNode(node1)
+	expectTableKeys(mockClient)
 
 	req := &types.DeleteRequest{
 		TableName: "test_table",
@@ -481,14 +697,14 @@ func TestDelete(t *testing.T) {
 	}
 
 	// Success case
-	mockClient.On("Delete", req).Return(nil).Once()
-	err := r.Delete(req)
+	mockClient.On("Delete", stamped(req)).Return(&types.DeleteItemResponse{}, nil).Once()
+	_, err := r.Delete(req)
 	assert.NoError(t, err)
 	mockClient.AssertExpectations(t)
 
 	// Error case from client
-	mockClient.On("Delete", req).Return(errors.New("client error")).Once()
-	err = r.Delete(req)
+	mockClient.On("Delete", stamped(req)).Return((*types.DeleteItemResponse)(nil), errors.New("client error")).Once()
+	_, err = r.Delete(req)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "client error")
 	mockClient.AssertExpectations(t)
@@ -502,28 +718,91 @@ func TestUpdate(t *testing.T) {
 
 	node1 := Node{ID: "node1", Addr: "localhost:8001"}
 	r.AddNode(node1)
+	expectTableKeys(mockClient)
 
+	key := map[string]*expression.AttributeValue{"id": {S: stringPtr("123")}}
 	req := &types.UpdateRequest{
-		TableName: "test_table",
-		Key: map[string]*expression.AttributeValue{
-			"id": {S: stringPtr("123")},
-		},
+		TableName:                 "test_table",
+		Key:                       key,
+		UpdateExpression:          "SET #d = :d",
+		ExpressionAttributeNames:  map[string]string{"#d": "data"},
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{":d": {S: stringPtr("item1")}},
+		ReturnValues:              types.ReturnValuesUpdatedNew,
 	}
-	expectedResult := map[string]*expression.AttributeValue{"updated_data": {S: stringPtr("item1")}}
-
-	// Success case
-	mockClient.On("Update", req).Return(expectedResult, nil).Once()
+	versionsReq := &types.GetItemVersionsRequest{TableName: "test_table", Keys: []map[string]*expression.AttributeValue{key}}
+	old := map[string]*expression.AttributeValue{"id": key["id"], "data": {S: stringPtr("item0")}, "other": {N: stringPtr("1")}}
+	updated := map[string]*expression.AttributeValue{"id": key["id"], "data": {S: stringPtr("item1")}, "other": {N: stringPtr("1")}}
+
+	// Success case: the update is applied by the router to the node's copy,
+	// which is replaced by the result.
+	mockClient.On("GetItemVersions", versionsReq).Return(&types.GetItemVersionsResponse{Items: []*types.ItemVersion{{Item: old, Version: 1}}}, nil).Once()
+	mockClient.On("Put", stamped(&types.PutRequest{TableName: "test_table", Item: updated})).Return(&types.PutItemResponse{}, nil).Once()
 	result, err := r.Update(req)
 	assert.NoError(t, err)
-	assert.Equal(t, expectedResult, result)
+	assert.Equal(t, &types.UpdateItemResponse{Attributes: map[string]*expression.AttributeValue{"data": {S: stringPtr("item1")}}}, result)
+	assert.Equal(t, "item0", *old["data"].S)
+	mockClient.AssertExpectations(t)
+
+	// A condition that does not hold writes nothing.
+	condReq := *req
+	condReq.ConditionExpression = "attribute_not_exists(id)"
+	mockClient.On("GetItemVersions", versionsReq).Return(&types.GetItemVersionsResponse{Items: []*types.ItemVersion{{Item: old, Version: 1}}}, nil).Once()
+	_, err = r.Update(&condReq)
+	assert.Equal(t, storage.ErrConditionalCheckFailed, err)
+	mockClient.AssertExpectations(t)
+
+	// Nor does one that fails to evaluate, which is a validation error.
+	condReq.ConditionExpression = "attribute_type(id, :d)"
+	mockClient.On("GetItemVersions", versionsReq).Return(&types.GetItemVersionsResponse{Items: []*types.ItemVersion{{Item: old, Version: 1}}}, nil).Once()
+	_, err = r.Update(&condReq)
+	assert.ErrorIs(t, err, storage.ErrValidation)
 	mockClient.AssertExpectations(t)
 
 	// Error case from client
-	mockClient.On("Update", req).Return(map[string]*expression.AttributeValue{}, errors.New("client error")).Once()
+	mockClient.On("GetItemVersions", versionsReq).Return((*types.GetItemVersionsResponse)(nil), errors.New("client error")).Once()
 	_, err = r.Update(req)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "client error")
 	mockClient.AssertExpectations(t)
+
+	// A plain Put of the item waits for an update reading it, rather than
+	// being overwritten by the update of the copy it replaces.
+	put := map[string]*expression.AttributeValue{"id": key["id"], "data": {S: stringPtr("put")}}
+	var order []string
+	var orderMu sync.Mutex
+	record := func(name string) func(mock.Arguments) {
+		return func(mock.Arguments) {
+			orderMu.Lock()
+			defer orderMu.Unlock()
+			order = append(order, name)
+		}
+	}
+	reading, release := make(chan struct{}), make(chan struct{})
+	mockClient.On("GetItemVersions", versionsReq).Run(func(mock.Arguments) {
+		close(reading)
+		<-release
+	}).Return(&types.GetItemVersionsResponse{Items: []*types.ItemVersion{{Item: old, Version: 1}}}, nil).Once()
+	mockClient.On("Put", stamped(&types.PutRequest{TableName: "test_table", Item: updated})).Run(record("update")).Return(&types.PutItemResponse{}, nil).Once()
+	mockClient.On("Put", stamped(&types.PutRequest{TableName: "test_table", Item: put})).Run(record("put")).Return(&types.PutItemResponse{}, nil).Once()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, err := r.Update(req)
+		assert.NoError(t, err)
+	}()
+	<-reading
+	go func() {
+		defer wg.Done()
+		_, err := r.Put(&types.PutRequest{TableName: "test_table", Item: put})
+		assert.NoError(t, err)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, []string{"update", "put"}, order)
+	mockClient.AssertExpectations(t)
 }
 
 func TestQuery(t *testing.T) {
@@ -534,12 +813,18 @@ func TestQuery(t *testing.T) {
 
 	node1 := Node{ID: "node1", Addr: "localhost:8001"}
 	r.AddNode(node1)
+	expectTableKeys(mockClient)
 
 	req := &types.QueryRequest{
-		TableName:            "test_table",
-		KeyConditionExpression: "HashKey = :val",
+		TableName:                 "test_table",
+		KeyConditionExpression:    "id = :val",
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{":val": {S: stringPtr("123")}},
+	}
+	expectedResult := &types.QueryResponse{
+		Items:        []map[string]*expression.AttributeValue{{"query_data": {S: stringPtr("item1")}}},
+		Count:        1,
+		ScannedCount: 1,
 	}
-	expectedResult := []map[string]*expression.AttributeValue{{"query_data": {S: stringPtr("item1")}}}
 
 	// Success case
 	mockClient.On("Query", req).Return(expectedResult, nil).Once()
@@ -549,11 +834,19 @@ func TestQuery(t *testing.T) {
 	mockClient.AssertExpectations(t)
 
 	// Error case from client
-	mockClient.On("Query", req).Return([]map[string]*expression.AttributeValue{}, errors.New("client error")).Once()
+	mockClient.On("Query", req).Return(&types.QueryResponse{}, errors.New("client error")).Once()
 	_, err = r.Query(req)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "client error")
 	mockClient.AssertExpectations(t)
+
+	// A query must name the partition it reads.
+	_, err = r.Query(&types.QueryRequest{
+		TableName:                 "test_table",
+		KeyConditionExpression:    "other = :val",
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{":val": {S: stringPtr("123")}},
+	})
+	assert.ErrorIs(t, err, storage.ErrValidation)
 }
 
 func stringPtr(s string) *string {
@@ -576,13 +869,16 @@ func TestScan(t *testing.T) {
 	node2 := Node{ID: "node2", Addr: "localhost:8002"}
 	r.AddNode(node2)
 
+	expectTableKeys(mockClient1, mockClient2)
+	ids := idsByNode(t, r, "test_table", 1)
+
 	req := &types.ScanRequest{TableName: "test_table"}
 	expectedResp1 := &types.ScanResponse{
-		Items:        []map[string]*expression.AttributeValue{{"id": {S: stringPtr("1")}, "data": {S: stringPtr("data1")}}},
+		Items:        []map[string]*expression.AttributeValue{{"id": {S: stringPtr(ids["node1"][0])}, "data": {S: stringPtr("data1")}}},
 		ScannedCount: 1,
 	}
 	expectedResp2 := &types.ScanResponse{
-		Items:        []map[string]*expression.AttributeValue{{"id": {S: stringPtr("2")}, "data": {S: stringPtr("data2")}}},
+		Items:        []map[string]*expression.AttributeValue{{"id": {S: stringPtr(ids["node2"][0])}, "data": {S: stringPtr("data2")}}},
 		ScannedCount: 1,
 	}
 
@@ -606,6 +902,7 @@ func TestScan(t *testing.T) {
 	mockClient2 = new(MockStorage)
 	mockFactory.On("NewNodeClient", "localhost:8002").Return(mockClient2).Once()
 	r.AddNode(node2) // Re-add node to reset mock
+	expectTableKeys(mockClient1, mockClient2)
 
 	mockClient1.On("Scan", req).Return(expectedResp1, nil).Once()
 	mockClient2.On("Scan", req).Return(&types.ScanResponse{}, errors.New("client 2 error")).Once()
@@ -620,3 +917,871 @@ func TestScan(t *testing.T) {
 	_, err = emptyRouter.Scan(req)
 	assert.ErrorContains(t, err, "no nodes in the ring to perform scan")
 }
+
+func TestBatchWriteItem(t *testing.T) {
+	mockFactory := new(MockNodeClientFactory)
+	r := NewRouter(mockFactory)
+
+	clients := map[string]*MockStorage{"node1": new(MockStorage), "node2": new(MockStorage)}
+	mockFactory.On("NewNodeClient", "localhost:8001").Return(clients["node1"]).Once()
+	r.AddNode(Node{ID: "node1", Addr: "localhost:8001"})
+	mockFactory.On("NewNodeClient", "localhost:8002").Return(clients["node2"]).Once()
+	r.AddNode(Node{ID: "node2", Addr: "localhost:8002"})
+
+	expectTableKeys(clients["node1"], clients["node2"])
+
+	// Find an item held by each node.
+	ids := idsByNode(t, r, "test_table", 1)
+
+	write := func(id string) *types.WriteRequest {
+		return &types.WriteRequest{PutRequest: &types.BatchPutRequest{Item: map[string]*expression.AttributeValue{"id": {S: stringPtr(id)}}}}
+	}
+	write1, write2 := write(ids["node1"][0]), write(ids["node2"][0])
+	part1 := &types.BatchWriteItemRequest{RequestItems: map[string][]*types.WriteRequest{"test_table": {write1}}}
+	part2 := &types.BatchWriteItemRequest{RequestItems: map[string][]*types.WriteRequest{"test_table": {write2}}}
+	req := &types.BatchWriteItemRequest{RequestItems: map[string][]*types.WriteRequest{"test_table": {write1, write2}}}
+
+	// Success case: each node receives only the writes for its items,
+	// stamped with versions.
+	clients["node1"].On("BatchWriteItem", stampedBatch(part1)).Return(&types.BatchWriteItemResponse{}, nil).Once()
+	clients["node2"].On("BatchWriteItem", stampedBatch(part2)).Return(&types.BatchWriteItemResponse{}, nil).Once()
+	resp, err := r.BatchWriteItem(req)
+	assert.NoError(t, err)
+	assert.Empty(t, resp.UnprocessedItems)
+
+	// A failing node's writes are returned as unprocessed, as the caller
+	// sent them.
+	clients["node1"].On("BatchWriteItem", stampedBatch(part1)).Return(&types.BatchWriteItemResponse{}, nil).Once()
+	clients["node2"].On("BatchWriteItem", stampedBatch(part2)).Return((*types.BatchWriteItemResponse)(nil), errors.New("client 2 error")).Once()
+	resp, err = r.BatchWriteItem(req)
+	assert.NoError(t, err)
+	assert.Equal(t, part2.RequestItems, resp.UnprocessedItems)
+
+	// The batch fails when every node does.
+	clients["node1"].On("BatchWriteItem", stampedBatch(part1)).Return((*types.BatchWriteItemResponse)(nil), errors.New("client 1 error")).Once()
+	clients["node2"].On("BatchWriteItem", stampedBatch(part2)).Return((*types.BatchWriteItemResponse)(nil), errors.New("client 2 error")).Once()
+	_, err = r.BatchWriteItem(req)
+	assert.Error(t, err)
+
+	clients["node1"].AssertExpectations(t)
+	clients["node2"].AssertExpectations(t)
+
+	// With both nodes replicas of every item, a write is processed once the
+	// write quorum has applied it. Each case has mocks of its own, as the
+	// writes left running when a batch returns end in the background.
+	replicated := func(w int) (*Router, *MockStorage, *MockStorage) {
+		factory := new(MockNodeClientFactory)
+		r := NewRouter(factory)
+		assert.NoError(t, r.SetReplicationFactor(2))
+		assert.NoError(t, r.SetQuorums(w, 1))
+		client1, client2 := new(MockStorage), new(MockStorage)
+		factory.On("NewNodeClient", "localhost:8001").Return(client1).Once()
+		r.AddNode(Node{ID: "node1", Addr: "localhost:8001"})
+		factory.On("NewNodeClient", "localhost:8002").Return(client2).Once()
+		r.AddNode(Node{ID: "node2", Addr: "localhost:8002"})
+		expectTableKeys(client1, client2)
+		return r, client1, client2
+	}
+
+	r, client1, client2 := replicated(1)
+	client1.On("BatchWriteItem", stampedBatch(req)).Return((*types.BatchWriteItemResponse)(nil), errors.New("client 1 error")).Maybe()
+	client2.On("BatchWriteItem", stampedBatch(req)).Return(&types.BatchWriteItemResponse{}, nil).Once()
+	resp, err = r.BatchWriteItem(req)
+	assert.NoError(t, err)
+	assert.Empty(t, resp.UnprocessedItems)
+	client2.AssertExpectations(t)
+
+	// Waiting for every replica, a write one of them failed is unprocessed.
+	r, client1, client2 = replicated(0)
+	client1.On("BatchWriteItem", stampedBatch(req)).Return((*types.BatchWriteItemResponse)(nil), errors.New("client 1 error")).Once()
+	client2.On("BatchWriteItem", stampedBatch(req)).Return(&types.BatchWriteItemResponse{}, nil).Maybe()
+	_, err = r.BatchWriteItem(req)
+	assert.Error(t, err)
+	client1.AssertExpectations(t)
+
+	// Oversized batches are rejected before any node is called.
+	tooMany := make([]*types.WriteRequest, types.MaxBatchWriteItems+1)
+	for i := range tooMany {
+		tooMany[i] = write(fmt.Sprint(i))
+	}
+	_, err = r.BatchWriteItem(&types.BatchWriteItemRequest{RequestItems: map[string][]*types.WriteRequest{"test_table": tooMany}})
+	assert.Error(t, err)
+}
+
+func TestBatchGetItem(t *testing.T) {
+	mockFactory := new(MockNodeClientFactory)
+	r := NewRouter(mockFactory)
+
+	clients := map[string]*MockStorage{"node1": new(MockStorage), "node2": new(MockStorage)}
+	mockFactory.On("NewNodeClient", "localhost:8001").Return(clients["node1"]).Once()
+	r.AddNode(Node{ID: "node1", Addr: "localhost:8001"})
+	mockFactory.On("NewNodeClient", "localhost:8002").Return(clients["node2"]).Once()
+	r.AddNode(Node{ID: "node2", Addr: "localhost:8002"})
+
+	expectTableKeys(clients["node1"], clients["node2"])
+	ids := idsByNode(t, r, "test_table", 1)
+
+	key := func(id string) map[string]*expression.AttributeValue {
+		return map[string]*expression.AttributeValue{"id": {S: stringPtr(id)}}
+	}
+	key1, key2 := key(ids["node1"][0]), key(ids["node2"][0])
+	names := map[string]string{"#d": "data"}
+	part := func(keys ...map[string]*expression.AttributeValue) *types.BatchGetItemRequest {
+		return &types.BatchGetItemRequest{RequestItems: map[string]*types.KeysAndAttributes{"test_table": {
+			Keys:                     keys,
+			ProjectionExpression:     "#d",
+			ExpressionAttributeNames: names,
+		}}}
+	}
+	part1, part2 := part(key1), part(key2)
+	req := part(key1, key2)
+
+	// Each node reads its keys with the projection of the request.
+	clients["node1"].On("BatchGetItem", part1).Return(&types.BatchGetItemResponse{
+		Responses: map[string][]map[string]*expression.AttributeValue{"test_table": {key1}},
+	}, nil).Once()
+	clients["node2"].On("BatchGetItem", part2).Return((*types.BatchGetItemResponse)(nil), errors.New("client 2 error")).Once()
+
+	resp, err := r.BatchGetItem(req)
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]*expression.AttributeValue{key1}, resp.Responses["test_table"])
+	assert.Equal(t, part2.RequestItems, resp.UnprocessedKeys)
+	clients["node1"].AssertExpectations(t)
+	clients["node2"].AssertExpectations(t)
+}
+
+func TestTransactWriteItems(t *testing.T) {
+	mockFactory := new(MockNodeClientFactory)
+	r := NewRouter(mockFactory)
+
+	clients := map[string]*MockStorage{"node1": new(MockStorage), "node2": new(MockStorage)}
+	mockFactory.On("NewNodeClient", "localhost:8001").Return(clients["node1"]).Once()
+	r.AddNode(Node{ID: "node1", Addr: "localhost:8001"})
+	mockFactory.On("NewNodeClient", "localhost:8002").Return(clients["node2"]).Once()
+	r.AddNode(Node{ID: "node2", Addr: "localhost:8002"})
+
+	expectTableKeys(clients["node1"], clients["node2"])
+	ids := idsByNode(t, r, "test_table", 1)
+
+	put := func(id string) *types.TransactWriteItem {
+		return &types.TransactWriteItem{Put: &types.PutRequest{
+			TableName: "test_table",
+			Item:      map[string]*expression.AttributeValue{"id": {S: stringPtr(id)}},
+		}}
+	}
+	item1, item2 := put(ids["node1"][0]), put(ids["node2"][0])
+	req := &types.TransactWriteItemsRequest{TransactItems: []*types.TransactWriteItem{item1, item2}}
+	prepareOf := func(item *types.TransactWriteItem) interface{} {
+		return mock.MatchedBy(func(req *types.PrepareTransactionRequest) bool {
+			return req.TransactionID != "" && len(req.TransactItems) == 1 && stampedAs(req.TransactItems[0], item)
+		})
+	}
+
+	// A transaction on one node is forwarded to it.
+	single := &types.TransactWriteItemsRequest{TransactItems: []*types.TransactWriteItem{item1}}
+	clients["node1"].On("TransactWriteItems", mock.MatchedBy(func(req *types.TransactWriteItemsRequest) bool {
+		return len(req.TransactItems) == 1 && stampedAs(req.TransactItems[0], item1)
+	})).Return(&types.TransactWriteItemsResponse{}, nil).Once()
+	_, err := r.TransactWriteItems(single)
+	assert.NoError(t, err)
+
+	// Both nodes prepare, then both commit.
+	clients["node1"].On("PrepareTransaction", prepareOf(item1)).Return(&types.PrepareTransactionResponse{}, nil).Once()
+	clients["node2"].On("PrepareTransaction", prepareOf(item2)).Return(&types.PrepareTransactionResponse{}, nil).Once()
+	clients["node1"].On("CommitTransaction", mock.Anything).Return(nil).Once()
+	clients["node2"].On("CommitTransaction", mock.Anything).Return(nil).Once()
+	_, err = r.TransactWriteItems(req)
+	assert.NoError(t, err)
+
+	// One node refuses its part, whose item another transaction holds, so
+	// both are aborted.
+	clients["node1"].On("PrepareTransaction", prepareOf(item1)).Return(&types.PrepareTransactionResponse{}, nil).Once()
+	clients["node2"].On("PrepareTransaction", prepareOf(item2)).Return(&types.PrepareTransactionResponse{
+		CancellationReasons: []*types.CancellationReason{{Code: types.CancellationReasonTransactionConflict}},
+	}, nil).Once()
+	clients["node1"].On("AbortTransaction", mock.Anything).Return(nil).Once()
+	clients["node2"].On("AbortTransaction", mock.Anything).Return(nil).Once()
+	_, err = r.TransactWriteItems(req)
+	var cancelled *storage.TransactionCanceledError
+	if assert.ErrorAs(t, err, &cancelled) {
+		assert.Equal(t, []*types.CancellationReason{
+			{Code: types.CancellationReasonNone},
+			{Code: types.CancellationReasonTransactionConflict},
+		}, cancelled.Reasons)
+	}
+
+	// A node that fails to prepare also aborts the transaction.
+	clients["node1"].On("PrepareTransaction", prepareOf(item1)).Return((*types.PrepareTransactionResponse)(nil), errors.New("client 1 error")).Once()
+	clients["node2"].On("PrepareTransaction", prepareOf(item2)).Return(&types.PrepareTransactionResponse{}, nil).Once()
+	clients["node1"].On("AbortTransaction", mock.Anything).Return(nil).Once()
+	clients["node2"].On("AbortTransaction", mock.Anything).Return(nil).Once()
+	_, err = r.TransactWriteItems(req)
+	assert.Error(t, err)
+
+	// A node that fails to commit does not fail the transaction, which every
+	// node prepared: its part is committed again until it is applied.
+	clients["node1"].On("PrepareTransaction", prepareOf(item1)).Return(&types.PrepareTransactionResponse{}, nil).Once()
+	clients["node2"].On("PrepareTransaction", prepareOf(item2)).Return(&types.PrepareTransactionResponse{}, nil).Once()
+	clients["node1"].On("CommitTransaction", mock.Anything).Return(nil).Once()
+	clients["node2"].On("CommitTransaction", mock.Anything).Return(errors.New("client 2 error")).Twice()
+	_, err = r.TransactWriteItems(req)
+	assert.NoError(t, err)
+	r.resolveTransactions()
+	clients["node2"].On("CommitTransaction", mock.Anything).Return(nil).Once()
+	r.resolveTransactions()
+	r.resolveTransactions()
+
+	// A node that fails to abort has its part aborted later.
+	clients["node1"].On("PrepareTransaction", prepareOf(item1)).Return(&types.PrepareTransactionResponse{}, nil).Once()
+	clients["node2"].On("PrepareTransaction", prepareOf(item2)).Return((*types.PrepareTransactionResponse)(nil), errors.New("client 2 error")).Once()
+	clients["node1"].On("AbortTransaction", mock.Anything).Return(errors.New("client 1 error")).Once()
+	clients["node2"].On("AbortTransaction", mock.Anything).Return(nil).Once()
+	_, err = r.TransactWriteItems(req)
+	assert.Error(t, err)
+	clients["node1"].On("AbortTransaction", mock.Anything).Return(nil).Once()
+	r.resolveTransactions()
+	r.resolveTransactions()
+
+	clients["node1"].AssertExpectations(t)
+	clients["node2"].AssertExpectations(t)
+}
+
+func TestTransactWriteItemsNewestCopy(t *testing.T) {
+	mockFactory := new(MockNodeClientFactory)
+	r := NewRouter(mockFactory)
+	assert.NoError(t, r.SetReplicationFactor(2))
+	assert.NoError(t, r.SetQuorums(1, 1))
+
+	clients := map[string]*MockStorage{"node1": new(MockStorage), "node2": new(MockStorage)}
+	mockFactory.On("NewNodeClient", "localhost:8001").Return(clients["node1"]).Once()
+	r.AddNode(Node{ID: "node1", Addr: "localhost:8001"})
+	mockFactory.On("NewNodeClient", "localhost:8002").Return(clients["node2"]).Once()
+	r.AddNode(Node{ID: "node2", Addr: "localhost:8002"})
+	expectTableKeys(clients["node1"], clients["node2"])
+
+	// The replicas have diverged: node1 missed the write creating the item.
+	key := map[string]*expression.AttributeValue{"id": {S: stringPtr("a")}}
+	newest := map[string]*expression.AttributeValue{"id": key["id"], "n": {N: stringPtr("1")}}
+	versionsReq := &types.GetItemVersionsRequest{TableName: "test_table", Keys: []map[string]*expression.AttributeValue{key}}
+	expectCopies := func() {
+		clients["node1"].On("GetItemVersions", versionsReq).Return(&types.GetItemVersionsResponse{Items: []*types.ItemVersion{{}}}, nil).Once()
+		clients["node2"].On("GetItemVersions", versionsReq).Return(&types.GetItemVersionsResponse{Items: []*types.ItemVersion{{Item: newest, Version: 2}}}, nil).Once()
+	}
+
+	// A condition that the stale copy meets fails against the newest, and
+	// nothing is prepared.
+	expectCopies()
+	_, err := r.TransactWriteItems(&types.TransactWriteItemsRequest{TransactItems: []*types.TransactWriteItem{
+		{ConditionCheck: &types.ConditionCheck{TableName: "test_table", Key: key, ConditionExpression: "attribute_not_exists(id)"}},
+	}})
+	var cancelled *storage.TransactionCanceledError
+	if assert.ErrorAs(t, err, &cancelled) {
+		assert.Equal(t, types.CancellationReasonConditionalCheckFailed, cancelled.Reasons[0].Code)
+	}
+	clients["node1"].AssertExpectations(t)
+	clients["node2"].AssertExpectations(t)
+
+	// An update is computed once, from the newest copy, and both replicas
+	// are sent its result. A replica that cannot prepare is left out, as the
+	// other is enough for the write quorum.
+	updated := map[string]*expression.AttributeValue{"id": key["id"], "n": {N: stringPtr("2")}}
+	prepareOfUpdated := mock.MatchedBy(func(req *types.PrepareTransactionRequest) bool {
+		return len(req.TransactItems) == 1 && stampedAs(req.TransactItems[0], &types.TransactWriteItem{Put: &types.PutRequest{TableName: "test_table", Item: updated}})
+	})
+	expectCopies()
+	clients["node1"].On("PrepareTransaction", prepareOfUpdated).Return((*types.PrepareTransactionResponse)(nil), errors.New("client 1 error")).Once()
+	clients["node2"].On("PrepareTransaction", prepareOfUpdated).Return(&types.PrepareTransactionResponse{}, nil).Once()
+	clients["node1"].On("AbortTransaction", mock.Anything).Return(nil).Once()
+	clients["node2"].On("CommitTransaction", mock.Anything).Return(nil).Once()
+	_, err = r.TransactWriteItems(&types.TransactWriteItemsRequest{TransactItems: []*types.TransactWriteItem{
+		{Update: &types.UpdateRequest{
+			TableName:                 "test_table",
+			Key:                       key,
+			UpdateExpression:          "SET n = n + :one",
+			ConditionExpression:       "attribute_exists(id)",
+			ExpressionAttributeValues: map[string]*expression.AttributeValue{":one": {N: stringPtr("1")}},
+		}},
+	}})
+	assert.NoError(t, err)
+	clients["node1"].AssertExpectations(t)
+	clients["node2"].AssertExpectations(t)
+
+	// Without the write quorum, the transaction fails and is aborted.
+	assert.NoError(t, r.SetQuorums(2, 1))
+	put := &types.TransactWriteItem{Put: &types.PutRequest{TableName: "test_table", Item: newest}}
+	clients["node1"].On("PrepareTransaction", mock.Anything).Return((*types.PrepareTransactionResponse)(nil), errors.New("client 1 error")).Once()
+	clients["node2"].On("PrepareTransaction", mock.Anything).Return(&types.PrepareTransactionResponse{}, nil).Once()
+	clients["node1"].On("AbortTransaction", mock.Anything).Return(nil).Once()
+	clients["node2"].On("AbortTransaction", mock.Anything).Return(nil).Once()
+	_, err = r.TransactWriteItems(&types.TransactWriteItemsRequest{TransactItems: []*types.TransactWriteItem{put}})
+	assert.Error(t, err)
+	clients["node1"].AssertExpectations(t)
+	clients["node2"].AssertExpectations(t)
+}
+
+func TestTransactionLog(t *testing.T) {
+	path := t.TempDir() + "/transactions.db"
+	newRouter := func() (*Router, map[string]*MockStorage) {
+		mockFactory := new(MockNodeClientFactory)
+		r := NewRouter(mockFactory)
+		assert.NoError(t, r.OpenTransactionLog(path))
+		clients := map[string]*MockStorage{"node1": new(MockStorage), "node2": new(MockStorage)}
+		mockFactory.On("NewNodeClient", "localhost:8001").Return(clients["node1"]).Once()
+		r.AddNode(Node{ID: "node1", Addr: "localhost:8001"})
+		mockFactory.On("NewNodeClient", "localhost:8002").Return(clients["node2"]).Once()
+		r.AddNode(Node{ID: "node2", Addr: "localhost:8002"})
+		expectTableKeys(clients["node1"], clients["node2"])
+		return r, clients
+	}
+
+	r, clients := newRouter()
+	ids := idsByNode(t, r, "test_table", 1)
+	req := &types.TransactWriteItemsRequest{}
+	for _, nodeID := range []string{"node1", "node2"} {
+		req.TransactItems = append(req.TransactItems, &types.TransactWriteItem{Put: &types.PutRequest{
+			TableName: "test_table",
+			Item:      map[string]*expression.AttributeValue{"id": {S: stringPtr(ids[nodeID][0])}},
+		}})
+	}
+
+	// The commit reaches one node before the router stops.
+	var txID string
+	clients["node1"].On("PrepareTransaction", mock.Anything).Run(func(args mock.Arguments) {
+		txID = args.Get(0).(*types.PrepareTransactionRequest).TransactionID
+	}).Return(&types.PrepareTransactionResponse{}, nil).Once()
+	clients["node2"].On("PrepareTransaction", mock.Anything).Return(&types.PrepareTransactionResponse{}, nil).Once()
+	clients["node1"].On("CommitTransaction", mock.Anything).Return(nil).Once()
+	clients["node2"].On("CommitTransaction", mock.Anything).Return(errors.New("router stopped")).Once()
+	_, err := r.TransactWriteItems(req)
+	assert.NoError(t, err)
+	assert.NoError(t, r.CloseTransactionLog())
+	clients["node1"].AssertExpectations(t)
+	clients["node2"].AssertExpectations(t)
+
+	// The next router commits the part on the other node only, and a node
+	// that had committed already counts as done.
+	r, clients = newRouter()
+	clients["node2"].On("CommitTransaction", &types.CommitTransactionRequest{TransactionID: txID}).
+		Return(storage.NewResourceNotFoundError("transaction %s is not prepared", txID)).Once()
+	r.resolveTransactions()
+	assert.NoError(t, r.CloseTransactionLog())
+	clients["node1"].AssertExpectations(t)
+	clients["node2"].AssertExpectations(t)
+
+	r, clients = newRouter()
+	r.resolveTransactions()
+	assert.NoError(t, r.CloseTransactionLog())
+	clients["node1"].AssertExpectations(t)
+	clients["node2"].AssertExpectations(t)
+}
+
+func TestTransactGetItems(t *testing.T) {
+	mockFactory := new(MockNodeClientFactory)
+	r := NewRouter(mockFactory)
+
+	clients := map[string]*MockStorage{"node1": new(MockStorage), "node2": new(MockStorage)}
+	mockFactory.On("NewNodeClient", "localhost:8001").Return(clients["node1"]).Once()
+	r.AddNode(Node{ID: "node1", Addr: "localhost:8001"})
+	mockFactory.On("NewNodeClient", "localhost:8002").Return(clients["node2"]).Once()
+	r.AddNode(Node{ID: "node2", Addr: "localhost:8002"})
+
+	expectTableKeys(clients["node1"], clients["node2"])
+	ids := idsByNode(t, r, "test_table", 2)
+
+	key := func(id string) map[string]*expression.AttributeValue {
+		return map[string]*expression.AttributeValue{"id": {S: stringPtr(id)}}
+	}
+	get := func(id string) *types.TransactGetItem {
+		return &types.TransactGetItem{Get: &types.GetRequest{TableName: "test_table", Key: key(id)}}
+	}
+	get1, get2, get3 := get(ids["node1"][0]), get(ids["node2"][0]), get(ids["node1"][1])
+	req := &types.TransactGetItemsRequest{TransactItems: []*types.TransactGetItem{get1, get2, get3}}
+
+	// The responses of each node are put back in request order.
+	clients["node1"].On("TransactGetItems", &types.TransactGetItemsRequest{TransactItems: []*types.TransactGetItem{get1, get3}}).Return(&types.TransactGetItemsResponse{
+		Responses: []*types.ItemResponse{{Item: get1.Get.Key}, {}},
+	}, nil).Once()
+	clients["node2"].On("TransactGetItems", &types.TransactGetItemsRequest{TransactItems: []*types.TransactGetItem{get2}}).Return(&types.TransactGetItemsResponse{
+		Responses: []*types.ItemResponse{{Item: get2.Get.Key}},
+	}, nil).Once()
+
+	resp, err := r.TransactGetItems(req)
+	assert.NoError(t, err)
+	assert.Equal(t, []*types.ItemResponse{{Item: get1.Get.Key}, {Item: get2.Get.Key}, {}}, resp.Responses)
+	clients["node1"].AssertExpectations(t)
+	clients["node2"].AssertExpectations(t)
+}
+
+func TestListStreams(t *testing.T) {
+	mockFactory := new(MockNodeClientFactory)
+	r := NewRouter(mockFactory)
+
+	clients := map[string]*MockStorage{"node1": new(MockStorage), "node2": new(MockStorage)}
+	mockFactory.On("NewNodeClient", "localhost:8001").Return(clients["node1"]).Once()
+	r.AddNode(Node{ID: "node1", Addr: "localhost:8001"})
+	mockFactory.On("NewNodeClient", "localhost:8002").Return(clients["node2"]).Once()
+	r.AddNode(Node{ID: "node2", Addr: "localhost:8002"})
+
+	summary := func(tableName string) *types.StreamSummary {
+		return &types.StreamSummary{StreamArn: storage.StreamArn(tableName, "a"), StreamLabel: "a", TableName: tableName}
+	}
+
+	// Every node has every stream, so a single node lists them.
+	for _, req := range []*types.ListStreamsRequest{{}, {TableName: "test_table"}} {
+		node, err := r.GetNode(req.TableName)
+		assert.NoError(t, err)
+		expected := &types.ListStreamsResponse{Streams: []*types.StreamSummary{summary("test_table")}}
+		clients[node.ID].On("ListStreams", req).Return(expected, nil).Once()
+		resp, err := r.ListStreams(req)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, resp)
+	}
+
+	clients["node1"].AssertExpectations(t)
+	clients["node2"].AssertExpectations(t)
+}
+
+func TestGetRecords(t *testing.T) {
+	mockFactory := new(MockNodeClientFactory)
+	r := NewRouter(mockFactory)
+
+	clients := map[string]*MockStorage{"node1": new(MockStorage), "node2": new(MockStorage)}
+	mockFactory.On("NewNodeClient", "localhost:8001").Return(clients["node1"]).Once()
+	r.AddNode(Node{ID: "node1", Addr: "localhost:8001"})
+	mockFactory.On("NewNodeClient", "localhost:8002").Return(clients["node2"]).Once()
+	r.AddNode(Node{ID: "node2", Addr: "localhost:8002"})
+
+	// Each node describes the stream with the shard of the items it holds,
+	// and the router lists every shard under an ID naming its node.
+	arn := storage.StreamArn("test_table", "2026-01-01T00:00:00.000")
+	const shardID = "shardId-00000001767225600000"
+	describeReq := &types.DescribeStreamRequest{StreamArn: arn}
+	for _, client := range clients {
+		client.On("DescribeStream", describeReq).Return(&types.DescribeStreamResponse{
+			StreamDescription: types.StreamDescription{
+				StreamArn: arn,
+				Shards:    []*types.Shard{{ShardId: shardID}},
+			},
+		}, nil).Twice()
+	}
+	describeResp, err := r.DescribeStream(describeReq)
+	assert.NoError(t, err)
+	assert.Equal(t, []*types.Shard{{ShardId: shardID + "-node1"}, {ShardId: shardID + "-node2"}}, describeResp.StreamDescription.Shards)
+
+	describeResp, err = r.DescribeStream(&types.DescribeStreamRequest{StreamArn: arn, Limit: 1, ExclusiveStartShardId: shardID + "-node1"})
+	assert.NoError(t, err)
+	assert.Equal(t, []*types.Shard{{ShardId: shardID + "-node2"}}, describeResp.StreamDescription.Shards)
+	assert.Empty(t, describeResp.StreamDescription.LastEvaluatedShardId)
+
+	// Requests for a shard go to its node, with the node's ID for the shard.
+	iteratorReq := &types.GetShardIteratorRequest{StreamArn: arn, ShardId: shardID, ShardIteratorType: types.ShardIteratorTypeTrimHorizon}
+	iterator := (&storage.ShardIterator{StreamArn: arn, ShardId: shardID}).String()
+	clients["node2"].On("GetShardIterator", iteratorReq).Return(&types.GetShardIteratorResponse{ShardIterator: iterator}, nil).Once()
+	iteratorResp, err := r.GetShardIterator(&types.GetShardIteratorRequest{
+		StreamArn:         arn,
+		ShardId:           shardID + "-node2",
+		ShardIteratorType: types.ShardIteratorTypeTrimHorizon,
+	})
+	assert.NoError(t, err)
+	routerIterator := (&storage.ShardIterator{StreamArn: arn, ShardId: shardID + "-node2"}).String()
+	assert.Equal(t, routerIterator, iteratorResp.ShardIterator)
+
+	clients["node2"].On("GetRecords", &types.GetRecordsRequest{ShardIterator: iterator}).Return(&types.GetRecordsResponse{NextShardIterator: iterator}, nil).Once()
+	resp, err := r.GetRecords(&types.GetRecordsRequest{ShardIterator: iteratorResp.ShardIterator})
+	assert.NoError(t, err)
+	assert.Equal(t, routerIterator, resp.NextShardIterator)
+	clients["node1"].AssertExpectations(t)
+	clients["node2"].AssertExpectations(t)
+
+	_, err = r.GetRecords(&types.GetRecordsRequest{ShardIterator: "not an iterator"})
+	assert.ErrorContains(t, err, "invalid shard iterator")
+	_, err = r.GetShardIterator(&types.GetShardIteratorRequest{StreamArn: arn, ShardId: shardID + "-node3"})
+	assert.ErrorIs(t, err, storage.ErrResourceNotFound)
+}
+
+func TestGetReplicas(t *testing.T) {
+	r := NewRouter(nil)
+	_, err := r.GetReplicas("key")
+	assert.ErrorContains(t, err, "no nodes in the ring")
+
+	for i := 1; i <= 3; i++ {
+		r.AddNode(Node{ID: fmt.Sprintf("node%d", i), Addr: fmt.Sprintf("localhost:800%d", i)})
+	}
+	primary, err := r.GetNode("key")
+	assert.NoError(t, err)
+
+	// By default, each key has a single copy, on the node holding it.
+	replicas, err := r.GetReplicas("key")
+	assert.NoError(t, err)
+	assert.Equal(t, []Node{primary}, replicas)
+
+	assert.Error(t, r.SetReplicationFactor(0))
+	assert.NoError(t, r.SetReplicationFactor(2))
+	assert.Equal(t, 2, r.ReplicationFactor())
+	replicas, err = r.GetReplicas("key")
+	assert.NoError(t, err)
+	assert.Len(t, replicas, 2)
+	assert.Equal(t, primary, replicas[0])
+	assert.NotEqual(t, replicas[0].ID, replicas[1].ID)
+
+	// A ring with fewer nodes than the replication factor keeps a copy on
+	// every node.
+	assert.NoError(t, r.SetReplicationFactor(5))
+	replicas, err = r.GetReplicas("key")
+	assert.NoError(t, err)
+	assert.Len(t, replicas, 3)
+}
+
+func TestReplicatedItems(t *testing.T) {
+	mockFactory := new(MockNodeClientFactory)
+	r := NewRouter(mockFactory)
+	assert.NoError(t, r.SetReplicationFactor(2))
+
+	clients := make(map[string]*MockStorage)
+	for i := 1; i <= 3; i++ {
+		id, addr := fmt.Sprintf("node%d", i), fmt.Sprintf("localhost:800%d", i)
+		clients[id] = new(MockStorage)
+		mockFactory.On("NewNodeClient", addr).Return(clients[id]).Once()
+		r.AddNode(Node{ID: id, Addr: addr})
+		expectTableKeys(clients[id])
+	}
+
+	key := map[string]*expression.AttributeValue{"id": {S: stringPtr("123")}}
+	replicas, err := r.ReplicasForKey("test_table", key["id"])
+	assert.NoError(t, err)
+	assert.Len(t, replicas, 2)
+	primary, secondary := clients[replicas[0].ID], clients[replicas[1].ID]
+
+	// Writes are applied on every replica, and the primary's response is
+	// returned.
+	putReq := &types.PutRequest{TableName: "test_table", Item: key, ReturnValues: types.ReturnValuesAllOld}
+	primaryResp := &types.PutItemResponse{Attributes: map[string]*expression.AttributeValue{"data": {S: stringPtr("primary")}}}
+	primary.On("Put", stamped(putReq)).Return(primaryResp, nil).Once()
+	secondary.On("Put", stamped(putReq)).Return(&types.PutItemResponse{}, nil).Once()
+	putResp, err := r.Put(putReq)
+	assert.NoError(t, err)
+	assert.Equal(t, primaryResp, putResp)
+
+	// A write fails if any replica fails.
+	deleteReq := &types.DeleteRequest{TableName: "test_table", Key: key}
+	primary.On("Delete", stamped(deleteReq)).Return(&types.DeleteItemResponse{}, nil).Once()
+	secondary.On("Delete", stamped(deleteReq)).Return((*types.DeleteItemResponse)(nil), errors.New("connection refused")).Once()
+	_, err = r.Delete(deleteReq)
+	assert.ErrorContains(t, err, "failed to write to replica "+replicas[1].ID)
+
+	// Reads fail over to the next replica when one does not answer.
+	getReq := &types.GetRequest{TableName: "test_table", Key: key}
+	primary.On("Get", getReq).Return((map[string]*expression.AttributeValue)(nil), errors.New("connection refused")).Once()
+	secondary.On("Get", getReq).Return(key, nil).Once()
+	item, err := r.Get(getReq)
+	assert.NoError(t, err)
+	assert.Equal(t, key, item)
+
+	// An error raised by storage is the answer of the replica.
+	queryReq := &types.QueryRequest{
+		TableName:                 "test_table",
+		KeyConditionExpression:    "id = :id",
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{":id": key["id"]},
+	}
+	primary.On("Query", queryReq).Return((*types.QueryResponse)(nil), storage.NewValidationError("bad query")).Once()
+	_, err = r.Query(queryReq)
+	assert.ErrorIs(t, err, storage.ErrValidation)
+
+	for _, client := range clients {
+		client.AssertExpectations(t)
+	}
+}
+
+func TestQuorums(t *testing.T) {
+	mockFactory := new(MockNodeClientFactory)
+	r := NewRouter(mockFactory)
+	assert.NoError(t, r.SetReplicationFactor(3))
+	assert.Error(t, r.SetQuorums(-1, 1))
+	assert.Error(t, r.SetQuorums(2, 0))
+	assert.NoError(t, r.SetQuorums(2, 1))
+
+	clients := make(map[string]*MockStorage)
+	for i := 1; i <= 3; i++ {
+		id, addr := fmt.Sprintf("node%d", i), fmt.Sprintf("localhost:800%d", i)
+		clients[id] = new(MockStorage)
+		mockFactory.On("NewNodeClient", addr).Return(clients[id]).Once()
+		r.AddNode(Node{ID: id, Addr: addr})
+		expectTableKeys(clients[id])
+	}
+
+	key := map[string]*expression.AttributeValue{"id": {S: stringPtr("123")}}
+	replicas, err := r.ReplicasForKey("test_table", key["id"])
+	assert.NoError(t, err)
+	assert.Len(t, replicas, 3)
+	first, second, third := clients[replicas[0].ID], clients[replicas[1].ID], clients[replicas[2].ID]
+	item := func(data string) map[string]*expression.AttributeValue {
+		return map[string]*expression.AttributeValue{"id": key["id"], "data": {S: stringPtr(data)}}
+	}
+	versions := func(item map[string]*expression.AttributeValue, version int64) *types.GetItemVersionsResponse {
+		return &types.GetItemVersionsResponse{Items: []*types.ItemVersion{{Item: item, Version: version}}}
+	}
+
+	// A write succeeds once the write quorum has acknowledged it, with the
+	// response of the first replica that did. The write to the primary may
+	// still be running when Put returns.
+	putReq := &types.PutRequest{TableName: "test_table", Item: item("new"), ReturnValues: types.ReturnValuesAllOld}
+	secondResp := &types.PutItemResponse{Attributes: item("old")}
+	first.On("Put", stamped(putReq)).Return((*types.PutItemResponse)(nil), errors.New("connection refused")).Maybe()
+	second.On("Put", stamped(putReq)).Return(secondResp, nil).Once()
+	third.On("Put", stamped(putReq)).Return(&types.PutItemResponse{}, nil).Once()
+	putResp, err := r.Put(putReq)
+	assert.NoError(t, err)
+	assert.Equal(t, secondResp, putResp)
+
+	// A conditional write is judged once, against the newest copy among the
+	// replicas a consistent read reads, and then written to every replica
+	// unconditionally.
+	deleteReq := &types.DeleteRequest{TableName: "test_table", Key: key, ConditionExpression: "attribute_not_exists(id)"}
+	first.On("GetItemVersions", mock.Anything).Return(versions(nil, 1), nil).Once()
+	second.On("GetItemVersions", mock.Anything).Return(versions(item("new"), 2), nil).Once()
+	_, err = r.Delete(deleteReq)
+	assert.Equal(t, storage.ErrConditionalCheckFailed, err)
+
+	deleteReq = &types.DeleteRequest{TableName: "test_table", Key: key, ConditionExpression: "attribute_exists(id)", ReturnValues: types.ReturnValuesAllOld}
+	unconditional := stamped(&types.DeleteRequest{TableName: "test_table", Key: key})
+	first.On("GetItemVersions", mock.Anything).Return(versions(nil, 1), nil).Once()
+	second.On("GetItemVersions", mock.Anything).Return(versions(item("new"), 2), nil).Once()
+	first.On("Delete", unconditional).Return(&types.DeleteItemResponse{}, nil).Once()
+	second.On("Delete", unconditional).Return(&types.DeleteItemResponse{}, nil).Once()
+	third.On("Delete", unconditional).Return(&types.DeleteItemResponse{}, nil).Once()
+	deleteResp, err := r.Delete(deleteReq)
+	assert.NoError(t, err)
+	assert.Equal(t, item("new"), deleteResp.Attributes)
+
+	// An eventually consistent read is served by one replica.
+	getReq := &types.GetRequest{TableName: "test_table", Key: key}
+	first.On("Get", getReq).Return(item("old"), nil).Once()
+	got, err := r.Get(getReq)
+	assert.NoError(t, err)
+	assert.Equal(t, item("old"), got)
+
+	// A consistent read overlaps the write quorum, reading two replicas,
+	// and returns the newest copy.
+	consistentReq := &types.GetRequest{TableName: "test_table", Key: key, ConsistentRead: true}
+	first.On("GetItemVersions", mock.Anything).Return(versions(item("old"), 1), nil).Once()
+	second.On("GetItemVersions", mock.Anything).Return(versions(item("new"), 2), nil).Once()
+	got, err = r.Get(consistentReq)
+	assert.NoError(t, err)
+	assert.Equal(t, item("new"), got)
+
+	// The newest copy may be a delete.
+	first.On("GetItemVersions", mock.Anything).Return(versions(item("old"), 3), nil).Once()
+	second.On("GetItemVersions", mock.Anything).Return(versions(nil, 4), nil).Once()
+	got, err = r.Get(consistentReq)
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+
+	// A replica that does not answer is replaced by the next one.
+	first.On("GetItemVersions", mock.Anything).Return((*types.GetItemVersionsResponse)(nil), errors.New("connection refused")).Once()
+	second.On("GetItemVersions", mock.Anything).Return(versions(item("old"), 5), nil).Once()
+	third.On("GetItemVersions", mock.Anything).Return(versions(item("new"), 6), nil).Once()
+	got, err = r.Get(consistentReq)
+	assert.NoError(t, err)
+	assert.Equal(t, item("new"), got)
+
+	// A consistent query keeps the copies of the replica with the newest
+	// version of each item, leaving out items it does not return.
+	queryReq := &types.QueryRequest{
+		TableName:                 "test_table",
+		KeyConditionExpression:    "id = :id",
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{":id": key["id"]},
+		ConsistentRead:            true,
+	}
+	first.On("Query", mock.Anything).Return(&types.QueryResponse{Items: []map[string]*expression.AttributeValue{item("old")}, Count: 1, ScannedCount: 1}, nil).Once()
+	second.On("Query", mock.Anything).Return(&types.QueryResponse{Items: []map[string]*expression.AttributeValue{}}, nil).Once()
+	first.On("GetItemVersions", mock.Anything).Return(versions(item("old"), 7), nil).Once()
+	second.On("GetItemVersions", mock.Anything).Return(versions(nil, 8), nil).Once()
+	queryResp, err := r.Query(queryReq)
+	assert.NoError(t, err)
+	assert.Empty(t, queryResp.Items)
+
+	first.On("Query", mock.Anything).Return(&types.QueryResponse{Items: []map[string]*expression.AttributeValue{item("new")}, Count: 1, ScannedCount: 1}, nil).Once()
+	second.On("Query", mock.Anything).Return(&types.QueryResponse{Items: []map[string]*expression.AttributeValue{item("old")}, Count: 1, ScannedCount: 1}, nil).Once()
+	first.On("GetItemVersions", mock.Anything).Return(versions(item("new"), 10), nil).Once()
+	second.On("GetItemVersions", mock.Anything).Return(versions(item("old"), 9), nil).Once()
+	queryResp, err = r.Query(queryReq)
+	assert.NoError(t, err)
+	assert.Equal(t, []map[string]*expression.AttributeValue{item("new")}, queryResp.Items)
+	assert.Equal(t, 1, queryResp.Count)
+
+	// A node whose partitions are still being copied to it is not one of
+	// the replicas a consistent read overlaps.
+	assert.NoError(t, r.SetReplicationFactor(4))
+	assert.NoError(t, r.SetQuorums(1, 1))
+	r.mu.Lock()
+	r.nodes["node4"] = Node{ID: "node4", Addr: "localhost:8004"}
+	r.mu.Unlock()
+	assert.Equal(t, 3, r.readsNeeded(true))
+
+	for _, client := range clients {
+		client.AssertExpectations(t)
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	mockFactory := new(MockNodeClientFactory)
+	r := NewRouter(mockFactory)
+	now := time.Unix(1000, 0)
+	r.now = func() time.Time { return now }
+
+	assert.Error(t, r.SetHealthConfig(HealthConfig{ProbeInterval: time.Second, SuspectAfter: 3 * time.Second}))
+	assert.Error(t, r.SetHealthConfig(HealthConfig{ProbeInterval: time.Second, SuspectAfter: 3 * time.Second, FailAfter: 2 * time.Second}))
+	assert.NoError(t, r.SetHealthConfig(DefaultHealthConfig))
+
+	clients := make(map[string]*MockStorage)
+	for i := 1; i <= 3; i++ {
+		node := Node{ID: fmt.Sprintf("node%d", i), Addr: fmt.Sprintf("localhost:800%d", i)}
+		clients[node.ID] = new(MockStorage)
+		mockFactory.On("NewNodeClient", node.Addr).Return(clients[node.ID]).Once()
+		r.AddNode(node)
+	}
+	clients["node1"].On("Ping", time.Second).Return(nil)
+	clients["node3"].On("Ping", time.Second).Return(nil)
+	clients["node2"].On("Ping", time.Second).Return(errors.New("connection refused")).Times(3)
+	clients["node2"].On("Ping", time.Second).Return(nil)
+
+	states := func() map[string]NodeState {
+		states := make(map[string]NodeState)
+		for _, status := range r.NodeStatuses() {
+			states[status.ID] = status.State
+		}
+		return states
+	}
+
+	assert.ErrorIs(t, r.Heartbeat("node4"), ErrUnknownNode)
+
+	// A node missing probes is suspected, but stays in the ring.
+	now = now.Add(4 * time.Second)
+	r.checkHealth()
+	assert.Equal(t, map[string]NodeState{"node1": NodeAlive, "node2": NodeSuspect, "node3": NodeAlive}, states())
+	assert.Len(t, r.GetActiveNodes(), 3)
+
+	// A heartbeat clears the suspicion.
+	assert.NoError(t, r.Heartbeat("node2"))
+	r.checkHealth()
+	assert.Equal(t, NodeAlive, states()["node2"])
+
+	// A node not heard from for the failure timeout leaves the ring, and its
+	// partitions are copied to the nodes taking them over.
+	for _, id := range []string{"node1", "node3"} {
+		clients[id].On("ListTables", &types.ListTablesRequest{}).Return(&types.ListTablesResponse{}, nil).Once()
+	}
+	now = now.Add(11 * time.Second)
+	r.checkHealth()
+	assert.Equal(t, map[string]NodeState{"node1": NodeAlive, "node2": NodeFailed, "node3": NodeAlive}, states())
+	assert.Len(t, r.GetActiveNodes(), 2)
+	assert.NotContains(t, r.nodes, "node2")
+
+	// Once it answers again, it gets the tables it missed, loses the ones
+	// deleted while it was away, gets its partitions, and rejoins.
+	desc := types.TableDescription{
+		TableName:            "T",
+		KeySchema:            []*types.KeySchemaElement{{AttributeName: "ID", KeyType: "HASH"}},
+		AttributeDefinitions: []*types.AttributeDefinition{{AttributeName: "ID", AttributeType: "S"}},
+	}
+	clients["node2"].On("ListTables", &types.ListTablesRequest{}).Return(&types.ListTablesResponse{TableNames: []string{"Old"}}, nil).Once()
+	clients["node2"].On("DeleteTable", &types.DeleteTableRequest{TableName: "Old"}).Return(&types.DeleteTableResponse{}, nil).Once()
+	clients["node2"].On("ListTables", &types.ListTablesRequest{}).Return(&types.ListTablesResponse{}, nil).Once()
+	// The tables are read from node1, the first node of the ring, and then
+	// from every node to find the partitions to copy.
+	clients["node1"].On("ListTables", &types.ListTablesRequest{}).Return(&types.ListTablesResponse{TableNames: []string{"T"}}, nil).Twice()
+	clients["node3"].On("ListTables", &types.ListTablesRequest{}).Return(&types.ListTablesResponse{TableNames: []string{"T"}}, nil).Once()
+	for _, id := range []string{"node1", "node3"} {
+		clients[id].On("ScanItemVersions", mock.Anything).Return(&types.ScanItemVersionsResponse{}, nil).Once()
+		clients[id].On("DescribeTable", &types.DescribeTableRequest{TableName: "T"}).Return(&types.DescribeTableResponse{Table: desc}, nil).Maybe()
+		clients[id].On("DescribeTimeToLive", &types.DescribeTimeToLiveRequest{TableName: "T"}).Return(&types.DescribeTimeToLiveResponse{
+			TimeToLiveDescription: types.TimeToLiveDescription{TimeToLiveStatus: types.TimeToLiveStatusDisabled},
+		}, nil).Maybe()
+	}
+	clients["node2"].On("CreateTable", &types.CreateTableRequest{
+		TableName:            "T",
+		KeySchema:            desc.KeySchema,
+		AttributeDefinitions: desc.AttributeDefinitions,
+	}).Return(&types.CreateTableResponse{}, nil).Once()
+
+	now = now.Add(time.Second)
+	r.checkHealth()
+	assert.Equal(t, NodeAlive, states()["node2"])
+	assert.Len(t, r.GetActiveNodes(), 3)
+	for _, status := range r.NodeStatuses() {
+		if status.ID == "node2" {
+			assert.Equal(t, now, status.Since)
+			assert.Equal(t, now, status.LastSeen)
+		}
+	}
+
+	// A node that deregisters is forgotten.
+	r.RemoveNode("node2")
+	assert.Len(t, r.NodeStatuses(), 2)
+	assert.ErrorIs(t, r.Heartbeat("node2"), ErrUnknownNode)
+
+	for _, client := range clients {
+		client.AssertExpectations(t)
+	}
+}
+
+func TestTableOperationsWithHeartbeats(t *testing.T) {
+	mockFactory := new(MockNodeClientFactory)
+	r := NewRouter(mockFactory)
+
+	for i := 1; i <= 3; i++ {
+		node := Node{ID: fmt.Sprintf("node%d", i), Addr: fmt.Sprintf("localhost:800%d", i)}
+		client := new(MockStorage)
+		// Slow replies leave heartbeats time to queue while a table
+		// operation goes from node to node.
+		delay := time.Millisecond
+		client.On("CreateTable", mock.Anything).Return(&types.CreateTableResponse{}, nil).After(delay)
+		client.On("UpdateTable", mock.Anything).Return(&types.UpdateTableResponse{}, nil).After(delay)
+		client.On("UpdateTimeToLive", mock.Anything).Return(&types.UpdateTimeToLiveResponse{}, nil).After(delay)
+		client.On("ListTables", mock.Anything).Return(&types.ListTablesResponse{TableNames: []string{"test_table"}}, nil).After(delay)
+		client.On("DeleteTable", mock.Anything).Return(&types.DeleteTableResponse{}, nil).After(delay)
+		mockFactory.On("NewNodeClient", node.Addr).Return(client).Once()
+		r.AddNode(node)
+	}
+
+	stop := make(chan struct{})
+	heartbeats := make(chan struct{})
+	go func() {
+		defer close(heartbeats)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(100 * time.Microsecond):
+				for i := 1; i <= 3; i++ {
+					assert.NoError(t, r.Heartbeat(fmt.Sprintf("node%d", i)))
+				}
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 10; i++ {
+			_, err := r.CreateTable(&types.CreateTableRequest{TableName: "test_table"})
+			assert.NoError(t, err)
+			_, err = r.UpdateTable(&types.UpdateTableRequest{TableName: "test_table"})
+			assert.NoError(t, err)
+			_, err = r.UpdateTimeToLive(&types.UpdateTimeToLiveRequest{TableName: "test_table"})
+			assert.NoError(t, err)
+			_, err = r.ListTables(&types.ListTablesRequest{})
+			assert.NoError(t, err)
+			_, err = r.DeleteTable(&types.DeleteTableRequest{TableName: "test_table"})
+			assert.NoError(t, err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("table operations did not finish while nodes sent heartbeats")
+	}
+	close(stop)
+	<-heartbeats
+}
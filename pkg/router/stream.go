@@ -0,0 +1,181 @@
+package router
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"zagreb/pkg/storage"
+	"zagreb/pkg/types"
+)
+
+// Every node holds the definition of every table, and so has a stream for
+// each table with one enabled, under the same ARN, as the router labels the
+// stream when enabling it. A node's stream has a single shard recording the
+// changes to the items it holds, so the router presents the stream as one
+// shard per node. The ID of such a shard is the node's shard ID followed by
+// the node ID, and requests for a shard are sent to its node with the
+// node's own shard ID. Every replica of a partition records its changes, so
+// the shard of a node only returns the records of the partitions it is the
+// primary of.
+
+// newStreamLabel returns the label of a stream enabled now.
+func newStreamLabel() string {
+	return time.Now().UTC().Format(storage.StreamLabelFormat)
+}
+
+// ListStreams lists the streams from a single node, as every node has every
+// stream.
+func (r *Router) ListStreams(req *types.ListStreamsRequest) (*types.ListStreamsResponse, error) {
+	client, err := r.metadataClient(req.TableName)
+	if err != nil {
+		return nil, err
+	}
+	return client.ListStreams(req)
+}
+
+// DescribeStream describes the stream with the shard of every node. Shards
+// are listed in ID order, a page of at most Limit at a time.
+func (r *Router) DescribeStream(req *types.DescribeStreamRequest) (*types.DescribeStreamResponse, error) {
+	nodes := r.sortedNodes()
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no nodes in the ring")
+	}
+
+	var desc types.StreamDescription
+	shards := []*types.Shard{}
+	for i, node := range nodes {
+		client, err := r.getClientForNode(node)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.DescribeStream(&types.DescribeStreamRequest{StreamArn: req.StreamArn})
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe stream on node %s: %w", node.ID, err)
+		}
+		if i == 0 {
+			desc = resp.StreamDescription
+		}
+		if resp.StreamDescription.StreamStatus == types.StreamStatusDisabled {
+			desc.StreamStatus = types.StreamStatusDisabled
+		}
+		for _, shard := range resp.StreamDescription.Shards {
+			routed := *shard
+			routed.ShardId = shard.ShardId + "-" + node.ID
+			shards = append(shards, &routed)
+		}
+	}
+
+	sort.Slice(shards, func(i, j int) bool { return shards[i].ShardId < shards[j].ShardId })
+	if req.ExclusiveStartShardId != "" {
+		start := sort.Search(len(shards), func(i int) bool { return shards[i].ShardId > req.ExclusiveStartShardId })
+		shards = shards[start:]
+	}
+	desc.LastEvaluatedShardId = ""
+	if req.Limit > 0 && len(shards) > req.Limit {
+		shards = shards[:req.Limit]
+		desc.LastEvaluatedShardId = shards[len(shards)-1].ShardId
+	}
+	desc.Shards = shards
+
+	return &types.DescribeStreamResponse{StreamDescription: desc}, nil
+}
+
+// GetShardIterator routes the GetShardIterator request to the node of the
+// shard.
+func (r *Router) GetShardIterator(req *types.GetShardIteratorRequest) (*types.GetShardIteratorResponse, error) {
+	node, shardID, err := r.nodeForShard(req.ShardId)
+	if err != nil {
+		return nil, err
+	}
+	client, err := r.getClientForNode(node)
+	if err != nil {
+		return nil, err
+	}
+	nodeReq := *req
+	nodeReq.ShardId = shardID
+	resp, err := client.GetShardIterator(&nodeReq)
+	if err != nil {
+		return nil, err
+	}
+	iterator, err := renameIterator(resp.ShardIterator, req.ShardId)
+	if err != nil {
+		return nil, err
+	}
+	return &types.GetShardIteratorResponse{ShardIterator: iterator}, nil
+}
+
+// GetRecords routes the GetRecords request to the node of the shard the
+// iterator reads.
+func (r *Router) GetRecords(req *types.GetRecordsRequest) (*types.GetRecordsResponse, error) {
+	iterator, err := storage.ParseShardIterator(req.ShardIterator)
+	if err != nil {
+		return nil, err
+	}
+	tableName, _, err := storage.ParseStreamArn(iterator.StreamArn)
+	if err != nil {
+		return nil, err
+	}
+	node, shardID, err := r.nodeForShard(iterator.ShardId)
+	if err != nil {
+		return nil, err
+	}
+	client, err := r.getClientForNode(node)
+	if err != nil {
+		return nil, err
+	}
+	nodeIterator := *iterator
+	nodeIterator.ShardId = shardID
+	nodeReq := *req
+	nodeReq.ShardIterator = nodeIterator.String()
+
+	resp, err := client.GetRecords(&nodeReq)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*types.Record, 0, len(resp.Records))
+	for _, record := range resp.Records {
+		primary, err := r.nodeForKey(tableName, record.Dynamodb.Keys)
+		if err != nil {
+			return nil, err
+		}
+		if primary.ID == node.ID {
+			records = append(records, record)
+		}
+	}
+	resp.Records = records
+	if resp.NextShardIterator != "" {
+		if resp.NextShardIterator, err = renameIterator(resp.NextShardIterator, iterator.ShardId); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// nodeForShard returns the node of a shard, and the node's own ID for the
+// shard.
+func (r *Router) nodeForShard(shardID string) (Node, string, error) {
+	seq, nodeID, ok := strings.Cut(strings.TrimPrefix(shardID, "shardId-"), "-")
+	if !ok {
+		return Node{}, "", storage.NewResourceNotFoundError("shard not found: %s", shardID)
+	}
+	r.mu.RLock()
+	node, ok := r.nodes[nodeID]
+	r.mu.RUnlock()
+	if !ok {
+		return Node{}, "", storage.NewResourceNotFoundError("shard not found: %s", shardID)
+	}
+	return node, "shardId-" + seq, nil
+}
+
+// renameIterator replaces the shard ID in an iterator returned by a node
+// with the router's ID for the shard.
+func renameIterator(s, shardID string) (string, error) {
+	iterator, err := storage.ParseShardIterator(s)
+	if err != nil {
+		return "", err
+	}
+	iterator.ShardId = shardID
+	return iterator.String(), nil
+}
@@ -0,0 +1,542 @@
+package router
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	"zagreb/pkg/expression"
+	"zagreb/pkg/storage"
+	"zagreb/pkg/types"
+)
+
+// transactionPart is the share of a transaction held by one node, with the
+// positions of its items in the original request. An item written by a
+// transaction is part of the share of each of its replicas.
+type transactionPart struct {
+	node    Node
+	client  storage.Storage
+	indexes []int
+}
+
+// TransactWriteItems runs a write transaction. As for the writes of
+// writeNewest, the router judges the transaction against the newest copy of
+// each item it reads or updates: it checks every condition and computes
+// every update, and cancels the transaction if a condition fails. What
+// remains, a put or a delete of each item written, is then applied on the
+// items' replicas. When every item is held by one node, that node applies
+// the writes atomically on its own. Otherwise the router coordinates a
+// two-phase commit: each node first prepares its part, locking the items,
+// and the parts are committed once enough replicas of every item, as many
+// as acknowledge a write, prepared theirs; if not, the prepared parts are
+// aborted and nothing is written. A replica that did not prepare misses the
+// writes, as it would a write made while it was down. A committed
+// transaction is committed even on a node that fails to apply its part at
+// once, as described in transactionlog.go. Every write of the transaction
+// is stamped with the same new version.
+func (r *Router) TransactWriteItems(req *types.TransactWriteItemsRequest) (*types.TransactWriteItemsResponse, error) {
+	if err := storage.ValidateTransactWriteItems(req.TransactItems); err != nil {
+		return nil, err
+	}
+	actions, err := r.transactActions(req.TransactItems)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]itemKey, len(actions))
+	for i, action := range actions {
+		items[i] = action.item
+	}
+	unlock, err := r.lockItems(items)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	done := r.beginWrite()
+	resp, err := r.transactWriteItems(actions)
+	if err != nil && storage.ExceptionName(err) != "" {
+		// A transaction cancelled or refused by storage wrote nothing.
+		done()
+		return nil, err
+	}
+	var written []itemKey
+	for _, action := range actions {
+		if action.write != nil {
+			written = append(written, action.item)
+		}
+	}
+	done(written...)
+	return resp, err
+}
+
+// transactAction is an action of a write transaction, as the router judges
+// it: the item it addresses, by primary key, the condition the item must
+// meet, and how it derives the item it writes from the item it replaces.
+type transactAction struct {
+	item itemKey
+	cond *expression.Condition
+	// read is whether the action depends on the item it replaces.
+	read bool
+	// write returns the item the action writes, or nil to delete it. It is
+	// nil for a ConditionCheck.
+	write func(old map[string]*types.AttributeValue) (map[string]*types.AttributeValue, error)
+}
+
+// transactActions parses the actions of a validated write transaction.
+func (r *Router) transactActions(items []*types.TransactWriteItem) ([]*transactAction, error) {
+	actions := make([]*transactAction, len(items))
+	seen := make(map[string]bool)
+	for i, item := range items {
+		target := transactWriteKey(item)
+		keys, err := r.tableKeys(target.tableName)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range []string{keys.hashKey, keys.rangeKey} {
+			if _, ok := target.key[name]; name != "" && !ok {
+				return nil, storage.NewValidationError("missing key attribute: %s", name)
+			}
+		}
+		action := &transactAction{item: itemKey{tableName: target.tableName, key: keys.primaryKey(target.key)}}
+		name, err := keyName(action.item.key)
+		if err != nil {
+			return nil, err
+		}
+		if seen[target.tableName+"\x00"+name] {
+			return nil, storage.NewValidationError("transaction request cannot include multiple operations on one item")
+		}
+		seen[target.tableName+"\x00"+name] = true
+
+		switch {
+		case item.ConditionCheck != nil:
+			cc := item.ConditionCheck
+			if cc.ConditionExpression == "" {
+				return nil, storage.NewValidationError("ConditionCheck on table %s requires a ConditionExpression", cc.TableName)
+			}
+			action.cond, err = parseCondition(cc.ConditionExpression, cc.ExpressionAttributeNames, cc.ExpressionAttributeValues)
+		case item.Put != nil:
+			put := item.Put
+			action.cond, err = parseCondition(put.ConditionExpression, put.ExpressionAttributeNames, put.ExpressionAttributeValues)
+			action.write = func(map[string]*types.AttributeValue) (map[string]*types.AttributeValue, error) {
+				return put.Item, nil
+			}
+		case item.Delete != nil:
+			del := item.Delete
+			action.cond, err = parseCondition(del.ConditionExpression, del.ExpressionAttributeNames, del.ExpressionAttributeValues)
+			action.write = func(map[string]*types.AttributeValue) (map[string]*types.AttributeValue, error) {
+				return nil, nil
+			}
+		case item.Update != nil:
+			var update *expression.UpdateExpression
+			update, action.cond, err = r.parseUpdate(item.Update)
+			key := item.Update.Key
+			action.write = func(old map[string]*types.AttributeValue) (map[string]*types.AttributeValue, error) {
+				return updatedItem(update, key, old)
+			}
+			action.read = true
+		}
+		if err != nil {
+			return nil, err
+		}
+		action.read = action.read || action.cond != nil
+		actions[i] = action
+	}
+	return actions, nil
+}
+
+// transactWriteItems runs a parsed write transaction, as described for
+// TransactWriteItems.
+func (r *Router) transactWriteItems(actions []*transactAction) (*types.TransactWriteItemsResponse, error) {
+	olds, err := r.newestItems(actions)
+	if err != nil {
+		return nil, err
+	}
+
+	reasons := make([]*types.CancellationReason, len(actions))
+	cancelled := false
+	version := r.newVersion()
+	var writes []*types.TransactWriteItem
+	var writeKeys []itemKey
+	var writeActions []int // Index of the action of each write
+	for i, action := range actions {
+		reasons[i] = &types.CancellationReason{Code: types.CancellationReasonNone}
+		err := matchCondition(action.cond, olds[i])
+		if errors.Is(err, storage.ErrConditionalCheckFailed) {
+			reasons[i] = &types.CancellationReason{Code: types.CancellationReasonConditionalCheckFailed, Message: "The conditional request failed"}
+			cancelled = true
+			continue
+		}
+		if err != nil {
+			return nil, storage.NewValidationError("invalid ConditionExpression: %w", err)
+		}
+		if action.write == nil {
+			continue
+		}
+		item, err := action.write(olds[i])
+		if err != nil {
+			return nil, err
+		}
+		write := &types.TransactWriteItem{Put: &types.PutRequest{TableName: action.item.tableName, Item: item}}
+		if item == nil {
+			write = &types.TransactWriteItem{Delete: &types.DeleteRequest{TableName: action.item.tableName, Key: action.item.key}}
+		}
+		writes = append(writes, withVersion(write, version))
+		writeKeys = append(writeKeys, action.item)
+		writeActions = append(writeActions, i)
+	}
+	if cancelled {
+		return nil, &storage.TransactionCanceledError{Reasons: reasons}
+	}
+	if len(writes) == 0 {
+		return &types.TransactWriteItemsResponse{}, nil
+	}
+
+	// A write the nodes refuse, because a transaction prepared on one of
+	// them holds the item, cancels the transaction with the reasons given
+	// for the actions it came from.
+	cancelledBy := func(writeReasons []*types.CancellationReason, indexes []int) {
+		for j, index := range indexes {
+			if j < len(writeReasons) && writeReasons[j].Code != types.CancellationReasonNone {
+				reasons[writeActions[index]] = writeReasons[j]
+			}
+		}
+	}
+
+	parts, err := r.splitTransaction(writeKeys, r.replicasForKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 1 {
+		resp, err := parts[0].client.TransactWriteItems(&types.TransactWriteItemsRequest{TransactItems: writes})
+		var partCancelled *storage.TransactionCanceledError
+		if errors.As(err, &partCancelled) {
+			cancelledBy(partCancelled.Reasons, parts[0].indexes)
+			return nil, &storage.TransactionCanceledError{Reasons: reasons}
+		}
+		return resp, err
+	}
+
+	txID, err := newTransactionID()
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]Node, len(parts))
+	for i, part := range parts {
+		nodes[i] = part.node
+	}
+	txLog := r.transactionLog()
+	if err := txLog.begin(txID, nodes); err != nil {
+		return nil, fmt.Errorf("failed to log transaction %s: %w", txID, err)
+	}
+	defer txLog.release(txID)
+
+	// Phase one: every node locks its part.
+	responses := make([]*types.PrepareTransactionResponse, len(parts))
+	errs := make([]error, len(parts))
+	inParallel(parts, func(i int, part *transactionPart) {
+		items := make([]*types.TransactWriteItem, len(part.indexes))
+		for j, index := range part.indexes {
+			items[j] = writes[index]
+		}
+		responses[i], errs[i] = part.client.PrepareTransaction(&types.PrepareTransactionRequest{
+			TransactionID: txID,
+			TransactItems: items,
+		})
+	})
+
+	replicas := make([]int, len(writes))
+	prepared := make([]int, len(writes))
+	var prepareErr error
+	refused := false
+	excluded := make(map[string]bool)
+	for i, part := range parts {
+		for _, index := range part.indexes {
+			replicas[index]++
+		}
+		switch {
+		case errs[i] != nil:
+			if prepareErr == nil {
+				prepareErr = fmt.Errorf("failed to prepare transaction %s on node %s: %w", txID, part.node.ID, errs[i])
+			}
+		case len(responses[i].CancellationReasons) > 0:
+			refused = true
+			cancelledBy(responses[i].CancellationReasons, part.indexes)
+		default:
+			for _, index := range part.indexes {
+				prepared[index]++
+			}
+			continue
+		}
+		excluded[part.node.ID] = true
+	}
+	quorum := true
+	for index := range writes {
+		if prepared[index] < r.acksNeeded(replicas[index]) {
+			quorum = false
+		}
+	}
+
+	// The decision to commit is logged before any node learns it, so that
+	// the parts a node does not commit now are committed later, even by
+	// another run of the router.
+	if quorum {
+		if err := txLog.commit(txID, excluded); err != nil {
+			quorum = false
+			prepareErr = fmt.Errorf("failed to log the commit of transaction %s: %w", txID, err)
+		}
+	}
+
+	if !quorum {
+		// Parts that were not prepared hold no locks, so aborting them is a
+		// no-op. The parts not aborted now are aborted by the health checks.
+		inParallel(parts, func(i int, part *transactionPart) {
+			r.abortPart(txLog, txID, part)
+		})
+		if refused {
+			return nil, &storage.TransactionCanceledError{Reasons: reasons}
+		}
+		return nil, prepareErr
+	}
+
+	// Phase two: every node that prepared applies its part, and the others
+	// drop theirs. The transaction is committed once logged, so a node that
+	// fails to apply its part is left for the health checks to commit it
+	// again.
+	inParallel(parts, func(i int, part *transactionPart) {
+		if excluded[part.node.ID] {
+			r.abortPart(txLog, txID, part)
+			return
+		}
+		if err := part.client.CommitTransaction(&types.CommitTransactionRequest{TransactionID: txID}); err != nil {
+			log.Printf("failed to commit transaction %s on node %s, will retry: %v", txID, part.node.ID, err)
+			return
+		}
+		txLog.resolve(txID, part.node.ID)
+	})
+
+	return &types.TransactWriteItemsResponse{}, nil
+}
+
+// abortPart aborts a node's part of a transaction.
+func (r *Router) abortPart(txLog *transactionLog, txID string, part *transactionPart) {
+	if err := part.client.AbortTransaction(&types.AbortTransactionRequest{TransactionID: txID}); err != nil {
+		log.Printf("failed to abort transaction %s on node %s: %v", txID, part.node.ID, err)
+		return
+	}
+	txLog.resolve(txID, part.node.ID)
+}
+
+// newestItems reads the newest copy of the item of every action that
+// depends on it, as a consistent read does. The items of the other actions
+// are left nil.
+func (r *Router) newestItems(actions []*transactAction) ([]map[string]*types.AttributeValue, error) {
+	olds := make([]map[string]*types.AttributeValue, len(actions))
+	errs := make([]error, len(actions))
+	var wg sync.WaitGroup
+	for i, action := range actions {
+		if !action.read {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, item itemKey) {
+			defer wg.Done()
+			replicas, err := r.replicasForKey(item.tableName, item.key)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			versionsReq := &types.GetItemVersionsRequest{TableName: item.tableName, Keys: []map[string]*types.AttributeValue{item.key}}
+			copies, answered, err := r.readVersions(versionsReq, replicas, r.readsNeeded(true))
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			olds[i] = copies[newestReplica(copies, answered, 0)].Items[0].Item
+		}(i, action.item)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return olds, nil
+}
+
+// TransactGetItems runs a read transaction. Each node reads its part from a
+// single snapshot; when the items span nodes, the parts are read in parallel
+// and are not isolated from each other.
+func (r *Router) TransactGetItems(req *types.TransactGetItemsRequest) (*types.TransactGetItemsResponse, error) {
+	if err := storage.ValidateTransactGetItems(req.TransactItems); err != nil {
+		return nil, err
+	}
+
+	items := make([]itemKey, len(req.TransactItems))
+	for i, item := range req.TransactItems {
+		items[i] = itemKey{tableName: item.Get.TableName, key: item.Get.Key}
+	}
+	// Items are read from their primary.
+	parts, err := r.splitTransaction(items, func(tableName string, key map[string]*types.AttributeValue) ([]Node, error) {
+		node, err := r.nodeForKey(tableName, key)
+		return []Node{node}, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(parts) == 1 {
+		return parts[0].client.TransactGetItems(req)
+	}
+
+	responses := make([]*types.TransactGetItemsResponse, len(parts))
+	errs := make([]error, len(parts))
+	inParallel(parts, func(i int, part *transactionPart) {
+		items := make([]*types.TransactGetItem, len(part.indexes))
+		for j, index := range part.indexes {
+			items[j] = req.TransactItems[index]
+		}
+		responses[i], errs[i] = part.client.TransactGetItems(&types.TransactGetItemsRequest{TransactItems: items})
+	})
+
+	resp := &types.TransactGetItemsResponse{Responses: make([]*types.ItemResponse, len(req.TransactItems))}
+	reasons := make([]*types.CancellationReason, len(req.TransactItems))
+	for i := range reasons {
+		reasons[i] = &types.CancellationReason{Code: types.CancellationReasonNone}
+	}
+	cancelled := false
+	for i, part := range parts {
+		var partCancelled *storage.TransactionCanceledError
+		switch {
+		case errors.As(errs[i], &partCancelled):
+			cancelled = true
+			for j, index := range part.indexes {
+				if j < len(partCancelled.Reasons) {
+					reasons[index] = partCancelled.Reasons[j]
+				}
+			}
+		case errs[i] != nil:
+			return nil, fmt.Errorf("failed to read transaction items on node %s: %w", part.node.ID, errs[i])
+		default:
+			for j, index := range part.indexes {
+				if j < len(responses[i].Responses) {
+					resp.Responses[index] = responses[i].Responses[j]
+				}
+			}
+		}
+	}
+	if cancelled {
+		return nil, &storage.TransactionCanceledError{Reasons: reasons}
+	}
+
+	return resp, nil
+}
+
+// PrepareTransaction is part of the node protocol for two-phase commits,
+// which the router drives rather than takes part in.
+func (r *Router) PrepareTransaction(req *types.PrepareTransactionRequest) (*types.PrepareTransactionResponse, error) {
+	return nil, fmt.Errorf("PrepareTransaction is not supported by the router")
+}
+
+// CommitTransaction is part of the node protocol for two-phase commits.
+func (r *Router) CommitTransaction(req *types.CommitTransactionRequest) error {
+	return fmt.Errorf("CommitTransaction is not supported by the router")
+}
+
+// AbortTransaction is part of the node protocol for two-phase commits.
+func (r *Router) AbortTransaction(req *types.AbortTransactionRequest) error {
+	return fmt.Errorf("AbortTransaction is not supported by the router")
+}
+
+// itemKey names an item of a transaction by its table and key.
+type itemKey struct {
+	tableName string
+	key       map[string]*types.AttributeValue
+}
+
+// splitTransaction groups the items of a transaction by node, each item
+// going to the nodes that nodesFor returns for it.
+func (r *Router) splitTransaction(items []itemKey, nodesFor func(tableName string, key map[string]*types.AttributeValue) ([]Node, error)) ([]*transactionPart, error) {
+	var parts []*transactionPart
+	byNode := make(map[string]*transactionPart)
+	for i, item := range items {
+		nodes, err := nodesFor(item.tableName, item.key)
+		if err != nil {
+			return nil, err
+		}
+		for _, node := range nodes {
+			part, ok := byNode[node.ID]
+			if !ok {
+				client, err := r.getClientForNode(node)
+				if err != nil {
+					return nil, err
+				}
+				part = &transactionPart{node: node, client: client}
+				byNode[node.ID] = part
+				parts = append(parts, part)
+			}
+			part.indexes = append(part.indexes, i)
+		}
+	}
+	return parts, nil
+}
+
+// inParallel calls fn for every part at once and waits for all the calls.
+func inParallel(parts []*transactionPart, fn func(i int, part *transactionPart)) {
+	var wg sync.WaitGroup
+	for i, part := range parts {
+		wg.Add(1)
+		go func(i int, part *transactionPart) {
+			defer wg.Done()
+			fn(i, part)
+		}(i, part)
+	}
+	wg.Wait()
+}
+
+// transactWriteKey returns the item that a transaction action addresses.
+// The key of a Put is its whole item.
+func transactWriteKey(item *types.TransactWriteItem) itemKey {
+	switch {
+	case item.ConditionCheck != nil:
+		return itemKey{tableName: item.ConditionCheck.TableName, key: item.ConditionCheck.Key}
+	case item.Put != nil:
+		return itemKey{tableName: item.Put.TableName, key: item.Put.Item}
+	case item.Update != nil:
+		return itemKey{tableName: item.Update.TableName, key: item.Update.Key}
+	default:
+		return itemKey{tableName: item.Delete.TableName, key: item.Delete.Key}
+	}
+}
+
+// withVersion returns a copy of a transaction action whose write carries
+// version.
+func withVersion(item *types.TransactWriteItem, version int64) *types.TransactWriteItem {
+	stamped := *item
+	switch {
+	case item.Put != nil:
+		put := *item.Put
+		put.Version = version
+		stamped.Put = &put
+	case item.Update != nil:
+		update := *item.Update
+		update.Version = version
+		stamped.Update = &update
+	case item.Delete != nil:
+		del := *item.Delete
+		del.Version = version
+		stamped.Delete = &del
+	}
+	return &stamped
+}
+
+// newTransactionID returns a random identifier for a two-phase commit.
+func newTransactionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate transaction ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
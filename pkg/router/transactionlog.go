@@ -0,0 +1,268 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+	"zagreb/pkg/storage"
+	"zagreb/pkg/types"
+)
+
+// The router records every two-phase commit it coordinates in a transaction
+// log: the nodes taking part before they prepare, then whether the
+// transaction commits, which is decided once enough nodes have prepared and
+// logged before any node is told to commit. A node holds a prepared part
+// until the router commits or aborts it, so a transaction whose commit or
+// abort did not reach every node, because a node failed or the router
+// stopped, stays in the log until the health checks resolve it: parts of a
+// committed transaction are committed, except on the nodes left out of it,
+// and parts of any other are aborted.
+
+// transactionsBucket holds the logged transactions by ID.
+const transactionsBucket = "transactions"
+
+// loggedTransaction is a two-phase commit in the transaction log.
+type loggedTransaction struct {
+	Nodes     []Node          `json:"Nodes"`
+	Committed bool            `json:"Committed"`
+	Excluded  map[string]bool `json:"Excluded,omitempty"` // Node IDs left out of a committed transaction, whose parts are aborted
+	Resolved  map[string]bool `json:"Resolved,omitempty"` // Node IDs that committed or aborted their part
+
+	active bool // Still being run by the router, so not to be resolved
+}
+
+// transactionLog is the router's record of its unresolved two-phase commits,
+// kept in a bbolt database or, if it has none, in memory only.
+type transactionLog struct {
+	mu           sync.Mutex
+	db           *bolt.DB
+	transactions map[string]*loggedTransaction
+}
+
+func newTransactionLog() *transactionLog {
+	return &transactionLog{transactions: make(map[string]*loggedTransaction)}
+}
+
+// openTransactionLog opens the transaction log kept at path, creating it if
+// needed, with the transactions left unresolved when it was last closed.
+func openTransactionLog(path string) (*transactionLog, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	l := newTransactionLog()
+	l.db = db
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(transactionsBucket))
+		if err != nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var t loggedTransaction
+			if err := json.Unmarshal(v, &t); err != nil {
+				return fmt.Errorf("invalid logged transaction %s: %w", k, err)
+			}
+			if t.Resolved == nil {
+				t.Resolved = make(map[string]bool)
+			}
+			l.transactions[string(k)] = &t
+			return nil
+		})
+	})
+
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// close closes the database of the log, if it has one.
+func (l *transactionLog) close() error {
+	if l.db == nil {
+		return nil
+	}
+	return l.db.Close()
+}
+
+// begin logs a transaction about to be prepared on nodes, as being run.
+func (l *transactionLog) begin(id string, nodes []Node) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t := &loggedTransaction{Nodes: nodes, Resolved: make(map[string]bool), active: true}
+	if err := l.save(id, t); err != nil {
+		return err
+	}
+	l.transactions[id] = t
+	return nil
+}
+
+// commit logs the decision to commit a transaction on its nodes but the
+// excluded ones, which did not prepare.
+func (l *transactionLog) commit(id string, excluded map[string]bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t := l.transactions[id]
+	t.Committed, t.Excluded = true, excluded
+	if err := l.save(id, t); err != nil {
+		t.Committed, t.Excluded = false, nil
+		return err
+	}
+	return nil
+}
+
+// resolve records that a node committed or aborted its part of a
+// transaction, and forgets the transaction once every node has.
+func (l *transactionLog) resolve(id, nodeID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t, ok := l.transactions[id]
+	if !ok {
+		return
+	}
+	t.Resolved[nodeID] = true
+
+	var err error
+	if len(t.Resolved) == len(t.Nodes) {
+		err = l.save(id, nil)
+		if err == nil {
+			delete(l.transactions, id)
+		}
+	} else {
+		err = l.save(id, t)
+	}
+	if err != nil {
+		// The part is resolved again, which nodes accept.
+		log.Printf("failed to log transaction %s as resolved on node %s: %v", id, nodeID, err)
+	}
+}
+
+// release marks a transaction as no longer being run by the router.
+func (l *transactionLog) release(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if t, ok := l.transactions[id]; ok {
+		t.active = false
+	}
+}
+
+// unresolved returns the transactions that the router is not running, with
+// the nodes yet to commit or abort their parts.
+func (l *transactionLog) unresolved() map[string]*loggedTransaction {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	pending := make(map[string]*loggedTransaction)
+	for id, t := range l.transactions {
+		if t.active {
+			continue
+		}
+		left := &loggedTransaction{Committed: t.Committed, Excluded: t.Excluded}
+		for _, node := range t.Nodes {
+			if !t.Resolved[node.ID] {
+				left.Nodes = append(left.Nodes, node)
+			}
+		}
+		pending[id] = left
+	}
+	return pending
+}
+
+// save writes a transaction to the database, or deletes it if t is nil.
+// l.mu must be held.
+func (l *transactionLog) save(id string, t *loggedTransaction) error {
+	if l.db == nil {
+		return nil
+	}
+	return l.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(transactionsBucket))
+		if t == nil {
+			return b.Delete([]byte(id))
+		}
+		val, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), val)
+	})
+}
+
+// OpenTransactionLog keeps the router's log of two-phase commits in the
+// bbolt database at path, so that the commits left unfinished by a router
+// that stopped are finished by the next. Without it, the log is kept in
+// memory. It should be called before the router runs any transaction.
+func (r *Router) OpenTransactionLog(path string) error {
+	l, err := openTransactionLog(path)
+	if err != nil {
+		return err
+	}
+	r.txLogMu.Lock()
+	defer r.txLogMu.Unlock()
+	if err := r.txLog.close(); err != nil {
+		l.close()
+		return err
+	}
+	r.txLog = l
+	return nil
+}
+
+// CloseTransactionLog closes the database of the transaction log, if it has
+// one, going back to a log in memory.
+func (r *Router) CloseTransactionLog() error {
+	r.txLogMu.Lock()
+	defer r.txLogMu.Unlock()
+	err := r.txLog.close()
+	r.txLog = newTransactionLog()
+	return err
+}
+
+// transactionLog returns the log of two-phase commits.
+func (r *Router) transactionLog() *transactionLog {
+	r.txLogMu.Lock()
+	defer r.txLogMu.Unlock()
+	return r.txLog
+}
+
+// resolveTransactions commits or aborts the parts of the logged transactions
+// that the router is not running and that some node still holds. A part
+// that cannot be resolved now is tried again on the next call.
+func (r *Router) resolveTransactions() {
+	l := r.transactionLog()
+	for id, t := range l.unresolved() {
+		for _, node := range t.Nodes {
+			client := r.transactionClient(node)
+			var err error
+			if t.Committed && !t.Excluded[node.ID] {
+				err = client.CommitTransaction(&types.CommitTransactionRequest{TransactionID: id})
+				if errors.Is(err, storage.ErrResourceNotFound) {
+					// The node committed its part, but the router did not
+					// learn it.
+					err = nil
+				}
+			} else {
+				err = client.AbortTransaction(&types.AbortTransactionRequest{TransactionID: id})
+			}
+			if err != nil {
+				log.Printf("failed to resolve transaction %s on node %s: %v", id, node.ID, err)
+				continue
+			}
+			l.resolve(id, node.ID)
+		}
+	}
+}
+
+// transactionClient returns a client for a node taking part in a logged
+// transaction, which may no longer be registered.
+func (r *Router) transactionClient(node Node) storage.Storage {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if m, ok := r.members[node.ID]; ok {
+		return m.client
+	}
+	return r.nodeClientFactory.NewNodeClient(node.Addr)
+}
@@ -1,6 +1,8 @@
 package routerapi
 
 import (
+	"time"
+
 	"zagreb/pkg/router"
 )
 
@@ -13,7 +15,39 @@ type DeregisterNodeRequest struct {
 	ID string `json:"id"`
 }
 
+// HeartbeatRequest is the request body a node sends the router periodically
+// to tell it that it is up.
+type HeartbeatRequest struct {
+	ID string `json:"id"`
+}
+
 // RegisterNodeResponse is the response body for registering a node with the router.
 type RegisterNodeResponse struct {
 	ActiveNodes []router.Node `json:"activeNodes"`
 }
+
+// ReplicasResponse is the response body of the replicas admin endpoint: the
+// nodes holding copies of a partition, its primary first, and the quorums
+// of the router, a write quorum of 0 standing for every replica.
+type ReplicasResponse struct {
+	ReplicationFactor int           `json:"replicationFactor"`
+	WriteQuorum       int           `json:"writeQuorum"`
+	ReadQuorum        int           `json:"readQuorum"`
+	Replicas          []router.Node `json:"replicas"`
+}
+
+// NodesResponse is the response body of the node status endpoint.
+type NodesResponse struct {
+	Nodes []NodeStatus `json:"nodes"`
+}
+
+// NodeStatus is the health of a node: alive, suspect, failed, joining or
+// leaving, as router.NodeState, with when it was last heard from and since
+// when it has been in its state.
+type NodeStatus struct {
+	ID       string    `json:"id"`
+	Addr     string    `json:"addr"`
+	State    string    `json:"state"`
+	LastSeen time.Time `json:"lastSeen"`
+	Since    time.Time `json:"since"`
+}
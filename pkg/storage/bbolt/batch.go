@@ -0,0 +1,135 @@
+package bbolt
+
+import (
+	"sort"
+
+	bolt "go.etcd.io/bbolt"
+	"zagreb/pkg/expression"
+	"zagreb/pkg/storage"
+	"zagreb/pkg/types"
+)
+
+// BatchWriteItem applies up to 25 puts and deletes, across any number of
+// tables, in a single transaction. Either every write is applied or, on
+// error, none is, so a node never reports unprocessed items.
+func (s *BBoltStorage) BatchWriteItem(req *types.BatchWriteItemRequest) (*types.BatchWriteItemResponse, error) {
+	if err := storage.ValidateBatchWriteItem(req); err != nil {
+		return nil, err
+	}
+
+	tableNames := make([]string, 0, len(req.RequestItems))
+	for tableName := range req.RequestItems {
+		tableNames = append(tableNames, tableName)
+	}
+	sort.Strings(tableNames)
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		for _, tableName := range tableNames {
+			tableDef, err := s.getTableDef(tx, tableName)
+			if err != nil {
+				return err
+			}
+
+			seen := make(map[string]bool)
+			for _, w := range req.RequestItems[tableName] {
+				var item map[string]*expression.AttributeValue
+				if w.PutRequest != nil {
+					item = w.PutRequest.Item
+				} else {
+					item = w.DeleteRequest.Key
+				}
+				if err := s.checkDuplicateKey(tableDef, item, seen); err != nil {
+					return err
+				}
+
+				if w.PutRequest != nil {
+					_, err = s.putItem(tx, &types.PutRequest{TableName: tableName, Item: w.PutRequest.Item, Version: w.PutRequest.Version})
+				} else {
+					_, err = s.deleteItem(tx, &types.DeleteRequest{TableName: tableName, Key: w.DeleteRequest.Key, Version: w.DeleteRequest.Version})
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.BatchWriteItemResponse{UnprocessedItems: map[string][]*types.WriteRequest{}}, nil
+}
+
+// BatchGetItem reads up to 100 items, across any number of tables, from a
+// single consistent snapshot. Missing items are left out of the response.
+func (s *BBoltStorage) BatchGetItem(req *types.BatchGetItemRequest) (*types.BatchGetItemResponse, error) {
+	if err := storage.ValidateBatchGetItem(req); err != nil {
+		return nil, err
+	}
+
+	responses := make(map[string][]map[string]*expression.AttributeValue)
+
+	tableNames := make([]string, 0, len(req.RequestItems))
+	for tableName := range req.RequestItems {
+		tableNames = append(tableNames, tableName)
+	}
+	sort.Strings(tableNames)
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, tableName := range tableNames {
+			ka := req.RequestItems[tableName]
+			tableDef, err := s.getTableDef(tx, tableName)
+			if err != nil {
+				return err
+			}
+
+			items := make([]map[string]*expression.AttributeValue, 0, len(ka.Keys))
+			seen := make(map[string]bool)
+			for _, key := range ka.Keys {
+				if err := s.checkDuplicateKey(tableDef, key, seen); err != nil {
+					return err
+				}
+
+				item, err := s.getItem(tx, &types.GetRequest{
+					TableName:                tableName,
+					Key:                      key,
+					ProjectionExpression:     ka.ProjectionExpression,
+					ExpressionAttributeNames: ka.ExpressionAttributeNames,
+				})
+				if err != nil {
+					return err
+				}
+				if item != nil {
+					items = append(items, item)
+				}
+			}
+			responses[tableName] = items
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.BatchGetItemResponse{
+		Responses:       responses,
+		UnprocessedKeys: map[string]*types.KeysAndAttributes{},
+	}, nil
+}
+
+// checkDuplicateKey rejects a batch that names the same item twice, as
+// DynamoDB does, recording the item's key in seen.
+func (s *BBoltStorage) checkDuplicateKey(tableDef *types.CreateTableRequest, item map[string]*expression.AttributeValue, seen map[string]bool) error {
+	key, err := s.encodeKey(tableDef, item)
+	if err != nil {
+		return err
+	}
+	if seen[string(key)] {
+		return storage.NewValidationError("provided list of item keys contains duplicates for table %s", tableDef.TableName)
+	}
+	seen[string(key)] = true
+	return nil
+}
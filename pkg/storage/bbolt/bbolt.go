@@ -3,23 +3,41 @@ package bbolt
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"strconv"
-	"strings"
+	"sync"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 	"zagreb/pkg/expression"
+	"zagreb/pkg/storage"
 	"zagreb/pkg/types"
 )
 
 const (
 	metadataBucket = "_metadata"
-	keyDelimiter   = "|"
+
+	// maxPageBytes caps the amount of item data read by a single Query, as DynamoDB does.
+	maxPageBytes = 1 << 20
 )
 
 // BBoltStorage is a storage engine that uses bbolt.
 type BBoltStorage struct {
 	db *bolt.DB
+
+	// txMu guards the transactions prepared by a two-phase commit and the
+	// item locks they hold.
+	txMu     sync.Mutex
+	prepared map[string]*preparedTransaction
+	locks    map[string]string // item lock key to transaction ID
+
+	// keyMigration is what opening the database migrated.
+	keyMigration KeyMigration
+
+	// stopSweeper ends the goroutine that deletes expired items and trims
+	// streams, which closes sweeperDone when it returns.
+	stopSweeper chan struct{}
+	sweeperDone chan struct{}
 }
 
 // NewBBoltStorage creates a new BBoltStorage.
@@ -29,49 +47,101 @@ func NewBBoltStorage(path string) (*BBoltStorage, error) {
 		return nil, err
 	}
 
+	s := &BBoltStorage{
+		db:          db,
+		prepared:    make(map[string]*preparedTransaction),
+		locks:       make(map[string]string),
+		stopSweeper: make(chan struct{}),
+		sweeperDone: make(chan struct{}),
+	}
+
 	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(metadataBucket))
-		return err
+		if _, err := tx.CreateBucketIfNotExists([]byte(metadataBucket)); err != nil {
+			return err
+		}
+
+		// Bring tables written by older versions up to the current key encoding.
+		if err := s.migrateKeyFormat(tx); err != nil {
+			return err
+		}
+
+		return s.loadPrepared(tx)
 	})
 
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	return &BBoltStorage{db: db}, nil
+	go s.sweep(ttlSweepInterval)
+
+	return s, nil
+}
+
+// Close stops the sweeper and closes the database.
+func (s *BBoltStorage) Close() error {
+	close(s.stopSweeper)
+	<-s.sweeperDone
+	return s.db.Close()
 }
 
 // CreateTable creates a new table.
 func (s *BBoltStorage) CreateTable(req *types.CreateTableRequest) (*types.CreateTableResponse, error) {
+	tableDef := &types.CreateTableRequest{
+		TableName:            req.TableName,
+		KeySchema:            req.KeySchema,
+		AttributeDefinitions: req.AttributeDefinitions,
+	}
+	for _, gsi := range req.GlobalSecondaryIndexes {
+		if err := validateGlobalSecondaryIndex(tableDef, gsi); err != nil {
+			return nil, err
+		}
+		tableDef.GlobalSecondaryIndexes = append(tableDef.GlobalSecondaryIndexes, gsi)
+	}
+	for _, lsi := range req.LocalSecondaryIndexes {
+		if err := validateLocalSecondaryIndex(tableDef, lsi); err != nil {
+			return nil, err
+		}
+		tableDef.LocalSecondaryIndexes = append(tableDef.LocalSecondaryIndexes, lsi)
+	}
+	if spec := req.StreamSpecification; spec != nil {
+		if err := validateStreamSpecification(spec); err != nil {
+			return nil, err
+		}
+	}
+
 	err := s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(metadataBucket)).Get([]byte(req.TableName)) != nil {
+			return fmt.Errorf("%w: table already exists: %s", storage.ErrResourceInUse, req.TableName)
+		}
+
 		// Create the table bucket.
 		_, err := tx.CreateBucketIfNotExists([]byte(req.TableName))
 		if err != nil {
 			return err
 		}
 
-		// Store the table definition.
-		mb := tx.Bucket([]byte(metadataBucket))
-		key := []byte(req.TableName)
-		val, err := json.Marshal(req)
-		if err != nil {
-			return err
+		for _, idx := range secondaryIndexes(tableDef) {
+			if err := s.buildIndex(tx, tableDef, idx); err != nil {
+				return err
+			}
+		}
+
+		if spec := req.StreamSpecification; spec != nil && spec.StreamEnabled {
+			if err := updateStream(tx, tableDef, spec, req.LatestStreamLabel, time.Now()); err != nil {
+				return err
+			}
 		}
 
-		return mb.Put(key, val)
+		// Store the table definition.
+		return putTableDef(tx, tableDef)
 	})
 
 	if err != nil {
 		return nil, err
 	}
 
-	return &types.CreateTableResponse{
-		TableDescription: types.TableDescription{
-			TableName:            req.TableName,
-			KeySchema:            req.KeySchema,
-			AttributeDefinitions: req.AttributeDefinitions,
-		},
-	}, nil
+	return &types.CreateTableResponse{TableDescription: tableDescription(tableDef)}, nil
 }
 
 // DeleteTable deletes a table.
@@ -81,15 +151,29 @@ func (s *BBoltStorage) DeleteTable(req *types.DeleteTableRequest) (*types.Delete
 	err := s.db.Update(func(tx *bolt.Tx) error {
 		// Get table definition
 		var err error
-		tableDef, err = s.getTableDef(tx, req.TableName)
+		tableDef, err = s.readTableDef(tx, req.TableName)
 		if err != nil {
 			return err
 		}
 
-		// Delete the table bucket.
+		// Delete the table bucket, its indexes, its stream and its versions.
 		if err := tx.DeleteBucket([]byte(req.TableName)); err != nil {
 			return err
 		}
+		for _, idx := range secondaryIndexes(tableDef) {
+			if err := dropIndex(tx, req.TableName, idx.name); err != nil {
+				return err
+			}
+		}
+		if err := dropStream(tx, req.TableName); err != nil {
+			return err
+		}
+		if err := dropVersions(tx, req.TableName); err != nil {
+			return err
+		}
+		if err := forgetUnmigrated(tx, req.TableName); err != nil {
+			return err
+		}
 
 		// Delete the table definition.
 		mb := tx.Bucket([]byte(metadataBucket))
@@ -100,13 +184,7 @@ func (s *BBoltStorage) DeleteTable(req *types.DeleteTableRequest) (*types.Delete
 		return nil, err
 	}
 
-	return &types.DeleteTableResponse{
-		TableDescription: types.TableDescription{
-			TableName:            tableDef.TableName,
-			KeySchema:            tableDef.KeySchema,
-			AttributeDefinitions: tableDef.AttributeDefinitions,
-		},
-	}, nil
+	return &types.DeleteTableResponse{TableDescription: tableDescription(tableDef)}, nil
 }
 
 // DescribeTable describes a table.
@@ -115,7 +193,7 @@ func (s *BBoltStorage) DescribeTable(req *types.DescribeTableRequest) (*types.De
 
 	err := s.db.View(func(tx *bolt.Tx) error {
 		var err error
-		tableDef, err = s.getTableDef(tx, req.TableName)
+		tableDef, err = s.readTableDef(tx, req.TableName)
 		return err
 	})
 
@@ -123,13 +201,75 @@ func (s *BBoltStorage) DescribeTable(req *types.DescribeTableRequest) (*types.De
 		return nil, err
 	}
 
-	return &types.DescribeTableResponse{
-		Table: types.TableDescription{
-			TableName:            tableDef.TableName,
-			KeySchema:            tableDef.KeySchema,
-			AttributeDefinitions: tableDef.AttributeDefinitions,
-		},
-	}, nil
+	return &types.DescribeTableResponse{Table: tableDescription(tableDef)}, nil
+}
+
+// UpdateTable adds or removes global secondary indexes and enables or
+// disables the table's stream. A new index is backfilled from the items
+// already in the table before UpdateTable returns. Local secondary indexes
+// are fixed when the table is created.
+func (s *BBoltStorage) UpdateTable(req *types.UpdateTableRequest) (*types.UpdateTableResponse, error) {
+	var tableDef *types.CreateTableRequest
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		tableDef, err = s.getTableDef(tx, req.TableName)
+		if err != nil {
+			return err
+		}
+
+		for _, ad := range req.AttributeDefinitions {
+			declared, ok := attributeType(tableDef, ad.AttributeName)
+			if !ok {
+				tableDef.AttributeDefinitions = append(tableDef.AttributeDefinitions, ad)
+			} else if declared != ad.AttributeType {
+				return storage.NewValidationError("attribute %s is already defined with type %s", ad.AttributeName, declared)
+			}
+		}
+
+		for _, update := range req.GlobalSecondaryIndexUpdates {
+			switch {
+			case update.Create != nil && update.Delete == nil:
+				if err := validateGlobalSecondaryIndex(tableDef, update.Create); err != nil {
+					return err
+				}
+				tableDef.GlobalSecondaryIndexes = append(tableDef.GlobalSecondaryIndexes, update.Create)
+				if err := s.buildIndex(tx, tableDef, globalIndex(update.Create)); err != nil {
+					return err
+				}
+			case update.Delete != nil && update.Create == nil:
+				kept := tableDef.GlobalSecondaryIndexes[:0]
+				for _, gsi := range tableDef.GlobalSecondaryIndexes {
+					if gsi.IndexName != update.Delete.IndexName {
+						kept = append(kept, gsi)
+					}
+				}
+				if len(kept) == len(tableDef.GlobalSecondaryIndexes) {
+					return storage.NewResourceNotFoundError("the table %s does not have the specified global secondary index: %s", req.TableName, update.Delete.IndexName)
+				}
+				tableDef.GlobalSecondaryIndexes = kept
+				if err := dropIndex(tx, req.TableName, update.Delete.IndexName); err != nil {
+					return err
+				}
+			default:
+				return storage.NewValidationError("GlobalSecondaryIndexUpdate must have exactly one of Create and Delete")
+			}
+		}
+
+		if req.StreamSpecification != nil {
+			if err := updateStream(tx, tableDef, req.StreamSpecification, req.LatestStreamLabel, time.Now()); err != nil {
+				return err
+			}
+		}
+
+		return putTableDef(tx, tableDef)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.UpdateTableResponse{TableDescription: tableDescription(tableDef)}, nil
 }
 
 // ListTables lists all tables.
@@ -152,38 +292,88 @@ func (s *BBoltStorage) ListTables(req *types.ListTablesRequest) (*types.ListTabl
 }
 
 // Put adds an item to a table.
-func (s *BBoltStorage) Put(req *types.PutRequest) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		tableDef, err := s.getTableDef(tx, req.TableName)
-		if err != nil {
-			return err
-		}
+func (s *BBoltStorage) Put(req *types.PutRequest) (*types.PutItemResponse, error) {
+	var resp *types.PutItemResponse
 
-		if err := s.validatePutRequest(tableDef, req); err != nil {
-			return err
-		}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		resp, err = s.putItem(tx, req)
+		return err
+	})
 
-		// Get the bucket for the table.
-		b := tx.Bucket([]byte(req.TableName))
-		if b == nil {
-			return fmt.Errorf("bucket not found: %s", req.TableName)
-		}
+	if err != nil {
+		return nil, err
+	}
 
-		// Generate the key string for the item.
-		keyStr, err := s.generateKeyString(tableDef, req.Item)
-		if err != nil {
-			return err
-		}
-		key := []byte(keyStr)
+	return resp, nil
+}
 
-		// Marshal the item to JSON.
-		val, err := json.Marshal(req.Item)
-		if err != nil {
-			return err
-		}
+// putItem writes an item within tx, so that single and batched writes share it.
+func (s *BBoltStorage) putItem(tx *bolt.Tx, req *types.PutRequest) (*types.PutItemResponse, error) {
+	tableDef, err := s.getTableDef(tx, req.TableName)
+	if err != nil {
+		return nil, err
+	}
 
-		return b.Put(key, val)
-	})
+	if err := s.validatePutRequest(tableDef, req); err != nil {
+		return nil, err
+	}
+
+	// Get the bucket for the table.
+	b := tx.Bucket([]byte(req.TableName))
+	if b == nil {
+		return nil, fmt.Errorf("bucket not found: %s", req.TableName)
+	}
+
+	// Encode the primary key of the item.
+	key, err := s.encodeKey(tableDef, req.Item)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.checkLock(req.TableName, key); err != nil {
+		return nil, err
+	}
+	if superseded(tx, req.TableName, key, req.Version) {
+		return &types.PutItemResponse{}, nil
+	}
+
+	if err := checkCondition(b, key, req.ConditionExpression, req.ExpressionAttributeNames, req.ExpressionAttributeValues); err != nil {
+		return nil, err
+	}
+
+	// The item being replaced is returned for ALL_OLD, has its index
+	// entries removed and is recorded in the stream.
+	old, err := loadItem(b, key)
+	if err != nil {
+		return nil, err
+	}
+	resp := &types.PutItemResponse{}
+	if req.ReturnValues == types.ReturnValuesAllOld {
+		resp.Attributes = old
+	}
+
+	if err := s.updateIndexes(tx, tableDef, key, old, req.Item); err != nil {
+		return nil, err
+	}
+	if err := s.writeStreamRecord(tx, tableDef, old, req.Item, nil); err != nil {
+		return nil, err
+	}
+
+	if err := recordVersion(tx, req.TableName, key, req.Version); err != nil {
+		return nil, err
+	}
+
+	// Marshal the item to JSON.
+	val, err := json.Marshal(req.Item)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.Put(key, val); err != nil {
+		return nil, err
+	}
+	return resp, nil
 }
 
 // Get retrieves an item from a table.
@@ -191,132 +381,257 @@ func (s *BBoltStorage) Get(req *types.GetRequest) (map[string]*expression.Attrib
 	var item map[string]*expression.AttributeValue
 
 	err := s.db.View(func(tx *bolt.Tx) error {
-		tableDef, err := s.getTableDef(tx, req.TableName)
-		if err != nil {
-			return err
-		}
+		var err error
+		item, err = s.getItem(tx, req)
+		return err
+	})
 
-		if err := s.validateGetRequest(tableDef, req); err != nil {
-			return err
-		}
+	if err != nil {
+		return nil, err
+	}
 
-		// Get the bucket for the table.
-		b := tx.Bucket([]byte(req.TableName))
-		if b == nil {
-			return fmt.Errorf("bucket not found: %s", req.TableName)
-		}
+	return item, nil
+}
 
-		// Generate the key string for the item.
-		keyStr, err := s.generateKeyString(tableDef, req.Key)
-		if err != nil {
-			return err
-		}
-		key := []byte(keyStr)
+// getItem reads an item within tx, returning nil if it does not exist.
+func (s *BBoltStorage) getItem(tx *bolt.Tx, req *types.GetRequest) (map[string]*expression.AttributeValue, error) {
+	projection, err := parseProjectionExpression(req.ProjectionExpression, req.ExpressionAttributeNames)
+	if err != nil {
+		return nil, err
+	}
 
-		val := b.Get(key)
-		if val == nil {
-			return nil // not found
-		}
+	tableDef, err := s.getTableDef(tx, req.TableName)
+	if err != nil {
+		return nil, err
+	}
 
-		return json.Unmarshal(val, &item)
-	})
+	if err := s.validateGetRequest(tableDef, req); err != nil {
+		return nil, err
+	}
+
+	// Get the bucket for the table.
+	b := tx.Bucket([]byte(req.TableName))
+	if b == nil {
+		return nil, fmt.Errorf("bucket not found: %s", req.TableName)
+	}
 
+	// Encode the primary key of the item.
+	key, err := s.encodeKey(tableDef, req.Key)
 	if err != nil {
 		return nil, err
 	}
 
-	return item, nil
+	item, err := loadItem(b, key)
+	if err != nil {
+		return nil, err
+	}
+	if expired(tableDef, item, time.Now()) {
+		return nil, nil
+	}
+	return projection.Apply(item), nil
 }
 
 // Delete removes an item from a table.
-func (s *BBoltStorage) Delete(req *types.DeleteRequest) error {
-	return s.db.Update(func(tx *bolt.Tx) error {
-		tableDef, err := s.getTableDef(tx, req.TableName)
-		if err != nil {
-			return err
-		}
+func (s *BBoltStorage) Delete(req *types.DeleteRequest) (*types.DeleteItemResponse, error) {
+	var resp *types.DeleteItemResponse
 
-		if err := s.validateDeleteRequest(tableDef, req); err != nil {
-			return err
-		}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		resp, err = s.deleteItem(tx, req)
+		return err
+	})
 
-		// Get the bucket for the table.
-		b := tx.Bucket([]byte(req.TableName))
-		if b == nil {
-			return fmt.Errorf("bucket not found: %s", req.TableName)
-		}
+	if err != nil {
+		return nil, err
+	}
 
-		// Generate the key string for the item.
-		keyStr, err := s.generateKeyString(tableDef, req.Key)
-		if err != nil {
-			return err
-		}
-		key := []byte(keyStr)
+	return resp, nil
+}
 
-		return b.Delete(key)
-	})
+// deleteItem removes an item within tx, so that single and batched deletes share it.
+func (s *BBoltStorage) deleteItem(tx *bolt.Tx, req *types.DeleteRequest) (*types.DeleteItemResponse, error) {
+	tableDef, err := s.getTableDef(tx, req.TableName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.validateDeleteRequest(tableDef, req); err != nil {
+		return nil, err
+	}
+
+	// Get the bucket for the table.
+	b := tx.Bucket([]byte(req.TableName))
+	if b == nil {
+		return nil, fmt.Errorf("bucket not found: %s", req.TableName)
+	}
+
+	// Encode the primary key of the item.
+	key, err := s.encodeKey(tableDef, req.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.checkLock(req.TableName, key); err != nil {
+		return nil, err
+	}
+	if superseded(tx, req.TableName, key, req.Version) {
+		return &types.DeleteItemResponse{}, nil
+	}
+
+	if err := checkCondition(b, key, req.ConditionExpression, req.ExpressionAttributeNames, req.ExpressionAttributeValues); err != nil {
+		return nil, err
+	}
+
+	old, err := loadItem(b, key)
+	if err != nil {
+		return nil, err
+	}
+	resp := &types.DeleteItemResponse{}
+	if req.ReturnValues == types.ReturnValuesAllOld {
+		resp.Attributes = old
+	}
+
+	if err := s.updateIndexes(tx, tableDef, key, old, nil); err != nil {
+		return nil, err
+	}
+	if err := s.writeStreamRecord(tx, tableDef, old, nil, nil); err != nil {
+		return nil, err
+	}
+
+	if err := recordVersion(tx, req.TableName, key, req.Version); err != nil {
+		return nil, err
+	}
+	if err := b.Delete(key); err != nil {
+		return nil, err
+	}
+	return resp, nil
 }
 
 // Update updates an item in a table.
-func (s *BBoltStorage) Update(req *types.UpdateRequest) (map[string]*expression.AttributeValue, error) {
-	var updatedItem map[string]*expression.AttributeValue
+func (s *BBoltStorage) Update(req *types.UpdateRequest) (*types.UpdateItemResponse, error) {
+	var resp *types.UpdateItemResponse
 
 	err := s.db.Update(func(tx *bolt.Tx) error {
-		tableDef, err := s.getTableDef(tx, req.TableName)
-		if err != nil {
-			return err
-		}
+		var err error
+		resp, err = s.updateItem(tx, req)
+		return err
+	})
 
-		if err := s.validateUpdateRequest(tableDef, req); err != nil {
-			return err
-		}
+	if err != nil {
+		return nil, err
+	}
 
-		// Get the bucket for the table.
-		b := tx.Bucket([]byte(req.TableName))
-		if b == nil {
-			return fmt.Errorf("bucket not found: %s", req.TableName)
-		}
+	return resp, nil
+}
 
-		// Generate the key string for the item.
-		keyStr, err := s.generateKeyString(tableDef, req.Key)
-		if err != nil {
-			return err
-		}
-		key := []byte(keyStr)
+// updateItem updates an item within tx, so that single and transactional
+// updates share it.
+func (s *BBoltStorage) updateItem(tx *bolt.Tx, req *types.UpdateRequest) (*types.UpdateItemResponse, error) {
+	tableDef, err := s.getTableDef(tx, req.TableName)
+	if err != nil {
+		return nil, err
+	}
 
-		val := b.Get(key)
-		if val == nil {
-			return fmt.Errorf("item not found")
-		}
+	if err := s.validateUpdateRequest(tableDef, req); err != nil {
+		return nil, err
+	}
 
-		var item map[string]*expression.AttributeValue
-		if err := json.Unmarshal(val, &item); err != nil {
-			return err
+	update, err := expression.ParseUpdateExpression(req.UpdateExpression, req.ExpressionAttributeNames, req.ExpressionAttributeValues)
+	if err != nil {
+		return nil, storage.NewValidationError("invalid UpdateExpression: %w", err)
+	}
+	for _, ks := range tableDef.KeySchema {
+		if update.Modifies(ks.AttributeName) {
+			return nil, storage.NewValidationError("cannot update attribute %s: this attribute is part of the key", ks.AttributeName)
 		}
+	}
 
-				updatedItem, err = expression.Update(item, req.UpdateExpression, req.ExpressionAttributeValues)
-		if err != nil {
-			return err
-		}
+	// Get the bucket for the table.
+	b := tx.Bucket([]byte(req.TableName))
+	if b == nil {
+		return nil, fmt.Errorf("bucket not found: %s", req.TableName)
+	}
 
-		newVal, err := json.Marshal(updatedItem)
-		if err != nil {
-			return err
+	// Encode the primary key of the item.
+	key, err := s.encodeKey(tableDef, req.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.checkLock(req.TableName, key); err != nil {
+		return nil, err
+	}
+	if superseded(tx, req.TableName, key, req.Version) {
+		return &types.UpdateItemResponse{}, nil
+	}
+
+	if err := checkCondition(b, key, req.ConditionExpression, req.ExpressionAttributeNames, req.ExpressionAttributeValues); err != nil {
+		return nil, err
+	}
+
+	// Apply changes nested values in place, so the before-image is
+	// decoded separately from the item being updated.
+	old, err := loadItem(b, key)
+	if err != nil {
+		return nil, err
+	}
+	item, err := loadItem(b, key)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		// Like DynamoDB, updating a missing item creates it from its key.
+		item = make(map[string]*expression.AttributeValue)
+		for name, v := range req.Key {
+			item[name] = v
 		}
+	}
 
-		return b.Put(key, newVal)
-	})
+	if err := update.Apply(item); err != nil {
+		return nil, storage.NewValidationError("invalid UpdateExpression: %w", err)
+	}
+
+	if err := s.updateIndexes(tx, tableDef, key, old, item); err != nil {
+		return nil, err
+	}
+	if err := s.writeStreamRecord(tx, tableDef, old, item, nil); err != nil {
+		return nil, err
+	}
+
+	if err := recordVersion(tx, req.TableName, key, req.Version); err != nil {
+		return nil, err
+	}
 
+	newVal, err := json.Marshal(item)
 	if err != nil {
 		return nil, err
 	}
+	if err := b.Put(key, newVal); err != nil {
+		return nil, err
+	}
 
-	return updatedItem, nil
+	resp := &types.UpdateItemResponse{}
+	switch req.ReturnValues {
+	case types.ReturnValuesAllOld:
+		resp.Attributes = old
+	case types.ReturnValuesUpdatedOld:
+		resp.Attributes = update.UpdatedAttributes(old)
+	case types.ReturnValuesAllNew:
+		resp.Attributes = item
+	case types.ReturnValuesUpdatedNew:
+		resp.Attributes = update.UpdatedAttributes(item)
+	}
+	if len(resp.Attributes) == 0 {
+		resp.Attributes = nil
+	}
+	return resp, nil
 }
 
 // Query queries a table.
-func (s *BBoltStorage) Query(req *types.QueryRequest) ([]map[string]*expression.AttributeValue, error) {
-	var items []map[string]*expression.AttributeValue
+func (s *BBoltStorage) Query(req *types.QueryRequest) (*types.QueryResponse, error) {
+	items := make([]map[string]*expression.AttributeValue, 0)
+	var lastEvaluatedKey map[string]*expression.AttributeValue
+	scannedCount := 0
 
 	err := s.db.View(func(tx *bolt.Tx) error {
 		tableDef, err := s.getTableDef(tx, req.TableName)
@@ -324,53 +639,99 @@ func (s *BBoltStorage) Query(req *types.QueryRequest) ([]map[string]*expression.
 			return err
 		}
 
-		if err := s.validateQueryRequest(tableDef, req); err != nil {
-			return err
+		// An index is queried like a table keyed by the index key.
+		keyDef, bucketName := tableDef, []byte(req.TableName)
+		var idx *secondaryIndex
+		if req.IndexName != "" {
+			idx, err = findIndex(tableDef, req.IndexName)
+			if err != nil {
+				return err
+			}
+			if req.ConsistentRead && idx.global {
+				return errConsistentGlobalIndex
+			}
+			keyDef, bucketName = indexKeyDef(tableDef, idx), indexBucketName(req.TableName, req.IndexName)
 		}
 
-		// Get the bucket for the table.
-		b := tx.Bucket([]byte(req.TableName))
-		if b == nil {
-			return fmt.Errorf("bucket not found: %s", req.TableName)
+		conds, err := s.validateQueryRequest(keyDef, req)
+		if err != nil {
+			return err
 		}
 
-		// This is a simplified implementation of Query that only supports querying by hash key.
-		parts := strings.Split(req.KeyConditionExpression, " ")
-		if len(parts) != 3 || parts[1] != "=" {
-			return fmt.Errorf("invalid key condition expression format")
+		filter, err := parseFilterExpression(req.FilterExpression, req.ExpressionAttributeNames, req.ExpressionAttributeValues)
+		if err != nil {
+			return err
 		}
-		hashKeyName := parts[0]
-		hashKeyValuePlaceholder := parts[2]
 
-		// Look up the actual value from ExpressionAttributeValues
-		hashKeyValue, ok := req.ExpressionAttributeValues[hashKeyValuePlaceholder]
-		if !ok {
-			return fmt.Errorf("expression attribute value not found: %s", hashKeyValuePlaceholder)
+		projection, err := parseProjectionExpression(req.ProjectionExpression, req.ExpressionAttributeNames)
+		if err != nil {
+			return err
 		}
 
-		// Construct the seek key string for bbolt based on the hash key.
-		// This must match the prefix generated by generateKeyString.
-		seekKeyMap := map[string]*expression.AttributeValue{
-			hashKeyName: hashKeyValue,
+		// Get the bucket for the table or index.
+		b := tx.Bucket(bucketName)
+		if b == nil {
+			return fmt.Errorf("bucket not found: %s", req.TableName)
 		}
-		seekKeyStr, err := s.generateKeyString(tableDef, seekKeyMap)
+
+		kr, err := s.queryKeyRange(keyDef, conds)
 		if err != nil {
-			return fmt.Errorf("failed to generate seek key string: %v", err)
+			return err
+		}
+		if idx != nil {
+			kr.widen()
+		}
+
+		forward := req.ScanIndexForward == nil || *req.ScanIndexForward
+		if req.ExclusiveStartKey != nil {
+			startKey, err := s.startKey(tableDef, idx, req.ExclusiveStartKey)
+			if err != nil {
+				return storage.NewValidationError("invalid ExclusiveStartKey: %w", err)
+			}
+			if err := kr.resumeAfter(startKey, forward); err != nil {
+				return err
+			}
 		}
-		seekKey := []byte(seekKeyStr)
 
 		c := b.Cursor()
+		pageBytes := 0
+		now := time.Now()
 
-		// Seek to the first key that matches the hash key prefix.
-		for k, v := c.Seek(seekKey); k != nil && bytes.HasPrefix(k, seekKey); k, v = c.Next() {
+		// Walk the key range in the requested direction, stopping at its bounds.
+		for k, v := kr.first(c, forward); k != nil && kr.contains(k); k, v = kr.next(c, forward) {
 			var item map[string]*expression.AttributeValue
 			if err := json.Unmarshal(v, &item); err != nil {
 				return err
 			}
 
-			// Double-check the hash key match (redundant if seek/prefix logic is perfect, but safe).
-			if item[hashKeyName] != nil && s.compareAttributeValues(item[hashKeyName], hashKeyValue) {
-				items = append(items, item)
+			scannedCount++
+			pageBytes += len(v)
+
+			// Double-check the key conditions against the decoded item (redundant if the range is exact, but safe).
+			ok, err := conds.matches(item)
+			if err != nil {
+				return err
+			}
+			// Expired items are hidden before the sweeper deletes them.
+			ok = ok && !expired(tableDef, item, now)
+			// The filter only decides what is returned; the item still counts towards the page.
+			if ok {
+				ok, err = filter.Matches(item)
+				if err != nil {
+					return err
+				}
+			}
+			if ok {
+				items = append(items, projection.Apply(item))
+			}
+
+			// Stop once the page is full, either by item count or by size.
+			if (req.Limit != nil && scannedCount >= *req.Limit) || pageBytes >= maxPageBytes {
+				lastEvaluatedKey, err = s.lastEvaluatedKey(tableDef, idx, item)
+				if err != nil {
+					return err
+				}
+				break
 			}
 		}
 
@@ -381,36 +742,71 @@ func (s *BBoltStorage) Query(req *types.QueryRequest) ([]map[string]*expression.
 		return nil, err
 	}
 
-	return items, nil
+	return &types.QueryResponse{
+		Items:            items,
+		Count:            len(items),
+		ScannedCount:     scannedCount,
+		LastEvaluatedKey: lastEvaluatedKey,
+	}, nil
 }
 
 // Scan retrieves all items from a table.
 func (s *BBoltStorage) Scan(req *types.ScanRequest) (*types.ScanResponse, error) {
+	if req.Limit != nil && *req.Limit < 1 {
+		return nil, storage.NewValidationError("invalid Limit: must be at least 1, got %d", *req.Limit)
+	}
+
 	items := make([]map[string]*expression.AttributeValue, 0)
 	var lastEvaluatedKey map[string]*expression.AttributeValue
 	scannedCount := 0
 
-	err := s.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(req.TableName))
+	filter, err := parseFilterExpression(req.FilterExpression, req.ExpressionAttributeNames, req.ExpressionAttributeValues)
+	if err != nil {
+		return nil, err
+	}
+
+	projection, err := parseProjectionExpression(req.ProjectionExpression, req.ExpressionAttributeNames)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		tableDef, err := s.getTableDef(tx, req.TableName)
+		if err != nil {
+			return err
+		}
+
+		// Scanning an index walks its entries instead of the table's items.
+		bucketName := []byte(req.TableName)
+		var idx *secondaryIndex
+		if req.IndexName != "" {
+			idx, err = findIndex(tableDef, req.IndexName)
+			if err != nil {
+				return err
+			}
+			if req.ConsistentRead && idx.global {
+				return errConsistentGlobalIndex
+			}
+			bucketName = indexBucketName(req.TableName, req.IndexName)
+		}
+
+		b := tx.Bucket(bucketName)
 		if b == nil {
-			return nil // Table not found, return empty results
+			return fmt.Errorf("bucket not found: %s", req.TableName)
 		}
 
 		c := b.Cursor()
+		now := time.Now()
 
 		var k, v []byte
 		if req.ExclusiveStartKey != nil {
-			tableDef, err := s.getTableDef(tx, req.TableName)
+			startKey, err := s.startKey(tableDef, idx, req.ExclusiveStartKey)
 			if err != nil {
 				return err
 			}
-			startKeyStr, err := s.generateKeyString(tableDef, req.ExclusiveStartKey)
-			if err != nil {
-				return err
-			}
-			k, v = c.Seek([]byte(startKeyStr))
+			k, v = c.Seek(startKey)
 			// If the seeked key is the ExclusiveStartKey itself, move to the next key
-			if k != nil && bytes.Equal(k, []byte(startKeyStr)) {
+			if k != nil && bytes.Equal(k, startKey) {
 				k, v = c.Next()
 			}
 		} else {
@@ -424,20 +820,24 @@ func (s *BBoltStorage) Scan(req *types.ScanRequest) (*types.ScanResponse, error)
 			}
 
 			scannedCount++
-			items = append(items, item) // Always add the item first
-
-			// Check if limit is reached after adding the item
-			if req.Limit != nil && len(items) >= *req.Limit {
-				// Limit reached, the last item added is the LastEvaluatedKey
-				tableDef, err := s.getTableDef(tx, req.TableName)
+			ok := !expired(tableDef, item, now)
+			if ok {
+				ok, err = filter.Matches(item)
 				if err != nil {
 					return err
 				}
-				primaryKey, err := s.extractPrimaryKey(tableDef, item)
+			}
+			if ok {
+				items = append(items, projection.Apply(item))
+			}
+
+			// Limit counts scanned items, so a page may hold fewer items once filtered
+			if req.Limit != nil && scannedCount >= *req.Limit {
+				// Limit reached, the last item added is the LastEvaluatedKey
+				lastEvaluatedKey, err = s.lastEvaluatedKey(tableDef, idx, item)
 				if err != nil {
 					return err
 				}
-				lastEvaluatedKey = primaryKey
 				break // Stop scanning
 			}
 		}
@@ -448,7 +848,7 @@ func (s *BBoltStorage) Scan(req *types.ScanRequest) (*types.ScanResponse, error)
 		return nil, err
 	}
 
-	return &types.ScanResponse{Items: items, LastEvaluatedKey: lastEvaluatedKey, ScannedCount: scannedCount}, nil
+	return &types.ScanResponse{Items: items, LastEvaluatedKey: lastEvaluatedKey, Count: len(items), ScannedCount: scannedCount}, nil
 }
 
 // InternalScan retrieves all items from a table for internal node synchronization.
@@ -470,84 +870,67 @@ func (s *BBoltStorage) extractPrimaryKey(tableDef *types.CreateTableRequest, ite
 	return primaryKey, nil
 }
 
-// generateKeyString creates a deterministic string key for bbolt.
-
-// generateKeyString creates a deterministic string key for bbolt.
-// It concatenates the hash key and range key (if present) values.
-func (s *BBoltStorage) generateKeyString(tableDef *types.CreateTableRequest, item map[string]*expression.AttributeValue) (string, error) {
-	var hashKeyVal string
-	var rangeKeyVal string
-
-	for _, ks := range tableDef.KeySchema {
-		attrVal, ok := item[ks.AttributeName]
-		if !ok {
-			if ks.KeyType == "HASH" {
-				return "", fmt.Errorf("missing key attribute %s in item", ks.AttributeName)
-			}
-			// It's okay for a range key to be missing in a query
-			continue
-		}
-
-		// Convert AttributeValue to string for key concatenation.
-		var valStr string
-		switch expression.GetAttributeValueType(attrVal) {
-		case "S":
-			valStr = *attrVal.S
-		case "N":
-			valStr = *attrVal.N
-		case "BOOL":
-			valStr = strconv.FormatBool(*attrVal.BOOL)
-		case "NULL":
-			valStr = "NULL"
-		default:
-			return "", fmt.Errorf("unsupported attribute type for key: %s", expression.GetAttributeValueType(attrVal))
-		}
-
-		if ks.KeyType == "HASH" {
-			hashKeyVal = valStr
-		} else if ks.KeyType == "RANGE" {
-			rangeKeyVal = valStr
-		}
+// putTableDef stores a table definition in the metadata bucket.
+func putTableDef(tx *bolt.Tx, tableDef *types.CreateTableRequest) error {
+	val, err := json.Marshal(tableDef)
+	if err != nil {
+		return err
 	}
+	return tx.Bucket([]byte(metadataBucket)).Put([]byte(tableDef.TableName), val)
+}
 
-	if hashKeyVal == "" {
-		return "", fmt.Errorf("hash key not found in item")
+// tableDescription describes a table from its definition.
+func tableDescription(tableDef *types.CreateTableRequest) types.TableDescription {
+	desc := types.TableDescription{
+		TableName:            tableDef.TableName,
+		KeySchema:            tableDef.KeySchema,
+		AttributeDefinitions: tableDef.AttributeDefinitions,
 	}
-
-	// Construct the key string.
-	key := hashKeyVal
-	if rangeKeyVal != "" {
-		key += keyDelimiter + rangeKeyVal
+	for _, gsi := range tableDef.GlobalSecondaryIndexes {
+		desc.GlobalSecondaryIndexes = append(desc.GlobalSecondaryIndexes, &types.GlobalSecondaryIndexDescription{
+			IndexName:   gsi.IndexName,
+			KeySchema:   gsi.KeySchema,
+			Projection:  gsi.Projection,
+			IndexStatus: types.IndexStatusActive,
+		})
 	}
-
-	return key, nil
+	for _, lsi := range tableDef.LocalSecondaryIndexes {
+		desc.LocalSecondaryIndexes = append(desc.LocalSecondaryIndexes, &types.LocalSecondaryIndexDescription{
+			IndexName:  lsi.IndexName,
+			KeySchema:  lsi.KeySchema,
+			Projection: lsi.Projection,
+		})
+	}
+	if label := tableDef.LatestStreamLabel; label != "" {
+		desc.StreamSpecification = &types.StreamSpecification{StreamEnabled: false}
+		if streamEnabled(tableDef) {
+			desc.StreamSpecification = tableDef.StreamSpecification
+		}
+		desc.LatestStreamArn = storage.StreamArn(tableDef.TableName, label)
+		desc.LatestStreamLabel = label
+	}
+	return desc
 }
 
-func (s *BBoltStorage) compareAttributeValues(val1, val2 *expression.AttributeValue) bool {
-	if expression.GetAttributeValueType(val1) != expression.GetAttributeValueType(val2) {
-		return false
+func (s *BBoltStorage) getTableDef(tx *bolt.Tx, tableName string) (*types.CreateTableRequest, error) {
+	tableDef, err := s.readTableDef(tx, tableName)
+	if err != nil {
+		return nil, err
 	}
-
-	switch expression.GetAttributeValueType(val1) {
-	case "S":
-		return *val1.S == *val2.S
-	case "N":
-		return *val1.N == *val2.N
-	case "BOOL":
-		return *val1.BOOL == *val2.BOOL
-	case "NULL":
-		return true
-	// Add other types as needed
-	default:
-		return false
+	if err := checkMigrated(tx, tableName); err != nil {
+		return nil, err
 	}
+	return tableDef, nil
 }
 
-func (s *BBoltStorage) getTableDef(tx *bolt.Tx, tableName string) (*types.CreateTableRequest, error) {
+// readTableDef reads the definition of a table, even one whose items could
+// not be migrated to the current key format, which may only be described
+// and deleted.
+func (s *BBoltStorage) readTableDef(tx *bolt.Tx, tableName string) (*types.CreateTableRequest, error) {
 	mb := tx.Bucket([]byte(metadataBucket))
 	val := mb.Get([]byte(tableName))
 	if val == nil {
-		return nil, fmt.Errorf("table not found: %s", tableName)
+		return nil, storage.NewResourceNotFoundError("table not found: %s", tableName)
 	}
 
 	var tableDef types.CreateTableRequest
@@ -558,9 +941,13 @@ func (s *BBoltStorage) getTableDef(tx *bolt.Tx, tableName string) (*types.Create
 }
 
 func (s *BBoltStorage) validatePutRequest(tableDef *types.CreateTableRequest, req *types.PutRequest) error {
+	if err := storage.ValidateReturnValues(req.ReturnValues, types.ReturnValuesNone, types.ReturnValuesAllOld); err != nil {
+		return err
+	}
+
 	for _, ks := range tableDef.KeySchema {
 		if _, ok := req.Item[ks.AttributeName]; !ok {
-			return fmt.Errorf("missing key attribute: %s", ks.AttributeName)
+			return storage.NewValidationError("missing key attribute: %s", ks.AttributeName)
 		}
 	}
 
@@ -574,12 +961,12 @@ func (s *BBoltStorage) validateGetRequest(tableDef *types.CreateTableRequest, re
 	}
 
 	if len(req.Key) != len(keySchema) {
-		return fmt.Errorf("invalid number of key attributes: expected %d, got %d", len(keySchema), len(req.Key))
+		return storage.NewValidationError("invalid number of key attributes: expected %d, got %d", len(keySchema), len(req.Key))
 	}
 
 	for name := range req.Key {
 		if _, ok := keySchema[name]; !ok {
-			return fmt.Errorf("invalid key attribute: %s", name)
+			return storage.NewValidationError("invalid key attribute: %s", name)
 		}
 	}
 
@@ -587,18 +974,22 @@ func (s *BBoltStorage) validateGetRequest(tableDef *types.CreateTableRequest, re
 }
 
 func (s *BBoltStorage) validateDeleteRequest(tableDef *types.CreateTableRequest, req *types.DeleteRequest) error {
+	if err := storage.ValidateReturnValues(req.ReturnValues, types.ReturnValuesNone, types.ReturnValuesAllOld); err != nil {
+		return err
+	}
+
 	keySchema := make(map[string]string)
 	for _, ks := range tableDef.KeySchema {
 		keySchema[ks.AttributeName] = ks.KeyType
 	}
 
 	if len(req.Key) != len(keySchema) {
-		return fmt.Errorf("invalid number of key attributes: expected %d, got %d", len(keySchema), len(req.Key))
+		return storage.NewValidationError("invalid number of key attributes: expected %d, got %d", len(keySchema), len(req.Key))
 	}
 
 	for name := range req.Key {
 		if _, ok := keySchema[name]; !ok {
-			return fmt.Errorf("invalid key attribute: %s", name)
+			return storage.NewValidationError("invalid key attribute: %s", name)
 		}
 	}
 
@@ -606,68 +997,190 @@ func (s *BBoltStorage) validateDeleteRequest(tableDef *types.CreateTableRequest,
 }
 
 func (s *BBoltStorage) validateUpdateRequest(tableDef *types.CreateTableRequest, req *types.UpdateRequest) error {
+	if err := storage.ValidateReturnValues(req.ReturnValues, types.ReturnValuesNone, types.ReturnValuesAllOld, types.ReturnValuesUpdatedOld, types.ReturnValuesAllNew, types.ReturnValuesUpdatedNew); err != nil {
+		return err
+	}
+
 	keySchema := make(map[string]string)
 	for _, ks := range tableDef.KeySchema {
 		keySchema[ks.AttributeName] = ks.KeyType
 	}
 
 	if len(req.Key) != len(keySchema) {
-		return fmt.Errorf("invalid number of key attributes: expected %d, got %d", len(keySchema), len(req.Key))
+		return storage.NewValidationError("invalid number of key attributes: expected %d, got %d", len(keySchema), len(req.Key))
 	}
 
 	for name := range req.Key {
 		if _, ok := keySchema[name]; !ok {
-			return fmt.Errorf("invalid key attribute: %s", name)
+			return storage.NewValidationError("invalid key attribute: %s", name)
 		}
 	}
 
 	return nil
 }
 
-func (s *BBoltStorage) validateQueryRequest(tableDef *types.CreateTableRequest, req *types.QueryRequest) error {
-	parts := strings.Split(req.KeyConditionExpression, " ")
-	if len(parts) != 3 || parts[1] != "=" {
-		return fmt.Errorf("invalid KeyConditionExpression format: expected 'attributeName = value'")
+func (s *BBoltStorage) validateQueryRequest(tableDef *types.CreateTableRequest, req *types.QueryRequest) (*keyConditions, error) {
+	if req.Limit != nil && *req.Limit < 1 {
+		return nil, storage.NewValidationError("invalid Limit: must be at least 1, got %d", *req.Limit)
 	}
 
-	attrName := parts[0]
-	hashKeyValuePlaceholder := parts[2]
+	parsed, err := expression.ParseKeyConditionExpression(req.KeyConditionExpression, req.ExpressionAttributeNames, req.ExpressionAttributeValues)
+	if err != nil {
+		var syntaxErr *expression.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return nil, storage.NewValidationError("invalid KeyConditionExpression format: expected 'attributeName = value' optionally followed by AND and a range key condition: %v", err)
+		}
+		return nil, err
+	}
 
-	// Find the hash key from the table definition
-	hashKeyDef := types.AttributeDefinition{}
-	hashKeyFound := false
+	// Find the hash and range keys from the table definition
+	var hashKeyName, rangeKeyName string
 	for _, ks := range tableDef.KeySchema {
-		if ks.KeyType == "HASH" {
-			for _, ad := range tableDef.AttributeDefinitions {
-				if ad.AttributeName == ks.AttributeName {
-					hashKeyDef = *ad
-					hashKeyFound = true
-					break
-				}
+		switch ks.KeyType {
+		case "HASH":
+			hashKeyName = ks.AttributeName
+		case "RANGE":
+			rangeKeyName = ks.AttributeName
+		}
+	}
+
+	hashKeyType, hashKeyFound := attributeType(tableDef, hashKeyName)
+	if hashKeyName == "" || !hashKeyFound {
+		return nil, fmt.Errorf("hash key not found in table definition")
+	}
+
+	conds := &keyConditions{hashKeyName: hashKeyName}
+	for _, cond := range parsed {
+		if cond.AttributeName == hashKeyName && conds.hashValue == nil {
+			if cond.Operator != expression.KeyConditionEqual {
+				return nil, storage.NewValidationError("KeyConditionExpression must use '=' on the hash key '%s', but got '%s'", hashKeyName, cond.Operator)
 			}
+			conds.hashValue = cond.Values[0]
+			continue
+		}
+		if len(parsed) == 1 {
 			break
 		}
+		if rangeKeyName == "" {
+			return nil, storage.NewValidationError("KeyConditionExpression has a range key condition on '%s', but the table has no range key", cond.AttributeName)
+		}
+		if cond.AttributeName != rangeKeyName {
+			return nil, storage.NewValidationError("KeyConditionExpression must use the range key '%s', but got '%s'", rangeKeyName, cond.AttributeName)
+		}
+		conds.rangeKey = cond
 	}
 
-	if !hashKeyFound {
-		return fmt.Errorf("hash key not found in table definition")
+	// Validate that the expression addresses the hash key
+	if conds.hashValue == nil {
+		return nil, storage.NewValidationError("KeyConditionExpression must use the hash key '%s', but got '%s'", hashKeyName, parsed[0].AttributeName)
 	}
 
-	// Validate that the attribute name in the expression matches the hash key name
-	if attrName != hashKeyDef.AttributeName {
-		return fmt.Errorf("KeyConditionExpression must use the hash key '%s', but got '%s'", hashKeyDef.AttributeName, attrName)
+	// Validate the type of the values in the expression
+	if expression.GetAttributeValueType(conds.hashValue) != hashKeyType {
+		return nil, storage.NewValidationError("invalid type for hash key '%s': expected %s, got %s", hashKeyName, hashKeyType, expression.GetAttributeValueType(conds.hashValue))
 	}
 
-	// Validate the type of the value in the expression
-	attrVal, ok := req.ExpressionAttributeValues[hashKeyValuePlaceholder]
-	if !ok {
-		return fmt.Errorf("expression attribute value not found: %s", hashKeyValuePlaceholder)
+	if conds.rangeKey != nil {
+		rangeKeyType, ok := attributeType(tableDef, rangeKeyName)
+		if !ok {
+			return nil, fmt.Errorf("range key not found in table definition")
+		}
+		for _, val := range conds.rangeKey.Values {
+			if expression.GetAttributeValueType(val) != rangeKeyType {
+				return nil, storage.NewValidationError("invalid type for range key '%s': expected %s, got %s", rangeKeyName, rangeKeyType, expression.GetAttributeValueType(val))
+			}
+		}
+		if conds.rangeKey.Operator == expression.KeyConditionBeginsWith && rangeKeyType == "N" {
+			return nil, storage.NewValidationError("begins_with is not supported for number range key '%s'", rangeKeyName)
+		}
+		if conds.rangeKey.Operator == expression.KeyConditionBetween {
+			cmp, err := expression.CompareAttributeValues(conds.rangeKey.Values[0], conds.rangeKey.Values[1])
+			if err != nil {
+				return nil, err
+			}
+			if cmp > 0 {
+				return nil, storage.NewValidationError("invalid BETWEEN condition on range key '%s': lower bound is greater than upper bound", rangeKeyName)
+			}
+		}
 	}
 
-	if expression.GetAttributeValueType(attrVal) != hashKeyDef.AttributeType {
-		return fmt.Errorf("invalid type for hash key '%s': expected %s, got %s", hashKeyDef.AttributeName, hashKeyDef.AttributeType, expression.GetAttributeValueType(attrVal))
+	return conds, nil
+}
+
+// checkCondition evaluates an optional ConditionExpression against the item
+// currently stored under key, treating a missing item as one with no
+// attributes. It must run in the same transaction as the write it guards.
+func checkCondition(b *bolt.Bucket, key []byte, expr string, names map[string]string, values map[string]*expression.AttributeValue) error {
+	if expr == "" {
+		return nil
+	}
+	cond, err := expression.ParseConditionExpression(expr, names, values)
+	if err != nil {
+		return storage.NewValidationError("invalid ConditionExpression: %w", err)
 	}
 
+	current := map[string]*expression.AttributeValue{}
+	if val := b.Get(key); val != nil {
+		if err := json.Unmarshal(val, &current); err != nil {
+			return err
+		}
+	}
+
+	ok, err := cond.Matches(current)
+	if err != nil {
+		return storage.NewValidationError("invalid ConditionExpression: %w", err)
+	}
+	if !ok {
+		return storage.ErrConditionalCheckFailed
+	}
 	return nil
 }
 
+// parseFilterExpression parses an optional FilterExpression. An empty
+// expression yields a nil condition, which matches every item.
+func parseFilterExpression(expr string, names map[string]string, values map[string]*expression.AttributeValue) (*expression.Condition, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	filter, err := expression.ParseConditionExpression(expr, names, values)
+	if err != nil {
+		return nil, storage.NewValidationError("invalid FilterExpression: %w", err)
+	}
+	return filter, nil
+}
+
+// parseProjectionExpression parses an optional ProjectionExpression. An empty
+// expression yields a nil projection, which keeps whole items.
+func parseProjectionExpression(expr string, names map[string]string) (*expression.Projection, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	projection, err := expression.ParseProjectionExpression(expr, names)
+	if err != nil {
+		return nil, storage.NewValidationError("invalid ProjectionExpression: %w", err)
+	}
+	return projection, nil
+}
+
+// attributeType returns the declared type of an attribute in the table definition.
+func attributeType(tableDef *types.CreateTableRequest, name string) (string, bool) {
+	for _, ad := range tableDef.AttributeDefinitions {
+		if ad.AttributeName == name {
+			return ad.AttributeType, true
+		}
+	}
+	return "", false
+}
+
+// loadItem decodes the item stored under key, or returns nil if there is none.
+func loadItem(b *bolt.Bucket, key []byte) (map[string]*expression.AttributeValue, error) {
+	val := b.Get(key)
+	if val == nil {
+		return nil, nil
+	}
+	var item map[string]*expression.AttributeValue
+	if err := json.Unmarshal(val, &item); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
@@ -1,15 +1,20 @@
 package bbolt_test
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
 
 	"zagreb/pkg/expression"
+	"zagreb/pkg/storage"
 	"zagreb/pkg/storage/bbolt"
 	"zagreb/pkg/types"
 )
@@ -77,7 +82,7 @@ func TestBBoltStorage_PutGet(t *testing.T) {
 		},
 	}
 
-	if err := s.Put(putReq); err != nil {
+	if _, err := s.Put(putReq); err != nil {
 		t.Fatal(err)
 	}
 
@@ -145,7 +150,7 @@ func TestBBoltStorage_PutGet_CompositeKey(t *testing.T) {
 		},
 	}
 
-	if err := s.Put(putReq); err != nil {
+	if _, err := s.Put(putReq); err != nil {
 		t.Fatal(err)
 	}
 
@@ -215,7 +220,7 @@ func TestBBoltStorage_Delete(t *testing.T) {
 		},
 	}
 
-	if err := s.Put(putReq); err != nil {
+	if _, err := s.Put(putReq); err != nil {
 		t.Fatal(err)
 	}
 
@@ -226,7 +231,7 @@ func TestBBoltStorage_Delete(t *testing.T) {
 		},
 	}
 
-	if err := s.Delete(deleteReq); err != nil {
+	if _, err := s.Delete(deleteReq); err != nil {
 		t.Fatal(err)
 	}
 
@@ -283,7 +288,7 @@ func TestBBoltStorage_Update(t *testing.T) {
 		},
 	}
 
-	if err := s.Put(putReq); err != nil {
+	if _, err := s.Put(putReq); err != nil {
 		t.Fatal(err)
 	}
 
@@ -296,163 +301,2380 @@ func TestBBoltStorage_Update(t *testing.T) {
 		ExpressionAttributeValues: map[string]*expression.AttributeValue{
 			":newName": {S: stringPtr("new-name")},
 		},
+		ReturnValues: types.ReturnValuesAllNew,
 	}
 
-	updatedItem, err := s.Update(updateReq)
+	resp, err := s.Update(updateReq)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	updatedItem := resp.Attributes
 	if *updatedItem["name"].S != "new-name" {
 		t.Errorf("expected name to be 'new-name', got '%s'", *updatedItem["name"].S)
 	}
 }
 
+func TestBBoltStorage_Update_Upsert(t *testing.T) {
+	f, err := ioutil.TempFile("", "bbolt.db")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := bbolt.NewBBoltStorage(f.Name())
+	require.NoError(t, err)
+
+	_, err = s.CreateTable(&types.CreateTableRequest{
+		TableName: "counters",
+		AttributeDefinitions: []*types.AttributeDefinition{
+			{AttributeName: "page", AttributeType: "S"},
+			{AttributeName: "day", AttributeType: "N"},
+		},
+		KeySchema: []*types.KeySchemaElement{
+			{AttributeName: "page", KeyType: "HASH"},
+			{AttributeName: "day", KeyType: "RANGE"},
+		},
+	})
+	require.NoError(t, err)
+
+	key := map[string]*expression.AttributeValue{
+		"page": {S: stringPtr("home")},
+		"day":  {N: stringPtr("1")},
+	}
+	increment := &types.UpdateRequest{
+		TableName:                 "counters",
+		Key:                       key,
+		UpdateExpression:          "ADD hits :one",
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{":one": {N: stringPtr("1")}},
+		ReturnValues:              types.ReturnValuesAllNew,
+	}
+
+	// The first update creates the item from its key.
+	updated, err := s.Update(increment)
+	require.NoError(t, err)
+	assert.Equal(t, "home", *updated.Attributes["page"].S)
+	assert.Equal(t, "1", *updated.Attributes["day"].N)
+	assert.Equal(t, "1", *updated.Attributes["hits"].N)
+
+	_, err = s.Update(increment)
+	require.NoError(t, err)
+
+	item, err := s.Get(&types.GetRequest{TableName: "counters", Key: key})
+	require.NoError(t, err)
+	assert.Equal(t, "2", *item["hits"].N)
+	assert.Equal(t, "home", *item["page"].S)
+
+	// A failed condition does not create the item.
+	missingKey := map[string]*expression.AttributeValue{
+		"page": {S: stringPtr("about")},
+		"day":  {N: stringPtr("1")},
+	}
+	_, err = s.Update(&types.UpdateRequest{
+		TableName:                 "counters",
+		Key:                       missingKey,
+		UpdateExpression:          "ADD hits :one",
+		ConditionExpression:       "attribute_exists(page)",
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{":one": {N: stringPtr("1")}},
+	})
+	assert.ErrorIs(t, err, storage.ErrConditionalCheckFailed)
+
+	item, err = s.Get(&types.GetRequest{TableName: "counters", Key: missingKey})
+	require.NoError(t, err)
+	assert.Nil(t, item)
+
+	// Key attributes cannot be modified.
+	for _, expr := range []string{"SET page = :v", "REMOVE #d", "SET hits = :one, day = :one"} {
+		_, err = s.Update(&types.UpdateRequest{
+			TableName:                "counters",
+			Key:                      key,
+			UpdateExpression:         expr,
+			ExpressionAttributeNames: map[string]string{"#d": "day"},
+			ExpressionAttributeValues: map[string]*expression.AttributeValue{
+				":v":   {S: stringPtr("other")},
+				":one": {N: stringPtr("1")},
+			},
+		})
+		assert.Error(t, err, expr)
+	}
+
+	item, err = s.Get(&types.GetRequest{TableName: "counters", Key: key})
+	require.NoError(t, err)
+	assert.Equal(t, "2", *item["hits"].N)
+}
+
+func TestBBoltStorage_ReturnValues(t *testing.T) {
+	f, err := ioutil.TempFile("", "bbolt.db")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := bbolt.NewBBoltStorage(f.Name())
+	require.NoError(t, err)
+
+	_, err = s.CreateTable(&types.CreateTableRequest{
+		TableName:            "profiles",
+		AttributeDefinitions: []*types.AttributeDefinition{{AttributeName: "id", AttributeType: "S"}},
+		KeySchema:            []*types.KeySchemaElement{{AttributeName: "id", KeyType: "HASH"}},
+	})
+	require.NoError(t, err)
+
+	key := map[string]*expression.AttributeValue{"id": {S: stringPtr("p1")}}
+	_, err = s.Put(&types.PutRequest{
+		TableName: "profiles",
+		Item: map[string]*expression.AttributeValue{
+			"id": {S: stringPtr("p1")},
+			"address": {M: map[string]*expression.AttributeValue{
+				"city": {S: stringPtr("Zagreb")},
+				"zip":  {S: stringPtr("10000")},
+			}},
+			"nickname": {S: stringPtr("pp")},
+		},
+	})
+	require.NoError(t, err)
+
+	// The before-image is not affected by a nested update.
+	resp, err := s.Update(&types.UpdateRequest{
+		TableName:                 "profiles",
+		Key:                       key,
+		UpdateExpression:          "SET address.city = :city",
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{":city": {S: stringPtr("Split")}},
+		ReturnValues:              types.ReturnValuesAllOld,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Zagreb", *resp.Attributes["address"].M["city"].S)
+
+	// Removed attributes are left out of UPDATED_NEW.
+	resp, err = s.Update(&types.UpdateRequest{
+		TableName:                 "profiles",
+		Key:                       key,
+		UpdateExpression:          "SET address.zip = :zip REMOVE nickname",
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{":zip": {S: stringPtr("21000")}},
+		ReturnValues:              types.ReturnValuesUpdatedNew,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]*expression.AttributeValue{
+		"address": {M: map[string]*expression.AttributeValue{"zip": {S: stringPtr("21000")}}},
+	}, resp.Attributes)
+
+	deleted, err := s.Delete(&types.DeleteRequest{TableName: "profiles", Key: key, ReturnValues: types.ReturnValuesAllOld})
+	require.NoError(t, err)
+	assert.Equal(t, "Split", *deleted.Attributes["address"].M["city"].S)
+
+	deleted, err = s.Delete(&types.DeleteRequest{TableName: "profiles", Key: key, ReturnValues: types.ReturnValuesAllOld})
+	require.NoError(t, err)
+	assert.Nil(t, deleted.Attributes)
+
+	_, err = s.Delete(&types.DeleteRequest{TableName: "profiles", Key: key, ReturnValues: types.ReturnValuesAllNew})
+	assert.Error(t, err)
+}
+
+func TestBBoltStorage_ConditionExpression(t *testing.T) {
+	f, err := ioutil.TempFile("", "bbolt.db")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := bbolt.NewBBoltStorage(f.Name())
+	require.NoError(t, err)
+
+	_, err = s.CreateTable(&types.CreateTableRequest{
+		TableName: "accounts",
+		AttributeDefinitions: []*types.AttributeDefinition{
+			{AttributeName: "id", AttributeType: "S"},
+		},
+		KeySchema: []*types.KeySchemaElement{
+			{AttributeName: "id", KeyType: "HASH"},
+		},
+	})
+	require.NoError(t, err)
+
+	key := map[string]*expression.AttributeValue{"id": {S: stringPtr("a1")}}
+	item := map[string]*expression.AttributeValue{
+		"id":      {S: stringPtr("a1")},
+		"version": {N: stringPtr("1")},
+	}
+
+	// Create-if-absent succeeds once and then fails.
+	putIfAbsent := &types.PutRequest{TableName: "accounts", Item: item, ConditionExpression: "attribute_not_exists(id)"}
+	_, err = s.Put(putIfAbsent)
+	require.NoError(t, err)
+	_, err = s.Put(putIfAbsent)
+	assert.ErrorIs(t, err, storage.ErrConditionalCheckFailed)
+
+	// Optimistic locking on the version attribute.
+	_, err = s.Update(&types.UpdateRequest{
+		TableName:           "accounts",
+		Key:                 key,
+		UpdateExpression:    "SET version = :next",
+		ConditionExpression: "version = :expected",
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{
+			":expected": {N: stringPtr("2")},
+			":next":     {N: stringPtr("3")},
+		},
+	})
+	assert.ErrorIs(t, err, storage.ErrConditionalCheckFailed)
+
+	updated, err := s.Update(&types.UpdateRequest{
+		TableName:           "accounts",
+		Key:                 key,
+		UpdateExpression:    "SET version = :next",
+		ConditionExpression: "version = :expected",
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{
+			":expected": {N: stringPtr("1")},
+			":next":     {N: stringPtr("2")},
+		},
+		ReturnValues: types.ReturnValuesUpdatedNew,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "2", *updated.Attributes["version"].N)
+
+	// A failed delete leaves the item in place.
+	_, err = s.Delete(&types.DeleteRequest{
+		TableName:                 "accounts",
+		Key:                       key,
+		ConditionExpression:       "version > :v",
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{":v": {N: stringPtr("5")}},
+	})
+	assert.ErrorIs(t, err, storage.ErrConditionalCheckFailed)
+
+	got, err := s.Get(&types.GetRequest{TableName: "accounts", Key: key})
+	require.NoError(t, err)
+	require.NotNil(t, got)
+
+	_, err = s.Delete(&types.DeleteRequest{
+		TableName:           "accounts",
+		Key:                 key,
+		ConditionExpression: "attribute_exists(version)",
+	})
+	require.NoError(t, err)
+
+	got, err = s.Get(&types.GetRequest{TableName: "accounts", Key: key})
+	require.NoError(t, err)
+	assert.Nil(t, got)
+
+	// Malformed conditions are rejected rather than treated as failed checks.
+	_, err = s.Put(&types.PutRequest{TableName: "accounts", Item: item, ConditionExpression: "version ="})
+	assert.ErrorIs(t, err, storage.ErrValidation)
+
+	// So are conditions that fail to evaluate.
+	_, err = s.Put(&types.PutRequest{
+		TableName:                 "accounts",
+		Item:                      item,
+		ConditionExpression:       "attribute_type(version, :t)",
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{":t": {S: stringPtr("X")}},
+	})
+	assert.ErrorIs(t, err, storage.ErrValidation)
+}
+
+func TestBBoltStorage_BatchWriteGetItem(t *testing.T) {
+	f, err := ioutil.TempFile("", "bbolt.db")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := bbolt.NewBBoltStorage(f.Name())
+	require.NoError(t, err)
+
+	for _, table := range []string{"users", "groups"} {
+		_, err = s.CreateTable(&types.CreateTableRequest{
+			TableName:            table,
+			AttributeDefinitions: []*types.AttributeDefinition{{AttributeName: "id", AttributeType: "S"}},
+			KeySchema:            []*types.KeySchemaElement{{AttributeName: "id", KeyType: "HASH"}},
+		})
+		require.NoError(t, err)
+	}
+
+	key := func(id string) map[string]*expression.AttributeValue {
+		return map[string]*expression.AttributeValue{"id": {S: stringPtr(id)}}
+	}
+	put := func(id, name string) *types.WriteRequest {
+		return &types.WriteRequest{PutRequest: &types.BatchPutRequest{Item: map[string]*expression.AttributeValue{
+			"id":   {S: stringPtr(id)},
+			"name": {S: stringPtr(name)},
+		}}}
+	}
+
+	_, err = s.Put(&types.PutRequest{TableName: "users", Item: key("u0")})
+	require.NoError(t, err)
+
+	resp, err := s.BatchWriteItem(&types.BatchWriteItemRequest{RequestItems: map[string][]*types.WriteRequest{
+		"users":  {put("u1", "ana"), put("u2", "ivan"), {DeleteRequest: &types.BatchDeleteRequest{Key: key("u0")}}},
+		"groups": {put("g1", "admins")},
+	}})
+	require.NoError(t, err)
+	assert.Empty(t, resp.UnprocessedItems)
+
+	got, err := s.BatchGetItem(&types.BatchGetItemRequest{RequestItems: map[string]*types.KeysAndAttributes{
+		"users":  {Keys: []map[string]*expression.AttributeValue{key("u0"), key("u1"), key("u2")}, ProjectionExpression: "#n", ExpressionAttributeNames: map[string]string{"#n": "name"}},
+		"groups": {Keys: []map[string]*expression.AttributeValue{key("g1")}},
+	}})
+	require.NoError(t, err)
+	assert.Empty(t, got.UnprocessedKeys)
+	assert.ElementsMatch(t, []map[string]*expression.AttributeValue{
+		{"name": {S: stringPtr("ana")}},
+		{"name": {S: stringPtr("ivan")}},
+	}, got.Responses["users"])
+	require.Len(t, got.Responses["groups"], 1)
+	assert.Equal(t, "admins", *got.Responses["groups"][0]["name"].S)
+
+	t.Run("a failing write rolls back the batch", func(t *testing.T) {
+		_, err := s.BatchWriteItem(&types.BatchWriteItemRequest{RequestItems: map[string][]*types.WriteRequest{
+			"users":   {put("u3", "marko")},
+			"missing": {put("m1", "nobody")},
+		}})
+		assert.Error(t, err)
+
+		item, err := s.Get(&types.GetRequest{TableName: "users", Key: key("u3")})
+		require.NoError(t, err)
+		assert.Nil(t, item)
+	})
+
+	t.Run("invalid batches", func(t *testing.T) {
+		tooMany := make([]*types.WriteRequest, types.MaxBatchWriteItems+1)
+		for i := range tooMany {
+			tooMany[i] = put(fmt.Sprintf("x%d", i), "x")
+		}
+		invalid := []*types.BatchWriteItemRequest{
+			{RequestItems: map[string][]*types.WriteRequest{}},
+			{RequestItems: map[string][]*types.WriteRequest{"users": tooMany}},
+			{RequestItems: map[string][]*types.WriteRequest{"users": {put("u4", "a"), put("u4", "b")}}},
+			{RequestItems: map[string][]*types.WriteRequest{"users": {{}}}},
+		}
+		for _, req := range invalid {
+			_, err := s.BatchWriteItem(req)
+			assert.Error(t, err)
+		}
+
+		_, err := s.BatchGetItem(&types.BatchGetItemRequest{RequestItems: map[string]*types.KeysAndAttributes{
+			"users": {Keys: []map[string]*expression.AttributeValue{key("u1"), key("u1")}},
+		}})
+		assert.Error(t, err)
+	})
+}
+
+func TestBBoltStorage_TransactWriteItems(t *testing.T) {
+	f, err := ioutil.TempFile("", "bbolt.db")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := bbolt.NewBBoltStorage(f.Name())
+	require.NoError(t, err)
+
+	_, err = s.CreateTable(&types.CreateTableRequest{
+		TableName:            "accounts",
+		AttributeDefinitions: []*types.AttributeDefinition{{AttributeName: "id", AttributeType: "S"}},
+		KeySchema:            []*types.KeySchemaElement{{AttributeName: "id", KeyType: "HASH"}},
+	})
+	require.NoError(t, err)
+
+	key := func(id string) map[string]*expression.AttributeValue {
+		return map[string]*expression.AttributeValue{"id": {S: stringPtr(id)}}
+	}
+	balance := func(id string) string {
+		item, err := s.Get(&types.GetRequest{TableName: "accounts", Key: key(id)})
+		require.NoError(t, err)
+		require.NotNil(t, item)
+		return *item["balance"].N
+	}
+	for _, id := range []string{"a", "b"} {
+		_, err = s.Put(&types.PutRequest{TableName: "accounts", Item: map[string]*expression.AttributeValue{
+			"id":      {S: stringPtr(id)},
+			"balance": {N: stringPtr("100")},
+		}})
+		require.NoError(t, err)
+	}
+
+	transfer := func(amount string) *types.TransactWriteItemsRequest {
+		values := map[string]*expression.AttributeValue{":amount": {N: stringPtr(amount)}}
+		return &types.TransactWriteItemsRequest{TransactItems: []*types.TransactWriteItem{
+			{Update: &types.UpdateRequest{
+				TableName:                 "accounts",
+				Key:                       key("a"),
+				UpdateExpression:          "SET balance = balance - :amount",
+				ConditionExpression:       "balance >= :amount",
+				ExpressionAttributeValues: values,
+			}},
+			{Update: &types.UpdateRequest{
+				TableName:                 "accounts",
+				Key:                       key("b"),
+				UpdateExpression:          "SET balance = balance + :amount",
+				ExpressionAttributeValues: values,
+			}},
+			{ConditionCheck: &types.ConditionCheck{
+				TableName:           "accounts",
+				Key:                 key("b"),
+				ConditionExpression: "attribute_exists(id)",
+			}},
+		}}
+	}
+
+	t.Run("multiple operations on one item are rejected", func(t *testing.T) {
+		_, err := s.TransactWriteItems(transfer("10"))
+		assert.Error(t, err)
+		assert.Equal(t, "100", balance("a"))
+	})
+
+	t.Run("commit", func(t *testing.T) {
+		req := transfer("30")
+		req.TransactItems[2] = &types.TransactWriteItem{Put: &types.PutRequest{
+			TableName:           "accounts",
+			Item:                map[string]*expression.AttributeValue{"id": {S: stringPtr("log")}, "balance": {N: stringPtr("0")}},
+			ConditionExpression: "attribute_not_exists(id)",
+		}}
+		_, err := s.TransactWriteItems(req)
+		require.NoError(t, err)
+		assert.Equal(t, "70", balance("a"))
+		assert.Equal(t, "130", balance("b"))
+	})
+
+	t.Run("cancel", func(t *testing.T) {
+		req := transfer("500")
+		req.TransactItems[2] = &types.TransactWriteItem{Delete: &types.DeleteRequest{TableName: "accounts", Key: key("log")}}
+		_, err := s.TransactWriteItems(req)
+		var cancelled *storage.TransactionCanceledError
+		require.ErrorAs(t, err, &cancelled)
+		require.Len(t, cancelled.Reasons, 3)
+		assert.Equal(t, types.CancellationReasonConditionalCheckFailed, cancelled.Reasons[0].Code)
+		assert.Equal(t, types.CancellationReasonNone, cancelled.Reasons[1].Code)
+		assert.Equal(t, types.CancellationReasonNone, cancelled.Reasons[2].Code)
+
+		// Nothing was written.
+		assert.Equal(t, "70", balance("a"))
+		assert.Equal(t, "130", balance("b"))
+		item, err := s.Get(&types.GetRequest{TableName: "accounts", Key: key("log")})
+		require.NoError(t, err)
+		assert.NotNil(t, item)
+	})
+
+	t.Run("two-phase commit", func(t *testing.T) {
+		req := transfer("20")
+		req.TransactItems = req.TransactItems[:2]
+		prepared, err := s.PrepareTransaction(&types.PrepareTransactionRequest{TransactionID: "tx1", TransactItems: req.TransactItems})
+		require.NoError(t, err)
+		assert.Empty(t, prepared.CancellationReasons)
+
+		// Prepared items are locked, but not yet written.
+		assert.Equal(t, "70", balance("a"))
+		_, err = s.Put(&types.PutRequest{TableName: "accounts", Item: key("a")})
+		assert.ErrorIs(t, err, storage.ErrTransactionConflict)
+		_, err = s.TransactGetItems(&types.TransactGetItemsRequest{TransactItems: []*types.TransactGetItem{
+			{Get: &types.GetRequest{TableName: "accounts", Key: key("b")}},
+		}})
+		var cancelled *storage.TransactionCanceledError
+		require.ErrorAs(t, err, &cancelled)
+		assert.Equal(t, types.CancellationReasonTransactionConflict, cancelled.Reasons[0].Code)
+
+		require.NoError(t, s.CommitTransaction(&types.CommitTransactionRequest{TransactionID: "tx1"}))
+		assert.Equal(t, "50", balance("a"))
+		assert.Equal(t, "150", balance("b"))
+		assert.ErrorIs(t, s.CommitTransaction(&types.CommitTransactionRequest{TransactionID: "tx1"}), storage.ErrResourceNotFound)
+
+		// An aborted transaction writes nothing and releases its locks.
+		_, err = s.PrepareTransaction(&types.PrepareTransactionRequest{TransactionID: "tx2", TransactItems: req.TransactItems})
+		require.NoError(t, err)
+		require.NoError(t, s.AbortTransaction(&types.AbortTransactionRequest{TransactionID: "tx2"}))
+		assert.Equal(t, "50", balance("a"))
+
+		got, err := s.TransactGetItems(&types.TransactGetItemsRequest{TransactItems: []*types.TransactGetItem{
+			{Get: &types.GetRequest{TableName: "accounts", Key: key("a")}},
+			{Get: &types.GetRequest{TableName: "accounts", Key: key("missing")}},
+		}})
+		require.NoError(t, err)
+		require.Len(t, got.Responses, 2)
+		assert.Equal(t, "50", *got.Responses[0].Item["balance"].N)
+		assert.Nil(t, got.Responses[1].Item)
+
+		// A part that cannot be applied is not prepared.
+		prepared, err = s.PrepareTransaction(&types.PrepareTransactionRequest{TransactionID: "tx3", TransactItems: transfer("1000").TransactItems[:2]})
+		require.NoError(t, err)
+		require.Len(t, prepared.CancellationReasons, 2)
+		assert.Equal(t, types.CancellationReasonConditionalCheckFailed, prepared.CancellationReasons[0].Code)
+		_, err = s.Put(&types.PutRequest{TableName: "accounts", Item: map[string]*expression.AttributeValue{
+			"id":      {S: stringPtr("a")},
+			"balance": {N: stringPtr("50")},
+		}})
+		assert.NoError(t, err)
+	})
+
+	t.Run("prepared transactions survive a restart", func(t *testing.T) {
+		req := transfer("20")
+		req.TransactItems = req.TransactItems[:2]
+		_, err := s.PrepareTransaction(&types.PrepareTransactionRequest{TransactionID: "tx4", TransactItems: req.TransactItems})
+		require.NoError(t, err)
+
+		require.NoError(t, s.Close())
+		s, err = bbolt.NewBBoltStorage(f.Name())
+		require.NoError(t, err)
+
+		_, err = s.Put(&types.PutRequest{TableName: "accounts", Item: key("b")})
+		assert.ErrorIs(t, err, storage.ErrTransactionConflict)
+		require.NoError(t, s.CommitTransaction(&types.CommitTransactionRequest{TransactionID: "tx4"}))
+		assert.Equal(t, "30", balance("a"))
+		assert.Equal(t, "170", balance("b"))
+
+		// Once committed, the transaction is gone from the database too.
+		require.NoError(t, s.Close())
+		s, err = bbolt.NewBBoltStorage(f.Name())
+		require.NoError(t, err)
+		assert.ErrorIs(t, s.CommitTransaction(&types.CommitTransactionRequest{TransactionID: "tx4"}), storage.ErrResourceNotFound)
+		_, err = s.Put(&types.PutRequest{TableName: "accounts", Item: map[string]*expression.AttributeValue{
+			"id":      {S: stringPtr("b")},
+			"balance": {N: stringPtr("170")},
+		}})
+		assert.NoError(t, err)
+	})
+}
+
+func TestBBoltStorage_GlobalSecondaryIndex(t *testing.T) {
+	f, err := ioutil.TempFile("", "bbolt.db")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := bbolt.NewBBoltStorage(f.Name())
+	require.NoError(t, err)
+
+	_, err = s.CreateTable(&types.CreateTableRequest{
+		TableName: "orders",
+		AttributeDefinitions: []*types.AttributeDefinition{
+			{AttributeName: "id", AttributeType: "S"},
+			{AttributeName: "customer", AttributeType: "S"},
+			{AttributeName: "total", AttributeType: "N"},
+		},
+		KeySchema: []*types.KeySchemaElement{{AttributeName: "id", KeyType: "HASH"}},
+		GlobalSecondaryIndexes: []*types.GlobalSecondaryIndex{{
+			IndexName: "byCustomer",
+			KeySchema: []*types.KeySchemaElement{
+				{AttributeName: "customer", KeyType: "HASH"},
+				{AttributeName: "total", KeyType: "RANGE"},
+			},
+			Projection: &types.Projection{ProjectionType: types.ProjectionTypeInclude, NonKeyAttributes: []string{"status"}},
+		}},
+	})
+	require.NoError(t, err)
+
+	put := func(id, customer, total string) {
+		item := map[string]*expression.AttributeValue{
+			"id":     {S: stringPtr(id)},
+			"status": {S: stringPtr("open")},
+			"note":   {S: stringPtr("not projected")},
+		}
+		if customer != "" {
+			item["customer"] = &expression.AttributeValue{S: stringPtr(customer)}
+		}
+		if total != "" {
+			item["total"] = &expression.AttributeValue{N: stringPtr(total)}
+		}
+		_, err := s.Put(&types.PutRequest{TableName: "orders", Item: item})
+		require.NoError(t, err)
+	}
+	ids := func(items []map[string]*expression.AttributeValue) []string {
+		var ids []string
+		for _, item := range items {
+			ids = append(ids, *item["id"].S)
+		}
+		return ids
+	}
+	query := func(cond string, values map[string]*expression.AttributeValue) *types.QueryResponse {
+		resp, err := s.Query(&types.QueryRequest{
+			TableName:                 "orders",
+			IndexName:                 "byCustomer",
+			KeyConditionExpression:    cond,
+			ExpressionAttributeValues: values,
+		})
+		require.NoError(t, err)
+		return resp
+	}
+	alice := map[string]*expression.AttributeValue{":c": {S: stringPtr("alice")}, ":t": {N: stringPtr("20")}}
+
+	put("o1", "alice", "30")
+	put("o2", "alice", "20")
+	put("o3", "bob", "10")
+	put("o4", "alice", "20")
+	put("o5", "alice", "") // not indexed without the range key
+	put("o6", "", "")
+
+	t.Run("query", func(t *testing.T) {
+		resp := query("customer = :c", alice)
+		assert.Equal(t, []string{"o2", "o4", "o1"}, ids(resp.Items))
+
+		// Only the keys and the included attribute are projected.
+		assert.Len(t, resp.Items[0], 4)
+		assert.Equal(t, "open", *resp.Items[0]["status"].S)
+		assert.Nil(t, resp.Items[0]["note"])
+
+		// Bounds on the index key take in every item sharing it.
+		assert.Equal(t, []string{"o2", "o4"}, ids(query("customer = :c AND total = :t", alice).Items))
+		assert.Equal(t, []string{"o2", "o4"}, ids(query("customer = :c AND total <= :t", alice).Items))
+		assert.Equal(t, []string{"o1"}, ids(query("customer = :c AND total > :t", alice).Items))
+		assert.Empty(t, query("customer = :c AND total < :t", alice).Items)
+	})
+
+	t.Run("pagination", func(t *testing.T) {
+		limit := 1
+		var got []string
+		var startKey map[string]*expression.AttributeValue
+		for {
+			resp, err := s.Query(&types.QueryRequest{
+				TableName:                 "orders",
+				IndexName:                 "byCustomer",
+				KeyConditionExpression:    "customer = :c",
+				ExpressionAttributeValues: alice,
+				Limit:                     &limit,
+				ExclusiveStartKey:         startKey,
+			})
+			require.NoError(t, err)
+			got = append(got, ids(resp.Items)...)
+			if resp.LastEvaluatedKey == nil {
+				break
+			}
+			assert.Len(t, resp.LastEvaluatedKey, 3)
+			startKey = resp.LastEvaluatedKey
+		}
+		assert.Equal(t, []string{"o2", "o4", "o1"}, got)
+	})
+
+	t.Run("writes maintain the index", func(t *testing.T) {
+		_, err := s.Update(&types.UpdateRequest{
+			TableName:                 "orders",
+			Key:                       map[string]*expression.AttributeValue{"id": {S: stringPtr("o1")}},
+			UpdateExpression:          "SET customer = :c",
+			ExpressionAttributeValues: map[string]*expression.AttributeValue{":c": {S: stringPtr("bob")}},
+		})
+		require.NoError(t, err)
+		_, err = s.Delete(&types.DeleteRequest{TableName: "orders", Key: map[string]*expression.AttributeValue{"id": {S: stringPtr("o2")}}})
+		require.NoError(t, err)
+		put("o5", "alice", "5")
+
+		assert.Equal(t, []string{"o5", "o4"}, ids(query("customer = :c", alice).Items))
+		bob := map[string]*expression.AttributeValue{":c": {S: stringPtr("bob")}}
+		assert.Equal(t, []string{"o3", "o1"}, ids(query("customer = :c", bob).Items))
+
+		// An index key of the wrong type is rejected.
+		_, err = s.Put(&types.PutRequest{TableName: "orders", Item: map[string]*expression.AttributeValue{
+			"id":       {S: stringPtr("o7")},
+			"customer": {N: stringPtr("1")},
+			"total":    {N: stringPtr("1")},
+		}})
+		assert.Error(t, err)
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		resp, err := s.Scan(&types.ScanRequest{TableName: "orders", IndexName: "byCustomer"})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"o5", "o4", "o3", "o1"}, ids(resp.Items))
+
+		_, err = s.Scan(&types.ScanRequest{TableName: "orders", IndexName: "missing"})
+		assert.Error(t, err)
+	})
+
+	t.Run("update table", func(t *testing.T) {
+		resp, err := s.UpdateTable(&types.UpdateTableRequest{
+			TableName:            "orders",
+			AttributeDefinitions: []*types.AttributeDefinition{{AttributeName: "status", AttributeType: "S"}},
+			GlobalSecondaryIndexUpdates: []*types.GlobalSecondaryIndexUpdate{{Create: &types.GlobalSecondaryIndex{
+				IndexName:  "byStatus",
+				KeySchema:  []*types.KeySchemaElement{{AttributeName: "status", KeyType: "HASH"}},
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeKeysOnly},
+			}}},
+		})
+		require.NoError(t, err)
+		require.Len(t, resp.TableDescription.GlobalSecondaryIndexes, 2)
+		assert.Equal(t, types.IndexStatusActive, resp.TableDescription.GlobalSecondaryIndexes[1].IndexStatus)
+
+		// The new index is backfilled from the existing items.
+		queried, err := s.Query(&types.QueryRequest{
+			TableName:                 "orders",
+			IndexName:                 "byStatus",
+			KeyConditionExpression:    "#s = :s",
+			ExpressionAttributeNames:  map[string]string{"#s": "status"},
+			ExpressionAttributeValues: map[string]*expression.AttributeValue{":s": {S: stringPtr("open")}},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"o1", "o3", "o4", "o5", "o6"}, ids(queried.Items))
+		assert.Len(t, queried.Items[0], 2)
+
+		_, err = s.UpdateTable(&types.UpdateTableRequest{
+			TableName: "orders",
+			GlobalSecondaryIndexUpdates: []*types.GlobalSecondaryIndexUpdate{
+				{Delete: &types.DeleteGlobalSecondaryIndexAction{IndexName: "byCustomer"}},
+			},
+		})
+		require.NoError(t, err)
+		described, err := s.DescribeTable(&types.DescribeTableRequest{TableName: "orders"})
+		require.NoError(t, err)
+		require.Len(t, described.Table.GlobalSecondaryIndexes, 1)
+		assert.Equal(t, "byStatus", described.Table.GlobalSecondaryIndexes[0].IndexName)
+		_, err = s.Query(&types.QueryRequest{
+			TableName:                 "orders",
+			IndexName:                 "byCustomer",
+			KeyConditionExpression:    "customer = :c",
+			ExpressionAttributeValues: alice,
+		})
+		assert.Error(t, err)
+
+		// Deleting an item removes it from the remaining index.
+		_, err = s.Delete(&types.DeleteRequest{TableName: "orders", Key: map[string]*expression.AttributeValue{"id": {S: stringPtr("o6")}}})
+		require.NoError(t, err)
+		scanned, err := s.Scan(&types.ScanRequest{TableName: "orders", IndexName: "byStatus"})
+		require.NoError(t, err)
+		assert.Equal(t, 4, scanned.Count)
+	})
+
+	t.Run("invalid definitions", func(t *testing.T) {
+		for name, gsi := range map[string]*types.GlobalSecondaryIndex{
+			"undefined attribute": {
+				IndexName:  "idx",
+				KeySchema:  []*types.KeySchemaElement{{AttributeName: "other", KeyType: "HASH"}},
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+			},
+			"no hash key": {
+				IndexName:  "idx",
+				KeySchema:  []*types.KeySchemaElement{{AttributeName: "total", KeyType: "RANGE"}},
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+			},
+			"include without attributes": {
+				IndexName:  "idx",
+				KeySchema:  []*types.KeySchemaElement{{AttributeName: "total", KeyType: "HASH"}},
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeInclude},
+			},
+			"duplicate name": {
+				IndexName:  "byStatus",
+				KeySchema:  []*types.KeySchemaElement{{AttributeName: "total", KeyType: "HASH"}},
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+			},
+		} {
+			_, err := s.UpdateTable(&types.UpdateTableRequest{
+				TableName:                   "orders",
+				GlobalSecondaryIndexUpdates: []*types.GlobalSecondaryIndexUpdate{{Create: gsi}},
+			})
+			assert.Error(t, err, name)
+		}
+	})
+}
+
+func TestBBoltStorage_LocalSecondaryIndex(t *testing.T) {
+	f, err := ioutil.TempFile("", "bbolt.db")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := bbolt.NewBBoltStorage(f.Name())
+	require.NoError(t, err)
+
+	attributes := []*types.AttributeDefinition{
+		{AttributeName: "user", AttributeType: "S"},
+		{AttributeName: "id", AttributeType: "S"},
+		{AttributeName: "created", AttributeType: "N"},
+		{AttributeName: "status", AttributeType: "S"},
+	}
+	keySchema := []*types.KeySchemaElement{
+		{AttributeName: "user", KeyType: "HASH"},
+		{AttributeName: "id", KeyType: "RANGE"},
+	}
+	lsi := func(name, rangeKey, projectionType string) *types.LocalSecondaryIndex {
+		return &types.LocalSecondaryIndex{
+			IndexName: name,
+			KeySchema: []*types.KeySchemaElement{
+				{AttributeName: "user", KeyType: "HASH"},
+				{AttributeName: rangeKey, KeyType: "RANGE"},
+			},
+			Projection: &types.Projection{ProjectionType: projectionType},
+		}
+	}
+
+	created, err := s.CreateTable(&types.CreateTableRequest{
+		TableName:             "tasks",
+		AttributeDefinitions:  attributes,
+		KeySchema:             keySchema,
+		LocalSecondaryIndexes: []*types.LocalSecondaryIndex{lsi("byCreated", "created", types.ProjectionTypeAll), lsi("byStatus", "status", types.ProjectionTypeKeysOnly)},
+	})
+	require.NoError(t, err)
+	assert.Len(t, created.TableDescription.LocalSecondaryIndexes, 2)
+
+	for _, task := range []struct{ user, id, created, status string }{
+		{"alice", "t1", "300", "done"},
+		{"alice", "t2", "100", "open"},
+		{"alice", "t3", "200", "open"},
+		{"alice", "t4", "400", "blocked"},
+		{"bob", "t5", "50", "open"},
+	} {
+		_, err := s.Put(&types.PutRequest{TableName: "tasks", Item: map[string]*expression.AttributeValue{
+			"user":    {S: stringPtr(task.user)},
+			"id":      {S: stringPtr(task.id)},
+			"created": {N: stringPtr(task.created)},
+			"status":  {S: stringPtr(task.status)},
+		}})
+		require.NoError(t, err)
+	}
+
+	ids := func(items []map[string]*expression.AttributeValue) []string {
+		var ids []string
+		for _, item := range items {
+			ids = append(ids, *item["id"].S)
+		}
+		return ids
+	}
+	values := map[string]*expression.AttributeValue{
+		":u": {S: stringPtr("alice")},
+		":t": {N: stringPtr("200")},
+		":s": {S: stringPtr("open")},
+	}
+	query := func(req *types.QueryRequest) *types.QueryResponse {
+		req.TableName = "tasks"
+		req.ExpressionAttributeNames = map[string]string{"#u": "user", "#s": "status"}
+		req.ExpressionAttributeValues = values
+		resp, err := s.Query(req)
+		require.NoError(t, err)
+		return resp
+	}
+
+	// Each index orders the partition by its own range key.
+	assert.Equal(t, []string{"t2", "t3", "t1", "t4"}, ids(query(&types.QueryRequest{IndexName: "byCreated", KeyConditionExpression: "#u = :u"}).Items))
+	assert.Equal(t, []string{"t4", "t1"}, ids(query(&types.QueryRequest{IndexName: "byCreated", KeyConditionExpression: "#u = :u AND created > :t", ScanIndexForward: boolPtr(false)}).Items))
+	assert.Equal(t, []string{"t4", "t1", "t2", "t3"}, ids(query(&types.QueryRequest{IndexName: "byStatus", KeyConditionExpression: "#u = :u"}).Items))
+
+	open := query(&types.QueryRequest{IndexName: "byStatus", KeyConditionExpression: "#u = :u AND #s = :s"})
+	assert.Equal(t, []string{"t2", "t3"}, ids(open.Items))
+	assert.Len(t, open.Items[0], 3, "KEYS_ONLY projects the table and index keys")
+
+	// Pagination walks the index in both directions.
+	for _, forward := range []bool{true, false} {
+		limit := 1
+		var got []string
+		var startKey map[string]*expression.AttributeValue
+		for {
+			resp := query(&types.QueryRequest{
+				IndexName:              "byCreated",
+				KeyConditionExpression: "#u = :u AND created >= :t",
+				ScanIndexForward:       boolPtr(forward),
+				Limit:                  &limit,
+				ExclusiveStartKey:      startKey,
+			})
+			got = append(got, ids(resp.Items)...)
+			if resp.LastEvaluatedKey == nil {
+				break
+			}
+			startKey = resp.LastEvaluatedKey
+		}
+		if forward {
+			assert.Equal(t, []string{"t3", "t1", "t4"}, got)
+		} else {
+			assert.Equal(t, []string{"t4", "t1", "t3"}, got)
+		}
+	}
+
+	// The index follows updates to its range key.
+	_, err = s.Update(&types.UpdateRequest{
+		TableName:                 "tasks",
+		Key:                       map[string]*expression.AttributeValue{"user": {S: stringPtr("alice")}, "id": {S: stringPtr("t4")}},
+		UpdateExpression:          "SET #s = :s",
+		ExpressionAttributeNames:  map[string]string{"#s": "status"},
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{":s": {S: stringPtr("open")}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"t2", "t3", "t4"}, ids(query(&types.QueryRequest{IndexName: "byStatus", KeyConditionExpression: "#u = :u AND #s = :s"}).Items))
+
+	// Local indexes cannot be deleted, and need a table with a range key and
+	// the same hash key.
+	_, err = s.UpdateTable(&types.UpdateTableRequest{
+		TableName:                   "tasks",
+		GlobalSecondaryIndexUpdates: []*types.GlobalSecondaryIndexUpdate{{Delete: &types.DeleteGlobalSecondaryIndexAction{IndexName: "byStatus"}}},
+	})
+	assert.Error(t, err)
+	_, err = s.CreateTable(&types.CreateTableRequest{
+		TableName:             "no-range",
+		AttributeDefinitions:  attributes,
+		KeySchema:             keySchema[:1],
+		LocalSecondaryIndexes: []*types.LocalSecondaryIndex{lsi("byCreated", "created", types.ProjectionTypeAll)},
+	})
+	assert.Error(t, err)
+	other := lsi("byCreated", "created", types.ProjectionTypeAll)
+	other.KeySchema[0].AttributeName = "status"
+	_, err = s.CreateTable(&types.CreateTableRequest{
+		TableName:             "other-hash",
+		AttributeDefinitions:  attributes,
+		KeySchema:             keySchema,
+		LocalSecondaryIndexes: []*types.LocalSecondaryIndex{other},
+	})
+	assert.Error(t, err)
+}
+
+func TestBBoltStorage_TimeToLive(t *testing.T) {
+	f, err := ioutil.TempFile("", "bbolt.db")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := bbolt.NewBBoltStorage(f.Name())
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, err = s.CreateTable(&types.CreateTableRequest{
+		TableName: "sessions",
+		AttributeDefinitions: []*types.AttributeDefinition{
+			{AttributeName: "id", AttributeType: "S"},
+			{AttributeName: "user", AttributeType: "S"},
+		},
+		KeySchema: []*types.KeySchemaElement{{AttributeName: "id", KeyType: "HASH"}},
+		GlobalSecondaryIndexes: []*types.GlobalSecondaryIndex{{
+			IndexName:  "byUser",
+			KeySchema:  []*types.KeySchemaElement{{AttributeName: "user", KeyType: "HASH"}},
+			Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+		}},
+	})
+	require.NoError(t, err)
+
+	for id, expires := range map[string]*expression.AttributeValue{
+		"expired":  {N: stringPtr("1000")},
+		"live":     {N: stringPtr("9999999999")},
+		"no-ttl":   nil,
+		"not-a-n":  {S: stringPtr("1000")},
+		"expired2": {N: stringPtr("1.5e3")},
+	} {
+		item := map[string]*expression.AttributeValue{"id": {S: stringPtr(id)}, "user": {S: stringPtr("alice")}}
+		if expires != nil {
+			item["expires"] = expires
+		}
+		_, err := s.Put(&types.PutRequest{TableName: "sessions", Item: item})
+		require.NoError(t, err)
+	}
+
+	get := func(id string) map[string]*expression.AttributeValue {
+		item, err := s.Get(&types.GetRequest{TableName: "sessions", Key: map[string]*expression.AttributeValue{"id": {S: stringPtr(id)}}})
+		require.NoError(t, err)
+		return item
+	}
+	scanCount := func(indexName string) int {
+		resp, err := s.Scan(&types.ScanRequest{TableName: "sessions", IndexName: indexName})
+		require.NoError(t, err)
+		return resp.Count
+	}
+
+	// Nothing expires until time to live is enabled.
+	described, err := s.DescribeTimeToLive(&types.DescribeTimeToLiveRequest{TableName: "sessions"})
+	require.NoError(t, err)
+	assert.Equal(t, types.TimeToLiveStatusDisabled, described.TimeToLiveDescription.TimeToLiveStatus)
+	assert.NotNil(t, get("expired"))
+	deleted, err := s.DeleteExpiredItems()
+	require.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+
+	spec := &types.TimeToLiveSpecification{AttributeName: "expires", Enabled: true}
+	_, err = s.UpdateTimeToLive(&types.UpdateTimeToLiveRequest{TableName: "sessions", TimeToLiveSpecification: spec})
+	require.NoError(t, err)
+	_, err = s.UpdateTimeToLive(&types.UpdateTimeToLiveRequest{TableName: "sessions", TimeToLiveSpecification: spec})
+	assert.Error(t, err, "time to live is already enabled")
+	described, err = s.DescribeTimeToLive(&types.DescribeTimeToLiveRequest{TableName: "sessions"})
+	require.NoError(t, err)
+	assert.Equal(t, types.TimeToLiveDescription{TimeToLiveStatus: types.TimeToLiveStatusEnabled, AttributeName: "expires"}, described.TimeToLiveDescription)
+
+	// Reads hide expired items before they are deleted.
+	assert.Nil(t, get("expired"))
+	assert.NotNil(t, get("live"))
+	assert.NotNil(t, get("not-a-n"))
+	assert.Equal(t, 3, scanCount(""))
+	queried, err := s.Query(&types.QueryRequest{
+		TableName:                 "sessions",
+		IndexName:                 "byUser",
+		KeyConditionExpression:    "#u = :u",
+		ExpressionAttributeNames:  map[string]string{"#u": "user"},
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{":u": {S: stringPtr("alice")}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 3, queried.Count)
+	assert.Equal(t, 5, queried.ScannedCount)
+
+	versionOf := func(id string) *types.ItemVersion {
+		resp, err := s.GetItemVersions(&types.GetItemVersionsRequest{TableName: "sessions", Keys: []map[string]*expression.AttributeValue{{"id": {S: stringPtr(id)}}}})
+		require.NoError(t, err)
+		return resp.Items[0]
+	}
+	before := versionOf("expired").Version
+
+	deleted, err = s.DeleteExpiredItems()
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+	deleted, err = s.DeleteExpiredItems()
+	require.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+
+	// The deletes are versioned, so that a copy of an expired item from a
+	// replica yet to sweep it is older.
+	assert.Equal(t, &types.ItemVersion{Version: before + 1}, versionOf("expired"))
+	imported, err := s.ImportItems(&types.ImportItemsRequest{
+		TableName: "sessions",
+		Keys:      []map[string]*expression.AttributeValue{{"id": {S: stringPtr("expired")}}},
+		Items:     []*types.ItemVersion{{Item: map[string]*expression.AttributeValue{"id": {S: stringPtr("expired")}, "user": {S: stringPtr("alice")}}, Version: before}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 0, imported.ImportedCount)
+
+	// The deleted items are gone from the index too, which a disabled time to
+	// live no longer hides.
+	_, err = s.UpdateTimeToLive(&types.UpdateTimeToLiveRequest{TableName: "sessions", TimeToLiveSpecification: &types.TimeToLiveSpecification{AttributeName: "other"}})
+	assert.Error(t, err)
+	_, err = s.UpdateTimeToLive(&types.UpdateTimeToLiveRequest{TableName: "sessions", TimeToLiveSpecification: &types.TimeToLiveSpecification{AttributeName: "expires"}})
+	require.NoError(t, err)
+	assert.Equal(t, 3, scanCount(""))
+	assert.Equal(t, 3, scanCount("byUser"))
+}
+
+func TestBBoltStorage_Streams(t *testing.T) {
+	f, err := ioutil.TempFile("", "bbolt.db")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := bbolt.NewBBoltStorage(f.Name())
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, err = s.CreateTable(&types.CreateTableRequest{
+		TableName:            "invalid",
+		AttributeDefinitions: []*types.AttributeDefinition{{AttributeName: "id", AttributeType: "S"}},
+		KeySchema:            []*types.KeySchemaElement{{AttributeName: "id", KeyType: "HASH"}},
+		StreamSpecification:  &types.StreamSpecification{StreamEnabled: true, StreamViewType: "ALL"},
+	})
+	assert.Error(t, err)
+
+	created, err := s.CreateTable(&types.CreateTableRequest{
+		TableName:            "orders",
+		AttributeDefinitions: []*types.AttributeDefinition{{AttributeName: "id", AttributeType: "S"}},
+		KeySchema:            []*types.KeySchemaElement{{AttributeName: "id", KeyType: "HASH"}},
+		StreamSpecification:  &types.StreamSpecification{StreamEnabled: true, StreamViewType: types.StreamViewTypeNewAndOldImages},
+	})
+	require.NoError(t, err)
+	streamArn := created.TableDescription.LatestStreamArn
+	assert.Equal(t, storage.StreamArn("orders", created.TableDescription.LatestStreamLabel), streamArn)
+	assert.Equal(t, &types.StreamSpecification{StreamEnabled: true, StreamViewType: types.StreamViewTypeNewAndOldImages}, created.TableDescription.StreamSpecification)
+
+	key := map[string]*expression.AttributeValue{"id": {S: stringPtr("1")}}
+	item := map[string]*expression.AttributeValue{"id": {S: stringPtr("1")}, "status": {S: stringPtr("new")}}
+	_, err = s.Put(&types.PutRequest{TableName: "orders", Item: item})
+	require.NoError(t, err)
+	// Writes that leave the item as it was, and deletes of missing items, are not recorded.
+	_, err = s.Put(&types.PutRequest{TableName: "orders", Item: item})
+	require.NoError(t, err)
+	_, err = s.Update(&types.UpdateRequest{
+		TableName:                 "orders",
+		Key:                       key,
+		UpdateExpression:          "SET #s = :s",
+		ExpressionAttributeNames:  map[string]string{"#s": "status"},
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{":s": {S: stringPtr("paid")}},
+	})
+	require.NoError(t, err)
+	_, err = s.Delete(&types.DeleteRequest{TableName: "orders", Key: key})
+	require.NoError(t, err)
+	_, err = s.Delete(&types.DeleteRequest{TableName: "orders", Key: key})
+	require.NoError(t, err)
+
+	listed, err := s.ListStreams(&types.ListStreamsRequest{})
+	require.NoError(t, err)
+	require.Len(t, listed.Streams, 1)
+	assert.Equal(t, "orders", listed.Streams[0].TableName)
+	assert.Equal(t, streamArn, listed.Streams[0].StreamArn)
+
+	described, err := s.DescribeStream(&types.DescribeStreamRequest{StreamArn: streamArn})
+	require.NoError(t, err)
+	assert.Equal(t, types.StreamStatusEnabled, described.StreamDescription.StreamStatus)
+	assert.Equal(t, types.StreamViewTypeNewAndOldImages, described.StreamDescription.StreamViewType)
+	require.Len(t, described.StreamDescription.Shards, 1)
+	shard := described.StreamDescription.Shards[0]
+	assert.Empty(t, shard.SequenceNumberRange.EndingSequenceNumber)
+
+	iterator := func(iteratorType, seq string) string {
+		resp, err := s.GetShardIterator(&types.GetShardIteratorRequest{StreamArn: streamArn, ShardId: shard.ShardId, ShardIteratorType: iteratorType, SequenceNumber: seq})
+		require.NoError(t, err)
+		return resp.ShardIterator
+	}
+
+	records, err := s.GetRecords(&types.GetRecordsRequest{ShardIterator: iterator(types.ShardIteratorTypeTrimHorizon, "")})
+	require.NoError(t, err)
+	require.Len(t, records.Records, 3)
+	insert, modify, remove := records.Records[0], records.Records[1], records.Records[2]
+	assert.Equal(t, types.StreamEventInsert, insert.EventName)
+	assert.Equal(t, "aws:dynamodb", insert.EventSource)
+	assert.Equal(t, key, insert.Dynamodb.Keys)
+	assert.Equal(t, item, insert.Dynamodb.NewImage)
+	assert.Nil(t, insert.Dynamodb.OldImage)
+	assert.Equal(t, types.StreamEventModify, modify.EventName)
+	assert.Equal(t, "new", *modify.Dynamodb.OldImage["status"].S)
+	assert.Equal(t, "paid", *modify.Dynamodb.NewImage["status"].S)
+	assert.Equal(t, types.StreamEventRemove, remove.EventName)
+	assert.Nil(t, remove.Dynamodb.NewImage)
+	assert.Equal(t, "paid", *remove.Dynamodb.OldImage["status"].S)
+	assert.Equal(t, shard.SequenceNumberRange.StartingSequenceNumber, insert.Dynamodb.SequenceNumber)
+	assert.Less(t, insert.Dynamodb.SequenceNumber, modify.Dynamodb.SequenceNumber)
+	assert.NotEqual(t, insert.EventID, modify.EventID)
+
+	// An open shard always has a next iterator, from which new records are read.
+	require.NotEmpty(t, records.NextShardIterator)
+	next, err := s.GetRecords(&types.GetRecordsRequest{ShardIterator: records.NextShardIterator})
+	require.NoError(t, err)
+	assert.Empty(t, next.Records)
+	require.NotEmpty(t, next.NextShardIterator)
+
+	// Pages hold at most Limit records.
+	page, err := s.GetRecords(&types.GetRecordsRequest{ShardIterator: iterator(types.ShardIteratorTypeTrimHorizon, ""), Limit: 2})
+	require.NoError(t, err)
+	assert.Len(t, page.Records, 2)
+	page, err = s.GetRecords(&types.GetRecordsRequest{ShardIterator: page.NextShardIterator, Limit: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []*types.Record{remove}, page.Records)
+
+	page, err = s.GetRecords(&types.GetRecordsRequest{ShardIterator: iterator(types.ShardIteratorTypeAtSequenceNumber, modify.Dynamodb.SequenceNumber)})
+	require.NoError(t, err)
+	assert.Equal(t, []*types.Record{modify, remove}, page.Records)
+	page, err = s.GetRecords(&types.GetRecordsRequest{ShardIterator: iterator(types.ShardIteratorTypeAfterSequenceNumber, modify.Dynamodb.SequenceNumber)})
+	require.NoError(t, err)
+	assert.Equal(t, []*types.Record{remove}, page.Records)
+	latest := iterator(types.ShardIteratorTypeLatest, "")
+	_, err = s.Put(&types.PutRequest{TableName: "orders", Item: item})
+	require.NoError(t, err)
+	page, err = s.GetRecords(&types.GetRecordsRequest{ShardIterator: latest})
+	require.NoError(t, err)
+	require.Len(t, page.Records, 1)
+	assert.Equal(t, types.StreamEventInsert, page.Records[0].EventName)
+
+	_, err = s.GetShardIterator(&types.GetShardIteratorRequest{StreamArn: streamArn, ShardId: shard.ShardId, ShardIteratorType: types.ShardIteratorTypeAtSequenceNumber, SequenceNumber: "999"})
+	assert.Error(t, err)
+	_, err = s.GetShardIterator(&types.GetShardIteratorRequest{StreamArn: streamArn, ShardId: "shardId-0", ShardIteratorType: types.ShardIteratorTypeTrimHorizon})
+	assert.Error(t, err)
+	_, err = s.GetRecords(&types.GetRecordsRequest{ShardIterator: "invalid"})
+	assert.Error(t, err)
+
+	// Disabling the stream closes its shard, which can still be read to its end.
+	_, err = s.UpdateTable(&types.UpdateTableRequest{TableName: "orders", StreamSpecification: &types.StreamSpecification{StreamEnabled: false}})
+	require.NoError(t, err)
+	_, err = s.UpdateTable(&types.UpdateTableRequest{TableName: "orders", StreamSpecification: &types.StreamSpecification{StreamEnabled: false}})
+	assert.Error(t, err)
+	_, err = s.Put(&types.PutRequest{TableName: "orders", Item: map[string]*expression.AttributeValue{"id": {S: stringPtr("2")}}})
+	require.NoError(t, err)
+	described, err = s.DescribeStream(&types.DescribeStreamRequest{StreamArn: streamArn})
+	require.NoError(t, err)
+	assert.Equal(t, types.StreamStatusDisabled, described.StreamDescription.StreamStatus)
+	assert.Equal(t, page.Records[0].Dynamodb.SequenceNumber, described.StreamDescription.Shards[0].SequenceNumberRange.EndingSequenceNumber)
+	page, err = s.GetRecords(&types.GetRecordsRequest{ShardIterator: page.NextShardIterator})
+	require.NoError(t, err)
+	assert.Empty(t, page.Records)
+	assert.Empty(t, page.NextShardIterator)
+
+	// Enabling it again starts a new stream.
+	updated, err := s.UpdateTable(&types.UpdateTableRequest{TableName: "orders", StreamSpecification: &types.StreamSpecification{StreamEnabled: true, StreamViewType: types.StreamViewTypeKeysOnly}})
+	require.NoError(t, err)
+	newArn := updated.TableDescription.LatestStreamArn
+	assert.NotEqual(t, streamArn, newArn)
+	_, err = s.UpdateTable(&types.UpdateTableRequest{TableName: "orders", StreamSpecification: &types.StreamSpecification{StreamEnabled: true, StreamViewType: types.StreamViewTypeKeysOnly}})
+	assert.Error(t, err)
+	_, err = s.DescribeStream(&types.DescribeStreamRequest{StreamArn: streamArn})
+	assert.Error(t, err)
+
+	// Deletes by time to live are recorded as made by the service.
+	_, err = s.UpdateTimeToLive(&types.UpdateTimeToLiveRequest{TableName: "orders", TimeToLiveSpecification: &types.TimeToLiveSpecification{AttributeName: "expires", Enabled: true}})
+	require.NoError(t, err)
+	_, err = s.Put(&types.PutRequest{TableName: "orders", Item: map[string]*expression.AttributeValue{"id": {S: stringPtr("3")}, "expires": {N: stringPtr("1000")}}})
+	require.NoError(t, err)
+	deleted, err := s.DeleteExpiredItems()
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+
+	described, err = s.DescribeStream(&types.DescribeStreamRequest{StreamArn: newArn})
+	require.NoError(t, err)
+	shardID := described.StreamDescription.Shards[0].ShardId
+	resp, err := s.GetShardIterator(&types.GetShardIteratorRequest{StreamArn: newArn, ShardId: shardID, ShardIteratorType: types.ShardIteratorTypeTrimHorizon})
+	require.NoError(t, err)
+	records, err = s.GetRecords(&types.GetRecordsRequest{ShardIterator: resp.ShardIterator})
+	require.NoError(t, err)
+	require.Len(t, records.Records, 2)
+	assert.Nil(t, records.Records[0].Dynamodb.NewImage)
+	assert.Nil(t, records.Records[0].UserIdentity)
+	assert.Equal(t, types.StreamEventRemove, records.Records[1].EventName)
+	assert.Equal(t, &types.Identity{PrincipalId: "dynamodb.amazonaws.com", Type: "Service"}, records.Records[1].UserIdentity)
+
+	// Records are trimmed once past their retention.
+	trimmed, err := s.TrimStreams(time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 0, trimmed)
+	trimmed, err = s.TrimStreams(time.Now().Add(2 * time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, 2, trimmed)
+	records, err = s.GetRecords(&types.GetRecordsRequest{ShardIterator: resp.ShardIterator})
+	require.NoError(t, err)
+	assert.Empty(t, records.Records)
+
+	// Deleting the table deletes its stream.
+	_, err = s.DeleteTable(&types.DeleteTableRequest{TableName: "orders"})
+	require.NoError(t, err)
+	listed, err = s.ListStreams(&types.ListStreamsRequest{})
+	require.NoError(t, err)
+	assert.Empty(t, listed.Streams)
+}
+
 func TestBBoltStorage_Query(t *testing.T) {
 	f, err := ioutil.TempFile("", "bbolt.db")
-	if err != nil {
-		t.Fatal(err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	s, err := bbolt.NewBBoltStorage(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createReq := &types.CreateTableRequest{
+		TableName: "query-test-table",
+		AttributeDefinitions: []*types.AttributeDefinition{
+			{AttributeName: "id", AttributeType: "S"},
+			{AttributeName: "name", AttributeType: "S"},
+		},
+		KeySchema: []*types.KeySchemaElement{
+			{AttributeName: "id", KeyType: "HASH"},
+		},
+	}
+
+	_, err = s.CreateTable(createReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putReq1 := &types.PutRequest{
+		TableName: "query-test-table",
+		Item: map[string]*expression.AttributeValue{
+			"id":   {S: stringPtr("123")},
+			"name": {S: stringPtr("test-name-1")},
+		},
+	}
+
+	if _, err := s.Put(putReq1); err != nil {
+		t.Fatal(err)
+	}
+
+	queryReq := &types.QueryRequest{
+		TableName:              "query-test-table",
+		KeyConditionExpression: "id = :id",
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{
+			":id": {S: stringPtr("123")},
+		},
+	}
+
+	resp, err := s.Query(queryReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Items) != 1 {
+		t.Fatalf("expected 1 item, got %d", len(resp.Items))
+	}
+}
+
+func TestBBoltStorage_Query_Validation(t *testing.T) {
+	f, err := ioutil.TempFile("", "bbolt.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	s, err := bbolt.NewBBoltStorage(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	createReq := &types.CreateTableRequest{
+		TableName: "test-table",
+		AttributeDefinitions: []*types.AttributeDefinition{
+			{AttributeName: "id", AttributeType: "S"},
+			{AttributeName: "age", AttributeType: "N"},
+		},
+		KeySchema: []*types.KeySchemaElement{
+			{AttributeName: "id", KeyType: "HASH"},
+		},
+	}
+
+	_, err = s.CreateTable(createReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name                   string
+		keyConditionExpression string
+		expectedError          string
+	}{
+		{
+			name:                   "Invalid format - missing operator",
+			keyConditionExpression: "id 123",
+			expectedError:          "invalid KeyConditionExpression format: expected 'attributeName = value'",
+		},
+		{
+			name:                   "Invalid format - too many parts",
+			keyConditionExpression: "id = 123 extra",
+			expectedError:          "invalid KeyConditionExpression format: expected 'attributeName = value'",
+		},
+		{
+			name:                   "Attribute name does not match hash key",
+			keyConditionExpression: "age = 30",
+			expectedError:          "KeyConditionExpression must use the hash key 'id', but got 'age'",
+		},
+		{
+			name:                   "Value type mismatch",
+			keyConditionExpression: "id = :id", // id is S, but 123 is N
+			expectedError:          "invalid type for hash key 'id': expected S, got N",
+		},
+		{
+			name:                   "Valid expression",
+			keyConditionExpression: "id = :id", // id is S, and "123" is S
+			expectedError:          "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queryReq := &types.QueryRequest{
+				TableName:              "test-table",
+				KeyConditionExpression: tt.keyConditionExpression,
+				ExpressionAttributeValues: map[string]*expression.AttributeValue{
+					":id": {N: stringPtr("123")},
+				},
+			}
+			if tt.name == "Valid expression" {
+				queryReq.ExpressionAttributeValues = map[string]*expression.AttributeValue{
+					":id": {S: stringPtr("123")},
+				}
+			}
+
+			_, err := s.Query(queryReq)
+			if tt.expectedError == "" {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+			} else {
+				if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
+					t.Fatalf("expected error containing '%s', got %v", tt.expectedError, err)
+				}
+			}
+		})
+	}
+}
+
+func TestBBoltStorage_Query_SortKeyConditions(t *testing.T) {
+	f, err := ioutil.TempFile("", "bbolt.db")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := bbolt.NewBBoltStorage(f.Name())
+	require.NoError(t, err)
+
+	_, err = s.CreateTable(&types.CreateTableRequest{
+		TableName: "events",
+		AttributeDefinitions: []*types.AttributeDefinition{
+			{AttributeName: "device", AttributeType: "S"},
+			{AttributeName: "event", AttributeType: "S"},
+		},
+		KeySchema: []*types.KeySchemaElement{
+			{AttributeName: "device", KeyType: "HASH"},
+			{AttributeName: "event", KeyType: "RANGE"},
+		},
+	})
+	require.NoError(t, err)
+
+	for _, device := range []string{"d1", "d2"} {
+		for _, event := range []string{"boot", "error-1", "error-2", "login", "shutdown"} {
+			_, err = s.Put(&types.PutRequest{
+				TableName: "events",
+				Item: map[string]*expression.AttributeValue{
+					"device": {S: stringPtr(device)},
+					"event":  {S: stringPtr(event)},
+				},
+			})
+			require.NoError(t, err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		condition string
+		values    map[string]*expression.AttributeValue
+		expected  []string
+	}{
+		{
+			name:      "hash key only",
+			condition: "device = :d",
+			expected:  []string{"boot", "error-1", "error-2", "login", "shutdown"},
+		},
+		{
+			name:      "equal",
+			condition: "device = :d AND event = :e",
+			values:    map[string]*expression.AttributeValue{":e": {S: stringPtr("login")}},
+			expected:  []string{"login"},
+		},
+		{
+			name:      "less than",
+			condition: "device = :d AND event < :e",
+			values:    map[string]*expression.AttributeValue{":e": {S: stringPtr("error-2")}},
+			expected:  []string{"boot", "error-1"},
+		},
+		{
+			name:      "less than or equal",
+			condition: "device = :d AND event <= :e",
+			values:    map[string]*expression.AttributeValue{":e": {S: stringPtr("error-2")}},
+			expected:  []string{"boot", "error-1", "error-2"},
+		},
+		{
+			name:      "greater than",
+			condition: "device = :d AND event > :e",
+			values:    map[string]*expression.AttributeValue{":e": {S: stringPtr("login")}},
+			expected:  []string{"shutdown"},
+		},
+		{
+			name:      "greater than or equal",
+			condition: "device = :d AND event >= :e",
+			values:    map[string]*expression.AttributeValue{":e": {S: stringPtr("login")}},
+			expected:  []string{"login", "shutdown"},
+		},
+		{
+			name:      "between",
+			condition: "device = :d AND event BETWEEN :lo AND :hi",
+			values: map[string]*expression.AttributeValue{
+				":lo": {S: stringPtr("c")},
+				":hi": {S: stringPtr("login")},
+			},
+			expected: []string{"error-1", "error-2", "login"},
+		},
+		{
+			name:      "begins_with",
+			condition: "device = :d AND begins_with(event, :p)",
+			values:    map[string]*expression.AttributeValue{":p": {S: stringPtr("error")}},
+			expected:  []string{"error-1", "error-2"},
+		},
+		{
+			name:      "range key condition first",
+			condition: "event > :e AND device = :d",
+			values:    map[string]*expression.AttributeValue{":e": {S: stringPtr("login")}},
+			expected:  []string{"shutdown"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := map[string]*expression.AttributeValue{":d": {S: stringPtr("d1")}}
+			for k, v := range tt.values {
+				values[k] = v
+			}
+
+			resp, err := s.Query(&types.QueryRequest{
+				TableName:                 "events",
+				KeyConditionExpression:    tt.condition,
+				ExpressionAttributeValues: values,
+			})
+			require.NoError(t, err)
+			items := resp.Items
+
+			var events []string
+			for _, item := range items {
+				assert.Equal(t, "d1", *item["device"].S)
+				events = append(events, *item["event"].S)
+			}
+			assert.Equal(t, tt.expected, events)
+		})
+	}
+}
+
+func TestBBoltStorage_Query_NumericSortKey(t *testing.T) {
+	f, err := ioutil.TempFile("", "bbolt.db")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := bbolt.NewBBoltStorage(f.Name())
+	require.NoError(t, err)
+
+	_, err = s.CreateTable(&types.CreateTableRequest{
+		TableName: "readings",
+		AttributeDefinitions: []*types.AttributeDefinition{
+			{AttributeName: "sensor", AttributeType: "S"},
+			{AttributeName: "ts", AttributeType: "N"},
+		},
+		KeySchema: []*types.KeySchemaElement{
+			{AttributeName: "sensor", KeyType: "HASH"},
+			{AttributeName: "ts", KeyType: "RANGE"},
+		},
+	})
+	require.NoError(t, err)
+
+	for _, ts := range []string{"5", "9", "10", "100"} {
+		_, err = s.Put(&types.PutRequest{
+			TableName: "readings",
+			Item: map[string]*expression.AttributeValue{
+				"sensor": {S: stringPtr("s1")},
+				"ts":     {N: stringPtr(ts)},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	resp, err := s.Query(&types.QueryRequest{
+		TableName:              "readings",
+		KeyConditionExpression: "sensor = :s AND ts BETWEEN :lo AND :hi",
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{
+			":s":  {S: stringPtr("s1")},
+			":lo": {N: stringPtr("6")},
+			":hi": {N: stringPtr("50")},
+		},
+	})
+	require.NoError(t, err)
+	items := resp.Items
+
+	var timestamps []string
+	for _, item := range items {
+		timestamps = append(timestamps, *item["ts"].N)
 	}
+	assert.Equal(t, []string{"9", "10"}, timestamps)
+
+	_, err = s.Query(&types.QueryRequest{
+		TableName:              "readings",
+		KeyConditionExpression: "sensor = :s AND ts > :ts",
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{
+			":s":  {S: stringPtr("s1")},
+			":ts": {S: stringPtr("10")},
+		},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid type for range key 'ts': expected N, got S")
+
+	_, err = s.Query(&types.QueryRequest{
+		TableName:              "readings",
+		KeyConditionExpression: "sensor = :s AND ts BETWEEN :hi AND :lo",
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{
+			":s":  {S: stringPtr("s1")},
+			":lo": {N: stringPtr("6")},
+			":hi": {N: stringPtr("50")},
+		},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "lower bound is greater than upper bound")
+}
+
+func TestBBoltStorage_Query_Pagination(t *testing.T) {
+	f, err := ioutil.TempFile("", "bbolt.db")
+	require.NoError(t, err)
 	defer os.Remove(f.Name())
 
 	s, err := bbolt.NewBBoltStorage(f.Name())
-	if err != nil {
-		t.Fatal(err)
+	require.NoError(t, err)
+
+	_, err = s.CreateTable(&types.CreateTableRequest{
+		TableName: "events",
+		AttributeDefinitions: []*types.AttributeDefinition{
+			{AttributeName: "device", AttributeType: "S"},
+			{AttributeName: "event", AttributeType: "S"},
+		},
+		KeySchema: []*types.KeySchemaElement{
+			{AttributeName: "device", KeyType: "HASH"},
+			{AttributeName: "event", KeyType: "RANGE"},
+		},
+	})
+	require.NoError(t, err)
+
+	// Neighbouring partitions on both sides make sure paging never leaks out of d1.
+	for _, device := range []string{"d0", "d1", "d2"} {
+		for _, event := range []string{"boot", "error-1", "error-2", "login", "shutdown"} {
+			_, err = s.Put(&types.PutRequest{
+				TableName: "events",
+				Item: map[string]*expression.AttributeValue{
+					"device": {S: stringPtr(device)},
+					"event":  {S: stringPtr(event)},
+				},
+			})
+			require.NoError(t, err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		condition string
+		values    map[string]*expression.AttributeValue
+		forward   bool
+		expected  []string
+	}{
+		{
+			name:      "hash key only forward",
+			condition: "device = :d",
+			forward:   true,
+			expected:  []string{"boot", "error-1", "error-2", "login", "shutdown"},
+		},
+		{
+			name:      "hash key only backward",
+			condition: "device = :d",
+			expected:  []string{"shutdown", "login", "error-2", "error-1", "boot"},
+		},
+		{
+			name:      "greater than backward",
+			condition: "device = :d AND event > :e",
+			values:    map[string]*expression.AttributeValue{":e": {S: stringPtr("boot")}},
+			expected:  []string{"shutdown", "login", "error-2", "error-1"},
+		},
+		{
+			name:      "less than backward",
+			condition: "device = :d AND event < :e",
+			values:    map[string]*expression.AttributeValue{":e": {S: stringPtr("login")}},
+			expected:  []string{"error-2", "error-1", "boot"},
+		},
+		{
+			name:      "between backward",
+			condition: "device = :d AND event BETWEEN :lo AND :hi",
+			values: map[string]*expression.AttributeValue{
+				":lo": {S: stringPtr("error-1")},
+				":hi": {S: stringPtr("login")},
+			},
+			expected: []string{"login", "error-2", "error-1"},
+		},
+		{
+			name:      "begins_with forward",
+			condition: "device = :d AND begins_with(event, :p)",
+			values:    map[string]*expression.AttributeValue{":p": {S: stringPtr("error")}},
+			forward:   true,
+			expected:  []string{"error-1", "error-2"},
+		},
+	}
+
+	for _, tt := range tests {
+		for _, limit := range []int{1, 2, 10} {
+			t.Run(fmt.Sprintf("%s limit %d", tt.name, limit), func(t *testing.T) {
+				values := map[string]*expression.AttributeValue{":d": {S: stringPtr("d1")}}
+				for k, v := range tt.values {
+					values[k] = v
+				}
+
+				req := &types.QueryRequest{
+					TableName:                 "events",
+					KeyConditionExpression:    tt.condition,
+					ExpressionAttributeValues: values,
+					Limit:                     &limit,
+					ScanIndexForward:          &tt.forward,
+				}
+
+				var events []string
+				for pages := 0; ; pages++ {
+					require.Less(t, pages, 10, "pagination did not terminate")
+
+					resp, err := s.Query(req)
+					require.NoError(t, err)
+					assert.LessOrEqual(t, resp.ScannedCount, limit)
+					assert.Equal(t, len(resp.Items), resp.Count)
+
+					for _, item := range resp.Items {
+						assert.Equal(t, "d1", *item["device"].S)
+						events = append(events, *item["event"].S)
+					}
+
+					if resp.LastEvaluatedKey == nil {
+						break
+					}
+					req.ExclusiveStartKey = resp.LastEvaluatedKey
+				}
+				assert.Equal(t, tt.expected, events)
+			})
+		}
+	}
+
+	t.Run("invalid limit", func(t *testing.T) {
+		limit := 0
+		_, err := s.Query(&types.QueryRequest{
+			TableName:                 "events",
+			KeyConditionExpression:    "device = :d",
+			ExpressionAttributeValues: map[string]*expression.AttributeValue{":d": {S: stringPtr("d1")}},
+			Limit:                     &limit,
+		})
+		assert.Error(t, err)
+	})
+
+	t.Run("start key in another partition", func(t *testing.T) {
+		_, err := s.Query(&types.QueryRequest{
+			TableName:                 "events",
+			KeyConditionExpression:    "device = :d",
+			ExpressionAttributeValues: map[string]*expression.AttributeValue{":d": {S: stringPtr("d1")}},
+			ExclusiveStartKey: map[string]*expression.AttributeValue{
+				"device": {S: stringPtr("d2")},
+				"event":  {S: stringPtr("boot")},
+			},
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestBBoltStorage_Query_PageSizeLimit(t *testing.T) {
+	f, err := ioutil.TempFile("", "bbolt.db")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := bbolt.NewBBoltStorage(f.Name())
+	require.NoError(t, err)
+
+	_, err = s.CreateTable(&types.CreateTableRequest{
+		TableName: "blobs",
+		AttributeDefinitions: []*types.AttributeDefinition{
+			{AttributeName: "pk", AttributeType: "S"},
+			{AttributeName: "sk", AttributeType: "N"},
+		},
+		KeySchema: []*types.KeySchemaElement{
+			{AttributeName: "pk", KeyType: "HASH"},
+			{AttributeName: "sk", KeyType: "RANGE"},
+		},
+	})
+	require.NoError(t, err)
+
+	// Each item is a little over 400 KB, so a 1 MB page holds three of them.
+	payload := strings.Repeat("x", 400*1024)
+	for i := 0; i < 5; i++ {
+		_, err = s.Put(&types.PutRequest{
+			TableName: "blobs",
+			Item: map[string]*expression.AttributeValue{
+				"pk":      {S: stringPtr("p")},
+				"sk":      {N: stringPtr(fmt.Sprint(i))},
+				"payload": {S: stringPtr(payload)},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	req := &types.QueryRequest{
+		TableName:                 "blobs",
+		KeyConditionExpression:    "pk = :pk",
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{":pk": {S: stringPtr("p")}},
+	}
+
+	resp, err := s.Query(req)
+	require.NoError(t, err)
+	assert.Equal(t, 3, resp.Count)
+	assert.Equal(t, 3, resp.ScannedCount)
+	require.NotNil(t, resp.LastEvaluatedKey)
+	assert.Equal(t, "2", *resp.LastEvaluatedKey["sk"].N)
+
+	req.ExclusiveStartKey = resp.LastEvaluatedKey
+	resp, err = s.Query(req)
+	require.NoError(t, err)
+	assert.Equal(t, 2, resp.Count)
+	assert.Nil(t, resp.LastEvaluatedKey)
+}
+
+func TestBBoltStorage_FilterExpression(t *testing.T) {
+	f, err := ioutil.TempFile("", "bbolt.db")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := bbolt.NewBBoltStorage(f.Name())
+	require.NoError(t, err)
+
+	_, err = s.CreateTable(&types.CreateTableRequest{
+		TableName: "orders",
+		AttributeDefinitions: []*types.AttributeDefinition{
+			{AttributeName: "customer", AttributeType: "S"},
+			{AttributeName: "order", AttributeType: "N"},
+		},
+		KeySchema: []*types.KeySchemaElement{
+			{AttributeName: "customer", KeyType: "HASH"},
+			{AttributeName: "order", KeyType: "RANGE"},
+		},
+	})
+	require.NoError(t, err)
+
+	for i := 1; i <= 6; i++ {
+		item := map[string]*expression.AttributeValue{
+			"customer": {S: stringPtr("c1")},
+			"order":    {N: stringPtr(fmt.Sprint(i))},
+			"total":    {N: stringPtr(fmt.Sprint(i * 10))},
+		}
+		if i%2 == 0 {
+			item["shipped"] = &expression.AttributeValue{BOOL: boolPtr(true)}
+		}
+		_, err = s.Put(&types.PutRequest{TableName: "orders", Item: item})
+		require.NoError(t, err)
+	}
+
+	orders := func(items []map[string]*expression.AttributeValue) []string {
+		var got []string
+		for _, item := range items {
+			got = append(got, *item["order"].N)
+		}
+		return got
+	}
+
+	t.Run("query", func(t *testing.T) {
+		resp, err := s.Query(&types.QueryRequest{
+			TableName:              "orders",
+			KeyConditionExpression: "customer = :c AND order > :o",
+			FilterExpression:       "attribute_exists(shipped) AND total >= :min",
+			ExpressionAttributeValues: map[string]*expression.AttributeValue{
+				":c":   {S: stringPtr("c1")},
+				":o":   {N: stringPtr("1")},
+				":min": {N: stringPtr("30")},
+			},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"4", "6"}, orders(resp.Items))
+		assert.Equal(t, 2, resp.Count)
+		assert.Equal(t, 5, resp.ScannedCount)
+	})
+
+	t.Run("query limit counts scanned items", func(t *testing.T) {
+		limit := 3
+		resp, err := s.Query(&types.QueryRequest{
+			TableName:              "orders",
+			KeyConditionExpression: "customer = :c",
+			FilterExpression:       "shipped = :t",
+			ExpressionAttributeValues: map[string]*expression.AttributeValue{
+				":c": {S: stringPtr("c1")},
+				":t": {BOOL: boolPtr(true)},
+			},
+			Limit: &limit,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"2"}, orders(resp.Items))
+		assert.Equal(t, 1, resp.Count)
+		assert.Equal(t, 3, resp.ScannedCount)
+		require.NotNil(t, resp.LastEvaluatedKey)
+		assert.Equal(t, "3", *resp.LastEvaluatedKey["order"].N)
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		resp, err := s.Scan(&types.ScanRequest{
+			TableName:        "orders",
+			FilterExpression: "attribute_not_exists(shipped) OR total IN (:a, :b)",
+			ExpressionAttributeValues: map[string]*expression.AttributeValue{
+				":a": {N: stringPtr("20")},
+				":b": {N: stringPtr("60")},
+			},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1", "2", "3", "5", "6"}, orders(resp.Items))
+		assert.Equal(t, 5, resp.Count)
+		assert.Equal(t, 6, resp.ScannedCount)
+	})
+
+	t.Run("scan pages through filtered items", func(t *testing.T) {
+		limit := 4
+		req := &types.ScanRequest{
+			TableName:        "orders",
+			Limit:            &limit,
+			FilterExpression: "NOT shipped = :t",
+			ExpressionAttributeValues: map[string]*expression.AttributeValue{
+				":t": {BOOL: boolPtr(true)},
+			},
+		}
+
+		resp, err := s.Scan(req)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1", "3"}, orders(resp.Items))
+		assert.Equal(t, 4, resp.ScannedCount)
+		require.NotNil(t, resp.LastEvaluatedKey)
+
+		req.ExclusiveStartKey = resp.LastEvaluatedKey
+		resp, err = s.Scan(req)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"5"}, orders(resp.Items))
+		assert.Equal(t, 2, resp.ScannedCount)
+		assert.Nil(t, resp.LastEvaluatedKey)
+	})
+
+	t.Run("invalid filter", func(t *testing.T) {
+		_, err := s.Scan(&types.ScanRequest{TableName: "orders", FilterExpression: "total >"})
+		assert.Error(t, err)
+
+		_, err = s.Query(&types.QueryRequest{
+			TableName:                 "orders",
+			KeyConditionExpression:    "customer = :c",
+			FilterExpression:          "total = :missing",
+			ExpressionAttributeValues: map[string]*expression.AttributeValue{":c": {S: stringPtr("c1")}},
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestBBoltStorage_ProjectionExpression(t *testing.T) {
+	f, err := ioutil.TempFile("", "bbolt.db")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := bbolt.NewBBoltStorage(f.Name())
+	require.NoError(t, err)
+
+	_, err = s.CreateTable(&types.CreateTableRequest{
+		TableName: "orders",
+		AttributeDefinitions: []*types.AttributeDefinition{
+			{AttributeName: "customer", AttributeType: "S"},
+			{AttributeName: "order", AttributeType: "N"},
+		},
+		KeySchema: []*types.KeySchemaElement{
+			{AttributeName: "customer", KeyType: "HASH"},
+			{AttributeName: "order", KeyType: "RANGE"},
+		},
+	})
+	require.NoError(t, err)
+
+	for i := 1; i <= 3; i++ {
+		_, err = s.Put(&types.PutRequest{TableName: "orders", Item: map[string]*expression.AttributeValue{
+			"customer": {S: stringPtr("c1")},
+			"order":    {N: stringPtr(fmt.Sprint(i))},
+			"total":    {N: stringPtr(fmt.Sprint(i * 10))},
+			"shipping": {M: map[string]*expression.AttributeValue{
+				"city":    {S: stringPtr("Zagreb")},
+				"street":  {S: stringPtr("Ilica")},
+				"courier": {S: stringPtr("post")},
+			}},
+		}})
+		require.NoError(t, err)
+	}
+
+	names := map[string]string{"#s": "shipping"}
+	expected := map[string]*expression.AttributeValue{
+		"total": {N: stringPtr("10")},
+		"shipping": {M: map[string]*expression.AttributeValue{
+			"city": {S: stringPtr("Zagreb")},
+		}},
+	}
+
+	t.Run("get", func(t *testing.T) {
+		item, err := s.Get(&types.GetRequest{
+			TableName: "orders",
+			Key: map[string]*expression.AttributeValue{
+				"customer": {S: stringPtr("c1")},
+				"order":    {N: stringPtr("1")},
+			},
+			ProjectionExpression:     "total, #s.city",
+			ExpressionAttributeNames: names,
+		})
+		require.NoError(t, err)
+		assert.Equal(t, expected, item)
+	})
+
+	t.Run("query", func(t *testing.T) {
+		limit := 1
+		resp, err := s.Query(&types.QueryRequest{
+			TableName:                 "orders",
+			KeyConditionExpression:    "customer = :c",
+			ProjectionExpression:      "total, #s.city",
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: map[string]*expression.AttributeValue{":c": {S: stringPtr("c1")}},
+			Limit:                     &limit,
+		})
+		require.NoError(t, err)
+		require.Len(t, resp.Items, 1)
+		assert.Equal(t, expected, resp.Items[0])
+		// The page still resumes from the full primary key.
+		assert.Equal(t, "1", *resp.LastEvaluatedKey["order"].N)
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		resp, err := s.Scan(&types.ScanRequest{
+			TableName:                 "orders",
+			FilterExpression:          "#s.courier = :post",
+			ProjectionExpression:      "#o",
+			ExpressionAttributeNames:  map[string]string{"#s": "shipping", "#o": "order"},
+			ExpressionAttributeValues: map[string]*expression.AttributeValue{":post": {S: stringPtr("post")}},
+		})
+		require.NoError(t, err)
+		require.Len(t, resp.Items, 3)
+		for _, item := range resp.Items {
+			assert.Len(t, item, 1)
+			assert.NotNil(t, item["order"])
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, err := s.Scan(&types.ScanRequest{TableName: "orders", ProjectionExpression: "shipping, shipping.city"})
+		assert.Error(t, err)
+	})
+}
+
+func TestBBoltStorage_ExpressionAttributeNames(t *testing.T) {
+	f, err := ioutil.TempFile("", "bbolt.db")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := bbolt.NewBBoltStorage(f.Name())
+	require.NoError(t, err)
+
+	// Name, Timestamp and Status are DynamoDB reserved words.
+	_, err = s.CreateTable(&types.CreateTableRequest{
+		TableName: "audit",
+		AttributeDefinitions: []*types.AttributeDefinition{
+			{AttributeName: "Name", AttributeType: "S"},
+			{AttributeName: "Timestamp", AttributeType: "N"},
+		},
+		KeySchema: []*types.KeySchemaElement{
+			{AttributeName: "Name", KeyType: "HASH"},
+			{AttributeName: "Timestamp", KeyType: "RANGE"},
+		},
+	})
+	require.NoError(t, err)
+
+	names := map[string]string{"#n": "Name", "#ts": "Timestamp", "#s": "Status"}
+	for _, ts := range []string{"1", "2", "3"} {
+		_, err = s.Put(&types.PutRequest{
+			TableName: "audit",
+			Item: map[string]*expression.AttributeValue{
+				"Name":      {S: stringPtr("job")},
+				"Timestamp": {N: stringPtr(ts)},
+				"Status":    {S: stringPtr("pending")},
+			},
+			ConditionExpression:      "attribute_not_exists(#n)",
+			ExpressionAttributeNames: names,
+		})
+		require.NoError(t, err)
+	}
+
+	_, err = s.Update(&types.UpdateRequest{
+		TableName: "audit",
+		Key: map[string]*expression.AttributeValue{
+			"Name":      {S: stringPtr("job")},
+			"Timestamp": {N: stringPtr("2")},
+		},
+		UpdateExpression:         "SET #s = :done",
+		ConditionExpression:      "#s = :pending",
+		ExpressionAttributeNames: names,
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{
+			":done":    {S: stringPtr("done")},
+			":pending": {S: stringPtr("pending")},
+		},
+	})
+	require.NoError(t, err)
+
+	resp, err := s.Query(&types.QueryRequest{
+		TableName:                "audit",
+		KeyConditionExpression:   "#n = :n AND #ts >= :ts",
+		FilterExpression:         "#s = :done",
+		ExpressionAttributeNames: names,
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{
+			":n":    {S: stringPtr("job")},
+			":ts":   {N: stringPtr("2")},
+			":done": {S: stringPtr("done")},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, resp.Items, 1)
+	assert.Equal(t, "2", *resp.Items[0]["Timestamp"].N)
+	assert.Equal(t, 2, resp.ScannedCount)
+
+	scanResp, err := s.Scan(&types.ScanRequest{
+		TableName:                 "audit",
+		FilterExpression:          "#s = :pending",
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{":pending": {S: stringPtr("pending")}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, scanResp.Count)
+
+	_, err = s.Query(&types.QueryRequest{
+		TableName:                 "audit",
+		KeyConditionExpression:    "#missing = :n",
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{":n": {S: stringPtr("job")}},
+	})
+	assert.Error(t, err)
+}
+
+func TestBBoltStorage_KeyOrdering(t *testing.T) {
+	f, err := ioutil.TempFile("", "bbolt.db")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := bbolt.NewBBoltStorage(f.Name())
+	require.NoError(t, err)
+
+	_, err = s.CreateTable(&types.CreateTableRequest{
+		TableName: "numbers",
+		AttributeDefinitions: []*types.AttributeDefinition{
+			{AttributeName: "pk", AttributeType: "S"},
+			{AttributeName: "n", AttributeType: "N"},
+		},
+		KeySchema: []*types.KeySchemaElement{
+			{AttributeName: "pk", KeyType: "HASH"},
+			{AttributeName: "n", KeyType: "RANGE"},
+		},
+	})
+	require.NoError(t, err)
+
+	sorted := []string{
+		"-12345678901234567890123456789",
+		"-100",
+		"-2.5",
+		"-2",
+		"-0.001",
+		"0",
+		"0.001",
+		"0.01",
+		"1",
+		"9",
+		"10",
+		"99.99",
+		"100",
+		"1E+3",
+		"12345678901234567890123456789",
+	}
+	for i := len(sorted) - 1; i >= 0; i-- {
+		_, err = s.Put(&types.PutRequest{
+			TableName: "numbers",
+			Item: map[string]*expression.AttributeValue{
+				"pk": {S: stringPtr("p")},
+				"n":  {N: stringPtr(sorted[i])},
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	resp, err := s.Query(&types.QueryRequest{
+		TableName:              "numbers",
+		KeyConditionExpression: "pk = :pk",
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{
+			":pk": {S: stringPtr("p")},
+		},
+	})
+	require.NoError(t, err)
+	items := resp.Items
+
+	var got []string
+	for _, item := range items {
+		got = append(got, *item["n"].N)
 	}
+	assert.Equal(t, sorted, got)
+
+	// Equal numbers written differently address the same item.
+	item, err := s.Get(&types.GetRequest{
+		TableName: "numbers",
+		Key: map[string]*expression.AttributeValue{
+			"pk": {S: stringPtr("p")},
+			"n":  {N: stringPtr("1.000")},
+		},
+	})
+	require.NoError(t, err)
+	require.NotNil(t, item)
+	assert.Equal(t, "1", *item["n"].N)
+
+	_, err = s.Put(&types.PutRequest{
+		TableName: "numbers",
+		Item: map[string]*expression.AttributeValue{
+			"pk": {S: stringPtr("p")},
+			"n":  {N: stringPtr("123456789012345678901234567890123456789")},
+		},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "38 digits")
+}
+
+func TestBBoltStorage_StringAndBinaryKeys(t *testing.T) {
+	f, err := ioutil.TempFile("", "bbolt.db")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := bbolt.NewBBoltStorage(f.Name())
+	require.NoError(t, err)
 
-	createReq := &types.CreateTableRequest{
-		TableName: "query-test-table",
+	_, err = s.CreateTable(&types.CreateTableRequest{
+		TableName: "strings",
 		AttributeDefinitions: []*types.AttributeDefinition{
-			{AttributeName: "id", AttributeType: "S"},
-			{AttributeName: "name", AttributeType: "S"},
+			{AttributeName: "pk", AttributeType: "S"},
+			{AttributeName: "sk", AttributeType: "S"},
 		},
 		KeySchema: []*types.KeySchemaElement{
-			{AttributeName: "id", KeyType: "HASH"},
+			{AttributeName: "pk", KeyType: "HASH"},
+			{AttributeName: "sk", KeyType: "RANGE"},
 		},
-	}
+	})
+	require.NoError(t, err)
 
-	_, err = s.CreateTable(createReq)
-	if err != nil {
-		t.Fatal(err)
+	// These keys collided when hash and range keys were joined with "|".
+	for _, key := range [][2]string{{"a|b", "c"}, {"a", "b|c"}} {
+		_, err = s.Put(&types.PutRequest{
+			TableName: "strings",
+			Item: map[string]*expression.AttributeValue{
+				"pk": {S: stringPtr(key[0])},
+				"sk": {S: stringPtr(key[1])},
+			},
+		})
+		require.NoError(t, err)
 	}
+	scanResp, err := s.Scan(&types.ScanRequest{TableName: "strings"})
+	require.NoError(t, err)
+	assert.Len(t, scanResp.Items, 2)
 
-	putReq1 := &types.PutRequest{
-		TableName: "query-test-table",
-		Item: map[string]*expression.AttributeValue{
-			"id":   {S: stringPtr("123")},
-			"name": {S: stringPtr("test-name-1")},
+	resp, err := s.Query(&types.QueryRequest{
+		TableName:              "strings",
+		KeyConditionExpression: "pk = :pk",
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{
+			":pk": {S: stringPtr("a")},
 		},
-	}
+	})
+	require.NoError(t, err)
+	items := resp.Items
+	require.Len(t, items, 1)
+	assert.Equal(t, "b|c", *items[0]["sk"].S)
 
-	if err := s.Put(putReq1); err != nil {
-		t.Fatal(err)
+	_, err = s.CreateTable(&types.CreateTableRequest{
+		TableName: "blobs",
+		AttributeDefinitions: []*types.AttributeDefinition{
+			{AttributeName: "pk", AttributeType: "B"},
+			{AttributeName: "sk", AttributeType: "B"},
+		},
+		KeySchema: []*types.KeySchemaElement{
+			{AttributeName: "pk", KeyType: "HASH"},
+			{AttributeName: "sk", KeyType: "RANGE"},
+		},
+	})
+	require.NoError(t, err)
+
+	for _, sk := range [][]byte{{0x02}, {0x00, 0x01}, {0x00}, {0x01, 0xFF}} {
+		_, err = s.Put(&types.PutRequest{
+			TableName: "blobs",
+			Item: map[string]*expression.AttributeValue{
+				"pk": {B: []byte{0x00, 0x7F}},
+				"sk": {B: sk},
+			},
+		})
+		require.NoError(t, err)
 	}
 
-	queryReq := &types.QueryRequest{
-		TableName:              "query-test-table",
-		KeyConditionExpression: "id = :id",
+	resp, err = s.Query(&types.QueryRequest{
+		TableName:              "blobs",
+		KeyConditionExpression: "pk = :pk AND sk < :sk",
 		ExpressionAttributeValues: map[string]*expression.AttributeValue{
-			":id": {S: stringPtr("123")},
+			":pk": {B: []byte{0x00, 0x7F}},
+			":sk": {B: []byte{0x02}},
 		},
-	}
-
-	items, err := s.Query(queryReq)
-	if err != nil {
-		t.Fatal(err)
-	}
+	})
+	require.NoError(t, err)
+	items = resp.Items
 
-	if len(items) != 1 {
-		t.Fatalf("expected 1 item, got %d", len(items))
+	var got [][]byte
+	for _, item := range items {
+		got = append(got, item["sk"].B)
 	}
+	assert.Equal(t, [][]byte{{0x00}, {0x00, 0x01}, {0x01, 0xFF}}, got)
 }
 
-func TestBBoltStorage_Query_Validation(t *testing.T) {
+func TestBBoltStorage_MigrateKeyFormat(t *testing.T) {
 	f, err := ioutil.TempFile("", "bbolt.db")
-	if err != nil {
-		t.Fatal(err)
-	}
+	require.NoError(t, err)
+	f.Close()
 	defer os.Remove(f.Name())
 
-	s, err := bbolt.NewBBoltStorage(f.Name())
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	createReq := &types.CreateTableRequest{
-		TableName: "test-table",
+	// Write a database the way versions before the binary key encoding did.
+	db, err := bolt.Open(f.Name(), 0600, nil)
+	require.NoError(t, err)
+	tableDef := &types.CreateTableRequest{
+		TableName: "legacy",
 		AttributeDefinitions: []*types.AttributeDefinition{
 			{AttributeName: "id", AttributeType: "S"},
-			{AttributeName: "age", AttributeType: "N"},
+			{AttributeName: "ts", AttributeType: "N"},
 		},
 		KeySchema: []*types.KeySchemaElement{
 			{AttributeName: "id", KeyType: "HASH"},
+			{AttributeName: "ts", KeyType: "RANGE"},
 		},
 	}
-
-	_, err = s.CreateTable(createReq)
-	if err != nil {
-		t.Fatal(err)
+	flagsDef := &types.CreateTableRequest{
+		TableName:            "flags",
+		AttributeDefinitions: []*types.AttributeDefinition{{AttributeName: "id", AttributeType: "S"}},
+		KeySchema:            []*types.KeySchemaElement{{AttributeName: "id", KeyType: "HASH"}},
 	}
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		mb, err := tx.CreateBucket([]byte("_metadata"))
+		if err != nil {
+			return err
+		}
+		def, err := json.Marshal(tableDef)
+		if err != nil {
+			return err
+		}
+		if err := mb.Put([]byte("legacy"), def); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucket([]byte("legacy"))
+		if err != nil {
+			return err
+		}
+		for _, ts := range []string{"10", "9", "100"} {
+			item, err := json.Marshal(map[string]*expression.AttributeValue{
+				"id": {S: stringPtr("user")},
+				"ts": {N: stringPtr(ts)},
+			})
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte("user|"+ts), item); err != nil {
+				return err
+			}
+		}
 
-	tests := []struct {
-		name                   string
-		keyConditionExpression string
-		expectedError          string
-	}{
-		{
-			name:                   "Invalid format - missing operator",
-			keyConditionExpression: "id 123",
-			expectedError:          "invalid KeyConditionExpression format: expected 'attributeName = value'",
-		},
-		{
-			name:                   "Invalid format - too many parts",
-			keyConditionExpression: "id = 123 extra",
-			expectedError:          "invalid KeyConditionExpression format: expected 'attributeName = value'",
-		},
-		{
-			name:                   "Attribute name does not match hash key",
-			keyConditionExpression: "age = 30",
-			expectedError:          "KeyConditionExpression must use the hash key 'id', but got 'age'",
-		},
-		{
-			name:                   "Value type mismatch",
-			keyConditionExpression: "id = :id", // id is S, but 123 is N
-			expectedError:          "invalid type for hash key 'id': expected S, got N",
+		// Version 1 also took BOOL and NULL keys, which the current
+		// encoding cannot represent.
+		def, err = json.Marshal(flagsDef)
+		if err != nil {
+			return err
+		}
+		if err := mb.Put([]byte("flags"), def); err != nil {
+			return err
+		}
+		b, err = tx.CreateBucket([]byte("flags"))
+		if err != nil {
+			return err
+		}
+		item, err := json.Marshal(map[string]*expression.AttributeValue{"id": {BOOL: boolPtr(true)}})
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("true"), item)
+	}))
+	require.NoError(t, db.Close())
+
+	s, err := bbolt.NewBBoltStorage(f.Name())
+	require.NoError(t, err)
+
+	migration := s.KeyMigration()
+	assert.Equal(t, map[string]int{"legacy": 3}, migration.Migrated)
+	require.Contains(t, migration.Unmigrated, "flags")
+	_, err = s.Scan(&types.ScanRequest{TableName: "flags"})
+	assert.ErrorContains(t, err, "must be deleted")
+	_, err = s.DescribeTable(&types.DescribeTableRequest{TableName: "flags"})
+	assert.NoError(t, err)
+
+	item, err := s.Get(&types.GetRequest{
+		TableName: "legacy",
+		Key: map[string]*expression.AttributeValue{
+			"id": {S: stringPtr("user")},
+			"ts": {N: stringPtr("9")},
 		},
-		{
-			name:                   "Valid expression",
-			keyConditionExpression: "id = :id", // id is S, and "123" is S
-			expectedError:          "",
+	})
+	require.NoError(t, err)
+	require.NotNil(t, item)
+
+	resp, err := s.Query(&types.QueryRequest{
+		TableName:              "legacy",
+		KeyConditionExpression: "id = :id AND ts > :ts",
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{
+			":id": {S: stringPtr("user")},
+			":ts": {N: stringPtr("9")},
 		},
+	})
+	require.NoError(t, err)
+	items := resp.Items
+
+	var got []string
+	for _, item := range items {
+		got = append(got, *item["ts"].N)
 	}
+	assert.Equal(t, []string{"10", "100"}, got)
 
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			queryReq := &types.QueryRequest{
-				TableName:              "test-table",
-				KeyConditionExpression: tt.keyConditionExpression,
-				ExpressionAttributeValues: map[string]*expression.AttributeValue{
-					":id": {N: stringPtr("123")},
-				},
-			}
-			if tt.name == "Valid expression" {
-				queryReq.ExpressionAttributeValues = map[string]*expression.AttributeValue{
-					":id": {S: stringPtr("123")},
-				}
-			}
+	tables, err := s.ListTables(&types.ListTablesRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"flags", "legacy"}, tables.TableNames)
 
-			_, err := s.Query(queryReq)
-			if tt.expectedError == "" {
-				if err != nil {
-					t.Fatalf("expected no error, got %v", err)
-				}
-			} else {
-				if err == nil || !strings.Contains(err.Error(), tt.expectedError) {
-					t.Fatalf("expected error containing '%s', got %v", tt.expectedError, err)
-				}
-			}
-		})
-	}
+	// The unmigrated table is still reported after reopening, until it is
+	// deleted and can be created again.
+	require.NoError(t, s.Close())
+	s, err = bbolt.NewBBoltStorage(f.Name())
+	require.NoError(t, err)
+	defer s.Close()
+	assert.Empty(t, s.KeyMigration().Migrated)
+	assert.Contains(t, s.KeyMigration().Unmigrated, "flags")
+	_, err = s.DeleteTable(&types.DeleteTableRequest{TableName: "flags"})
+	require.NoError(t, err)
+	_, err = s.CreateTable(flagsDef)
+	require.NoError(t, err)
+	_, err = s.Scan(&types.ScanRequest{TableName: "flags"})
+	assert.NoError(t, err)
 }
 
 func TestDeleteTable(t *testing.T) {
@@ -644,7 +2866,7 @@ func TestBBoltStorage_Scan(t *testing.T) {
 			TableName: "scan-test-table",
 			Item:      item,
 		}
-		if err := s.Put(putReq); err != nil {
+		if _, err := s.Put(putReq); err != nil {
 			t.Fatal(err)
 		}
 	}
@@ -677,11 +2899,15 @@ func TestBBoltStorage_Scan(t *testing.T) {
 
 	// Test scanning a non-existent table
 	scanReq.TableName = "non-existent-table"
-	resp, err = s.Scan(scanReq)
-	assert.NoError(t, err)
-	assert.Empty(t, resp.Items, "Expected empty slice for non-existent table scan")
-	assert.Equal(t, 0, resp.ScannedCount, "Expected ScannedCount to be 0 for non-existent table scan")
-	assert.Nil(t, resp.LastEvaluatedKey, "Expected LastEvaluatedKey to be nil for non-existent table scan")
+	_, err = s.Scan(scanReq)
+	assert.ErrorIs(t, err, storage.ErrResourceNotFound)
+
+	// A limit must be positive.
+	scanReq.TableName = "scan-test-table"
+	zero := 0
+	scanReq.Limit = &zero
+	_, err = s.Scan(scanReq)
+	assert.ErrorIs(t, err, storage.ErrValidation)
 
 	// Test paginated scan
 	scanReq.TableName = "scan-test-table"
@@ -717,6 +2943,349 @@ func TestBBoltStorage_Scan(t *testing.T) {
 	assert.Equal(t, len(itemsToPut), foundCount, "Not all put items were found in paginated scan results")
 }
 
+func TestBBoltStorage_ItemVersions(t *testing.T) {
+	f, err := ioutil.TempFile("", "bbolt.db")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := bbolt.NewBBoltStorage(f.Name())
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, err = s.CreateTable(&types.CreateTableRequest{
+		TableName: "versions",
+		AttributeDefinitions: []*types.AttributeDefinition{
+			{AttributeName: "id", AttributeType: "S"},
+			{AttributeName: "owner", AttributeType: "S"},
+		},
+		KeySchema: []*types.KeySchemaElement{{AttributeName: "id", KeyType: "HASH"}},
+		GlobalSecondaryIndexes: []*types.GlobalSecondaryIndex{{
+			IndexName:  "byOwner",
+			KeySchema:  []*types.KeySchemaElement{{AttributeName: "owner", KeyType: "HASH"}},
+			Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+		}},
+	})
+	require.NoError(t, err)
+
+	key := func(id string) map[string]*expression.AttributeValue {
+		return map[string]*expression.AttributeValue{"id": {S: stringPtr(id)}}
+	}
+	versions := func(ids ...string) []*types.ItemVersion {
+		req := &types.GetItemVersionsRequest{TableName: "versions"}
+		for _, id := range ids {
+			req.Keys = append(req.Keys, key(id))
+		}
+		resp, err := s.GetItemVersions(req)
+		require.NoError(t, err)
+		require.Len(t, resp.Items, len(ids))
+		return resp.Items
+	}
+
+	// Writes without a version count up from the last one.
+	item := map[string]*expression.AttributeValue{"id": {S: stringPtr("a")}, "owner": {S: stringPtr("alice")}}
+	_, err = s.Put(&types.PutRequest{TableName: "versions", Item: item})
+	require.NoError(t, err)
+	_, err = s.Update(&types.UpdateRequest{TableName: "versions", Key: key("a"), UpdateExpression: "SET n = :n", ExpressionAttributeValues: map[string]*expression.AttributeValue{":n": {N: stringPtr("1")}}})
+	require.NoError(t, err)
+	got := versions("a", "missing")
+	assert.Equal(t, int64(2), got[0].Version)
+	assert.Equal(t, "1", *got[0].Item["n"].N)
+	assert.Equal(t, &types.ItemVersion{}, got[1])
+
+	// A write given a version records it, as do the writes of batches and
+	// transactions.
+	_, err = s.Put(&types.PutRequest{TableName: "versions", Item: item, Version: 100})
+	require.NoError(t, err)
+	assert.Equal(t, int64(100), versions("a")[0].Version)
+	_, err = s.BatchWriteItem(&types.BatchWriteItemRequest{RequestItems: map[string][]*types.WriteRequest{
+		"versions": {{PutRequest: &types.BatchPutRequest{Item: item}}},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(101), versions("a")[0].Version)
+	_, err = s.TransactWriteItems(&types.TransactWriteItemsRequest{TransactItems: []*types.TransactWriteItem{
+		{Put: &types.PutRequest{TableName: "versions", Item: item, Version: 200}},
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, int64(200), versions("a")[0].Version)
+
+	// A deleted item keeps its version.
+	_, err = s.Delete(&types.DeleteRequest{TableName: "versions", Key: key("a"), Version: 300})
+	require.NoError(t, err)
+	assert.Equal(t, &types.ItemVersion{Version: 300}, versions("a")[0])
+
+	// Writes reaching the node out of order leave it with the newest: an
+	// older write is dropped, as is the delete it would undo.
+	newer := map[string]*expression.AttributeValue{"id": {S: stringPtr("a")}, "owner": {S: stringPtr("bob")}}
+	_, err = s.Put(&types.PutRequest{TableName: "versions", Item: newer, Version: 500})
+	require.NoError(t, err)
+	_, err = s.Put(&types.PutRequest{TableName: "versions", Item: item, Version: 400})
+	require.NoError(t, err)
+	_, err = s.Update(&types.UpdateRequest{TableName: "versions", Key: key("a"), UpdateExpression: "SET n = :n", ExpressionAttributeValues: map[string]*expression.AttributeValue{":n": {N: stringPtr("2")}}, Version: 450})
+	require.NoError(t, err)
+	_, err = s.Delete(&types.DeleteRequest{TableName: "versions", Key: key("a"), Version: 500})
+	require.NoError(t, err)
+	assert.Equal(t, &types.ItemVersion{Item: newer, Version: 500}, versions("a")[0])
+
+	// Keys are checked against the table's key schema.
+	_, err = s.GetItemVersions(&types.GetItemVersionsRequest{TableName: "versions", Keys: []map[string]*expression.AttributeValue{{"owner": {S: stringPtr("alice")}}}})
+	assert.ErrorIs(t, err, storage.ErrValidation)
+
+	// Consistent reads of a global index are refused, as in DynamoDB.
+	_, err = s.Query(&types.QueryRequest{
+		TableName:                 "versions",
+		IndexName:                 "byOwner",
+		KeyConditionExpression:    "owner = :o",
+		ExpressionAttributeValues: map[string]*expression.AttributeValue{":o": {S: stringPtr("alice")}},
+		ConsistentRead:            true,
+	})
+	assert.ErrorIs(t, err, storage.ErrValidation)
+	_, err = s.Scan(&types.ScanRequest{TableName: "versions", IndexName: "byOwner", ConsistentRead: true})
+	assert.ErrorIs(t, err, storage.ErrValidation)
+
+	// Versions go with their table.
+	_, err = s.DeleteTable(&types.DeleteTableRequest{TableName: "versions"})
+	require.NoError(t, err)
+	_, err = s.CreateTable(&types.CreateTableRequest{
+		TableName:            "versions",
+		AttributeDefinitions: []*types.AttributeDefinition{{AttributeName: "id", AttributeType: "S"}},
+		KeySchema:            []*types.KeySchemaElement{{AttributeName: "id", KeyType: "HASH"}},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, &types.ItemVersion{}, versions("a")[0])
+}
+
+func TestBBoltStorage_ImportItems(t *testing.T) {
+	f, err := ioutil.TempFile("", "bbolt.db")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := bbolt.NewBBoltStorage(f.Name())
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, err = s.CreateTable(&types.CreateTableRequest{
+		TableName: "imports",
+		AttributeDefinitions: []*types.AttributeDefinition{
+			{AttributeName: "id", AttributeType: "S"},
+			{AttributeName: "owner", AttributeType: "S"},
+		},
+		KeySchema: []*types.KeySchemaElement{{AttributeName: "id", KeyType: "HASH"}},
+		GlobalSecondaryIndexes: []*types.GlobalSecondaryIndex{{
+			IndexName:  "byOwner",
+			KeySchema:  []*types.KeySchemaElement{{AttributeName: "owner", KeyType: "HASH"}},
+			Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+		}},
+		StreamSpecification: &types.StreamSpecification{StreamEnabled: true, StreamViewType: types.StreamViewTypeKeysOnly},
+	})
+	require.NoError(t, err)
+
+	key := func(id string) map[string]*expression.AttributeValue {
+		return map[string]*expression.AttributeValue{"id": {S: stringPtr(id)}}
+	}
+	owned := func(id, owner string) map[string]*expression.AttributeValue {
+		return map[string]*expression.AttributeValue{"id": {S: stringPtr(id)}, "owner": {S: stringPtr(owner)}}
+	}
+	importItem := func(id string, item map[string]*expression.AttributeValue, version int64) int {
+		resp, err := s.ImportItems(&types.ImportItemsRequest{
+			TableName: "imports",
+			Keys:      []map[string]*expression.AttributeValue{key(id)},
+			Items:     []*types.ItemVersion{{Item: item, Version: version}},
+		})
+		require.NoError(t, err)
+		return resp.ImportedCount
+	}
+	ownedBy := func(owner string) int {
+		resp, err := s.Query(&types.QueryRequest{
+			TableName:                 "imports",
+			IndexName:                 "byOwner",
+			KeyConditionExpression:    "owner = :o",
+			ExpressionAttributeValues: map[string]*expression.AttributeValue{":o": {S: stringPtr(owner)}},
+		})
+		require.NoError(t, err)
+		return resp.Count
+	}
+	version := func(id string) *types.ItemVersion {
+		resp, err := s.GetItemVersions(&types.GetItemVersionsRequest{TableName: "imports", Keys: []map[string]*expression.AttributeValue{key(id)}})
+		require.NoError(t, err)
+		return resp.Items[0]
+	}
+
+	// A copy is stored with its version, and indexed.
+	assert.Equal(t, 1, importItem("a", owned("a", "alice"), 10))
+	assert.Equal(t, &types.ItemVersion{Item: owned("a", "alice"), Version: 10}, version("a"))
+	assert.Equal(t, 1, ownedBy("alice"))
+
+	// An older copy does not replace a newer one, and a newer one does.
+	assert.Equal(t, 0, importItem("a", owned("a", "bob"), 5))
+	assert.Equal(t, 1, ownedBy("alice"))
+	assert.Equal(t, 1, importItem("a", owned("a", "bob"), 20))
+	assert.Equal(t, 0, ownedBy("alice"))
+	assert.Equal(t, 1, ownedBy("bob"))
+
+	// A newer write made on the node is kept.
+	_, err = s.Put(&types.PutRequest{TableName: "imports", Item: owned("a", "carol"), Version: 30})
+	require.NoError(t, err)
+	assert.Equal(t, 0, importItem("a", owned("a", "bob"), 25))
+	assert.Equal(t, 1, ownedBy("carol"))
+
+	// A copy of a deleted item deletes it, and keeps older copies out, even
+	// on a node that never had it.
+	assert.Equal(t, 1, importItem("a", nil, 40))
+	assert.Equal(t, &types.ItemVersion{Version: 40}, version("a"))
+	assert.Equal(t, 0, ownedBy("carol"))
+	assert.Equal(t, 1, importItem("b", nil, 50))
+	assert.Equal(t, 0, importItem("b", owned("b", "alice"), 45))
+	assert.Equal(t, &types.ItemVersion{Version: 50}, version("b"))
+
+	// Copies are checked against their keys.
+	_, err = s.ImportItems(&types.ImportItemsRequest{
+		TableName: "imports",
+		Keys:      []map[string]*expression.AttributeValue{key("c")},
+		Items:     []*types.ItemVersion{{Item: owned("d", "alice"), Version: 1}},
+	})
+	assert.ErrorIs(t, err, storage.ErrValidation)
+	_, err = s.ImportItems(&types.ImportItemsRequest{TableName: "imports", Keys: []map[string]*expression.AttributeValue{key("c")}})
+	assert.ErrorIs(t, err, storage.ErrValidation)
+
+	// Only the Put made on the node is in its stream.
+	listed, err := s.ListStreams(&types.ListStreamsRequest{TableName: "imports"})
+	require.NoError(t, err)
+	require.Len(t, listed.Streams, 1)
+	described, err := s.DescribeStream(&types.DescribeStreamRequest{StreamArn: listed.Streams[0].StreamArn})
+	require.NoError(t, err)
+	records := 0
+	for _, shard := range described.StreamDescription.Shards {
+		iterator, err := s.GetShardIterator(&types.GetShardIteratorRequest{
+			StreamArn:         listed.Streams[0].StreamArn,
+			ShardId:           shard.ShardId,
+			ShardIteratorType: types.ShardIteratorTypeTrimHorizon,
+		})
+		require.NoError(t, err)
+		resp, err := s.GetRecords(&types.GetRecordsRequest{ShardIterator: iterator.ShardIterator})
+		require.NoError(t, err)
+		records += len(resp.Records)
+	}
+	assert.Equal(t, 1, records)
+}
+
+func TestBBoltStorage_ScanItemVersions(t *testing.T) {
+	f, err := ioutil.TempFile("", "bbolt.db")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := bbolt.NewBBoltStorage(f.Name())
+	require.NoError(t, err)
+	defer s.Close()
+
+	_, err = s.CreateTable(&types.CreateTableRequest{
+		TableName: "scans",
+		AttributeDefinitions: []*types.AttributeDefinition{
+			{AttributeName: "n", AttributeType: "N"},
+			{AttributeName: "b", AttributeType: "B"},
+		},
+		KeySchema: []*types.KeySchemaElement{
+			{AttributeName: "n", KeyType: "HASH"},
+			{AttributeName: "b", KeyType: "RANGE"},
+		},
+	})
+	require.NoError(t, err)
+
+	key := func(n string, b []byte) map[string]*expression.AttributeValue {
+		return map[string]*expression.AttributeValue{"n": {N: stringPtr(n)}, "b": {B: b}}
+	}
+	for _, n := range []string{"-1.5", "0", "120", "3e-5"} {
+		_, err := s.Put(&types.PutRequest{TableName: "scans", Item: key(n, []byte{0x00, 0x01})})
+		require.NoError(t, err)
+	}
+	_, err = s.Delete(&types.DeleteRequest{TableName: "scans", Key: key("120", []byte{0x00, 0x01}), Version: 50})
+	require.NoError(t, err)
+
+	// Pages run in key order, with the deleted item as a version without a
+	// copy, and with keys that read back the same items.
+	var keys []map[string]*expression.AttributeValue
+	var items []*types.ItemVersion
+	req := &types.ScanItemVersionsRequest{TableName: "scans", Limit: 3}
+	for {
+		resp, err := s.ScanItemVersions(req)
+		require.NoError(t, err)
+		require.Len(t, resp.Items, len(resp.Keys))
+		keys = append(keys, resp.Keys...)
+		items = append(items, resp.Items...)
+		if resp.LastEvaluatedKey == nil {
+			break
+		}
+		req.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+	require.Len(t, items, 4)
+	for i, n := range []string{"-1.5", "0", "3e-5", "120"} {
+		if n == "120" {
+			assert.Equal(t, &types.ItemVersion{Version: 50}, items[i])
+			continue
+		}
+		assert.Equal(t, key(n, []byte{0x00, 0x01}), items[i].Item)
+		assert.Equal(t, int64(1), items[i].Version)
+	}
+	got, err := s.GetItemVersions(&types.GetItemVersionsRequest{TableName: "scans", Keys: keys})
+	require.NoError(t, err)
+	assert.Equal(t, items, got.Items)
+}
+
+func TestBBoltStorage_Errors(t *testing.T) {
+	f, err := ioutil.TempFile("", "bbolt.db")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	s, err := bbolt.NewBBoltStorage(f.Name())
+	require.NoError(t, err)
+	defer s.Close()
+
+	createReq := &types.CreateTableRequest{
+		TableName:            "errors",
+		AttributeDefinitions: []*types.AttributeDefinition{{AttributeName: "id", AttributeType: "S"}},
+		KeySchema:            []*types.KeySchemaElement{{AttributeName: "id", KeyType: "HASH"}},
+	}
+	_, err = s.CreateTable(createReq)
+	require.NoError(t, err)
+
+	_, err = s.CreateTable(createReq)
+	assert.ErrorIs(t, err, storage.ErrResourceInUse)
+	assert.Equal(t, "ResourceInUseException", storage.ExceptionName(err))
+
+	_, err = s.DescribeTable(&types.DescribeTableRequest{TableName: "missing"})
+	assert.ErrorIs(t, err, storage.ErrResourceNotFound)
+	_, err = s.Get(&types.GetRequest{TableName: "missing", Key: map[string]*expression.AttributeValue{"id": {S: stringPtr("1")}}})
+	assert.ErrorIs(t, err, storage.ErrResourceNotFound)
+
+	_, err = s.Put(&types.PutRequest{TableName: "errors", Item: map[string]*expression.AttributeValue{"id": {N: stringPtr("1")}}})
+	assert.ErrorIs(t, err, storage.ErrValidation)
+	_, err = s.Query(&types.QueryRequest{TableName: "errors", KeyConditionExpression: "id >"})
+	assert.ErrorIs(t, err, storage.ErrValidation)
+	_, err = s.Update(&types.UpdateRequest{
+		TableName:        "errors",
+		Key:              map[string]*expression.AttributeValue{"id": {S: stringPtr("1")}},
+		UpdateExpression: "SET",
+	})
+	assert.ErrorIs(t, err, storage.ErrValidation)
+	assert.Equal(t, "ValidationException", storage.ExceptionName(err))
+
+	_, err = s.Put(&types.PutRequest{
+		TableName:           "errors",
+		Item:                map[string]*expression.AttributeValue{"id": {S: stringPtr("1")}},
+		ConditionExpression: "attribute_exists(id)",
+	})
+	assert.Equal(t, "ConditionalCheckFailedException", storage.ExceptionName(err))
+
+	// Errors reported by a node are restored from the exception name.
+	err = storage.ExceptionError("ResourceNotFoundException", "table not found: missing")
+	assert.ErrorIs(t, err, storage.ErrResourceNotFound)
+	assert.Nil(t, storage.ExceptionError("InternalServerError", "failed"))
+	assert.Equal(t, "", storage.ExceptionName(fmt.Errorf("failed")))
+}
+
 func stringPtr(s string) *string {
 	return &s
 }
+
+func boolPtr(b bool) *bool {
+	return &b
+}
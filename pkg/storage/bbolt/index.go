@@ -0,0 +1,309 @@
+package bbolt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+	"zagreb/pkg/expression"
+	"zagreb/pkg/storage"
+	"zagreb/pkg/types"
+)
+
+// Each secondary index, global or local, is kept in a bucket of its own and
+// written in the same transaction as its table. An index entry is keyed by
+// the encoded index key followed by the item's primary key, so that entries
+// sharing an index key stay distinct and are ordered by primary key, and
+// holds the item reduced to the index projection. A local secondary index
+// shares the table's hash key, so its entries are grouped by partition and
+// ordered by the alternate range key. Items missing an index key attribute
+// are not indexed.
+
+// indexBucketPrefix cannot begin a table name, as table names never contain 0x00.
+const indexBucketPrefix = "_index\x00"
+
+// secondaryIndex is a global or local secondary index. Both kinds are
+// stored and read the same way, but only local ones allow consistent reads.
+type secondaryIndex struct {
+	name       string
+	keySchema  []*types.KeySchemaElement
+	projection *types.Projection
+	global     bool
+}
+
+func globalIndex(gsi *types.GlobalSecondaryIndex) *secondaryIndex {
+	return &secondaryIndex{name: gsi.IndexName, keySchema: gsi.KeySchema, projection: gsi.Projection, global: true}
+}
+
+func localIndex(lsi *types.LocalSecondaryIndex) *secondaryIndex {
+	return &secondaryIndex{name: lsi.IndexName, keySchema: lsi.KeySchema, projection: lsi.Projection}
+}
+
+// secondaryIndexes returns every index of a table.
+func secondaryIndexes(tableDef *types.CreateTableRequest) []*secondaryIndex {
+	var indexes []*secondaryIndex
+	for _, gsi := range tableDef.GlobalSecondaryIndexes {
+		indexes = append(indexes, globalIndex(gsi))
+	}
+	for _, lsi := range tableDef.LocalSecondaryIndexes {
+		indexes = append(indexes, localIndex(lsi))
+	}
+	return indexes
+}
+
+// indexBucketName returns the name of the bucket holding an index.
+func indexBucketName(tableName, indexName string) []byte {
+	return []byte(indexBucketPrefix + tableName + "\x00" + indexName)
+}
+
+// findIndex returns the named index of a table.
+func findIndex(tableDef *types.CreateTableRequest, indexName string) (*secondaryIndex, error) {
+	for _, idx := range secondaryIndexes(tableDef) {
+		if idx.name == indexName {
+			return idx, nil
+		}
+	}
+	return nil, storage.NewValidationError("the table %s does not have the specified index: %s", tableDef.TableName, indexName)
+}
+
+// indexKeyDef returns a table definition whose key schema is that of the
+// index, so that the key encoding and key conditions of tables apply to it.
+func indexKeyDef(tableDef *types.CreateTableRequest, idx *secondaryIndex) *types.CreateTableRequest {
+	return &types.CreateTableRequest{
+		TableName:            tableDef.TableName,
+		KeySchema:            idx.keySchema,
+		AttributeDefinitions: tableDef.AttributeDefinitions,
+	}
+}
+
+// validateGlobalSecondaryIndex checks an index definition against the table
+// it is added to.
+func validateGlobalSecondaryIndex(tableDef *types.CreateTableRequest, gsi *types.GlobalSecondaryIndex) error {
+	return validateIndex(tableDef, globalIndex(gsi))
+}
+
+// validateLocalSecondaryIndex checks a local index definition against its
+// table. The index must share the table's hash key and, like the table, have
+// a range key.
+func validateLocalSecondaryIndex(tableDef *types.CreateTableRequest, lsi *types.LocalSecondaryIndex) error {
+	var hashKeyName string
+	hasRangeKey := false
+	for _, ks := range tableDef.KeySchema {
+		switch ks.KeyType {
+		case "HASH":
+			hashKeyName = ks.AttributeName
+		case "RANGE":
+			hasRangeKey = true
+		}
+	}
+	if !hasRangeKey {
+		return storage.NewValidationError("local secondary index %s requires the table to have a range key", lsi.IndexName)
+	}
+	if len(lsi.KeySchema) != 2 {
+		return storage.NewValidationError("local secondary index %s must have a hash key and a range key", lsi.IndexName)
+	}
+	if lsi.KeySchema[0].AttributeName != hashKeyName {
+		return storage.NewValidationError("local secondary index %s must have the same hash key as the table", lsi.IndexName)
+	}
+	return validateIndex(tableDef, localIndex(lsi))
+}
+
+func validateIndex(tableDef *types.CreateTableRequest, idx *secondaryIndex) error {
+	if idx.name == "" {
+		return storage.NewValidationError("secondary index requires an IndexName")
+	}
+	if _, err := findIndex(tableDef, idx.name); err == nil {
+		return storage.NewValidationError("secondary index %s already exists", idx.name)
+	}
+
+	if len(idx.keySchema) == 0 || len(idx.keySchema) > 2 {
+		return storage.NewValidationError("secondary index %s must have a hash key and at most one range key", idx.name)
+	}
+	for i, ks := range idx.keySchema {
+		want := "HASH"
+		if i == 1 {
+			want = "RANGE"
+		}
+		if ks.KeyType != want {
+			return storage.NewValidationError("secondary index %s: key %s must be of type %s, got %s", idx.name, ks.AttributeName, want, ks.KeyType)
+		}
+		keyType, ok := attributeType(tableDef, ks.AttributeName)
+		if !ok {
+			return storage.NewValidationError("secondary index %s: key attribute %s is not defined in AttributeDefinitions", idx.name, ks.AttributeName)
+		}
+		if keyType != "S" && keyType != "N" && keyType != "B" {
+			return storage.NewValidationError("secondary index %s: key attribute %s must be of type S, N or B, got %s", idx.name, ks.AttributeName, keyType)
+		}
+	}
+
+	if idx.projection == nil {
+		return storage.NewValidationError("secondary index %s requires a Projection", idx.name)
+	}
+	switch idx.projection.ProjectionType {
+	case types.ProjectionTypeAll, types.ProjectionTypeKeysOnly:
+		if len(idx.projection.NonKeyAttributes) > 0 {
+			return storage.NewValidationError("secondary index %s: NonKeyAttributes can only be used with projection type %s", idx.name, types.ProjectionTypeInclude)
+		}
+	case types.ProjectionTypeInclude:
+		if len(idx.projection.NonKeyAttributes) == 0 {
+			return storage.NewValidationError("secondary index %s: projection type %s requires NonKeyAttributes", idx.name, types.ProjectionTypeInclude)
+		}
+	default:
+		return storage.NewValidationError("secondary index %s: invalid projection type %q", idx.name, idx.projection.ProjectionType)
+	}
+
+	return nil
+}
+
+// indexEntryKey returns the key of an item's entry in an index, or nil if the
+// item lacks an index key attribute and so is not indexed.
+func (s *BBoltStorage) indexEntryKey(tableDef *types.CreateTableRequest, idx *secondaryIndex, primaryKey []byte, item map[string]*expression.AttributeValue) ([]byte, error) {
+	if item == nil {
+		return nil, nil
+	}
+	for _, ks := range idx.keySchema {
+		if _, ok := item[ks.AttributeName]; !ok {
+			return nil, nil
+		}
+	}
+
+	indexKey, err := s.encodeKey(indexKeyDef(tableDef, idx), item)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key for index %s: %w", idx.name, err)
+	}
+	return append(indexKey, primaryKey...), nil
+}
+
+// projectIndexItem reduces an item to the attributes copied into an index.
+func projectIndexItem(tableDef *types.CreateTableRequest, idx *secondaryIndex, item map[string]*expression.AttributeValue) map[string]*expression.AttributeValue {
+	if idx.projection.ProjectionType == types.ProjectionTypeAll {
+		return item
+	}
+
+	projected := make(map[string]*expression.AttributeValue)
+	for _, ks := range tableDef.KeySchema {
+		projected[ks.AttributeName] = item[ks.AttributeName]
+	}
+	for _, ks := range idx.keySchema {
+		projected[ks.AttributeName] = item[ks.AttributeName]
+	}
+	for _, name := range idx.projection.NonKeyAttributes {
+		if v, ok := item[name]; ok {
+			projected[name] = v
+		}
+	}
+	return projected
+}
+
+// updateIndexes replaces the index entries of the item stored under
+// primaryKey, moving from before to after within tx. Either may be nil, for
+// an item that is created or deleted. A new item whose index key has the wrong
+// type is rejected.
+func (s *BBoltStorage) updateIndexes(tx *bolt.Tx, tableDef *types.CreateTableRequest, primaryKey []byte, before, after map[string]*expression.AttributeValue) error {
+	for _, idx := range secondaryIndexes(tableDef) {
+		ib := tx.Bucket(indexBucketName(tableDef.TableName, idx.name))
+		if ib == nil {
+			return fmt.Errorf("bucket not found for index %s", idx.name)
+		}
+
+		newKey, err := s.indexEntryKey(tableDef, idx, primaryKey, after)
+		if err != nil {
+			return err
+		}
+
+		// The old item may predate the index and not fit its key types, in
+		// which case it was never indexed.
+		if oldKey, err := s.indexEntryKey(tableDef, idx, primaryKey, before); err == nil && oldKey != nil {
+			if err := ib.Delete(oldKey); err != nil {
+				return err
+			}
+		}
+
+		if newKey == nil {
+			continue
+		}
+		val, err := json.Marshal(projectIndexItem(tableDef, idx, after))
+		if err != nil {
+			return err
+		}
+		if err := ib.Put(newKey, val); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildIndex creates the bucket of an index, replacing any left over, and
+// fills it from the items already in the table. Items whose index key has
+// the wrong type are left out of the index, as DynamoDB does when it
+// backfills.
+func (s *BBoltStorage) buildIndex(tx *bolt.Tx, tableDef *types.CreateTableRequest, idx *secondaryIndex) error {
+	name := indexBucketName(tableDef.TableName, idx.name)
+	if err := tx.DeleteBucket(name); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+		return err
+	}
+	ib, err := tx.CreateBucket(name)
+	if err != nil {
+		return err
+	}
+
+	b := tx.Bucket([]byte(tableDef.TableName))
+	if b == nil {
+		return fmt.Errorf("bucket not found: %s", tableDef.TableName)
+	}
+
+	return b.ForEach(func(k, v []byte) error {
+		var item map[string]*expression.AttributeValue
+		if err := json.Unmarshal(v, &item); err != nil {
+			return err
+		}
+		key, err := s.indexEntryKey(tableDef, idx, k, item)
+		if err != nil || key == nil {
+			return nil
+		}
+		val, err := json.Marshal(projectIndexItem(tableDef, idx, item))
+		if err != nil {
+			return err
+		}
+		return ib.Put(key, val)
+	})
+}
+
+// dropIndex deletes the bucket of an index.
+func dropIndex(tx *bolt.Tx, tableName, indexName string) error {
+	if err := tx.DeleteBucket(indexBucketName(tableName, indexName)); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+		return err
+	}
+	return nil
+}
+
+// startKey encodes the ExclusiveStartKey of a paginated Query or Scan. For an
+// index, it holds both the index key and the table's primary key.
+func (s *BBoltStorage) startKey(tableDef *types.CreateTableRequest, idx *secondaryIndex, exclusiveStartKey map[string]*expression.AttributeValue) ([]byte, error) {
+	primaryKey, err := s.encodeKey(tableDef, exclusiveStartKey)
+	if err != nil || idx == nil {
+		return primaryKey, err
+	}
+	key, err := s.indexEntryKey(tableDef, idx, primaryKey, exclusiveStartKey)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, storage.NewValidationError("missing key attribute of index %s", idx.name)
+	}
+	return key, nil
+}
+
+// lastEvaluatedKey returns the LastEvaluatedKey of a page that ends with
+// item: its primary key and, for an index, its index key.
+func (s *BBoltStorage) lastEvaluatedKey(tableDef *types.CreateTableRequest, idx *secondaryIndex, item map[string]*expression.AttributeValue) (map[string]*expression.AttributeValue, error) {
+	key, err := s.extractPrimaryKey(tableDef, item)
+	if err != nil || idx == nil {
+		return key, err
+	}
+	for _, ks := range idx.keySchema {
+		key[ks.AttributeName] = item[ks.AttributeName]
+	}
+	return key, nil
+}
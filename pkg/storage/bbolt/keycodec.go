@@ -0,0 +1,241 @@
+package bbolt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"zagreb/pkg/expression"
+	"zagreb/pkg/storage"
+	"zagreb/pkg/types"
+)
+
+// Primary keys are stored as the encoded hash key followed, for composite
+// keys, by the encoded range key. Every component starts with a type tag and
+// is self-delimiting, so comparing encoded keys byte by byte gives the same
+// order as comparing the values the way DynamoDB does, and the encoding of a
+// hash key is a prefix of exactly the keys in that partition.
+//
+// Strings and binaries are written as their bytes with 0x00 escaped as
+// 0x00 0xFF and terminated by 0x00 0x01. Numbers are normalised to
+// 0.d1d2...dn x 10^exp with d1 != 0 and written as the exponent followed by
+// the digits; negative numbers invert every byte so that larger magnitudes
+// sort first.
+const (
+	keyTagNegative byte = 0x05
+	keyTagZero     byte = 0x06
+	keyTagPositive byte = 0x07
+	keyTagString   byte = 0x10
+	keyTagBinary   byte = 0x11
+
+	keyEscape     byte = 0x00
+	keyEscaped00  byte = 0xFF
+	keyTerminator byte = 0x01
+)
+
+// encodeKey builds the bbolt key for an item or key map. The range key may be
+// absent, in which case the result is the prefix shared by the partition.
+func (s *BBoltStorage) encodeKey(tableDef *types.CreateTableRequest, item map[string]*expression.AttributeValue) ([]byte, error) {
+	var hashKey, rangeKey []byte
+
+	for _, ks := range tableDef.KeySchema {
+		attrVal, ok := item[ks.AttributeName]
+		if !ok {
+			if ks.KeyType == "HASH" {
+				return nil, storage.NewValidationError("missing key attribute %s in item", ks.AttributeName)
+			}
+			// It's okay for a range key to be missing in a query
+			continue
+		}
+
+		if declared, ok := attributeType(tableDef, ks.AttributeName); ok && declared != expression.GetAttributeValueType(attrVal) {
+			return nil, storage.NewValidationError("invalid type for key attribute %s: expected %s, got %s", ks.AttributeName, declared, expression.GetAttributeValueType(attrVal))
+		}
+
+		encoded, err := encodeKeyValue(attrVal)
+		if err != nil {
+			return nil, storage.NewValidationError("invalid value for key attribute %s: %w", ks.AttributeName, err)
+		}
+
+		if ks.KeyType == "HASH" {
+			hashKey = encoded
+		} else if ks.KeyType == "RANGE" {
+			rangeKey = encoded
+		}
+	}
+
+	if hashKey == nil {
+		return nil, storage.NewValidationError("hash key not found in item")
+	}
+
+	return append(hashKey, rangeKey...), nil
+}
+
+// decodeKey reads back the primary key attributes encodeKey wrote, for keys
+// whose item is no longer stored. Numbers come back in the form 0.dddEexp,
+// which encodes to the same key as the number written.
+func decodeKey(tableDef *types.CreateTableRequest, key []byte) (map[string]*expression.AttributeValue, error) {
+	var hashKeyName, rangeKeyName string
+	for _, ks := range tableDef.KeySchema {
+		switch ks.KeyType {
+		case "HASH":
+			hashKeyName = ks.AttributeName
+		case "RANGE":
+			rangeKeyName = ks.AttributeName
+		}
+	}
+
+	attrs := make(map[string]*expression.AttributeValue)
+	rest := key
+	for _, name := range []string{hashKeyName, rangeKeyName} {
+		if name == "" {
+			continue
+		}
+		v, n, err := decodeKeyValue(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %x: %w", key, err)
+		}
+		attrs[name] = v
+		rest = rest[n:]
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("invalid key %x: %d trailing bytes", key, len(rest))
+	}
+	return attrs, nil
+}
+
+// decodeKeyValue decodes the key component at the start of b, returning it
+// and the length of its encoding.
+func decodeKeyValue(b []byte) (*expression.AttributeValue, int, error) {
+	if len(b) == 0 {
+		return nil, 0, errors.New("truncated key")
+	}
+	switch b[0] {
+	case keyTagString, keyTagBinary:
+		val := []byte{}
+		for i := 1; i+1 < len(b); i++ {
+			if b[i] != keyEscape {
+				val = append(val, b[i])
+				continue
+			}
+			switch b[i+1] {
+			case keyEscaped00:
+				val = append(val, keyEscape)
+				i++
+			case keyTerminator:
+				if b[0] == keyTagBinary {
+					return &expression.AttributeValue{B: val}, i + 2, nil
+				}
+				s := string(val)
+				return &expression.AttributeValue{S: &s}, i + 2, nil
+			default:
+				return nil, 0, fmt.Errorf("invalid escape 0x%02x", b[i+1])
+			}
+		}
+		return nil, 0, errors.New("truncated key")
+	case keyTagZero:
+		zero := "0"
+		return &expression.AttributeValue{N: &zero}, 1, nil
+	case keyTagPositive, keyTagNegative:
+		negative := b[0] == keyTagNegative
+		if len(b) < 3 {
+			return nil, 0, errors.New("truncated key")
+		}
+		e := [2]byte{b[1], b[2]}
+		terminator := byte(0x00)
+		if negative {
+			e[0], e[1], terminator = ^e[0], ^e[1], 0xFF
+		}
+		exp := int(binary.BigEndian.Uint16(e[:])) - 0x8000
+		var digits []byte
+		for i := 3; i < len(b); i++ {
+			if b[i] == terminator {
+				n := fmt.Sprintf("0.%sE%d", digits, exp)
+				if negative {
+					n = "-" + n
+				}
+				return &expression.AttributeValue{N: &n}, i + 1, nil
+			}
+			if negative {
+				digits = append(digits, ^b[i])
+			} else {
+				digits = append(digits, b[i])
+			}
+		}
+		return nil, 0, errors.New("truncated key")
+	default:
+		return nil, 0, fmt.Errorf("unknown key tag 0x%02x", b[0])
+	}
+}
+
+// encodeKeyValue encodes a single S, N or B key attribute value.
+func encodeKeyValue(v *expression.AttributeValue) ([]byte, error) {
+	switch expression.GetAttributeValueType(v) {
+	case "S":
+		if *v.S == "" {
+			return nil, storage.NewValidationError("key values must not be empty")
+		}
+		return appendEscaped([]byte{keyTagString}, []byte(*v.S), true), nil
+	case "B":
+		if len(v.B) == 0 {
+			return nil, storage.NewValidationError("key values must not be empty")
+		}
+		return appendEscaped([]byte{keyTagBinary}, v.B, true), nil
+	case "N":
+		return encodeNumber(*v.N)
+	default:
+		return nil, storage.NewValidationError("unsupported attribute type for key: %s", expression.GetAttributeValueType(v))
+	}
+}
+
+// encodeKeyPrefix encodes an S or B value without its terminator, giving the
+// prefix shared by every key component that begins with the value.
+func encodeKeyPrefix(v *expression.AttributeValue) ([]byte, error) {
+	switch expression.GetAttributeValueType(v) {
+	case "S":
+		return appendEscaped([]byte{keyTagString}, []byte(*v.S), false), nil
+	case "B":
+		return appendEscaped([]byte{keyTagBinary}, v.B, false), nil
+	default:
+		return nil, storage.NewValidationError("unsupported attribute type for key prefix: %s", expression.GetAttributeValueType(v))
+	}
+}
+
+func appendEscaped(dst, src []byte, terminate bool) []byte {
+	for _, c := range src {
+		if c == keyEscape {
+			dst = append(dst, keyEscape, keyEscaped00)
+		} else {
+			dst = append(dst, c)
+		}
+	}
+	if terminate {
+		dst = append(dst, keyEscape, keyTerminator)
+	}
+	return dst
+}
+
+func encodeNumber(n string) ([]byte, error) {
+	negative, digits, exp, err := expression.ParseDecimal(n)
+	if err != nil {
+		return nil, err
+	}
+	if digits == "" {
+		return []byte{keyTagZero}, nil
+	}
+
+	buf := make([]byte, 0, 4+len(digits))
+	var e [2]byte
+	binary.BigEndian.PutUint16(e[:], uint16(exp+0x8000))
+	if !negative {
+		buf = append(buf, keyTagPositive, e[0], e[1])
+		buf = append(buf, digits...)
+		return append(buf, 0x00), nil
+	}
+
+	buf = append(buf, keyTagNegative, ^e[0], ^e[1])
+	for i := 0; i < len(digits); i++ {
+		buf = append(buf, ^digits[i])
+	}
+	return append(buf, 0xFF), nil
+}
@@ -0,0 +1,199 @@
+package bbolt
+
+import (
+	"bytes"
+
+	bolt "go.etcd.io/bbolt"
+	"zagreb/pkg/expression"
+	"zagreb/pkg/storage"
+	"zagreb/pkg/types"
+)
+
+// keyConditions is a KeyConditionExpression resolved against a table's key schema.
+type keyConditions struct {
+	hashKeyName string
+	hashValue   *expression.AttributeValue
+	rangeKey    *expression.KeyCondition // nil when the whole partition is selected
+}
+
+// matches reports whether an item satisfies both the hash key and range key conditions.
+func (c *keyConditions) matches(item map[string]*expression.AttributeValue) (bool, error) {
+	hashVal, ok := item[c.hashKeyName]
+	if !ok || expression.GetAttributeValueType(hashVal) != expression.GetAttributeValueType(c.hashValue) {
+		return false, nil
+	}
+	cmp, err := expression.CompareAttributeValues(hashVal, c.hashValue)
+	if err != nil || cmp != 0 {
+		return false, err
+	}
+
+	if c.rangeKey == nil {
+		return true, nil
+	}
+	return c.rangeKey.Matches(item[c.rangeKey.AttributeName])
+}
+
+// keyRange is the span of bbolt keys a query has to visit.
+type keyRange struct {
+	prefix         []byte // every key in the range starts with prefix
+	start          []byte // the key to seek to
+	startExclusive bool
+	end            []byte // the last key in the range, nil when it runs to the end of prefix
+	endExclusive   bool
+}
+
+// contains reports whether k lies within the range.
+func (r *keyRange) contains(k []byte) bool {
+	if !bytes.HasPrefix(k, r.prefix) {
+		return false
+	}
+	if cmp := bytes.Compare(k, r.start); cmp < 0 || (cmp == 0 && r.startExclusive) {
+		return false
+	}
+	if r.end != nil {
+		if cmp := bytes.Compare(k, r.end); cmp > 0 || (cmp == 0 && r.endExclusive) {
+			return false
+		}
+	}
+	return true
+}
+
+// first positions the cursor on the first key of the range when walking it
+// forward, or on the last key when walking it backward. The returned key may
+// lie outside the range, which callers detect with contains.
+func (r *keyRange) first(c *bolt.Cursor, forward bool) ([]byte, []byte) {
+	if forward {
+		k, v := c.Seek(r.start)
+		if k != nil && r.startExclusive && bytes.Equal(k, r.start) {
+			k, v = c.Next()
+		}
+		return k, v
+	}
+
+	upper, upperExclusive := r.end, r.endExclusive
+	if upper == nil {
+		upper, upperExclusive = prefixSuccessor(r.prefix), true
+	}
+	if upper == nil {
+		return c.Last()
+	}
+
+	k, v := c.Seek(upper)
+	if k == nil {
+		return c.Last()
+	}
+	if cmp := bytes.Compare(k, upper); cmp > 0 || (cmp == 0 && upperExclusive) {
+		return c.Prev()
+	}
+	return k, v
+}
+
+// next advances the cursor in the walking direction.
+func (r *keyRange) next(c *bolt.Cursor, forward bool) ([]byte, []byte) {
+	if forward {
+		return c.Next()
+	}
+	return c.Prev()
+}
+
+// resumeAfter narrows the range to the keys that follow startKey in the
+// walking direction, so that a paginated query continues where it left off.
+func (r *keyRange) resumeAfter(startKey []byte, forward bool) error {
+	if !bytes.HasPrefix(startKey, r.prefix) {
+		return storage.NewValidationError("invalid ExclusiveStartKey: it is outside the range of the key condition")
+	}
+
+	if forward {
+		if bytes.Compare(startKey, r.start) >= 0 {
+			r.start, r.startExclusive = startKey, true
+		}
+		return nil
+	}
+
+	if r.end == nil || bytes.Compare(startKey, r.end) <= 0 {
+		r.end, r.endExclusive = startKey, true
+	}
+	return nil
+}
+
+// widen adjusts the bounds of a range over index entries, whose keys carry
+// the item's primary key after the index key, so that a bound on the index
+// key takes in or leaves out every entry sharing it.
+func (r *keyRange) widen() {
+	if r.startExclusive {
+		if succ := prefixSuccessor(r.start); succ != nil {
+			r.start, r.startExclusive = succ, false
+		}
+	}
+	if r.end != nil && !r.endExclusive {
+		r.end, r.endExclusive = prefixSuccessor(r.end), true
+	}
+}
+
+// prefixSuccessor returns the smallest key greater than every key starting
+// with prefix, or nil if there is none.
+func prefixSuccessor(prefix []byte) []byte {
+	succ := append([]byte(nil), prefix...)
+	for i := len(succ) - 1; i >= 0; i-- {
+		if succ[i] != 0xFF {
+			succ[i]++
+			return succ[:i+1]
+		}
+	}
+	return nil
+}
+
+// queryKeyRange converts key conditions into the cursor range that holds every matching item.
+func (s *BBoltStorage) queryKeyRange(tableDef *types.CreateTableRequest, conds *keyConditions) (*keyRange, error) {
+	partition, err := s.encodeKey(tableDef, map[string]*expression.AttributeValue{
+		conds.hashKeyName: conds.hashValue,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	kr := &keyRange{prefix: partition, start: partition}
+	if conds.rangeKey == nil {
+		return kr, nil
+	}
+
+	bound := func(v *expression.AttributeValue) ([]byte, error) {
+		encoded, err := encodeKeyValue(v)
+		if err != nil {
+			return nil, err
+		}
+		return append(append([]byte{}, partition...), encoded...), nil
+	}
+
+	values := conds.rangeKey.Values
+	switch conds.rangeKey.Operator {
+	case expression.KeyConditionEqual:
+		kr.start, err = bound(values[0])
+		kr.end = kr.start
+	case expression.KeyConditionLess:
+		kr.end, err = bound(values[0])
+		kr.endExclusive = true
+	case expression.KeyConditionLessEqual:
+		kr.end, err = bound(values[0])
+	case expression.KeyConditionGreater:
+		kr.start, err = bound(values[0])
+		kr.startExclusive = true
+	case expression.KeyConditionGreaterEqual:
+		kr.start, err = bound(values[0])
+	case expression.KeyConditionBetween:
+		if kr.start, err = bound(values[0]); err == nil {
+			kr.end, err = bound(values[1])
+		}
+	case expression.KeyConditionBeginsWith:
+		var encoded []byte
+		if encoded, err = encodeKeyPrefix(values[0]); err == nil {
+			kr.prefix = append(append([]byte{}, partition...), encoded...)
+			kr.start = kr.prefix
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return kr, nil
+}
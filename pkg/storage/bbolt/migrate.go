@@ -0,0 +1,184 @@
+package bbolt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	bolt "go.etcd.io/bbolt"
+	"zagreb/pkg/expression"
+	"zagreb/pkg/types"
+)
+
+const (
+	systemBucket = "_system"
+	keyFormatKey = "keyFormat"
+
+	// unmigratedBucket, inside the system bucket, holds the tables whose
+	// keys the current encoding cannot represent, with the reason.
+	unmigratedBucket = "unmigrated"
+
+	// keyFormatVersion is the primary key encoding described in keycodec.go.
+	// Version 1, which has no marker in the database, joined the string forms
+	// of the hash and range keys with "|".
+	keyFormatVersion = 2
+)
+
+// KeyMigration reports what opening a database did to the tables written
+// with an older primary key encoding.
+type KeyMigration struct {
+	// Migrated is the number of items re-keyed, by table.
+	Migrated map[string]int
+	// Unmigrated holds the tables left with their old keys, which the
+	// current encoding cannot represent, with the reason. Requests for such
+	// a table fail until it is deleted.
+	Unmigrated map[string]error
+}
+
+// errUnencodableKey is wrapped by the errors of a table holding an item
+// whose key the current encoding cannot represent, such as a BOOL or NULL
+// key, which version 1 accepted.
+var errUnencodableKey = errors.New("key cannot be encoded")
+
+// KeyMigration returns what opening the database migrated, and the tables
+// left unmigrated as it was opened, then or by an earlier open.
+func (s *BBoltStorage) KeyMigration() KeyMigration {
+	return s.keyMigration
+}
+
+// migrateKeyFormat re-keys every table written with an older primary key
+// encoding and records the current version, so it only does work the first
+// time an old database is opened. A table whose keys cannot be re-keyed is
+// left as it is and recorded as unmigrated, so that the rest of the
+// database can still be opened.
+func (s *BBoltStorage) migrateKeyFormat(tx *bolt.Tx) error {
+	sb, err := tx.CreateBucketIfNotExists([]byte(systemBucket))
+	if err != nil {
+		return err
+	}
+	ub, err := sb.CreateBucketIfNotExists([]byte(unmigratedBucket))
+	if err != nil {
+		return err
+	}
+	s.keyMigration = KeyMigration{Migrated: make(map[string]int), Unmigrated: make(map[string]error)}
+	if err := ub.ForEach(func(k, v []byte) error {
+		s.keyMigration.Unmigrated[string(k)] = errors.New(string(v))
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if current := sb.Get([]byte(keyFormatKey)); current != nil {
+		version, err := strconv.Atoi(string(current))
+		if err != nil {
+			return fmt.Errorf("invalid key format version %q: %w", current, err)
+		}
+		if version > keyFormatVersion {
+			return fmt.Errorf("database uses key format %d, but this version only supports up to %d", version, keyFormatVersion)
+		}
+		if version == keyFormatVersion {
+			return nil
+		}
+	}
+
+	var tableNames []string
+	mb := tx.Bucket([]byte(metadataBucket))
+	if err := mb.ForEach(func(k, v []byte) error {
+		tableNames = append(tableNames, string(k))
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, tableName := range tableNames {
+		tableDef, err := s.readTableDef(tx, tableName)
+		if err != nil {
+			return err
+		}
+		n, err := s.migrateTable(tx, tableDef)
+		if errors.Is(err, errUnencodableKey) {
+			if err := ub.Put([]byte(tableName), []byte(err.Error())); err != nil {
+				return err
+			}
+			s.keyMigration.Unmigrated[tableName] = err
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to migrate table %s: %w", tableName, err)
+		}
+		s.keyMigration.Migrated[tableName] = n
+	}
+
+	return sb.Put([]byte(keyFormatKey), []byte(strconv.Itoa(keyFormatVersion)))
+}
+
+// migrateTable rebuilds a table bucket, deriving each key from the stored
+// item, and returns the number of items re-keyed. The bucket is left as it
+// is if any key cannot be encoded.
+func (s *BBoltStorage) migrateTable(tx *bolt.Tx, tableDef *types.CreateTableRequest) (int, error) {
+	b := tx.Bucket([]byte(tableDef.TableName))
+	if b == nil {
+		return 0, nil
+	}
+
+	type entry struct {
+		key, val []byte
+	}
+	var entries []entry
+
+	err := b.ForEach(func(k, v []byte) error {
+		var item map[string]*expression.AttributeValue
+		if err := json.Unmarshal(v, &item); err != nil {
+			return err
+		}
+		key, err := s.encodeKey(tableDef, item)
+		if err != nil {
+			return fmt.Errorf("%w: item %q: %w", errUnencodableKey, k, err)
+		}
+		entries = append(entries, entry{key: key, val: append([]byte(nil), v...)})
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := tx.DeleteBucket([]byte(tableDef.TableName)); err != nil {
+		return 0, err
+	}
+	nb, err := tx.CreateBucket([]byte(tableDef.TableName))
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range entries {
+		if err := nb.Put(e.key, e.val); err != nil {
+			return 0, err
+		}
+	}
+	return len(entries), nil
+}
+
+// checkMigrated returns an error for a table that was left unmigrated.
+func checkMigrated(tx *bolt.Tx, tableName string) error {
+	sb := tx.Bucket([]byte(systemBucket))
+	if sb == nil {
+		return nil
+	}
+	ub := sb.Bucket([]byte(unmigratedBucket))
+	if ub == nil {
+		return nil
+	}
+	if reason := ub.Get([]byte(tableName)); reason != nil {
+		return fmt.Errorf("table %s could not be migrated to key format %d and must be deleted and created again: %s", tableName, keyFormatVersion, reason)
+	}
+	return nil
+}
+
+// forgetUnmigrated drops the record of a table left unmigrated, once it is
+// deleted.
+func forgetUnmigrated(tx *bolt.Tx, tableName string) error {
+	if ub := tx.Bucket([]byte(systemBucket)).Bucket([]byte(unmigratedBucket)); ub != nil {
+		return ub.Delete([]byte(tableName))
+	}
+	return nil
+}
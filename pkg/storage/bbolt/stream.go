@@ -0,0 +1,522 @@
+package bbolt
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"zagreb/pkg/expression"
+	"zagreb/pkg/storage"
+	"zagreb/pkg/types"
+)
+
+// The stream of a table is kept in a bucket of its own and written in the
+// same transaction as each change to the table's items, so that it holds
+// exactly the committed changes, in commit order. Records are keyed by their
+// big-endian sequence number. A stream has a single shard. Disabling the
+// stream closes the shard, which stays readable until its records are
+// trimmed; enabling it again starts a new stream, with a new label, and
+// drops the records of the old one.
+
+// streamBucketPrefix cannot begin a table name, as table names never contain 0x00.
+const streamBucketPrefix = "_stream\x00"
+
+const (
+	// streamRetention is how long stream records are kept, as in DynamoDB.
+	streamRetention = 24 * time.Hour
+
+	// maxListStreams is the default and largest Limit of ListStreams.
+	maxListStreams = 100
+)
+
+// ttlIdentity is the identity recorded for items deleted by time to live.
+var ttlIdentity = &types.Identity{PrincipalId: "dynamodb.amazonaws.com", Type: "Service"}
+
+// streamBucketName returns the name of the bucket holding a table's stream.
+func streamBucketName(tableName string) []byte {
+	return []byte(streamBucketPrefix + tableName)
+}
+
+// streamEnabled reports whether changes to a table are being recorded.
+func streamEnabled(tableDef *types.CreateTableRequest) bool {
+	spec := tableDef.StreamSpecification
+	return spec != nil && spec.StreamEnabled
+}
+
+// streamCreated returns the time encoded in a stream label.
+func streamCreated(label string) time.Time {
+	t, _ := time.Parse(storage.StreamLabelFormat, label)
+	return t
+}
+
+// shardID returns the ID of the single shard of a stream.
+func shardID(label string) string {
+	return fmt.Sprintf("shardId-%020d", streamCreated(label).UnixMilli())
+}
+
+func sequenceKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// formatSequenceNumber pads sequence numbers so that they also sort as strings.
+func formatSequenceNumber(seq uint64) string {
+	return fmt.Sprintf("%021d", seq)
+}
+
+func parseSequenceNumber(s string) (uint64, error) {
+	seq, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, storage.NewValidationError("invalid sequence number %q", s)
+	}
+	return seq, nil
+}
+
+func validateStreamSpecification(spec *types.StreamSpecification) error {
+	if !spec.StreamEnabled {
+		if spec.StreamViewType != "" {
+			return storage.NewValidationError("StreamViewType cannot be specified when StreamEnabled is false")
+		}
+		return nil
+	}
+	switch spec.StreamViewType {
+	case types.StreamViewTypeKeysOnly, types.StreamViewTypeNewImage, types.StreamViewTypeOldImage, types.StreamViewTypeNewAndOldImages:
+		return nil
+	default:
+		return storage.NewValidationError("invalid StreamViewType %q", spec.StreamViewType)
+	}
+}
+
+// updateStream enables or disables the stream of a table within tx. A new
+// stream is given label, if set, or else a label made from now. The caller
+// stores the updated table definition.
+func updateStream(tx *bolt.Tx, tableDef *types.CreateTableRequest, spec *types.StreamSpecification, label string, now time.Time) error {
+	if err := validateStreamSpecification(spec); err != nil {
+		return err
+	}
+
+	if !spec.StreamEnabled {
+		if !streamEnabled(tableDef) {
+			return storage.NewValidationError("table %s does not have an enabled stream", tableDef.TableName)
+		}
+		// The view type is kept to describe the closed stream.
+		tableDef.StreamSpecification.StreamEnabled = false
+		return nil
+	}
+
+	if streamEnabled(tableDef) {
+		return storage.NewValidationError("table %s already has an enabled stream", tableDef.TableName)
+	}
+
+	// Each stream of a table must have its own label.
+	created := now.UTC().Truncate(time.Millisecond)
+	if label != "" {
+		t, err := time.Parse(storage.StreamLabelFormat, label)
+		if err != nil {
+			return storage.NewValidationError("invalid stream label %q", label)
+		}
+		created = t
+	}
+	if prev := tableDef.LatestStreamLabel; prev != "" && !created.After(streamCreated(prev)) {
+		created = streamCreated(prev).Add(time.Millisecond)
+	}
+
+	if err := dropStream(tx, tableDef.TableName); err != nil {
+		return err
+	}
+	if _, err := tx.CreateBucket(streamBucketName(tableDef.TableName)); err != nil {
+		return err
+	}
+
+	tableDef.StreamSpecification = &types.StreamSpecification{StreamEnabled: true, StreamViewType: spec.StreamViewType}
+	tableDef.LatestStreamLabel = created.Format(storage.StreamLabelFormat)
+	return nil
+}
+
+// dropStream deletes the bucket of a table's stream.
+func dropStream(tx *bolt.Tx, tableName string) error {
+	if err := tx.DeleteBucket(streamBucketName(tableName)); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+		return err
+	}
+	return nil
+}
+
+// writeStreamRecord records the change of an item from before to after in
+// the table's stream, if it is enabled. Either may be nil, for an item that
+// is created or deleted. Like DynamoDB, a write that leaves the item as it
+// was is not recorded. identity is only set for deletes by time to live.
+func (s *BBoltStorage) writeStreamRecord(tx *bolt.Tx, tableDef *types.CreateTableRequest, before, after map[string]*expression.AttributeValue, identity *types.Identity) error {
+	if !streamEnabled(tableDef) || (before == nil && after == nil) {
+		return nil
+	}
+
+	eventName := types.StreamEventModify
+	switch {
+	case before == nil:
+		eventName = types.StreamEventInsert
+	case after == nil:
+		eventName = types.StreamEventRemove
+	default:
+		unchanged, err := sameItem(before, after)
+		if err != nil || unchanged {
+			return err
+		}
+	}
+
+	b := tx.Bucket(streamBucketName(tableDef.TableName))
+	if b == nil {
+		return fmt.Errorf("bucket not found for the stream of table %s", tableDef.TableName)
+	}
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	item := after
+	if item == nil {
+		item = before
+	}
+	keys, err := s.extractPrimaryKey(tableDef, item)
+	if err != nil {
+		return err
+	}
+
+	viewType := tableDef.StreamSpecification.StreamViewType
+	record := &types.StreamRecord{
+		ApproximateCreationDateTime: float64(time.Now().Unix()),
+		Keys:                        keys,
+		SequenceNumber:              formatSequenceNumber(seq),
+		StreamViewType:              viewType,
+	}
+	if viewType == types.StreamViewTypeNewImage || viewType == types.StreamViewTypeNewAndOldImages {
+		record.NewImage = after
+	}
+	if viewType == types.StreamViewTypeOldImage || viewType == types.StreamViewTypeNewAndOldImages {
+		record.OldImage = before
+	}
+	size, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	record.SizeBytes = int64(len(size))
+
+	eventID := md5.Sum([]byte(tableDef.TableName + "\x00" + tableDef.LatestStreamLabel + "\x00" + record.SequenceNumber))
+	val, err := json.Marshal(&types.Record{
+		EventID:      hex.EncodeToString(eventID[:]),
+		EventName:    eventName,
+		EventVersion: "1.1",
+		EventSource:  "aws:dynamodb",
+		AwsRegion:    "ddblocal",
+		Dynamodb:     record,
+		UserIdentity: identity,
+	})
+	if err != nil {
+		return err
+	}
+	return b.Put(sequenceKey(seq), val)
+}
+
+// sameItem reports whether two items hold the same attributes. Maps are
+// marshalled with sorted keys, so equal items encode identically.
+func sameItem(a, b map[string]*expression.AttributeValue) (bool, error) {
+	aVal, err := json.Marshal(a)
+	if err != nil {
+		return false, err
+	}
+	bVal, err := json.Marshal(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(aVal, bVal), nil
+}
+
+// TrimStreams deletes the stream records written before the given time and
+// returns how many were deleted. The sweeper calls it periodically to drop
+// the records older than the retention period.
+func (s *BBoltStorage) TrimStreams(before time.Time) (int, error) {
+	trimmed := 0
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var tableNames []string
+		mb := tx.Bucket([]byte(metadataBucket))
+		if err := mb.ForEach(func(k, v []byte) error {
+			tableNames = append(tableNames, string(k))
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, tableName := range tableNames {
+			b := tx.Bucket(streamBucketName(tableName))
+			if b == nil {
+				continue
+			}
+
+			// Records are in the order they were written, so the old ones
+			// come first. They are collected before deleting, as bbolt
+			// cursors must not be used across deletes.
+			var keys [][]byte
+			c := b.Cursor()
+			for k, v := c.First(); k != nil; k, v = c.Next() {
+				var record types.Record
+				if err := json.Unmarshal(v, &record); err != nil {
+					return err
+				}
+				if record.Dynamodb.ApproximateCreationDateTime >= float64(before.Unix()) {
+					break
+				}
+				keys = append(keys, append([]byte(nil), k...))
+			}
+
+			for _, k := range keys {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			trimmed += len(keys)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return trimmed, nil
+}
+
+// ListStreams lists the streams of every table, or of one table, in ARN
+// order.
+func (s *BBoltStorage) ListStreams(req *types.ListStreamsRequest) (*types.ListStreamsResponse, error) {
+	limit := req.Limit
+	if limit == 0 {
+		limit = maxListStreams
+	}
+	if limit < 0 || limit > maxListStreams {
+		return nil, storage.NewValidationError("Limit must be between 1 and %d, got %d", maxListStreams, req.Limit)
+	}
+
+	var streams []*types.StreamSummary
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if req.TableName != "" {
+			if _, err := s.getTableDef(tx, req.TableName); err != nil {
+				return err
+			}
+		}
+
+		mb := tx.Bucket([]byte(metadataBucket))
+		return mb.ForEach(func(k, v []byte) error {
+			var tableDef types.CreateTableRequest
+			if err := json.Unmarshal(v, &tableDef); err != nil {
+				return err
+			}
+			if tableDef.LatestStreamLabel == "" || (req.TableName != "" && req.TableName != tableDef.TableName) {
+				return nil
+			}
+			streams = append(streams, &types.StreamSummary{
+				StreamArn:   storage.StreamArn(tableDef.TableName, tableDef.LatestStreamLabel),
+				StreamLabel: tableDef.LatestStreamLabel,
+				TableName:   tableDef.TableName,
+			})
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Streams are listed in ARN order, so that a page can start after any
+	// ARN, even one held by another node.
+	sort.Slice(streams, func(i, j int) bool { return streams[i].StreamArn < streams[j].StreamArn })
+	if req.ExclusiveStartStreamArn != "" {
+		start := sort.Search(len(streams), func(i int) bool { return streams[i].StreamArn > req.ExclusiveStartStreamArn })
+		streams = streams[start:]
+	}
+
+	resp := &types.ListStreamsResponse{Streams: []*types.StreamSummary{}}
+	if len(streams) > limit {
+		streams = streams[:limit]
+		resp.LastEvaluatedStreamArn = streams[limit-1].StreamArn
+	}
+	resp.Streams = append(resp.Streams, streams...)
+	return resp, nil
+}
+
+// DescribeStream describes a stream and its shard.
+func (s *BBoltStorage) DescribeStream(req *types.DescribeStreamRequest) (*types.DescribeStreamResponse, error) {
+	var desc types.StreamDescription
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		tableDef, b, err := s.lookupStream(tx, req.StreamArn)
+		if err != nil {
+			return err
+		}
+
+		label := tableDef.LatestStreamLabel
+		desc = types.StreamDescription{
+			StreamArn:               req.StreamArn,
+			StreamLabel:             label,
+			StreamStatus:            types.StreamStatusEnabled,
+			StreamViewType:          tableDef.StreamSpecification.StreamViewType,
+			TableName:               tableDef.TableName,
+			KeySchema:               tableDef.KeySchema,
+			CreationRequestDateTime: float64(streamCreated(label).UnixMilli()) / 1000,
+			Shards:                  []*types.Shard{},
+		}
+
+		// The shard starts at its oldest record that has not been trimmed.
+		shard := &types.Shard{ShardId: shardID(label), SequenceNumberRange: &types.SequenceNumberRange{}}
+		if k, _ := b.Cursor().First(); k != nil {
+			shard.SequenceNumberRange.StartingSequenceNumber = formatSequenceNumber(binary.BigEndian.Uint64(k))
+		} else {
+			shard.SequenceNumberRange.StartingSequenceNumber = formatSequenceNumber(b.Sequence() + 1)
+		}
+		if !streamEnabled(tableDef) {
+			desc.StreamStatus = types.StreamStatusDisabled
+			shard.SequenceNumberRange.EndingSequenceNumber = formatSequenceNumber(b.Sequence())
+		}
+
+		if req.ExclusiveStartShardId != shard.ShardId {
+			desc.Shards = append(desc.Shards, shard)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.DescribeStreamResponse{StreamDescription: desc}, nil
+}
+
+// GetShardIterator returns an iterator from which GetRecords reads a shard.
+func (s *BBoltStorage) GetShardIterator(req *types.GetShardIteratorRequest) (*types.GetShardIteratorResponse, error) {
+	var iterator *storage.ShardIterator
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		tableDef, b, err := s.lookupStream(tx, req.StreamArn)
+		if err != nil {
+			return err
+		}
+		if req.ShardId != shardID(tableDef.LatestStreamLabel) {
+			return storage.NewResourceNotFoundError("shard not found: %s", req.ShardId)
+		}
+
+		last := b.Sequence()
+		iterator = &storage.ShardIterator{StreamArn: req.StreamArn, ShardId: req.ShardId}
+		switch req.ShardIteratorType {
+		case types.ShardIteratorTypeTrimHorizon:
+			iterator.SequenceNumber = 0
+		case types.ShardIteratorTypeLatest:
+			iterator.SequenceNumber = last
+		case types.ShardIteratorTypeAtSequenceNumber, types.ShardIteratorTypeAfterSequenceNumber:
+			seq, err := parseSequenceNumber(req.SequenceNumber)
+			if err != nil {
+				return err
+			}
+			if seq == 0 || seq > last {
+				return storage.NewValidationError("sequence number %s is not in shard %s", req.SequenceNumber, req.ShardId)
+			}
+			iterator.SequenceNumber = seq
+			if req.ShardIteratorType == types.ShardIteratorTypeAtSequenceNumber {
+				iterator.SequenceNumber = seq - 1
+			}
+		default:
+			return storage.NewValidationError("invalid ShardIteratorType %q", req.ShardIteratorType)
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.GetShardIteratorResponse{ShardIterator: iterator.String()}, nil
+}
+
+// GetRecords reads the records of a shard from an iterator. A page holds
+// at most Limit records and about 1 MB. The next iterator is omitted once
+// a closed shard has been read to its end.
+func (s *BBoltStorage) GetRecords(req *types.GetRecordsRequest) (*types.GetRecordsResponse, error) {
+	limit := req.Limit
+	if limit == 0 {
+		limit = types.MaxGetRecordsLimit
+	}
+	if limit < 0 || limit > types.MaxGetRecordsLimit {
+		return nil, storage.NewValidationError("Limit must be between 1 and %d, got %d", types.MaxGetRecordsLimit, req.Limit)
+	}
+
+	iterator, err := storage.ParseShardIterator(req.ShardIterator)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &types.GetRecordsResponse{Records: []*types.Record{}}
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		tableDef, b, err := s.lookupStream(tx, iterator.StreamArn)
+		if err != nil {
+			return err
+		}
+		if iterator.ShardId != shardID(tableDef.LatestStreamLabel) {
+			return storage.NewResourceNotFoundError("shard not found: %s", iterator.ShardId)
+		}
+
+		next := iterator.SequenceNumber
+		size := 0
+		c := b.Cursor()
+		for k, v := c.Seek(sequenceKey(next + 1)); k != nil && len(resp.Records) < limit && size < maxPageBytes; k, v = c.Next() {
+			var record types.Record
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			resp.Records = append(resp.Records, &record)
+			next = binary.BigEndian.Uint64(k)
+			size += len(v)
+		}
+
+		if streamEnabled(tableDef) || next < b.Sequence() {
+			resp.NextShardIterator = (&storage.ShardIterator{
+				StreamArn:      iterator.StreamArn,
+				ShardId:        iterator.ShardId,
+				SequenceNumber: next,
+			}).String()
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// lookupStream returns the table whose stream has the given ARN, and the
+// bucket holding the stream.
+func (s *BBoltStorage) lookupStream(tx *bolt.Tx, streamArn string) (*types.CreateTableRequest, *bolt.Bucket, error) {
+	tableName, label, err := storage.ParseStreamArn(streamArn)
+	if err != nil {
+		return nil, nil, err
+	}
+	tableDef, err := s.getTableDef(tx, tableName)
+	if err != nil || tableDef.LatestStreamLabel != label {
+		return nil, nil, storage.NewResourceNotFoundError("stream not found: %s", streamArn)
+	}
+	b := tx.Bucket(streamBucketName(tableName))
+	if b == nil {
+		return nil, nil, storage.NewResourceNotFoundError("stream not found: %s", streamArn)
+	}
+	return tableDef, b, nil
+}
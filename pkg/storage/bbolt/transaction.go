@@ -0,0 +1,422 @@
+package bbolt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+	"zagreb/pkg/expression"
+	"zagreb/pkg/storage"
+	"zagreb/pkg/types"
+)
+
+// preparedBucket, inside the system bucket, holds the prepared transactions
+// by ID, so that their locks outlive a restart of the node.
+const preparedBucket = "prepared"
+
+// errRollback is returned from a bbolt transaction to discard its writes.
+var errRollback = errors.New("rollback")
+
+// preparedTransaction is a node's part of a transaction spanning several
+// nodes, checked and locked but not yet applied. It holds its locks until
+// the router commits or aborts it, which the router does even after failing
+// or restarting, so that a node never drops a part the router may commit.
+type preparedTransaction struct {
+	items    []*types.TransactWriteItem
+	lockKeys []string
+}
+
+// preparedRecord is how a prepared transaction is stored. Lock keys hold
+// encoded primary keys, which are not text.
+type preparedRecord struct {
+	Items    []*types.TransactWriteItem `json:"Items"`
+	LockKeys [][]byte                   `json:"LockKeys"`
+}
+
+// TransactWriteItems applies up to 100 actions atomically in a single bbolt
+// transaction. If any condition fails, or any item is locked by a prepared
+// transaction, nothing is written and a *storage.TransactionCanceledError
+// gives the reason for every item.
+func (s *BBoltStorage) TransactWriteItems(req *types.TransactWriteItemsRequest) (*types.TransactWriteItemsResponse, error) {
+	if err := storage.ValidateTransactWriteItems(req.TransactItems); err != nil {
+		return nil, err
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		_, err := s.transactWrite(tx, req.TransactItems)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.TransactWriteItemsResponse{}, nil
+}
+
+// TransactGetItems reads up to 100 items from a single consistent snapshot.
+// The read is cancelled if any item is locked by a prepared transaction.
+func (s *BBoltStorage) TransactGetItems(req *types.TransactGetItemsRequest) (*types.TransactGetItemsResponse, error) {
+	if err := storage.ValidateTransactGetItems(req.TransactItems); err != nil {
+		return nil, err
+	}
+
+	responses := make([]*types.ItemResponse, len(req.TransactItems))
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		reasons := make([]*types.CancellationReason, len(req.TransactItems))
+		cancelled := false
+		for i, item := range req.TransactItems {
+			lockKey, err := s.itemLockKey(tx, item.Get.TableName, item.Get.Key)
+			if err != nil {
+				return err
+			}
+			reasons[i] = &types.CancellationReason{Code: types.CancellationReasonNone}
+			if s.isLocked(lockKey) {
+				reasons[i] = conflictReason()
+				cancelled = true
+				continue
+			}
+
+			found, err := s.getItem(tx, item.Get)
+			if err != nil {
+				return err
+			}
+			responses[i] = &types.ItemResponse{Item: found}
+		}
+		if cancelled {
+			return &storage.TransactionCanceledError{Reasons: reasons}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.TransactGetItemsResponse{Responses: responses}, nil
+}
+
+// PrepareTransaction checks a node's part of a transaction and locks its
+// items until CommitTransaction or AbortTransaction. The writes are tried and
+// rolled back here, so that commit cannot fail on a condition or a
+// malformed action. If the part cannot be applied, the response gives the
+// cancellation reasons and nothing is locked.
+func (s *BBoltStorage) PrepareTransaction(req *types.PrepareTransactionRequest) (*types.PrepareTransactionResponse, error) {
+	if err := storage.ValidateTransactWriteItems(req.TransactItems); err != nil {
+		return nil, err
+	}
+
+	resp := &types.PrepareTransactionResponse{}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		lockKeys, err := s.transactWrite(tx, req.TransactItems)
+		var cancelled *storage.TransactionCanceledError
+		if errors.As(err, &cancelled) {
+			resp.CancellationReasons = cancelled.Reasons
+			return errRollback
+		}
+		if err != nil {
+			return err
+		}
+
+		// bbolt runs one write transaction at a time, so no other write can
+		// reach the items between the checks above and taking the locks.
+		s.txMu.Lock()
+		defer s.txMu.Unlock()
+		if _, ok := s.prepared[req.TransactionID]; ok {
+			return fmt.Errorf("transaction %s is already prepared", req.TransactionID)
+		}
+		s.hold(req.TransactionID, &preparedTransaction{items: req.TransactItems, lockKeys: lockKeys})
+		return errRollback
+	})
+
+	if err != nil && !errors.Is(err, errRollback) {
+		return nil, err
+	}
+	if len(resp.CancellationReasons) > 0 {
+		return resp, nil
+	}
+
+	// The checked writes were rolled back, and the part is stored on its
+	// own, before the router is told it is prepared.
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		s.txMu.Lock()
+		p := s.prepared[req.TransactionID]
+		s.txMu.Unlock()
+		return putPrepared(tx, req.TransactionID, p)
+	})
+	if err != nil {
+		s.txMu.Lock()
+		s.release(req.TransactionID)
+		s.txMu.Unlock()
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// CommitTransaction applies a prepared transaction and releases its locks.
+// A transaction the node does not hold is reported as not found: it was
+// committed already, as the router only commits transactions every node
+// prepared. A commit that fails leaves the transaction prepared, to be
+// committed again.
+func (s *BBoltStorage) CommitTransaction(req *types.CommitTransactionRequest) error {
+	var p *preparedTransaction
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		// As in PrepareTransaction, no other write can run between releasing
+		// the locks and applying the items.
+		s.txMu.Lock()
+		p = s.prepared[req.TransactionID]
+		s.release(req.TransactionID)
+		s.txMu.Unlock()
+
+		if p == nil {
+			return storage.NewResourceNotFoundError("transaction %s is not prepared", req.TransactionID)
+		}
+		if _, err := s.transactWrite(tx, p.items); err != nil {
+			return err
+		}
+		return deletePrepared(tx, req.TransactionID)
+	})
+	if err != nil && p != nil {
+		s.txMu.Lock()
+		s.hold(req.TransactionID, p)
+		s.txMu.Unlock()
+	}
+	return err
+}
+
+// AbortTransaction drops a prepared transaction and releases its locks.
+// Aborting an unknown transaction is a no-op.
+func (s *BBoltStorage) AbortTransaction(req *types.AbortTransactionRequest) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return deletePrepared(tx, req.TransactionID)
+	})
+	if err != nil {
+		return err
+	}
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	s.release(req.TransactionID)
+	return nil
+}
+
+// putPrepared stores a prepared transaction.
+func putPrepared(tx *bolt.Tx, id string, p *preparedTransaction) error {
+	record := preparedRecord{Items: p.items, LockKeys: make([][]byte, len(p.lockKeys))}
+	for i, lockKey := range p.lockKeys {
+		record.LockKeys[i] = []byte(lockKey)
+	}
+	val, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	pb, err := tx.Bucket([]byte(systemBucket)).CreateBucketIfNotExists([]byte(preparedBucket))
+	if err != nil {
+		return err
+	}
+	return pb.Put([]byte(id), val)
+}
+
+// deletePrepared removes a stored prepared transaction, if there is one.
+func deletePrepared(tx *bolt.Tx, id string) error {
+	pb := tx.Bucket([]byte(systemBucket)).Bucket([]byte(preparedBucket))
+	if pb == nil {
+		return nil
+	}
+	return pb.Delete([]byte(id))
+}
+
+// loadPrepared takes the locks of the transactions that were prepared when
+// the database was last closed.
+func (s *BBoltStorage) loadPrepared(tx *bolt.Tx) error {
+	pb := tx.Bucket([]byte(systemBucket)).Bucket([]byte(preparedBucket))
+	if pb == nil {
+		return nil
+	}
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+	return pb.ForEach(func(k, v []byte) error {
+		var record preparedRecord
+		if err := json.Unmarshal(v, &record); err != nil {
+			return fmt.Errorf("invalid prepared transaction %s: %w", k, err)
+		}
+		p := &preparedTransaction{items: record.Items, lockKeys: make([]string, len(record.LockKeys))}
+		for i, lockKey := range record.LockKeys {
+			p.lockKeys[i] = string(lockKey)
+		}
+		s.hold(string(k), p)
+		return nil
+	})
+}
+
+// transactWrite applies the actions of a transaction within tx and returns
+// the lock keys of their items. It reports a failed condition or a locked
+// item as a *storage.TransactionCanceledError after checking every action,
+// so that the caller can roll tx back with a reason for each item.
+func (s *BBoltStorage) transactWrite(tx *bolt.Tx, items []*types.TransactWriteItem) ([]string, error) {
+	reasons := make([]*types.CancellationReason, len(items))
+	lockKeys := make([]string, 0, len(items))
+	seen := make(map[string]bool)
+	cancelled := false
+
+	for i, item := range items {
+		tableName, key := transactTarget(item)
+		lockKey, err := s.itemLockKey(tx, tableName, key)
+		if err != nil {
+			return nil, err
+		}
+		if seen[lockKey] {
+			return nil, storage.NewValidationError("transaction request cannot include multiple operations on one item")
+		}
+		seen[lockKey] = true
+		lockKeys = append(lockKeys, lockKey)
+
+		switch {
+		case item.ConditionCheck != nil:
+			err = s.conditionCheck(tx, item.ConditionCheck)
+		case item.Put != nil:
+			_, err = s.putItem(tx, item.Put)
+		case item.Update != nil:
+			_, err = s.updateItem(tx, item.Update)
+		case item.Delete != nil:
+			_, err = s.deleteItem(tx, item.Delete)
+		}
+
+		reasons[i] = &types.CancellationReason{Code: types.CancellationReasonNone}
+		switch {
+		case errors.Is(err, storage.ErrConditionalCheckFailed):
+			reasons[i] = &types.CancellationReason{Code: types.CancellationReasonConditionalCheckFailed, Message: "The conditional request failed"}
+			cancelled = true
+		case errors.Is(err, storage.ErrTransactionConflict):
+			reasons[i] = conflictReason()
+			cancelled = true
+		case err != nil:
+			return nil, err
+		}
+	}
+
+	if cancelled {
+		return nil, &storage.TransactionCanceledError{Reasons: reasons}
+	}
+	return lockKeys, nil
+}
+
+// conditionCheck evaluates a ConditionCheck action against the stored item.
+func (s *BBoltStorage) conditionCheck(tx *bolt.Tx, cc *types.ConditionCheck) error {
+	if cc.ConditionExpression == "" {
+		return storage.NewValidationError("ConditionCheck on table %s requires a ConditionExpression", cc.TableName)
+	}
+
+	tableDef, err := s.getTableDef(tx, cc.TableName)
+	if err != nil {
+		return err
+	}
+
+	if err := s.validateGetRequest(tableDef, &types.GetRequest{TableName: cc.TableName, Key: cc.Key}); err != nil {
+		return err
+	}
+
+	b := tx.Bucket([]byte(cc.TableName))
+	if b == nil {
+		return fmt.Errorf("bucket not found: %s", cc.TableName)
+	}
+
+	key, err := s.encodeKey(tableDef, cc.Key)
+	if err != nil {
+		return err
+	}
+
+	if err := s.checkLock(cc.TableName, key); err != nil {
+		return err
+	}
+
+	return checkCondition(b, key, cc.ConditionExpression, cc.ExpressionAttributeNames, cc.ExpressionAttributeValues)
+}
+
+// transactTarget returns the table and the key, or for a Put the whole item,
+// that a transaction action addresses.
+func transactTarget(item *types.TransactWriteItem) (string, map[string]*expression.AttributeValue) {
+	switch {
+	case item.ConditionCheck != nil:
+		return item.ConditionCheck.TableName, item.ConditionCheck.Key
+	case item.Put != nil:
+		return item.Put.TableName, item.Put.Item
+	case item.Update != nil:
+		return item.Update.TableName, item.Update.Key
+	default:
+		return item.Delete.TableName, item.Delete.Key
+	}
+}
+
+// itemLockKey identifies an item across tables for locking.
+func (s *BBoltStorage) itemLockKey(tx *bolt.Tx, tableName string, item map[string]*expression.AttributeValue) (string, error) {
+	tableDef, err := s.getTableDef(tx, tableName)
+	if err != nil {
+		return "", err
+	}
+	key, err := s.encodeKey(tableDef, item)
+	if err != nil {
+		return "", err
+	}
+	return lockKeyFor(tableName, key), nil
+}
+
+func lockKeyFor(tableName string, key []byte) string {
+	return tableName + "\x00" + string(key)
+}
+
+// checkLock returns storage.ErrTransactionConflict if the item is locked by a
+// prepared transaction.
+func (s *BBoltStorage) checkLock(tableName string, key []byte) error {
+	if s.isLocked(lockKeyFor(tableName, key)) {
+		return storage.ErrTransactionConflict
+	}
+	return nil
+}
+
+// isLocked reports whether a prepared transaction holds the lock key.
+func (s *BBoltStorage) isLocked(lockKey string) bool {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	id, ok := s.locks[lockKey]
+	if !ok {
+		return false
+	}
+	p := s.prepared[id]
+	if p == nil {
+		delete(s.locks, lockKey)
+		return false
+	}
+	return true
+}
+
+// hold records a prepared transaction and takes its locks. s.txMu must be
+// held.
+func (s *BBoltStorage) hold(id string, p *preparedTransaction) {
+	s.prepared[id] = p
+	for _, lockKey := range p.lockKeys {
+		s.locks[lockKey] = id
+	}
+}
+
+// release drops a prepared transaction and its locks. s.txMu must be held.
+func (s *BBoltStorage) release(id string) {
+	p, ok := s.prepared[id]
+	if !ok {
+		return
+	}
+	for _, lockKey := range p.lockKeys {
+		if s.locks[lockKey] == id {
+			delete(s.locks, lockKey)
+		}
+	}
+	delete(s.prepared, id)
+}
+
+func conflictReason() *types.CancellationReason {
+	return &types.CancellationReason{Code: types.CancellationReasonTransactionConflict, Message: "Transaction is ongoing for the item"}
+}
@@ -0,0 +1,223 @@
+package bbolt
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"zagreb/pkg/expression"
+	"zagreb/pkg/storage"
+	"zagreb/pkg/types"
+)
+
+// ttlSweepInterval is how often the sweeper deletes expired items.
+const ttlSweepInterval = time.Minute
+
+// UpdateTimeToLive enables or disables expiry for a table. The setting is
+// kept with the table definition.
+func (s *BBoltStorage) UpdateTimeToLive(req *types.UpdateTimeToLiveRequest) (*types.UpdateTimeToLiveResponse, error) {
+	spec := req.TimeToLiveSpecification
+	if spec == nil || spec.AttributeName == "" {
+		return nil, storage.NewValidationError("TimeToLiveSpecification requires an AttributeName")
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		tableDef, err := s.getTableDef(tx, req.TableName)
+		if err != nil {
+			return err
+		}
+
+		current := tableDef.TimeToLiveSpecification
+		if spec.Enabled {
+			if current != nil && current.Enabled {
+				return storage.NewValidationError("TimeToLive is already enabled on table %s", req.TableName)
+			}
+			tableDef.TimeToLiveSpecification = &types.TimeToLiveSpecification{AttributeName: spec.AttributeName, Enabled: true}
+		} else {
+			if current == nil || !current.Enabled {
+				return storage.NewValidationError("TimeToLive is already disabled on table %s", req.TableName)
+			}
+			if current.AttributeName != spec.AttributeName {
+				return storage.NewValidationError("TimeToLive is enabled on attribute %s, not %s", current.AttributeName, spec.AttributeName)
+			}
+			tableDef.TimeToLiveSpecification = nil
+		}
+
+		return putTableDef(tx, tableDef)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.UpdateTimeToLiveResponse{TimeToLiveSpecification: spec}, nil
+}
+
+// DescribeTimeToLive reports whether expiry is enabled for a table, and on
+// which attribute.
+func (s *BBoltStorage) DescribeTimeToLive(req *types.DescribeTimeToLiveRequest) (*types.DescribeTimeToLiveResponse, error) {
+	var tableDef *types.CreateTableRequest
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		tableDef, err = s.getTableDef(tx, req.TableName)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	desc := types.TimeToLiveDescription{TimeToLiveStatus: types.TimeToLiveStatusDisabled}
+	if ttl := tableDef.TimeToLiveSpecification; ttl != nil && ttl.Enabled {
+		desc = types.TimeToLiveDescription{TimeToLiveStatus: types.TimeToLiveStatusEnabled, AttributeName: ttl.AttributeName}
+	}
+	return &types.DescribeTimeToLiveResponse{TimeToLiveDescription: desc}, nil
+}
+
+// DeleteExpiredItems deletes every item whose time to live has passed and
+// returns how many were deleted. The sweeper calls it periodically. Items
+// locked by a prepared transaction are left for a later sweep.
+func (s *BBoltStorage) DeleteExpiredItems() (int, error) {
+	now := time.Now()
+	deleted := 0
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var tableNames []string
+		mb := tx.Bucket([]byte(metadataBucket))
+		if err := mb.ForEach(func(k, v []byte) error {
+			tableNames = append(tableNames, string(k))
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, tableName := range tableNames {
+			if checkMigrated(tx, tableName) != nil {
+				continue
+			}
+			tableDef, err := s.getTableDef(tx, tableName)
+			if err != nil {
+				return err
+			}
+			n, err := s.deleteExpired(tx, tableDef, now)
+			if err != nil {
+				return fmt.Errorf("failed to delete expired items from table %s: %w", tableName, err)
+			}
+			deleted += n
+		}
+		return nil
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return deleted, nil
+}
+
+// deleteExpired deletes the expired items of one table within tx.
+func (s *BBoltStorage) deleteExpired(tx *bolt.Tx, tableDef *types.CreateTableRequest, now time.Time) (int, error) {
+	if ttl := tableDef.TimeToLiveSpecification; ttl == nil || !ttl.Enabled {
+		return 0, nil
+	}
+	b := tx.Bucket([]byte(tableDef.TableName))
+	if b == nil {
+		return 0, nil
+	}
+
+	// bbolt cursors must not be used across deletes, so collect the items first.
+	type expiredItem struct {
+		key  []byte
+		item map[string]*expression.AttributeValue
+	}
+	var items []expiredItem
+	err := b.ForEach(func(k, v []byte) error {
+		var item map[string]*expression.AttributeValue
+		if err := json.Unmarshal(v, &item); err != nil {
+			return err
+		}
+		if expired(tableDef, item, now) {
+			items = append(items, expiredItem{key: append([]byte(nil), k...), item: item})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, e := range items {
+		if s.isLocked(lockKeyFor(tableDef.TableName, e.key)) {
+			continue
+		}
+		if err := s.updateIndexes(tx, tableDef, e.key, e.item, nil); err != nil {
+			return 0, err
+		}
+		if err := s.writeStreamRecord(tx, tableDef, e.item, nil, ttlIdentity); err != nil {
+			return 0, err
+		}
+		// As for any delete, the item's version moves on, so that a replica
+		// yet to delete it is seen to be behind.
+		if err := recordVersion(tx, tableDef.TableName, e.key, 0); err != nil {
+			return 0, err
+		}
+		if err := b.Delete(e.key); err != nil {
+			return 0, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// sweep deletes expired items and trims stream records past their
+// retention every interval until stopSweeper is closed.
+func (s *BBoltStorage) sweep(interval time.Duration) {
+	defer close(s.sweeperDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stopSweeper:
+			return
+		case <-ticker.C:
+			n, err := s.DeleteExpiredItems()
+			if err != nil {
+				log.Printf("failed to delete expired items: %v", err)
+			} else if n > 0 {
+				log.Printf("deleted %d expired items", n)
+			}
+			n, err = s.TrimStreams(time.Now().Add(-streamRetention))
+			if err != nil {
+				log.Printf("failed to trim streams: %v", err)
+			} else if n > 0 {
+				log.Printf("trimmed %d stream records", n)
+			}
+		}
+	}
+}
+
+// expired reports whether the time to live of an item has passed. Like
+// DynamoDB, it ignores a time to live attribute that is not a number, and
+// an item read from an index only expires if the attribute is projected.
+// Reads use it to hide expired items that the sweeper has not yet deleted.
+func expired(tableDef *types.CreateTableRequest, item map[string]*expression.AttributeValue, now time.Time) bool {
+	ttl := tableDef.TimeToLiveSpecification
+	if ttl == nil || !ttl.Enabled || item == nil {
+		return false
+	}
+	v, ok := item[ttl.AttributeName]
+	if !ok || v.N == nil {
+		return false
+	}
+	seconds, err := strconv.ParseFloat(*v.N, 64)
+	if err != nil {
+		return false
+	}
+	return seconds <= float64(now.Unix())
+}
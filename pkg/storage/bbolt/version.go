@@ -0,0 +1,302 @@
+package bbolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"zagreb/pkg/storage"
+	"zagreb/pkg/types"
+)
+
+// Every write to an item records a version for it, so that the router can
+// tell which of the copies of an item held by its replicas is the newest.
+// The versions of a table are kept in a bucket of their own, keyed by the
+// item's encoded primary key and written in the same transaction as the
+// item. A write takes the version the router gave it, or the item's previous
+// version plus one when it has none, as for writes made on the node
+// directly; a write given a version no newer than the item's is dropped. The version of a deleted item is kept, so that a replica that
+// missed the delete is seen to be behind. Copies of items imported from
+// another node keep their versions, and are only stored if newer than what
+// the node has.
+
+// versionBucketPrefix cannot begin a table name, as table names never contain 0x00.
+const versionBucketPrefix = "_version\x00"
+
+// errConsistentGlobalIndex is returned by consistent reads of a global
+// secondary index, which DynamoDB does not support.
+var errConsistentGlobalIndex = storage.NewValidationError("consistent reads are not supported on global secondary indexes")
+
+// versionBucketName returns the name of the bucket holding a table's item
+// versions.
+func versionBucketName(tableName string) []byte {
+	return []byte(versionBucketPrefix + tableName)
+}
+
+// recordVersion records the version of a write to the item under key. The
+// bucket is created by the first write, so that tables created before items
+// had versions get one too.
+func recordVersion(tx *bolt.Tx, tableName string, key []byte, version int64) error {
+	b, err := tx.CreateBucketIfNotExists(versionBucketName(tableName))
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		version = itemVersion(b, key) + 1
+	}
+	val := make([]byte, 8)
+	binary.BigEndian.PutUint64(val, uint64(version))
+	return b.Put(key, val)
+}
+
+// superseded reports whether the node has recorded a write to the item
+// under key at least as recent as version. A write the router stamped with
+// such a version reached the node after a newer one, and is dropped, so that
+// replicas receiving the same writes in different orders end up alike.
+// Writes without a version, made on the node directly, are never superseded.
+func superseded(tx *bolt.Tx, tableName string, key []byte, version int64) bool {
+	if version == 0 {
+		return false
+	}
+	vb := tx.Bucket(versionBucketName(tableName))
+	return vb != nil && vb.Get(key) != nil && itemVersion(vb, key) >= version
+}
+
+// itemVersion returns the version of the item under key, or 0 if it was
+// never written.
+func itemVersion(b *bolt.Bucket, key []byte) int64 {
+	if b == nil {
+		return 0
+	}
+	val := b.Get(key)
+	if len(val) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(val))
+}
+
+// dropVersions deletes the versions of a table's items.
+func dropVersions(tx *bolt.Tx, tableName string) error {
+	if err := tx.DeleteBucket(versionBucketName(tableName)); err != nil && !errors.Is(err, bolt.ErrBucketNotFound) {
+		return err
+	}
+	return nil
+}
+
+// GetItemVersions returns the node's copy of each requested item with its
+// version. An expired item is returned as missing, as Get does.
+func (s *BBoltStorage) GetItemVersions(req *types.GetItemVersionsRequest) (*types.GetItemVersionsResponse, error) {
+	resp := &types.GetItemVersionsResponse{Items: make([]*types.ItemVersion, 0, len(req.Keys))}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		tableDef, err := s.getTableDef(tx, req.TableName)
+		if err != nil {
+			return err
+		}
+
+		b := tx.Bucket([]byte(req.TableName))
+		if b == nil {
+			return fmt.Errorf("bucket not found: %s", req.TableName)
+		}
+		vb := tx.Bucket(versionBucketName(req.TableName))
+		now := time.Now()
+
+		for _, k := range req.Keys {
+			if err := s.validateGetRequest(tableDef, &types.GetRequest{TableName: req.TableName, Key: k}); err != nil {
+				return err
+			}
+			key, err := s.encodeKey(tableDef, k)
+			if err != nil {
+				return err
+			}
+			item, err := loadItem(b, key)
+			if err != nil {
+				return err
+			}
+			if expired(tableDef, item, now) {
+				item = nil
+			}
+			resp.Items = append(resp.Items, &types.ItemVersion{Item: item, Version: itemVersion(vb, key)})
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// ScanItemVersions returns a page of the node's copies of a table's items
+// with their versions, in key order. The items deleted on the node are
+// included, with no copy, for as long as their versions are kept, so that a
+// node taking their partition over learns of the deletes. An expired item is
+// returned as missing, as GetItemVersions does.
+func (s *BBoltStorage) ScanItemVersions(req *types.ScanItemVersionsRequest) (*types.ScanItemVersionsResponse, error) {
+	resp := &types.ScanItemVersionsResponse{
+		Keys:  make([]map[string]*types.AttributeValue, 0),
+		Items: make([]*types.ItemVersion, 0),
+	}
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		tableDef, err := s.getTableDef(tx, req.TableName)
+		if err != nil {
+			return err
+		}
+
+		b := tx.Bucket([]byte(req.TableName))
+		if b == nil {
+			return fmt.Errorf("bucket not found: %s", req.TableName)
+		}
+		vb := tx.Bucket(versionBucketName(req.TableName))
+
+		after := &keyRange{startExclusive: true}
+		if req.ExclusiveStartKey != nil {
+			after.start, err = s.encodeKey(tableDef, req.ExclusiveStartKey)
+			if err != nil {
+				return err
+			}
+		}
+
+		// The keys of the items and of the versions are walked together, as
+		// a deleted item only has a version, and an item written before
+		// versions were recorded only has its copy.
+		items := b.Cursor()
+		k, v := after.first(items, true)
+		var versions *bolt.Cursor
+		var vk []byte
+		if vb != nil {
+			versions = vb.Cursor()
+			vk, _ = after.first(versions, true)
+		}
+		now := time.Now()
+		for k != nil || vk != nil {
+			key := k
+			if k == nil || (vk != nil && bytes.Compare(vk, k) < 0) {
+				key = vk
+			}
+
+			var item map[string]*types.AttributeValue
+			if k != nil && bytes.Equal(key, k) {
+				if err := json.Unmarshal(v, &item); err != nil {
+					return err
+				}
+				k, v = items.Next()
+			}
+			if vk != nil && bytes.Equal(key, vk) {
+				vk, _ = versions.Next()
+			}
+
+			attrs, err := decodeKey(tableDef, key)
+			if err != nil {
+				return err
+			}
+			if expired(tableDef, item, now) {
+				item = nil
+			}
+			resp.Keys = append(resp.Keys, attrs)
+			resp.Items = append(resp.Items, &types.ItemVersion{Item: item, Version: itemVersion(vb, key)})
+
+			if req.Limit > 0 && len(resp.Keys) == req.Limit {
+				resp.LastEvaluatedKey = attrs
+				break
+			}
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// ImportItems stores copies of items read from another node, each unless
+// the node has recorded a write to the item at least as recent. A copy of a
+// deleted item deletes it. Index entries are updated as for a put or a
+// delete, but no stream record is written, as the writes were recorded by
+// the node they were made on.
+func (s *BBoltStorage) ImportItems(req *types.ImportItemsRequest) (*types.ImportItemsResponse, error) {
+	if len(req.Items) != len(req.Keys) {
+		return nil, storage.NewValidationError("got %d items for %d keys", len(req.Items), len(req.Keys))
+	}
+	resp := &types.ImportItemsResponse{}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		tableDef, err := s.getTableDef(tx, req.TableName)
+		if err != nil {
+			return err
+		}
+
+		b := tx.Bucket([]byte(req.TableName))
+		if b == nil {
+			return fmt.Errorf("bucket not found: %s", req.TableName)
+		}
+
+		for i, k := range req.Keys {
+			if err := s.validateGetRequest(tableDef, &types.GetRequest{TableName: req.TableName, Key: k}); err != nil {
+				return err
+			}
+			key, err := s.encodeKey(tableDef, k)
+			if err != nil {
+				return err
+			}
+			imported := req.Items[i]
+			if imported.Item == nil && imported.Version == 0 {
+				// The item was never written.
+				continue
+			}
+			if imported.Item != nil {
+				if err := s.validatePutRequest(tableDef, &types.PutRequest{TableName: req.TableName, Item: imported.Item}); err != nil {
+					return err
+				}
+				if itemKey, err := s.encodeKey(tableDef, imported.Item); err != nil || !bytes.Equal(itemKey, key) {
+					return storage.NewValidationError("item %d does not have the key it is imported under", i)
+				}
+			}
+			if superseded(tx, req.TableName, key, imported.Version) {
+				continue
+			}
+
+			old, err := loadItem(b, key)
+			if err != nil {
+				return err
+			}
+			// The version of a delete is recorded even if the node never had
+			// the item, so that an older copy does not bring it back.
+			if old != nil || imported.Item != nil {
+				if err := s.updateIndexes(tx, tableDef, key, old, imported.Item); err != nil {
+					return err
+				}
+			}
+			if err := recordVersion(tx, req.TableName, key, imported.Version); err != nil {
+				return err
+			}
+			if imported.Item == nil {
+				err = b.Delete(key)
+			} else {
+				var val []byte
+				if val, err = json.Marshal(imported.Item); err == nil {
+					err = b.Put(key, val)
+				}
+			}
+			if err != nil {
+				return err
+			}
+			resp.ImportedCount++
+		}
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
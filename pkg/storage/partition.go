@@ -0,0 +1,35 @@
+package storage
+
+import (
+	"encoding/base64"
+	"math/big"
+
+	"zagreb/pkg/expression"
+	"zagreb/pkg/types"
+)
+
+// PartitionKey returns the key under which the items of a table sharing a
+// hash key value are placed on the consistent hash ring. Numbers are
+// normalised, so that values DynamoDB treats as equal, such as 1 and 1.0,
+// name the same partition.
+func PartitionKey(tableName string, hashKey *types.AttributeValue) (string, error) {
+	switch expression.GetAttributeValueType(hashKey) {
+	case "S":
+		return tableName + "\x00S" + *hashKey.S, nil
+	case "B":
+		return tableName + "\x00B" + base64.StdEncoding.EncodeToString(hashKey.B), nil
+	case "N":
+		// Numbers are checked as the key codec checks them, so that a key
+		// is routed only if the nodes can store it.
+		if _, _, _, err := expression.ParseDecimal(*hashKey.N); err != nil {
+			return "", NewValidationError("%w", err)
+		}
+		n, ok := new(big.Rat).SetString(*hashKey.N)
+		if !ok {
+			return "", NewValidationError("invalid number: %s", *hashKey.N)
+		}
+		return tableName + "\x00N" + n.RatString(), nil
+	default:
+		return "", NewValidationError("unsupported attribute type for key: %s", expression.GetAttributeValueType(hashKey))
+	}
+}
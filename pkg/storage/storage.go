@@ -1,21 +1,209 @@
 package storage
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+
 	"zagreb/pkg/expression"
 	"zagreb/pkg/types"
 )
 
+// ErrValidation is wrapped by the errors reporting an invalid request, such
+// as a malformed expression or a key that does not match the table schema.
+var ErrValidation = errors.New("ValidationException")
+
+// ErrResourceNotFound is wrapped by the errors reporting that a table,
+// index or stream does not exist.
+var ErrResourceNotFound = errors.New("ResourceNotFoundException")
+
+// ErrResourceInUse is wrapped by the errors reporting that a table being
+// created already exists.
+var ErrResourceInUse = errors.New("ResourceInUseException")
+
+// NewValidationError returns an error wrapping ErrValidation, with a message
+// formatted as by fmt.Errorf.
+func NewValidationError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %w", ErrValidation, fmt.Errorf(format, args...))
+}
+
+// NewResourceNotFoundError returns an error wrapping ErrResourceNotFound,
+// with a message formatted as by fmt.Errorf.
+func NewResourceNotFoundError(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %w", ErrResourceNotFound, fmt.Errorf(format, args...))
+}
+
+// ErrConditionalCheckFailed is returned by a write whose ConditionExpression
+// does not hold for the item currently stored.
+var ErrConditionalCheckFailed = errors.New("ConditionalCheckFailedException: the conditional request failed")
+
+// ErrTransactionConflict is returned by a write to an item locked by a
+// transaction that is being committed.
+var ErrTransactionConflict = errors.New("TransactionConflictException: the item is being modified by a transaction")
+
+// TransactionCanceledError is returned when a transaction is cancelled. It
+// holds one reason per item, in request order.
+type TransactionCanceledError struct {
+	Reasons []*types.CancellationReason
+}
+
+func (e *TransactionCanceledError) Error() string {
+	codes := make([]string, len(e.Reasons))
+	for i, reason := range e.Reasons {
+		codes[i] = reason.Code
+	}
+	return fmt.Sprintf("TransactionCanceledException: Transaction cancelled, please refer cancellation reasons for specific reasons [%s]", strings.Join(codes, ", "))
+}
+
+// exceptions are the storage errors that DynamoDB reports as exceptions of
+// their own, by exception name.
+var exceptions = map[string]error{
+	"ValidationException":             ErrValidation,
+	"ResourceNotFoundException":       ErrResourceNotFound,
+	"ResourceInUseException":          ErrResourceInUse,
+	"ConditionalCheckFailedException": ErrConditionalCheckFailed,
+	"TransactionConflictException":    ErrTransactionConflict,
+}
+
+// ExceptionName returns the name of the DynamoDB exception that reports err,
+// or "" if err is an internal error.
+func ExceptionName(err error) string {
+	var cancelled *TransactionCanceledError
+	if errors.As(err, &cancelled) {
+		return "TransactionCanceledException"
+	}
+	for name, target := range exceptions {
+		if errors.Is(err, target) {
+			return name
+		}
+	}
+	return ""
+}
+
+// ExceptionError returns the storage error for a DynamoDB exception, so that
+// an error reported by a node can be told apart like one raised locally. It
+// returns nil for an exception that has no storage error.
+func ExceptionError(name, message string) error {
+	target, ok := exceptions[name]
+	if !ok {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", target, message)
+}
+
 // Storage is an interface for a storage engine.
 type Storage interface {
 	CreateTable(req *types.CreateTableRequest) (*types.CreateTableResponse, error)
 	DeleteTable(req *types.DeleteTableRequest) (*types.DeleteTableResponse, error)
 	DescribeTable(req *types.DescribeTableRequest) (*types.DescribeTableResponse, error)
+	UpdateTable(req *types.UpdateTableRequest) (*types.UpdateTableResponse, error)
+	UpdateTimeToLive(req *types.UpdateTimeToLiveRequest) (*types.UpdateTimeToLiveResponse, error)
+	DescribeTimeToLive(req *types.DescribeTimeToLiveRequest) (*types.DescribeTimeToLiveResponse, error)
 	ListTables(req *types.ListTablesRequest) (*types.ListTablesResponse, error)
-	Put(req *types.PutRequest) error
+	Put(req *types.PutRequest) (*types.PutItemResponse, error)
 	Get(req *types.GetRequest) (map[string]*expression.AttributeValue, error)
-	Delete(req *types.DeleteRequest) error
-	Update(req *types.UpdateRequest) (map[string]*expression.AttributeValue, error)
-	Query(req *types.QueryRequest) ([]map[string]*expression.AttributeValue, error)
+	Delete(req *types.DeleteRequest) (*types.DeleteItemResponse, error)
+	Update(req *types.UpdateRequest) (*types.UpdateItemResponse, error)
+	Query(req *types.QueryRequest) (*types.QueryResponse, error)
 	Scan(req *types.ScanRequest) (*types.ScanResponse, error)
 	InternalScan(req *types.ScanRequest) (*types.ScanResponse, error)
+	BatchWriteItem(req *types.BatchWriteItemRequest) (*types.BatchWriteItemResponse, error)
+	BatchGetItem(req *types.BatchGetItemRequest) (*types.BatchGetItemResponse, error)
+	TransactWriteItems(req *types.TransactWriteItemsRequest) (*types.TransactWriteItemsResponse, error)
+	TransactGetItems(req *types.TransactGetItemsRequest) (*types.TransactGetItemsResponse, error)
+	PrepareTransaction(req *types.PrepareTransactionRequest) (*types.PrepareTransactionResponse, error)
+	CommitTransaction(req *types.CommitTransactionRequest) error
+	AbortTransaction(req *types.AbortTransactionRequest) error
+	GetItemVersions(req *types.GetItemVersionsRequest) (*types.GetItemVersionsResponse, error)
+	ScanItemVersions(req *types.ScanItemVersionsRequest) (*types.ScanItemVersionsResponse, error)
+	ImportItems(req *types.ImportItemsRequest) (*types.ImportItemsResponse, error)
+	ListStreams(req *types.ListStreamsRequest) (*types.ListStreamsResponse, error)
+	DescribeStream(req *types.DescribeStreamRequest) (*types.DescribeStreamResponse, error)
+	GetShardIterator(req *types.GetShardIteratorRequest) (*types.GetShardIteratorResponse, error)
+	GetRecords(req *types.GetRecordsRequest) (*types.GetRecordsResponse, error)
+}
+
+// ValidateReturnValues checks ReturnValues against the options an operation
+// accepts. Leaving it empty is the same as NONE.
+func ValidateReturnValues(returnValues string, allowed ...string) error {
+	if returnValues == "" {
+		return nil
+	}
+	for _, option := range allowed {
+		if returnValues == option {
+			return nil
+		}
+	}
+	return NewValidationError("invalid ReturnValues: %s is not one of %s", returnValues, strings.Join(allowed, ", "))
+}
+
+// ValidateBatchWriteItem checks the shape of a BatchWriteItem request: it
+// must hold between 1 and 25 writes, each a single put or delete.
+func ValidateBatchWriteItem(req *types.BatchWriteItemRequest) error {
+	count := 0
+	for tableName, writes := range req.RequestItems {
+		for _, w := range writes {
+			if w == nil || (w.PutRequest == nil) == (w.DeleteRequest == nil) {
+				return NewValidationError("invalid BatchWriteItem request for table %s: each write must be exactly one of PutRequest or DeleteRequest", tableName)
+			}
+		}
+		count += len(writes)
+	}
+	if count == 0 || count > types.MaxBatchWriteItems {
+		return NewValidationError("invalid BatchWriteItem request: must hold between 1 and %d writes, got %d", types.MaxBatchWriteItems, count)
+	}
+	return nil
+}
+
+// ValidateBatchGetItem checks the shape of a BatchGetItem request: it must
+// hold between 1 and 100 keys.
+func ValidateBatchGetItem(req *types.BatchGetItemRequest) error {
+	count := 0
+	for tableName, ka := range req.RequestItems {
+		if ka == nil || len(ka.Keys) == 0 {
+			return NewValidationError("invalid BatchGetItem request for table %s: no keys given", tableName)
+		}
+		count += len(ka.Keys)
+	}
+	if count == 0 || count > types.MaxBatchGetKeys {
+		return NewValidationError("invalid BatchGetItem request: must hold between 1 and %d keys, got %d", types.MaxBatchGetKeys, count)
+	}
+	return nil
+}
+
+// ValidateTransactWriteItems checks the shape of a TransactWriteItems
+// request: it must hold between 1 and 100 actions, each exactly one of
+// ConditionCheck, Put, Update or Delete.
+func ValidateTransactWriteItems(items []*types.TransactWriteItem) error {
+	if len(items) == 0 || len(items) > types.MaxTransactItems {
+		return NewValidationError("invalid TransactWriteItems request: must hold between 1 and %d items, got %d", types.MaxTransactItems, len(items))
+	}
+	for i, item := range items {
+		set := 0
+		if item != nil {
+			for _, present := range []bool{item.ConditionCheck != nil, item.Put != nil, item.Update != nil, item.Delete != nil} {
+				if present {
+					set++
+				}
+			}
+		}
+		if set != 1 {
+			return NewValidationError("invalid TransactWriteItems request: item %d must be exactly one of ConditionCheck, Put, Update or Delete", i)
+		}
+	}
+	return nil
+}
+
+// ValidateTransactGetItems checks the shape of a TransactGetItems request:
+// it must hold between 1 and 100 reads.
+func ValidateTransactGetItems(items []*types.TransactGetItem) error {
+	if len(items) == 0 || len(items) > types.MaxTransactItems {
+		return NewValidationError("invalid TransactGetItems request: must hold between 1 and %d items, got %d", types.MaxTransactItems, len(items))
+	}
+	for i, item := range items {
+		if item == nil || item.Get == nil {
+			return NewValidationError("invalid TransactGetItems request: item %d has no Get", i)
+		}
+	}
+	return nil
 }
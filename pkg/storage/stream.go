@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// streamArnFormat builds the ARN of a table's stream from the table name and
+// the stream label, in the form DynamoDB uses.
+const streamArnFormat = "arn:aws:dynamodb:ddblocal:000000000000:table/%s/stream/%s"
+
+// StreamLabelFormat is the layout of a stream label, the time at which the
+// stream was enabled.
+const StreamLabelFormat = "2006-01-02T15:04:05.000"
+
+// StreamArn returns the ARN of the stream of a table with the given label.
+func StreamArn(tableName, label string) string {
+	return fmt.Sprintf(streamArnFormat, tableName, label)
+}
+
+// ParseStreamArn returns the table name and label of a stream ARN.
+func ParseStreamArn(arn string) (tableName, label string, err error) {
+	parts := strings.Split(arn, "/")
+	if len(parts) != 4 || !strings.HasSuffix(parts[0], ":table") || parts[2] != "stream" || parts[1] == "" || parts[3] == "" {
+		return "", "", NewValidationError("invalid stream ARN: %s", arn)
+	}
+	return parts[1], parts[3], nil
+}
+
+// ShardIterator is the position of a reader in a stream shard: the next
+// GetRecords returns the records after SequenceNumber. Clients receive it
+// as an opaque string, which names the stream and shard so that a router can
+// send GetRecords to the node holding the shard.
+type ShardIterator struct {
+	StreamArn      string `json:"StreamArn"`
+	ShardId        string `json:"ShardId"`
+	SequenceNumber uint64 `json:"SequenceNumber"`
+}
+
+// String encodes the iterator for a client.
+func (it *ShardIterator) String() string {
+	b, _ := json.Marshal(it)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ParseShardIterator decodes an iterator returned by GetShardIterator or
+// GetRecords.
+func ParseShardIterator(s string) (*ShardIterator, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, NewValidationError("invalid shard iterator")
+	}
+	var it ShardIterator
+	if err := json.Unmarshal(b, &it); err != nil || it.StreamArn == "" {
+		return nil, NewValidationError("invalid shard iterator")
+	}
+	return &it, nil
+}
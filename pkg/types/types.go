@@ -19,29 +19,173 @@ type AttributeDefinition struct {
 	AttributeType string `json:"AttributeType"`
 }
 
+// Projection types of a secondary index.
+const (
+	ProjectionTypeAll      = "ALL"
+	ProjectionTypeKeysOnly = "KEYS_ONLY"
+	ProjectionTypeInclude  = "INCLUDE"
+)
+
+// Projection lists the attributes copied into a secondary index. The table
+// and index keys are always copied.
+type Projection struct {
+	ProjectionType   string   `json:"ProjectionType,omitempty"`
+	NonKeyAttributes []string `json:"NonKeyAttributes,omitempty"`
+}
+
+// GlobalSecondaryIndex defines an index with its own hash key, and
+// optionally range key, over the items of a table.
+type GlobalSecondaryIndex struct {
+	IndexName  string              `json:"IndexName"`
+	KeySchema  []*KeySchemaElement `json:"KeySchema"`
+	Projection *Projection         `json:"Projection,omitempty"`
+}
+
+// LocalSecondaryIndex defines an index that shares the table's hash key but
+// orders each partition by an alternate range key. Local indexes can only be
+// defined when the table is created.
+type LocalSecondaryIndex struct {
+	IndexName  string              `json:"IndexName"`
+	KeySchema  []*KeySchemaElement `json:"KeySchema"`
+	Projection *Projection         `json:"Projection,omitempty"`
+}
+
 // CreateTableRequest represents a DynamoDB CreateTable request.
 type CreateTableRequest struct {
-	TableName            string                 `json:"TableName"`
-	KeySchema            []*KeySchemaElement    `json:"KeySchema"`
-	AttributeDefinitions []*AttributeDefinition `json:"AttributeDefinitions"`
+	TableName              string                  `json:"TableName"`
+	KeySchema              []*KeySchemaElement     `json:"KeySchema"`
+	AttributeDefinitions   []*AttributeDefinition  `json:"AttributeDefinitions"`
+	GlobalSecondaryIndexes []*GlobalSecondaryIndex `json:"GlobalSecondaryIndexes,omitempty"`
+	LocalSecondaryIndexes  []*LocalSecondaryIndex  `json:"LocalSecondaryIndexes,omitempty"`
+	StreamSpecification    *StreamSpecification    `json:"StreamSpecification,omitempty"`
+
+	// LatestStreamLabel is not part of a CreateTable request. It identifies
+	// the table's stream, if one was ever enabled, and is kept with the
+	// stored table definition. The router sets it on the requests it sends
+	// to nodes, so that every node gives the stream the same label.
+	LatestStreamLabel string `json:"LatestStreamLabel,omitempty"`
+
+	// TimeToLiveSpecification is not part of a CreateTable request. It is
+	// set by UpdateTimeToLive and kept with the stored table definition.
+	TimeToLiveSpecification *TimeToLiveSpecification `json:"TimeToLiveSpecification,omitempty"`
+}
+
+// Time to live statuses reported by DescribeTimeToLive.
+const (
+	TimeToLiveStatusEnabled  = "ENABLED"
+	TimeToLiveStatusDisabled = "DISABLED"
+)
+
+// TimeToLiveSpecification names the attribute that holds the time, in epoch
+// seconds, at which an item expires.
+type TimeToLiveSpecification struct {
+	AttributeName string `json:"AttributeName"`
+	Enabled       bool   `json:"Enabled"`
+}
+
+// UpdateTimeToLiveRequest represents a DynamoDB UpdateTimeToLive request.
+type UpdateTimeToLiveRequest struct {
+	TableName               string                   `json:"TableName"`
+	TimeToLiveSpecification *TimeToLiveSpecification `json:"TimeToLiveSpecification"`
+}
+
+// UpdateTimeToLiveResponse represents a DynamoDB UpdateTimeToLive response.
+type UpdateTimeToLiveResponse struct {
+	TimeToLiveSpecification *TimeToLiveSpecification `json:"TimeToLiveSpecification"`
+}
+
+// DescribeTimeToLiveRequest represents a DynamoDB DescribeTimeToLive request.
+type DescribeTimeToLiveRequest struct {
+	TableName string `json:"TableName"`
 }
 
+// TimeToLiveDescription describes the time to live setting of a table.
+type TimeToLiveDescription struct {
+	TimeToLiveStatus string `json:"TimeToLiveStatus"`
+	AttributeName    string `json:"AttributeName,omitempty"`
+}
+
+// DescribeTimeToLiveResponse represents a DynamoDB DescribeTimeToLive response.
+type DescribeTimeToLiveResponse struct {
+	TimeToLiveDescription TimeToLiveDescription `json:"TimeToLiveDescription"`
+}
+
+// UpdateTableRequest represents a DynamoDB UpdateTable request.
+// AttributeDefinitions must declare the key attributes of any index created.
+type UpdateTableRequest struct {
+	TableName                   string                        `json:"TableName"`
+	AttributeDefinitions        []*AttributeDefinition        `json:"AttributeDefinitions,omitempty"`
+	GlobalSecondaryIndexUpdates []*GlobalSecondaryIndexUpdate `json:"GlobalSecondaryIndexUpdates,omitempty"`
+	StreamSpecification         *StreamSpecification          `json:"StreamSpecification,omitempty"`
+
+	// LatestStreamLabel is not part of an UpdateTable request. The router
+	// sets it when enabling a stream, as for CreateTable.
+	LatestStreamLabel string `json:"LatestStreamLabel,omitempty"`
+}
+
+// GlobalSecondaryIndexUpdate creates or deletes one index. Exactly one of
+// its fields is set.
+type GlobalSecondaryIndexUpdate struct {
+	Create *GlobalSecondaryIndex             `json:"Create,omitempty"`
+	Delete *DeleteGlobalSecondaryIndexAction `json:"Delete,omitempty"`
+}
+
+// DeleteGlobalSecondaryIndexAction names an index to delete.
+type DeleteGlobalSecondaryIndexAction struct {
+	IndexName string `json:"IndexName"`
+}
+
+// UpdateTableResponse represents a DynamoDB UpdateTable response.
+type UpdateTableResponse struct {
+	TableDescription TableDescription `json:"TableDescription"`
+}
+
+// ReturnValues options for PutItem, UpdateItem and DeleteItem. PutItem and
+// DeleteItem accept only NONE and ALL_OLD.
+const (
+	ReturnValuesNone       = "NONE"
+	ReturnValuesAllOld     = "ALL_OLD"
+	ReturnValuesUpdatedOld = "UPDATED_OLD"
+	ReturnValuesAllNew     = "ALL_NEW"
+	ReturnValuesUpdatedNew = "UPDATED_NEW"
+)
+
 // PutRequest represents a DynamoDB PutItem request.
 type PutRequest struct {
-	TableName string                     `json:"TableName"`
-	Item      map[string]*AttributeValue `json:"Item"`
+	TableName                 string                     `json:"TableName"`
+	Item                      map[string]*AttributeValue `json:"Item"`
+	ConditionExpression       string                     `json:"ConditionExpression,omitempty"`
+	ExpressionAttributeNames  map[string]string          `json:"ExpressionAttributeNames,omitempty"`
+	ExpressionAttributeValues map[string]*AttributeValue `json:"ExpressionAttributeValues,omitempty"`
+	ReturnValues              string                     `json:"ReturnValues,omitempty"`
+
+	// Version is not part of a PutItem request. The router sets it on the
+	// requests it sends to the replicas of an item, so that every replica
+	// records the same version for the write.
+	Version int64 `json:"Version,omitempty"`
 }
 
 // GetRequest represents a DynamoDB GetItem request.
 type GetRequest struct {
-	TableName string                     `json:"TableName"`
-	Key       map[string]*AttributeValue `json:"Key"`
+	TableName                string                     `json:"TableName"`
+	Key                      map[string]*AttributeValue `json:"Key"`
+	ProjectionExpression     string                     `json:"ProjectionExpression,omitempty"`
+	ExpressionAttributeNames map[string]string          `json:"ExpressionAttributeNames,omitempty"`
+	ConsistentRead           bool                       `json:"ConsistentRead,omitempty"`
 }
 
 // DeleteRequest represents a DynamoDB DeleteItem request.
 type DeleteRequest struct {
-	TableName string                     `json:"TableName"`
-	Key       map[string]*AttributeValue `json:"Key"`
+	TableName                 string                     `json:"TableName"`
+	Key                       map[string]*AttributeValue `json:"Key"`
+	ConditionExpression       string                     `json:"ConditionExpression,omitempty"`
+	ExpressionAttributeNames  map[string]string          `json:"ExpressionAttributeNames,omitempty"`
+	ExpressionAttributeValues map[string]*AttributeValue `json:"ExpressionAttributeValues,omitempty"`
+	ReturnValues              string                     `json:"ReturnValues,omitempty"`
+
+	// Version is not part of a DeleteItem request. The router sets it as for
+	// PutItem.
+	Version int64 `json:"Version,omitempty"`
 }
 
 // UpdateRequest represents a DynamoDB UpdateItem request.
@@ -49,13 +193,30 @@ type UpdateRequest struct {
 	TableName                 string                     `json:"TableName"`
 	Key                       map[string]*AttributeValue `json:"Key"`
 	UpdateExpression          string                     `json:"UpdateExpression"`
+	ConditionExpression       string                     `json:"ConditionExpression,omitempty"`
+	ExpressionAttributeNames  map[string]string          `json:"ExpressionAttributeNames,omitempty"`
 	ExpressionAttributeValues map[string]*AttributeValue `json:"ExpressionAttributeValues,omitempty"`
+	ReturnValues              string                     `json:"ReturnValues,omitempty"`
+
+	// Version is not part of an UpdateItem request. The router sets it as for
+	// PutItem.
+	Version int64 `json:"Version,omitempty"`
+}
+
+// PutItemResponse represents a DynamoDB PutItem response.
+type PutItemResponse struct {
+	Attributes map[string]*AttributeValue `json:"Attributes,omitempty"`
+}
+
+// DeleteItemResponse represents a DynamoDB DeleteItem response.
+type DeleteItemResponse struct {
+	Attributes map[string]*AttributeValue `json:"Attributes,omitempty"`
 }
 
 // UpdateItemResponse represents a DynamoDB UpdateItem response.
 
 type UpdateItemResponse struct {
-	Attributes map[string]*AttributeValue `json:"Attributes"`
+	Attributes map[string]*AttributeValue `json:"Attributes,omitempty"`
 }
 
 // GetItemResponse represents a DynamoDB GetItem response.
@@ -66,22 +227,57 @@ type GetItemResponse struct {
 
 // QueryRequest represents a DynamoDB Query request.
 type QueryRequest struct {
-	TableName              string                     `json:"TableName"`
-	KeyConditionExpression string                     `json:"KeyConditionExpression"`
+	TableName                 string                     `json:"TableName"`
+	IndexName                 string                     `json:"IndexName,omitempty"`
+	KeyConditionExpression    string                     `json:"KeyConditionExpression"`
+	FilterExpression          string                     `json:"FilterExpression,omitempty"`
+	ProjectionExpression      string                     `json:"ProjectionExpression,omitempty"`
+	ExpressionAttributeNames  map[string]string          `json:"ExpressionAttributeNames,omitempty"`
 	ExpressionAttributeValues map[string]*AttributeValue `json:"ExpressionAttributeValues,omitempty"`
+	Limit                     *int                       `json:"Limit,omitempty"`
+	ExclusiveStartKey         map[string]*AttributeValue `json:"ExclusiveStartKey,omitempty"`
+	ScanIndexForward          *bool                      `json:"ScanIndexForward,omitempty"`
+	ConsistentRead            bool                       `json:"ConsistentRead,omitempty"`
 }
 
 // QueryResponse represents a DynamoDB Query response.
-
 type QueryResponse struct {
-	Items []map[string]*AttributeValue `json:"Items"`
+	Items            []map[string]*AttributeValue `json:"Items"`
+	Count            int                          `json:"Count"`
+	ScannedCount     int                          `json:"ScannedCount"`
+	LastEvaluatedKey map[string]*AttributeValue   `json:"LastEvaluatedKey,omitempty"`
+}
+
+// IndexStatusActive is the status of an index that is ready for reads.
+// Indexes are backfilled before UpdateTable returns, so every index is
+// active.
+const IndexStatusActive = "ACTIVE"
+
+// GlobalSecondaryIndexDescription represents the properties of an index.
+type GlobalSecondaryIndexDescription struct {
+	IndexName   string              `json:"IndexName"`
+	KeySchema   []*KeySchemaElement `json:"KeySchema"`
+	Projection  *Projection         `json:"Projection,omitempty"`
+	IndexStatus string              `json:"IndexStatus"`
+}
+
+// LocalSecondaryIndexDescription represents the properties of a local index.
+type LocalSecondaryIndexDescription struct {
+	IndexName  string              `json:"IndexName"`
+	KeySchema  []*KeySchemaElement `json:"KeySchema"`
+	Projection *Projection         `json:"Projection,omitempty"`
 }
 
 // TableDescription represents the properties of a table.
 type TableDescription struct {
-	TableName            string                 `json:"TableName"`
-	KeySchema            []*KeySchemaElement    `json:"KeySchema"`
-	AttributeDefinitions []*AttributeDefinition `json:"AttributeDefinitions"`
+	TableName              string                             `json:"TableName"`
+	KeySchema              []*KeySchemaElement                `json:"KeySchema"`
+	AttributeDefinitions   []*AttributeDefinition             `json:"AttributeDefinitions"`
+	GlobalSecondaryIndexes []*GlobalSecondaryIndexDescription `json:"GlobalSecondaryIndexes,omitempty"`
+	LocalSecondaryIndexes  []*LocalSecondaryIndexDescription  `json:"LocalSecondaryIndexes,omitempty"`
+	StreamSpecification    *StreamSpecification               `json:"StreamSpecification,omitempty"`
+	LatestStreamArn        string                             `json:"LatestStreamArn,omitempty"`
+	LatestStreamLabel      string                             `json:"LatestStreamLabel,omitempty"`
 }
 
 // CreateTableResponse represents a DynamoDB CreateTable response.
@@ -121,14 +317,385 @@ type ListTablesResponse struct {
 
 // ScanRequest represents a DynamoDB Scan request.
 type ScanRequest struct {
-	TableName         string                     `json:"TableName"`
-	Limit             *int                       `json:"Limit,omitempty"`
-	ExclusiveStartKey map[string]*AttributeValue `json:"ExclusiveStartKey,omitempty"`
+	TableName                 string                     `json:"TableName"`
+	IndexName                 string                     `json:"IndexName,omitempty"`
+	Limit                     *int                       `json:"Limit,omitempty"`
+	ExclusiveStartKey         map[string]*AttributeValue `json:"ExclusiveStartKey,omitempty"`
+	FilterExpression          string                     `json:"FilterExpression,omitempty"`
+	ProjectionExpression      string                     `json:"ProjectionExpression,omitempty"`
+	ExpressionAttributeNames  map[string]string          `json:"ExpressionAttributeNames,omitempty"`
+	ExpressionAttributeValues map[string]*AttributeValue `json:"ExpressionAttributeValues,omitempty"`
+	ConsistentRead            bool                       `json:"ConsistentRead,omitempty"`
 }
 
 // ScanResponse represents a DynamoDB Scan response.
 type ScanResponse struct {
 	Items            []map[string]*AttributeValue `json:"Items"`
-	LastEvaluatedKey map[string]*AttributeValue `json:"LastEvaluatedKey,omitempty"`
-	ScannedCount     int                        `json:"ScannedCount"`
+	LastEvaluatedKey map[string]*AttributeValue   `json:"LastEvaluatedKey,omitempty"`
+	Count            int                          `json:"Count"`
+	ScannedCount     int                          `json:"ScannedCount"`
+}
+
+// Limits on the number of requests in a single batch, as in DynamoDB.
+const (
+	MaxBatchWriteItems = 25
+	MaxBatchGetKeys    = 100
+)
+
+// BatchPutRequest is a put within a BatchWriteItem request.
+type BatchPutRequest struct {
+	Item map[string]*AttributeValue `json:"Item"`
+
+	// Version is not part of a BatchWriteItem request. The router sets it as
+	// for PutItem.
+	Version int64 `json:"Version,omitempty"`
+}
+
+// BatchDeleteRequest is a delete within a BatchWriteItem request.
+type BatchDeleteRequest struct {
+	Key map[string]*AttributeValue `json:"Key"`
+
+	// Version is not part of a BatchWriteItem request. The router sets it as
+	// for PutItem.
+	Version int64 `json:"Version,omitempty"`
+}
+
+// WriteRequest is one put or delete of a BatchWriteItem request. Exactly one
+// of its fields is set.
+type WriteRequest struct {
+	PutRequest    *BatchPutRequest    `json:"PutRequest,omitempty"`
+	DeleteRequest *BatchDeleteRequest `json:"DeleteRequest,omitempty"`
+}
+
+// BatchWriteItemRequest represents a DynamoDB BatchWriteItem request.
+type BatchWriteItemRequest struct {
+	RequestItems map[string][]*WriteRequest `json:"RequestItems"`
+}
+
+// BatchWriteItemResponse represents a DynamoDB BatchWriteItem response.
+type BatchWriteItemResponse struct {
+	UnprocessedItems map[string][]*WriteRequest `json:"UnprocessedItems"`
+}
+
+// KeysAndAttributes lists the keys to read from one table in a BatchGetItem
+// request.
+type KeysAndAttributes struct {
+	Keys                     []map[string]*AttributeValue `json:"Keys"`
+	ProjectionExpression     string                       `json:"ProjectionExpression,omitempty"`
+	ExpressionAttributeNames map[string]string            `json:"ExpressionAttributeNames,omitempty"`
+}
+
+// BatchGetItemRequest represents a DynamoDB BatchGetItem request.
+type BatchGetItemRequest struct {
+	RequestItems map[string]*KeysAndAttributes `json:"RequestItems"`
+}
+
+// BatchGetItemResponse represents a DynamoDB BatchGetItem response.
+type BatchGetItemResponse struct {
+	Responses       map[string][]map[string]*AttributeValue `json:"Responses"`
+	UnprocessedKeys map[string]*KeysAndAttributes           `json:"UnprocessedKeys"`
+}
+
+// MaxTransactItems is the largest number of items in a single transaction, as
+// in DynamoDB.
+const MaxTransactItems = 100
+
+// Cancellation reason codes reported for each item of a cancelled transaction.
+const (
+	CancellationReasonNone                   = "None"
+	CancellationReasonConditionalCheckFailed = "ConditionalCheckFailed"
+	CancellationReasonTransactionConflict    = "TransactionConflict"
+)
+
+// ConditionCheck is a condition that a transaction requires of an item
+// without writing to it.
+type ConditionCheck struct {
+	TableName                 string                     `json:"TableName"`
+	Key                       map[string]*AttributeValue `json:"Key"`
+	ConditionExpression       string                     `json:"ConditionExpression"`
+	ExpressionAttributeNames  map[string]string          `json:"ExpressionAttributeNames,omitempty"`
+	ExpressionAttributeValues map[string]*AttributeValue `json:"ExpressionAttributeValues,omitempty"`
+}
+
+// TransactWriteItem is one action of a TransactWriteItems request. Exactly
+// one of its fields is set.
+type TransactWriteItem struct {
+	ConditionCheck *ConditionCheck `json:"ConditionCheck,omitempty"`
+	Put            *PutRequest     `json:"Put,omitempty"`
+	Update         *UpdateRequest  `json:"Update,omitempty"`
+	Delete         *DeleteRequest  `json:"Delete,omitempty"`
+}
+
+// TransactWriteItemsRequest represents a DynamoDB TransactWriteItems request.
+type TransactWriteItemsRequest struct {
+	TransactItems      []*TransactWriteItem `json:"TransactItems"`
+	ClientRequestToken string               `json:"ClientRequestToken,omitempty"`
+}
+
+// TransactWriteItemsResponse represents a DynamoDB TransactWriteItems response.
+type TransactWriteItemsResponse struct{}
+
+// TransactGetItem is one read of a TransactGetItems request.
+type TransactGetItem struct {
+	Get *GetRequest `json:"Get"`
+}
+
+// TransactGetItemsRequest represents a DynamoDB TransactGetItems request.
+type TransactGetItemsRequest struct {
+	TransactItems []*TransactGetItem `json:"TransactItems"`
+}
+
+// ItemResponse holds one item read by a transaction; Item is nil if the item
+// does not exist.
+type ItemResponse struct {
+	Item map[string]*AttributeValue `json:"Item,omitempty"`
+}
+
+// TransactGetItemsResponse represents a DynamoDB TransactGetItems response,
+// with one entry per requested item, in request order.
+type TransactGetItemsResponse struct {
+	Responses []*ItemResponse `json:"Responses"`
+}
+
+// CancellationReason says why a transaction was cancelled, for one item.
+type CancellationReason struct {
+	Code    string `json:"Code"`
+	Message string `json:"Message,omitempty"`
+}
+
+// PrepareTransactionRequest asks a node to check and lock its part of a
+// transaction spanning several nodes, the first phase of a two-phase commit.
+type PrepareTransactionRequest struct {
+	TransactionID string               `json:"TransactionId"`
+	TransactItems []*TransactWriteItem `json:"TransactItems"`
+}
+
+// PrepareTransactionResponse reports whether a node prepared its part of a
+// transaction. CancellationReasons, one per item, is set if it did not.
+type PrepareTransactionResponse struct {
+	CancellationReasons []*CancellationReason `json:"CancellationReasons,omitempty"`
+}
+
+// CommitTransactionRequest asks a node to apply a prepared transaction.
+type CommitTransactionRequest struct {
+	TransactionID string `json:"TransactionId"`
+}
+
+// AbortTransactionRequest asks a node to drop a prepared transaction.
+type AbortTransactionRequest struct {
+	TransactionID string `json:"TransactionId"`
+}
+
+// GetItemVersionsRequest asks a node for its copies of items and the
+// versions it recorded for them. It is part of the node protocol: the router
+// compares the copies the replicas of an item hold to read the newest.
+type GetItemVersionsRequest struct {
+	TableName string                       `json:"TableName"`
+	Keys      []map[string]*AttributeValue `json:"Keys"`
+}
+
+// ItemVersion is a node's copy of an item and the version of the last write
+// to it. Item is nil if the item does not exist, and Version is 0 if it was
+// never written.
+type ItemVersion struct {
+	Item    map[string]*AttributeValue `json:"Item,omitempty"`
+	Version int64                      `json:"Version,omitempty"`
+}
+
+// GetItemVersionsResponse holds a node's copy of each requested item, in
+// request order.
+type GetItemVersionsResponse struct {
+	Items []*ItemVersion `json:"Items"`
+}
+
+// ScanItemVersionsRequest asks a node for a page of its copies of the items
+// of a table with their versions, in key order. It is part of the node
+// protocol: the router copies the partitions of a table to the nodes taking
+// them over, deletes included. Limit is the largest number of items on the
+// page, and 0 leaves it unbounded.
+type ScanItemVersionsRequest struct {
+	TableName         string                     `json:"TableName"`
+	Limit             int                        `json:"Limit,omitempty"`
+	ExclusiveStartKey map[string]*AttributeValue `json:"ExclusiveStartKey,omitempty"`
+}
+
+// ScanItemVersionsResponse holds a page of a node's copies of items with
+// their keys. A deleted item whose version the node kept has no copy.
+type ScanItemVersionsResponse struct {
+	Keys             []map[string]*AttributeValue `json:"Keys"`
+	Items            []*ItemVersion               `json:"Items"`
+	LastEvaluatedKey map[string]*AttributeValue   `json:"LastEvaluatedKey,omitempty"`
+}
+
+// ImportItemsRequest asks a node to store copies of items read from another
+// node, as GetItemVersions returns them, in the order of Keys: an item that
+// is nil was deleted. It is part of the node protocol: the router copies
+// the items of a partition to the nodes taking it over. A copy only replaces
+// what the node holds if it is newer, so that an import does not undo a
+// write made since the copy was read.
+type ImportItemsRequest struct {
+	TableName string                       `json:"TableName"`
+	Keys      []map[string]*AttributeValue `json:"Keys"`
+	Items     []*ItemVersion               `json:"Items"`
+}
+
+// ImportItemsResponse tells how many of the copies a node stored.
+type ImportItemsResponse struct {
+	ImportedCount int `json:"ImportedCount"`
+}
+
+// Stream view types, which choose the item images written to a stream record.
+const (
+	StreamViewTypeKeysOnly        = "KEYS_ONLY"
+	StreamViewTypeNewImage        = "NEW_IMAGE"
+	StreamViewTypeOldImage        = "OLD_IMAGE"
+	StreamViewTypeNewAndOldImages = "NEW_AND_OLD_IMAGES"
+)
+
+// StreamSpecification enables or disables the stream of a table.
+type StreamSpecification struct {
+	StreamEnabled  bool   `json:"StreamEnabled"`
+	StreamViewType string `json:"StreamViewType,omitempty"`
+}
+
+// Stream statuses reported by DescribeStream.
+const (
+	StreamStatusEnabled  = "ENABLED"
+	StreamStatusDisabled = "DISABLED"
+)
+
+// Shard iterator types of a GetShardIterator request.
+const (
+	ShardIteratorTypeTrimHorizon         = "TRIM_HORIZON"
+	ShardIteratorTypeLatest              = "LATEST"
+	ShardIteratorTypeAtSequenceNumber    = "AT_SEQUENCE_NUMBER"
+	ShardIteratorTypeAfterSequenceNumber = "AFTER_SEQUENCE_NUMBER"
+)
+
+// Event names of a stream record.
+const (
+	StreamEventInsert = "INSERT"
+	StreamEventModify = "MODIFY"
+	StreamEventRemove = "REMOVE"
+)
+
+// MaxGetRecordsLimit is the most records a GetRecords request may return.
+const MaxGetRecordsLimit = 1000
+
+// ListStreamsRequest represents a DynamoDB Streams ListStreams request.
+type ListStreamsRequest struct {
+	TableName               string `json:"TableName,omitempty"`
+	Limit                   int    `json:"Limit,omitempty"`
+	ExclusiveStartStreamArn string `json:"ExclusiveStartStreamArn,omitempty"`
+}
+
+// StreamSummary identifies one stream in a ListStreams response.
+type StreamSummary struct {
+	StreamArn   string `json:"StreamArn"`
+	StreamLabel string `json:"StreamLabel"`
+	TableName   string `json:"TableName"`
+}
+
+// ListStreamsResponse represents a DynamoDB Streams ListStreams response.
+type ListStreamsResponse struct {
+	Streams                []*StreamSummary `json:"Streams"`
+	LastEvaluatedStreamArn string           `json:"LastEvaluatedStreamArn,omitempty"`
+}
+
+// DescribeStreamRequest represents a DynamoDB Streams DescribeStream request.
+type DescribeStreamRequest struct {
+	StreamArn             string `json:"StreamArn"`
+	Limit                 int    `json:"Limit,omitempty"`
+	ExclusiveStartShardId string `json:"ExclusiveStartShardId,omitempty"`
+}
+
+// SequenceNumberRange is the range of sequence numbers held by a shard.
+// EndingSequenceNumber is only set once the shard is closed.
+type SequenceNumberRange struct {
+	StartingSequenceNumber string `json:"StartingSequenceNumber,omitempty"`
+	EndingSequenceNumber   string `json:"EndingSequenceNumber,omitempty"`
+}
+
+// Shard is a sequence of stream records.
+type Shard struct {
+	ShardId             string               `json:"ShardId"`
+	SequenceNumberRange *SequenceNumberRange `json:"SequenceNumberRange"`
+	ParentShardId       string               `json:"ParentShardId,omitempty"`
+}
+
+// StreamDescription represents the properties of a stream.
+type StreamDescription struct {
+	StreamArn               string              `json:"StreamArn"`
+	StreamLabel             string              `json:"StreamLabel"`
+	StreamStatus            string              `json:"StreamStatus"`
+	StreamViewType          string              `json:"StreamViewType"`
+	TableName               string              `json:"TableName"`
+	KeySchema               []*KeySchemaElement `json:"KeySchema"`
+	CreationRequestDateTime float64             `json:"CreationRequestDateTime"`
+	Shards                  []*Shard            `json:"Shards"`
+	LastEvaluatedShardId    string              `json:"LastEvaluatedShardId,omitempty"`
+}
+
+// DescribeStreamResponse represents a DynamoDB Streams DescribeStream response.
+type DescribeStreamResponse struct {
+	StreamDescription StreamDescription `json:"StreamDescription"`
+}
+
+// GetShardIteratorRequest represents a DynamoDB Streams GetShardIterator
+// request. SequenceNumber is only used by the AT_SEQUENCE_NUMBER and
+// AFTER_SEQUENCE_NUMBER iterator types.
+type GetShardIteratorRequest struct {
+	StreamArn         string `json:"StreamArn"`
+	ShardId           string `json:"ShardId"`
+	ShardIteratorType string `json:"ShardIteratorType"`
+	SequenceNumber    string `json:"SequenceNumber,omitempty"`
+}
+
+// GetShardIteratorResponse represents a DynamoDB Streams GetShardIterator response.
+type GetShardIteratorResponse struct {
+	ShardIterator string `json:"ShardIterator"`
+}
+
+// GetRecordsRequest represents a DynamoDB Streams GetRecords request.
+type GetRecordsRequest struct {
+	ShardIterator string `json:"ShardIterator"`
+	Limit         int    `json:"Limit,omitempty"`
+}
+
+// GetRecordsResponse represents a DynamoDB Streams GetRecords response.
+// NextShardIterator is empty once a closed shard has been read to its end.
+type GetRecordsResponse struct {
+	Records           []*Record `json:"Records"`
+	NextShardIterator string    `json:"NextShardIterator,omitempty"`
+}
+
+// Identity identifies who made a change. It is only set on the records of
+// items deleted by time to live.
+type Identity struct {
+	PrincipalId string `json:"PrincipalId"`
+	Type        string `json:"Type"`
+}
+
+// Record describes one change to an item of a table. Its JSON field names
+// follow the DynamoDB Streams wire format.
+type Record struct {
+	EventID      string        `json:"eventID"`
+	EventName    string        `json:"eventName"`
+	EventVersion string        `json:"eventVersion"`
+	EventSource  string        `json:"eventSource"`
+	AwsRegion    string        `json:"awsRegion"`
+	Dynamodb     *StreamRecord `json:"dynamodb"`
+	UserIdentity *Identity     `json:"userIdentity,omitempty"`
+}
+
+// StreamRecord holds the key of a changed item and, depending on the
+// stream view type, its images before and after the change.
+type StreamRecord struct {
+	ApproximateCreationDateTime float64                    `json:"ApproximateCreationDateTime"`
+	Keys                        map[string]*AttributeValue `json:"Keys"`
+	NewImage                    map[string]*AttributeValue `json:"NewImage,omitempty"`
+	OldImage                    map[string]*AttributeValue `json:"OldImage,omitempty"`
+	SequenceNumber              string                     `json:"SequenceNumber"`
+	SizeBytes                   int64                      `json:"SizeBytes"`
+	StreamViewType              string                     `json:"StreamViewType"`
 }